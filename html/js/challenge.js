@@ -0,0 +1,42 @@
+TEAMWORK.signError = function (msg) {
+    $('#signError').text(msg);
+    $('#signError').show();
+}
+
+$(function(){
+    if( $('#challenge').length === 0 ) {
+	$('#userEmail').focus();
+	return;
+    }
+    $('#signature').focus();
+
+    $('#challengeSign').click(function(event){
+	event.preventDefault();
+	$('#signError').hide();
+	var file = $('#privateKey')[0].files[0];
+	if( !file ) {
+	    TEAMWORK.signError("Please pick your private key file");
+	    return false;
+	}
+	var reader = new FileReader();
+	reader.onload = function (e) {
+	    var privKey = openpgp.key.readArmored(e.target.result).keys[0];
+	    if( !privKey ) {
+		TEAMWORK.signError("That file does not contain an ASCII-armored private key");
+		return;
+	    }
+	    if( !privKey.decrypt($('#passphrase').val()) ) {
+		TEAMWORK.signError("The passphrase is not correct");
+		return;
+	    }
+	    openpgp.sign({ data: $('#challenge').val(), privateKeys: privKey }).then(function(signed) {
+		$('#signature').val(signed.data);
+		$('#challengeForm').submit();
+	    }).catch(function(error) {
+		TEAMWORK.signError(error.message);
+	    });
+	};
+	reader.readAsText(file);
+	return false;
+    });
+});
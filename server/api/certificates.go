@@ -0,0 +1,45 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// The server's TLS certificate and key, read from their files at startup
+// and again on every Reload, so renewed certificates are picked up without
+// a restart (connections already made keep the certificate they got)
+type CertificateReloader struct {
+	sync.RWMutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+}
+
+// Read the PEM certificate (chain) and key from these files
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	c := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	return c, c.Reload()
+}
+
+// Read the certificate and key files again, keeping the current pair if
+// they are missing or invalid
+func (c *CertificateReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// The current certificate, for tls.Config.GetCertificate
+func (c *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
@@ -0,0 +1,740 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"golang.org/x/crypto/openpgp/armor"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A database/sql driver which answers each prepared statement with canned
+// rows, so that the handlers can run without PostgreSQL
+
+type fakeResults map[string][][]driver.Value
+
+var currentResults fakeResults
+
+type fakeDriver struct{}
+
+type fakeConn struct{}
+
+type fakeStmt struct {
+	query string
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return &fakeConn{}, nil }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{query: query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{rows: currentResults[s.query]}, nil
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{}
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+func init() {
+	sql.Register("teamwork-fake", fakeDriver{})
+}
+
+const (
+	testPersonId  = "11111111-1111-1111-1111-111111111111"
+	testOtherId   = "22222222-2222-2222-2222-222222222222"
+	testSessionId = "33333333-3333-3333-3333-333333333333"
+	testMessageId = "44444444-4444-4444-4444-444444444444"
+	testKeyId     = "55555555-5555-5555-5555-555555555555"
+	testTokenId   = "66666666-6666-6666-6666-666666666666"
+	testEmail     = "dev@example.org"
+	testCode      = "correct horse battery staple"
+	testToken     = "tw_test"
+	testMessage   = "-----BEGIN PGP MESSAGE-----\r\nVersion: Test\r\n\r\n\r\n\r\nhQEMA0xqjF1xLm7kAQf/Y2lwaGVydGV4dA\r\n-----END PGP MESSAGE-----"
+)
+
+var (
+	testNow     = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	testExpires = testNow.Add(time.Hour)
+)
+
+func armoredKey(data string) string {
+	var buf bytes.Buffer
+	w, _ := armor.Encode(&buf, "PGP PUBLIC KEY BLOCK", nil)
+	w.Write([]byte(data))
+	w.Close()
+	return buf.String()
+}
+
+func personRow(id string, enabled bool) []driver.Value {
+	return []driver.Value{id, testEmail, testNow, true, testNow, enabled, database.ROLE_MEMBER}
+}
+
+func sessionRow(verified bool) []driver.Value {
+	return []driver.Value{testSessionId, testPersonId, testCode, testNow, verified, testNow, testExpires}
+}
+
+func messageRow(authorId string) []driver.Value {
+	return []driver.Value{testMessageId, authorId, testMessage, testNow, testExpires}
+}
+
+// A cursor token for paging from the test message
+func testCursor(direction string) string {
+	return (&database.MESSAGE{Id: testMessageId, DatePosted: testNow}).Cursor(direction).String()
+}
+
+func keyRow(id, key string) []driver.Value {
+	return []driver.Value{id, key, testNow, "laptop", ui.KEY_SOURCE}
+}
+
+func keyLogRow(index int64, id, key string) []driver.Value {
+	return []driver.Value{index, transparency.ACTION_ADD, testEmail, id, transparency.KeyHash(key), testNow.UnixNano() / int64(time.Millisecond)}
+}
+
+func leafRow(index int64, id, key string) []driver.Value {
+	entry := transparency.NewKeyEntry(transparency.ACTION_ADD, testEmail, id, key)
+	return []driver.Value{index, hex.EncodeToString(entry.LeafHash())}
+}
+
+// The rows returned when a case does not override them: a verified session
+// for an enabled person with two public keys, who has posted one message
+func defaultResults() fakeResults {
+	token := []driver.Value{testTokenId, testPersonId, "ci", SCOPE_MESSAGES_READ + "," + SCOPE_PEOPLE_READ, testNow, nil, nil}
+	return fakeResults{
+		database.SESSION_LOOKUP_BY_ID:           {sessionRow(true)},
+		database.SESSION_LOOKUP_BY_PERSON:       {sessionRow(true)},
+		database.SESSION_LOOKUP_CODES_BY_PERSON: {sessionRow(false)},
+		database.PERSON_LOOKUP_BY_ID:            {personRow(testPersonId, true)},
+		database.PERSON_LOOKUP_BY_EMAIL:         {personRow(testPersonId, true)},
+		database.LATEST_MESSAGES:                {messageRow(testPersonId)},
+		database.MESSAGE_BY_ID:                  {messageRow(testPersonId)},
+		database.RECIPIENTS_BY_MESSAGE:          {{testPersonId}},
+		database.MESSAGE_INSERT:                 {{testMessageId}},
+		database.PK_LOOKUP:                      {keyRow(testKeyId, armoredKey("first")), keyRow(testOtherId, armoredKey("second"))},
+		database.PK_INSERT:                      {{testKeyId}},
+		database.API_TOKEN_LOOKUP_BY_HASH:       {token},
+		database.API_TOKEN_LOOKUP_BY_PERSON:     {token},
+		database.API_TOKEN_INSERT:               {{testTokenId, testNow}},
+		database.KEY_LOG_BY_KEY:                 {keyLogRow(0, testKeyId, armoredKey("first"))},
+		database.KEY_LOG_INSERT:                 {{int64(1)}},
+		database.KEY_LOG_LEAVES:                 {leafRow(0, testKeyId, armoredKey("first")), leafRow(1, testOtherId, armoredKey("second"))},
+		database.KEY_LOG_ENTRIES:                {keyLogRow(0, testKeyId, armoredKey("first")), keyLogRow(1, testOtherId, armoredKey("second"))},
+	}
+}
+
+// Run functions with statements prepared on the fake driver
+func fakeRunner(t *testing.T) StatementRunner {
+	db, err := sql.Open("teamwork-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeKeyLog(""); err != nil {
+		t.Fatal(err)
+	}
+
+	statements := map[string]*sql.Stmt{}
+	for _, p := range database.PreparedStatements {
+		stmt, err := db.Prepare(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statements[p] = stmt
+	}
+
+	return func(ctx context.Context, fn func(map[string]*sql.Stmt)) error {
+		fn(statements)
+		return nil
+	}
+}
+
+type contractCase struct {
+	name    string
+	method  string
+	path    string
+	body    string
+	form    url.Values
+	auth    string // "session", "token", or a literal Authorization header
+	privacy bool
+	results fakeResults // overrides the default rows
+	setup   func(r *http.Request)
+	status  int
+}
+
+func contractCases() []*contractCase {
+	limitSessions := func(r *http.Request) {
+		ui.IPSessionLimit = ui.NewRateLimit(1, time.Hour, false)
+		ui.AllowNewSession(r, testEmail, nil)
+	}
+	newMessage := fmt.Sprintf(`{"message": %q, "recipients": [%q]}`, testMessage, testEmail)
+
+	return []*contractCase{
+		{name: "openapi document", method: "GET", path: "/api/v1/openapi.json", status: 200},
+
+		{name: "private session request", method: "POST", path: "/api/v1/sessions", body: `{"email": "` + testEmail + `"}`, privacy: true, setup: limitSessions, status: 202},
+		{name: "limited session request", method: "POST", path: "/api/v1/sessions", body: `{"email": "` + testEmail + `"}`, setup: limitSessions, status: 429},
+		{name: "session request without json", method: "POST", path: "/api/v1/sessions", body: `{`, status: 400},
+		{name: "session request for an unknown address", method: "POST", path: "/api/v1/sessions", body: `{"email": "` + testEmail + `"}`, results: fakeResults{database.PERSON_LOOKUP_BY_EMAIL: nil}, status: 404},
+		{name: "session request for a disabled address", method: "POST", path: "/api/v1/sessions", body: `{"email": "` + testEmail + `"}`, results: fakeResults{database.PERSON_LOOKUP_BY_EMAIL: {personRow(testPersonId, false)}}, status: 403},
+		{name: "session request without keys", method: "POST", path: "/api/v1/sessions", body: `{"email": "` + testEmail + `"}`, results: fakeResults{database.PK_LOOKUP: nil}, status: 409},
+		{name: "limited session request for an unknown address", method: "POST", path: "/api/v1/sessions", body: `{"email": "` + testEmail + `"}`, setup: limitSessions, results: fakeResults{database.PERSON_LOOKUP_BY_EMAIL: nil}, status: 404},
+
+		{name: "confirm session", method: "POST", path: "/api/v1/sessions/confirm", body: `{"email": "` + testEmail + `", "code": "` + testCode + `"}`, status: 200},
+		{name: "confirm session with extra spaces", method: "POST", path: "/api/v1/sessions/confirm", body: `{"email": "` + testEmail + `", "code": " ` + strings.Replace(testCode, " ", "  ", -1) + `\n"}`, status: 200},
+		{name: "confirm session with the wrong code", method: "POST", path: "/api/v1/sessions/confirm", body: `{"email": "` + testEmail + `", "code": "wrong"}`, status: 401},
+		{name: "confirm session without a code", method: "POST", path: "/api/v1/sessions/confirm", body: `{"email": "` + testEmail + `"}`, status: 400},
+
+		{name: "list sessions", method: "GET", path: "/api/v1/sessions", auth: "session", status: 200},
+		{name: "list sessions with a token", method: "GET", path: "/api/v1/sessions", auth: "token", status: 403},
+		{name: "list sessions without a session", method: "GET", path: "/api/v1/sessions", status: 401},
+		{name: "list sessions with an unverified session", method: "GET", path: "/api/v1/sessions", auth: "session", results: fakeResults{database.SESSION_LOOKUP_BY_ID: {sessionRow(false)}}, status: 401},
+		{name: "list sessions for a disabled person", method: "GET", path: "/api/v1/sessions", auth: "session", results: fakeResults{database.PERSON_LOOKUP_BY_ID: {personRow(testPersonId, false)}}, status: 403},
+		{name: "revoke all sessions", method: "DELETE", path: "/api/v1/sessions", auth: "session", status: 204},
+		{name: "revoke a session", method: "DELETE", path: "/api/v1/sessions/" + (&database.SESSION{Id: testSessionId}).Handle(), auth: "session", status: 204},
+		{name: "revoke a session by its id", method: "DELETE", path: "/api/v1/sessions/" + testSessionId, auth: "session", status: 404},
+		{name: "revoke an unknown session", method: "DELETE", path: "/api/v1/sessions/" + (&database.SESSION{Id: testOtherId}).Handle(), auth: "session", status: 404},
+
+		{name: "list messages", method: "GET", path: "/api/v1/messages?limit=5&offset=5", auth: "session", status: 200},
+		{name: "list messages with a token", method: "GET", path: "/api/v1/messages", auth: "token", status: 200},
+		{name: "list messages with a bad limit", method: "GET", path: "/api/v1/messages?limit=x", auth: "session", status: 400},
+		{name: "list older messages", method: "GET", path: "/api/v1/messages?limit=1&cursor=" + testCursor(database.CURSOR_OLDER), auth: "session", results: fakeResults{database.LATEST_MESSAGES_OLDER: {messageRow(testPersonId), messageRow(testPersonId)}}, status: 200},
+		{name: "list newer messages", method: "GET", path: "/api/v1/messages?cursor=" + testCursor(database.CURSOR_NEWER), auth: "token", status: 200},
+		{name: "list messages with a bad cursor", method: "GET", path: "/api/v1/messages?cursor=bm90IGEgY3Vyc29y", auth: "session", status: 400},
+		{name: "list messages with a cursor and an offset", method: "GET", path: "/api/v1/messages?offset=5&cursor=" + testCursor(database.CURSOR_OLDER), auth: "session", status: 400},
+		{name: "list received messages", method: "GET", path: "/api/v1/messages?view=received", auth: "session", results: fakeResults{database.MESSAGES_BY_RECIPIENT: {messageRow(testOtherId)}}, status: 200},
+		{name: "list older authored messages", method: "GET", path: "/api/v1/messages?view=authored&cursor=" + testCursor(database.CURSOR_OLDER), auth: "token", status: 200},
+		{name: "list involved messages at an offset", method: "GET", path: "/api/v1/messages?view=involved&offset=20", auth: "session", status: 200},
+		{name: "list messages in an unknown view", method: "GET", path: "/api/v1/messages?view=everything", auth: "session", status: 400},
+		{name: "list messages with a malformed token", method: "GET", path: "/api/v1/messages", auth: "Basic abc", status: 401},
+		{name: "list messages with an unknown token", method: "GET", path: "/api/v1/messages", auth: "token", results: fakeResults{database.API_TOKEN_LOOKUP_BY_HASH: nil}, status: 401},
+		{name: "post a message", method: "POST", path: "/api/v1/messages", body: newMessage, auth: "session", status: 201},
+		{name: "post a message without the scope", method: "POST", path: "/api/v1/messages", body: newMessage, auth: "token", status: 403},
+		{name: "post an empty message", method: "POST", path: "/api/v1/messages", body: `{"message": "", "recipients": ["` + testEmail + `"]}`, auth: "session", status: 400},
+		{name: "post a message to an unknown recipient", method: "POST", path: "/api/v1/messages", body: newMessage, auth: "session", results: fakeResults{database.PERSON_LOOKUP_BY_EMAIL: nil}, status: 400},
+		{name: "get a message", method: "GET", path: "/api/v1/messages/" + testMessageId, auth: "session", status: 200},
+		{name: "get an unknown message", method: "GET", path: "/api/v1/messages/" + testOtherId, auth: "session", results: fakeResults{database.MESSAGE_BY_ID: nil}, status: 404},
+		{name: "list recipients", method: "GET", path: "/api/v1/messages/" + testMessageId + "/recipients", auth: "session", status: 200},
+		{name: "delete a message", method: "DELETE", path: "/api/v1/messages/" + testMessageId, auth: "session", status: 204},
+		{name: "delete someone else's message", method: "DELETE", path: "/api/v1/messages/" + testMessageId, auth: "session", results: fakeResults{database.MESSAGE_BY_ID: {messageRow(testOtherId)}}, status: 403},
+
+		{name: "list keys", method: "GET", path: "/api/v1/keys", auth: "session", status: 200},
+		{name: "list keys without the scope", method: "GET", path: "/api/v1/keys", auth: "token", status: 403},
+		{name: "add a key", method: "POST", path: "/api/v1/keys", body: fmt.Sprintf(`{"key": %q, "name": "desktop"}`, armoredKey("third")), auth: "session", status: 201},
+		{name: "add a duplicate key", method: "POST", path: "/api/v1/keys", body: fmt.Sprintf(`{"key": %q}`, armoredKey("first")), auth: "session", status: 409},
+		{name: "add an invalid key", method: "POST", path: "/api/v1/keys", body: `{"key": "not armored"}`, auth: "session", status: 400},
+		{name: "delete a key", method: "DELETE", path: "/api/v1/keys/" + testKeyId, auth: "session", status: 204},
+		{name: "delete the last key", method: "DELETE", path: "/api/v1/keys/" + testKeyId, auth: "session", results: fakeResults{database.PK_LOOKUP: {keyRow(testKeyId, armoredKey("first"))}}, status: 409},
+		{name: "delete an unknown key", method: "DELETE", path: "/api/v1/keys/" + testMessageId, auth: "session", status: 404},
+
+		{name: "find a person", method: "GET", path: "/api/v1/people?email=" + testEmail, auth: "token", status: 200},
+		{name: "find a person since an earlier tree", method: "GET", path: "/api/v1/people?tree_size=1&email=" + testEmail, auth: "token", status: 200},
+		{name: "find a person with a bad tree size", method: "GET", path: "/api/v1/people?tree_size=x&email=" + testEmail, auth: "token", status: 400},
+		{name: "find a person without an email", method: "GET", path: "/api/v1/people", auth: "session", status: 400},
+		{name: "get a person", method: "GET", path: "/api/v1/people/" + testPersonId, auth: "session", status: 200},
+		{name: "get a person with a bad id", method: "GET", path: "/api/v1/people/nobody", auth: "session", status: 404},
+
+		{name: "list tokens", method: "GET", path: "/api/v1/tokens", auth: "session", status: 200},
+		{name: "create a token", method: "POST", path: "/api/v1/tokens", body: `{"name": "ci", "scopes": ["messages:write"], "expires_in_days": 90}`, auth: "session", status: 201},
+		{name: "create a token expiring too late", method: "POST", path: "/api/v1/tokens", body: `{"name": "ci", "scopes": ["messages:write"], "expires_in_days": 106752}`, auth: "session", status: 400},
+		{name: "create a token with an unknown scope", method: "POST", path: "/api/v1/tokens", body: `{"name": "ci", "scopes": ["admin"]}`, auth: "session", status: 400},
+		{name: "revoke a token", method: "DELETE", path: "/api/v1/tokens/" + testTokenId, auth: "session", status: 204},
+		{name: "revoke a token with a bad id", method: "DELETE", path: "/api/v1/tokens/nothing", auth: "session", status: 404},
+
+		{name: "search public keys", method: "POST", path: "/searchPublicKeys", form: url.Values{"sessionId": {testSessionId}, "personId": {testPersonId}, "email": {testEmail}}, status: 200},
+		{name: "search public keys since an earlier tree", method: "POST", path: "/searchPublicKeys", form: url.Values{"sessionId": {testSessionId}, "personId": {testPersonId}, "email": {testEmail}, "treeSize": {"1"}}, status: 200},
+		{name: "search public keys with an invalid session", method: "POST", path: "/searchPublicKeys", form: url.Values{"sessionId": {testOtherId}, "personId": {testPersonId}, "email": {testEmail}}, status: 200},
+		{name: "search public keys without an email", method: "POST", path: "/searchPublicKeys", form: url.Values{"sessionId": {testSessionId}, "personId": {testPersonId}}, status: 200},
+
+		{name: "get the tree head", method: "GET", path: KEY_LOG_PREFIX + TREE_HEAD_PATH, status: 200},
+		{name: "get a consistency proof", method: "GET", path: KEY_LOG_PREFIX + CONSISTENCY_PATH + "?first=1&second=2", status: 200},
+		{name: "get a consistency proof beyond the log", method: "GET", path: KEY_LOG_PREFIX + CONSISTENCY_PATH + "?first=1&second=5", status: 400},
+		{name: "list log entries", method: "GET", path: KEY_LOG_PREFIX + ENTRIES_PATH + "?start=0&end=10", status: 200},
+		{name: "list log entries backwards", method: "GET", path: KEY_LOG_PREFIX + ENTRIES_PATH + "?start=1&end=0", status: 400},
+	}
+}
+
+// Make the request for this case, with the real handlers
+func (c *contractCase) run(t *testing.T, runner StatementRunner) *httptest.ResponseRecorder {
+	currentResults = defaultResults()
+	for query, rows := range c.results {
+		currentResults[query] = rows
+	}
+
+	ui.SessionAttempts = ui.NewAttemptTracker()
+	ui.IPSessionLimit = nil
+	ui.EmailSessionLimit = nil
+
+	var body io.Reader
+	if c.form != nil {
+		body = strings.NewReader(c.form.Encode())
+	} else if len(c.body) > 0 {
+		body = strings.NewReader(c.body)
+	}
+
+	r := httptest.NewRequest(c.method, c.path, body)
+	if c.form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	switch c.auth {
+	case "":
+	case "session":
+		r.Header.Set(SESSION_HEADER, testSessionId)
+	case "token":
+		r.Header.Set("Authorization", "Bearer "+testToken)
+	default:
+		r.Header.Set("Authorization", c.auth)
+	}
+
+	if c.setup != nil {
+		c.setup(r)
+	}
+
+	w := httptest.NewRecorder()
+	if strings.HasPrefix(c.path, API_V1_PREFIX) {
+		V1Dispatcher(runner, c.privacy)(w, r)
+	} else if strings.HasPrefix(c.path, KEY_LOG_PREFIX) {
+		KeyLogDispatcher(runner)(w, r)
+	} else {
+		search := func(w http.ResponseWriter, r *http.Request) string {
+			return SearchPublicKeys(w, r, runner, c.privacy)
+		}
+		Respond("application/json", "utf-8", search)(w, r)
+	}
+	return w
+}
+
+// The document, as served
+func servedDocument(t *testing.T, runner StatementRunner) map[string]interface{} {
+	w := (&contractCase{method: "GET", path: "/api/v1/openapi.json"}).run(t, runner)
+	if w.Code != http.StatusOK {
+		t.Fatalf("openapi.json: status %d", w.Code)
+	}
+
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestResponsesMatchOpenAPI(t *testing.T) {
+	runner := fakeRunner(t)
+	doc := servedDocument(t, runner)
+	paths := doc["paths"].(map[string]interface{})
+
+	succeeded := map[string]bool{}
+	for _, c := range contractCases() {
+		w := c.run(t, runner)
+		if w.Code != c.status {
+			t.Errorf("%s: expected status %d, got %d: %s", c.name, c.status, w.Code, w.Body.String())
+			continue
+		}
+
+		var op *V1Operation
+		path := strings.SplitN(c.path, "?", 2)[0]
+		for _, candidate := range V1Operations {
+			if candidate.Matches(c.method, path) {
+				op = candidate
+				break
+			}
+		}
+		if op == nil {
+			t.Errorf("%s: %s %s is not documented", c.name, c.method, path)
+			continue
+		}
+
+		operation := paths[op.Path].(map[string]interface{})[strings.ToLower(op.Method)].(map[string]interface{})
+		response, documented := operation["responses"].(map[string]interface{})[fmt.Sprintf("%d", w.Code)].(map[string]interface{})
+		if !documented {
+			t.Errorf("%s: status %d is not documented for %s", c.name, w.Code, op.Id)
+			continue
+		}
+
+		content, hasContent := response["content"].(map[string]interface{})
+		if !hasContent {
+			if w.Body.Len() > 0 {
+				t.Errorf("%s: expected no content, got %s", c.name, w.Body.String())
+			}
+		} else {
+			if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+				t.Errorf("%s: unexpected content type %q", c.name, contentType)
+			}
+
+			var value interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &value); err != nil {
+				t.Errorf("%s: %v: %s", c.name, err, w.Body.String())
+				continue
+			}
+
+			schema := content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+			if err := validateSchema(doc, schema, value, "$"); err != nil {
+				t.Errorf("%s: %v: %s", c.name, err, w.Body.String())
+				continue
+			}
+		}
+
+		if w.Code < 300 {
+			succeeded[op.Id] = true
+		}
+	}
+
+	// every documented operation should be shown to work
+	for _, op := range V1Operations {
+		if !succeeded[op.Id] {
+			t.Errorf("%s: no successful response was checked", op.Id)
+		}
+	}
+}
+
+func TestErrorsAreSimpleMessages(t *testing.T) {
+	runner := fakeRunner(t)
+	doc := servedDocument(t, runner)
+	schema := map[string]interface{}{"$ref": "#/components/schemas/SimpleMessage"}
+
+	errorBodies := []string{
+		GenerateSimpleMessage(INVALID_REQUEST, MISSING_PARAMETER),
+		GenerateSimpleMessage(http.StatusText(http.StatusInternalServerError), INTERNAL_ERROR),
+		GenerateSimpleMessage(SESSION_SENT, ""),
+	}
+	for _, body := range errorBodies {
+		var value interface{}
+		if err := json.Unmarshal([]byte(body), &value); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateSchema(doc, schema, value, "$"); err != nil {
+			t.Errorf("%s: %v", body, err)
+		}
+	}
+
+	// requests the operations do not cover still get error objects
+	for _, c := range []*contractCase{
+		{method: "GET", path: "/api/v1/nothing"},
+		{method: "PUT", path: "/api/v1/messages", auth: "session"},
+		{method: "POST", path: "/api/v1/openapi.json"},
+	} {
+		w := c.run(t, runner)
+		var value interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &value); err != nil {
+			t.Errorf("%s %s: %v", c.method, c.path, err)
+			continue
+		}
+		if w.Code < 400 {
+			t.Errorf("%s %s: unexpected status %d", c.method, c.path, w.Code)
+		}
+		if err := validateSchema(doc, schema, value, "$"); err != nil {
+			t.Errorf("%s %s: %v", c.method, c.path, err)
+		}
+	}
+}
+
+func TestDocumentMatchesOperations(t *testing.T) {
+	doc := OpenAPIDocument()
+	if doc["openapi"] != OPENAPI_VERSION {
+		t.Errorf("unexpected version %v", doc["openapi"])
+	}
+
+	paths := doc["paths"].(map[string]interface{})
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	ids := map[string]bool{}
+
+	for _, op := range V1Operations {
+		if ids[op.Id] {
+			t.Errorf("duplicate operation id %s", op.Id)
+		}
+		ids[op.Id] = true
+
+		if _, exists := paths[op.Path].(map[string]interface{})[strings.ToLower(op.Method)]; !exists {
+			t.Errorf("%s: missing from the document", op.Id)
+		}
+
+		if strings.HasPrefix(op.Path, API_V1_PREFIX) {
+			resource := strings.Split(strings.TrimPrefix(op.Path, API_V1_PREFIX), "/")[0]
+			if _, exists := V1Resources[resource]; !exists && resource != OPENAPI_DOCUMENT {
+				t.Errorf("%s: no handler for the %s resource", op.Id, resource)
+			}
+		}
+	}
+
+	// every resource should have at least one documented operation
+	for resource := range V1Resources {
+		documented := false
+		for _, op := range V1Operations {
+			documented = documented || strings.HasPrefix(op.Path, API_V1_PREFIX+resource)
+		}
+		if !documented {
+			t.Errorf("the %s resource is not documented", resource)
+		}
+	}
+
+	// every reference should resolve
+	encoded, _ := json.Marshal(doc)
+	for _, ref := range strings.Split(string(encoded), `"$ref":"#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if _, exists := schemas[name]; !exists {
+			t.Errorf("unresolved schema %s", name)
+		}
+	}
+}
+
+// Check the decoded json value against the subset of the OpenAPI schema
+// vocabulary used by the generated document
+func validateSchema(doc map[string]interface{}, schema map[string]interface{}, value interface{}, at string) error {
+	if ref, isRef := schema["$ref"].(string); isRef {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, exists := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+		if !exists {
+			return fmt.Errorf("%s: unknown schema %s", at, name)
+		}
+		return validateSchema(doc, resolved, value, at)
+	}
+
+	if alternatives, isOneOf := schema["oneOf"].([]interface{}); isOneOf {
+		matches := 0
+		for _, alternative := range alternatives {
+			if validateSchema(doc, alternative.(map[string]interface{}), value, at) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: matches %d of the oneOf schemas", at, matches)
+		}
+		return nil
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %v", at, value)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, hasRequired := schema["required"].([]interface{}); hasRequired {
+			for _, name := range required {
+				if _, exists := object[name.(string)]; !exists {
+					return fmt.Errorf("%s: missing required property %s", at, name)
+				}
+			}
+		}
+		for name, v := range object {
+			property, known := properties[name].(map[string]interface{})
+			if !known {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: unexpected property %s", at, name)
+				}
+				continue
+			}
+			if err := validateSchema(doc, property, v, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %v", at, value)
+		}
+		for i, v := range array {
+			if err := validateSchema(doc, schema["items"].(map[string]interface{}), v, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %v", at, value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return fmt.Errorf("%s: expected an integer, got %v", at, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected a number, got %v", at, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean, got %v", at, value)
+		}
+	}
+
+	return nil
+}
+
+func TestMessageCursors(t *testing.T) {
+	runner := fakeRunner(t)
+
+	// a full page of older messages, with more after it
+	w := (&contractCase{method: "GET", path: "/api/v1/messages?limit=1&cursor=" + testCursor(database.CURSOR_OLDER), auth: "session",
+		results: fakeResults{database.LATEST_MESSAGES_OLDER: {messageRow(testPersonId), messageRow(testOtherId)}}}).run(t, runner)
+	page := struct {
+		Items        []*MessageResource
+		Newer, Older string
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].PersonId != testPersonId {
+		t.Fatalf("unexpected items %s", w.Body.String())
+	}
+	for direction, token := range map[string]string{database.CURSOR_NEWER: page.Newer, database.CURSOR_OLDER: page.Older} {
+		cursor, err := database.ParseMessageCursor(token)
+		if err != nil || cursor.Direction != direction || cursor.Id != testMessageId || !cursor.DatePosted.Equal(testNow) {
+			t.Errorf("unexpected %s cursor %+v: %v", direction, cursor, err)
+		}
+	}
+
+	// the first page has no newer one, nor (with one message) an older one
+	w = (&contractCase{method: "GET", path: "/api/v1/messages", auth: "session"}).run(t, runner)
+	if strings.Contains(w.Body.String(), `"newer"`) || strings.Contains(w.Body.String(), `"older"`) {
+		t.Errorf("unexpected cursors in %s", w.Body.String())
+	}
+}
+
+func TestMessageViews(t *testing.T) {
+	runner := fakeRunner(t)
+
+	// each view lists the messages from its own statements
+	views := map[string]string{database.VIEW_ALL: database.LATEST_MESSAGES,
+		database.VIEW_RECEIVED: database.MESSAGES_BY_RECIPIENT,
+		database.VIEW_AUTHORED: database.MESSAGES_BY_AUTHOR_OLDER,
+		database.VIEW_INVOLVED: database.LATEST_MESSAGES_INVOLVING_PERSON}
+	for view, query := range views {
+		path := "/api/v1/messages?view=" + view
+		if query == database.MESSAGES_BY_AUTHOR_OLDER {
+			path += "&cursor=" + testCursor(database.CURSOR_OLDER)
+		}
+		results := fakeResults{database.LATEST_MESSAGES: nil}
+		results[query] = [][]driver.Value{messageRow(testOtherId)}
+		w := (&contractCase{method: "GET", path: path, auth: "session", results: results}).run(t, runner)
+		page := struct{ Items []*MessageResource }{}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != 1 || page.Items[0].PersonId != testOtherId {
+			t.Errorf("view %s: unexpected items %s", view, w.Body.String())
+		}
+	}
+}
+
+func TestSessionIdsAreNotListed(t *testing.T) {
+	runner := fakeRunner(t)
+	handle := (&database.SESSION{Id: testSessionId}).Handle()
+
+	// the session's id is its credential, so only confirming it returns it
+	w := (&contractCase{method: "POST", path: "/api/v1/sessions/confirm", body: `{"email": "` + testEmail + `", "code": "` + testCode + `"}`}).run(t, runner)
+	if !strings.Contains(w.Body.String(), `"id":"`+testSessionId+`"`) {
+		t.Errorf("the confirmed session has no id: %s", w.Body.String())
+	}
+
+	w = (&contractCase{method: "GET", path: "/api/v1/sessions", auth: "session"}).run(t, runner)
+	sessions := make([]*SessionResource, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(w.Body.String(), testSessionId) || len(sessions) != 1 || sessions[0].Handle != handle || !sessions[0].Current {
+		t.Errorf("unexpected sessions %s", w.Body.String())
+	}
+}
+
+func TestTokenDatesAreOptional(t *testing.T) {
+	runner := fakeRunner(t)
+	used := []driver.Value{testOtherId, testPersonId, "deploy", SCOPE_MESSAGES_READ, testNow, testNow, testExpires}
+	results := defaultResults()
+	results[database.API_TOKEN_LOOKUP_BY_PERSON] = append(results[database.API_TOKEN_LOOKUP_BY_PERSON], used)
+
+	// a token which was never used, and never expires, has neither date
+	w := (&contractCase{method: "GET", path: "/api/v1/tokens", auth: "session", results: results}).run(t, runner)
+	tokens := make([]map[string]interface{}, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || len(tokens) != 2 {
+		t.Fatalf("unexpected tokens %s (%v)", w.Body.String(), err)
+	}
+	for i, expected := range []bool{false, true} {
+		_, lastUsed := tokens[i]["date_last_used"]
+		_, expires := tokens[i]["date_expires"]
+		if lastUsed != expected || expires != expected {
+			t.Errorf("token %s: date_last_used %v and date_expires %v, expected %v", tokens[i]["name"], lastUsed, expires, expected)
+		}
+	}
+
+	w = (&contractCase{method: "POST", path: "/api/v1/tokens", body: `{"name": "ci", "scopes": ["messages:write"], "expires_in_days": 90}`, auth: "session"}).run(t, runner)
+	if !strings.Contains(w.Body.String(), `"date_expires"`) || strings.Contains(w.Body.String(), `"date_last_used"`) {
+		t.Errorf("unexpected new token %s", w.Body.String())
+	}
+
+	// and the contract says so
+	schema := servedDocument(t, runner)["components"].(map[string]interface{})["schemas"].(map[string]interface{})["API_TOKEN"].(map[string]interface{})
+	for _, name := range schema["required"].([]interface{}) {
+		if name == "date_last_used" || name == "date_expires" {
+			t.Errorf("%s is required by the API_TOKEN schema", name)
+		}
+	}
+}
+
+func TestDatabaseUnavailable(t *testing.T) {
+	unavailable := func(ctx context.Context, fn func(map[string]*sql.Stmt)) error {
+		return errors.New("connection refused")
+	}
+
+	// the server answers 503 (and keeps running) when it cannot connect
+	cases := []*contractCase{
+		{method: "GET", path: "/api/v1/messages", auth: "session"},
+		{method: "GET", path: KEY_LOG_PREFIX + TREE_HEAD_PATH},
+		{method: "POST", path: "/searchPublicKeys", form: url.Values{"sessionId": {testSessionId}, "personId": {testPersonId}, "email": {testEmail}}},
+	}
+	for _, c := range cases {
+		w := c.run(t, unavailable)
+		message := new(SimpleMessage)
+		if err := json.Unmarshal(w.Body.Bytes(), message); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusServiceUnavailable || message.Err != NO_DATABASE || strings.Contains(w.Body.String(), "connection refused") {
+			t.Errorf("%s %s: unexpected response %d %s", c.method, c.path, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/emailer"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// for the orchestrator: is the process alive, and can it serve requests?
+	HEALTH_PATH    = "/healthz"
+	READINESS_PATH = "/readyz"
+
+	STATUS_OK          = "ok"
+	STATUS_UNAVAILABLE = "unavailable"
+
+	// the dependencies checked for readiness
+	CHECK_DATABASE  = "database"
+	CHECK_TEMPLATES = "templates"
+	CHECK_WORDS     = "words"
+	CHECK_MAIL      = "mail"
+)
+
+var (
+	// how long each readiness check may take
+	READINESS_TIMEOUT = 5 * time.Second
+)
+
+// The outcome of one dependency check
+type CheckResult struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type HealthStatus struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks,omitempty"`
+}
+
+// The process is alive (while it shuts down, every request gets a 503)
+func HealthHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, &HealthStatus{Status: STATUS_OK})
+	}
+}
+
+// The dependencies the server needs to serve requests: the database, the
+// html templates, the session code word list and the mail server
+func ReadinessChecks(db database.DBConnection) map[string]func() error {
+	return map[string]func() error{
+		CHECK_DATABASE:  func() error { return database.Ping(db, READINESS_TIMEOUT) },
+		CHECK_TEMPLATES: ui.CheckTemplates,
+		CHECK_WORDS:     func() error { return database.CheckWords(ui.SESSION_WORDS) },
+		CHECK_MAIL:      func() error { return emailer.Ping(READINESS_TIMEOUT) },
+	}
+}
+
+// Run the checks at once, and respond with each outcome: 200 if they all
+// pass, or 503 if any fails
+func ReadinessHandler(checks map[string]func() error) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result := &HealthStatus{Status: STATUS_OK, Checks: make(map[string]*CheckResult)}
+
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check func() error) {
+				defer wg.Done()
+				start := time.Now()
+				err := check()
+				outcome := &CheckResult{Status: STATUS_OK, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+				if err != nil {
+					outcome.Status = STATUS_UNAVAILABLE
+					outcome.Error = err.Error()
+					logging.FromRequest(r).Warn("Readiness check failed", "check", name, "error", err)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				result.Checks[name] = outcome
+				if err != nil {
+					result.Status = STATUS_UNAVAILABLE
+				}
+			}(name, check)
+		}
+		wg.Wait()
+
+		status := http.StatusOK
+		if result.Status != STATUS_OK {
+			status = http.StatusServiceUnavailable
+		}
+		WriteJSON(w, status, result)
+	}
+}
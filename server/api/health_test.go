@@ -0,0 +1,81 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	ok := func() error { return nil }
+	failing := func() error { return errors.New("connection refused") }
+
+	tests := []struct {
+		checks map[string]func() error
+		status int
+		failed string
+	}{
+		{map[string]func() error{CHECK_DATABASE: ok, CHECK_MAIL: ok}, http.StatusOK, ""},
+		{map[string]func() error{CHECK_DATABASE: ok, CHECK_MAIL: failing}, http.StatusServiceUnavailable, CHECK_MAIL},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		ReadinessHandler(test.checks)(recorder, httptest.NewRequest("GET", READINESS_PATH, nil))
+		if recorder.Code != test.status {
+			t.Errorf("status %d, expected %d", recorder.Code, test.status)
+		}
+
+		var result HealthStatus
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Checks) != len(test.checks) {
+			t.Errorf("%d checks reported, expected %d", len(result.Checks), len(test.checks))
+		}
+		for name, check := range result.Checks {
+			if (name == test.failed) != (check.Status == STATUS_UNAVAILABLE) {
+				t.Errorf("%s check is %s (%s)", name, check.Status, check.Error)
+			}
+		}
+	}
+
+}
+
+func TestHealth(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	HealthHandler()(recorder, httptest.NewRequest("GET", HEALTH_PATH, nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"status":"ok"}` {
+		t.Errorf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOperatorOnly(t *testing.T) {
+	counters := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) }
+
+	tests := []struct {
+		mode, remote string
+		status       int
+	}{
+		{MODE_HTTP, "127.0.0.1:50000", http.StatusOK},
+		{MODE_HTTPS, "[::1]:50000", http.StatusOK},
+		{MODE_HTTP, "192.0.2.7:50000", http.StatusForbidden},
+		{MODE_HTTPS, "203.0.113.9:443", http.StatusForbidden},
+		// the web server in front restricts access
+		{MODE_FCGI, "192.0.2.7:50000", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.RemoteAddr = test.remote
+		recorder := httptest.NewRecorder()
+		OperatorOnly(test.mode, counters)(recorder, r)
+		if recorder.Code != test.status {
+			t.Errorf("%s from %s: status %d, expected %d", test.mode, test.remote, recorder.Code, test.status)
+		}
+	}
+}
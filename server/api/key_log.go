@@ -0,0 +1,287 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"database/sql"
+	"errors"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// the key transparency log is published under this prefix
+	KEY_LOG_PREFIX   = "/.well-known/key-transparency/"
+	TREE_HEAD_PATH   = "sth"
+	LOG_KEY_PATH     = "public-key"
+	CONSISTENCY_PATH = "consistency"
+	ENTRIES_PATH     = "entries"
+
+	// how many log entries are returned at once
+	MAX_LOG_ENTRIES = 1000
+
+	NO_KEY_LOG        = "The key transparency log is not available"
+	INVALID_TREE_SIZE = "The tree sizes must be within the log, with first <= second"
+	INVALID_RANGE     = "The start and end must be within the log, with start < end"
+)
+
+// The server's view of the key log: the key which signs its tree heads, the
+// tree of the leaf hashes read so far (the log only grows, so its nodes
+// never change, and only new leaves are read and hashed), and the latest
+// signed tree head
+type KeyLogState struct {
+	sync.Mutex
+	key  *ecdsa.PrivateKey
+	tree *transparency.Tree
+	head *transparency.SignedTreeHead
+}
+
+// A public key, as served, with the proof that it is in the key log
+type LoggedKey struct {
+	*database.PUBLIC_KEY
+	Proof *transparency.KeyProof `json:"proof,omitempty"`
+}
+
+var (
+	KeyLog = new(KeyLogState)
+)
+
+// Sign the key log's tree heads with the private key in this PEM file; if
+// no file is given, a new key is generated, which clients cannot pin
+// across restarts
+func InitializeKeyLog(keyFile string) error {
+	var (
+		key *ecdsa.PrivateKey
+		err error
+	)
+
+	if len(keyFile) == 0 {
+		logging.Warn("Signing key transparency tree heads with a temporary key (use -keyLogKey to keep one)")
+		key, err = transparency.GenerateKey()
+	} else {
+		data, readErr := ioutil.ReadFile(keyFile)
+		if readErr != nil {
+			return readErr
+		}
+		key, err = transparency.ReadPrivateKey(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	KeyLog.Lock()
+	defer KeyLog.Unlock()
+	KeyLog.key = key
+	KeyLog.head = nil
+	return nil
+}
+
+// Read any new leaves from the database, and call fn with the whole tree,
+// along with its signed tree head (which is only signed again once it
+// grows); fn must not keep the tree, which is only read under the lock
+func (l *KeyLogState) current(stmt map[string]*sql.Stmt, fn func(*transparency.Tree, *transparency.SignedTreeHead) error) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.key == nil {
+		return errors.New(NO_KEY_LOG)
+	}
+	if l.tree == nil {
+		l.tree = new(transparency.Tree)
+	}
+
+	more, err := database.LookupKeyLogLeaves(stmt[database.KEY_LOG_LEAVES], l.tree.Size())
+	if err != nil {
+		return err
+	}
+	for _, leaf := range more {
+		l.tree.Append(leaf)
+	}
+
+	if l.head == nil || l.head.TreeSize != l.tree.Size() {
+		head, headErr := l.tree.SignedTreeHead(l.key)
+		if headErr != nil {
+			return headErr
+		}
+		l.head = head
+	}
+
+	return fn(l.tree, l.head)
+}
+
+// Attach the proof of inclusion in the key log to each of these keys, found
+// for this email address; keys which were never logged for the address are
+// logged now, and if since is positive (the size of a tree the client saw
+// earlier) the proofs also show that the log only grew since then
+func ProveKeys(stmt map[string]*sql.Stmt, email string, keys []*database.PUBLIC_KEY, since int64) ([]*LoggedKey, error) {
+	results := make([]*LoggedKey, 0)
+	entries := make([]*database.KEY_LOG_ENTRY, 0)
+	for _, key := range keys {
+		results = append(results, &LoggedKey{PUBLIC_KEY: key})
+
+		entry, err := database.LookupKeyLogEntry(stmt[database.KEY_LOG_BY_KEY], key.Id)
+		if err != nil {
+			return results, err
+		}
+		if entry.KeyId != key.Id || entry.Action != transparency.ACTION_ADD || entry.Email != email || entry.KeyHash != transparency.KeyHash(key.Key) {
+			entry, err = database.LogKeyChange(stmt[database.KEY_LOG_INSERT], transparency.ACTION_ADD, email, key)
+			if err != nil {
+				return results, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(keys) == 0 {
+		return results, nil
+	}
+
+	err := KeyLog.current(stmt, func(tree *transparency.Tree, head *transparency.SignedTreeHead) error {
+		var consistency *transparency.Consistency
+		if since > 0 && since <= head.TreeSize {
+			proof, proofErr := tree.ConsistencyProof(since, head.TreeSize)
+			if proofErr != nil {
+				return proofErr
+			}
+			consistency = &transparency.Consistency{First: since, Second: head.TreeSize, Proof: transparency.EncodeHashes(proof)}
+		}
+
+		for i, entry := range entries {
+			path, pathErr := tree.InclusionProof(entry.LeafIndex, head.TreeSize)
+			if pathErr != nil {
+				return pathErr
+			}
+			results[i].Proof = &transparency.KeyProof{LeafIndex: entry.LeafIndex,
+				Entry:       entry.KeyEntry,
+				AuditPath:   transparency.EncodeHashes(path),
+				TreeHead:    head,
+				Consistency: consistency}
+		}
+		return nil
+	})
+
+	return results, err
+}
+
+// Respond to requests for the published key log: the signed tree head, the
+// public key which signs it, consistency proofs between two tree sizes, and
+// the entries themselves (for monitors which rebuild the tree)
+func KeyLogHandler(db database.DBConnection) func(http.ResponseWriter, *http.Request) {
+	return KeyLogDispatcher(DatabaseRunner(db))
+}
+
+// Dispatch key log requests, with the prepared statements from withDatabase
+func KeyLogDispatcher(withDatabase StatementRunner) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			status int
+			result interface{}
+		)
+
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, KEY_LOG_PREFIX), "/")
+		switch {
+		case r.Method != "GET":
+			status, result = V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+		case name == LOG_KEY_PATH:
+			writeLogKey(w, r)
+			return
+		case name == TREE_HEAD_PATH || name == CONSISTENCY_PATH || name == ENTRIES_PATH:
+			fn := func(stmt map[string]*sql.Stmt) {
+				status, result = keyLogResource(r, name, stmt)
+			}
+			if err := withDatabase(r.Context(), fn); err != nil {
+				logging.FromRequest(r).Error("Cannot use the database", "error", err)
+				status, result = V1Error(http.StatusServiceUnavailable, NO_DATABASE)
+			}
+		default:
+			status, result = V1Error(http.StatusNotFound, UNKNOWN_RESOURCE)
+		}
+
+		WriteJSON(w, status, result)
+	}
+}
+
+// Send the PEM-encoded public key which verifies the tree heads
+func writeLogKey(w http.ResponseWriter, r *http.Request) {
+	KeyLog.Lock()
+	key := KeyLog.key
+	KeyLog.Unlock()
+
+	if key == nil {
+		status, result := V1Error(http.StatusServiceUnavailable, NO_KEY_LOG)
+		WriteJSON(w, status, result)
+		return
+	}
+
+	data, err := transparency.EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		logging.FromRequest(r).Error("Cannot encode the key log public key", "error", err)
+		status, result := V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		WriteJSON(w, status, result)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(data)
+}
+
+func keyLogResource(r *http.Request, name string, stmt map[string]*sql.Stmt) (int, interface{}) {
+	var (
+		head        *transparency.SignedTreeHead
+		consistency *transparency.Consistency
+		proofErr    error
+	)
+	query := r.URL.Query()
+	first, firstErr := strconv.ParseInt(query.Get("first"), 10, 64)
+	second, secondErr := strconv.ParseInt(query.Get("second"), 10, 64)
+
+	err := KeyLog.current(stmt, func(tree *transparency.Tree, current *transparency.SignedTreeHead) error {
+		head = current
+		if name == CONSISTENCY_PATH && firstErr == nil && secondErr == nil {
+			var proof [][]byte
+			proof, proofErr = tree.ConsistencyProof(first, second)
+			consistency = &transparency.Consistency{First: first, Second: second, Proof: transparency.EncodeHashes(proof)}
+		}
+		return nil
+	})
+	if err != nil {
+		logging.FromRequest(r).Error("Cannot read the key log", "error", err)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	switch name {
+	case CONSISTENCY_PATH:
+		if firstErr != nil || secondErr != nil || proofErr != nil || second > head.TreeSize {
+			return V1Error(http.StatusBadRequest, INVALID_TREE_SIZE)
+		}
+		return http.StatusOK, consistency
+	case ENTRIES_PATH:
+		start, startErr := strconv.ParseInt(query.Get("start"), 10, 64)
+		end, endErr := strconv.ParseInt(query.Get("end"), 10, 64)
+		if startErr != nil || endErr != nil || start < 0 || start >= end || start >= head.TreeSize {
+			return V1Error(http.StatusBadRequest, INVALID_RANGE)
+		}
+		if end > head.TreeSize {
+			end = head.TreeSize
+		}
+		if end-start > MAX_LOG_ENTRIES {
+			end = start + MAX_LOG_ENTRIES
+		}
+		entries, entriesErr := database.LookupKeyLogEntries(stmt[database.KEY_LOG_ENTRIES], start, end)
+		if entriesErr != nil {
+			logging.FromRequest(r).Error("Cannot look up key log entries", "start", start, "end", end, "error", entriesErr)
+			return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		}
+		return http.StatusOK, entries
+	}
+
+	return http.StatusOK, head
+}
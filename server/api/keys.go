@@ -0,0 +1,119 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/cryptutil"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	INVALID_KEY    = "Not a valid armored public key"
+	DUPLICATE_KEY  = "This public key has already been added"
+	LAST_KEY       = "At least one public key is required"
+	API_KEY_SOURCE = ui.KEY_SOURCE + " API"
+)
+
+// The body of a new public key request
+type NewPublicKey struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+// GET /keys, POST /keys, DELETE /keys/{id}: the requestor's own public keys
+func KeysResource(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{}) {
+	_, person, authStatus, authErr := req.Authenticate(stmt, methodScope(req.Request, SCOPE_KEYS_READ, SCOPE_KEYS_WRITE))
+	if authErr != nil {
+		return authStatus, authErr
+	}
+
+	publicKeys, publicKeysErr := person.LookupPublicKeys(stmt[database.PK_LOOKUP])
+	if publicKeysErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up public keys", "person_id", person.Id, "error", publicKeysErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	if len(req.Path) == 0 {
+		switch req.Request.Method {
+		case "GET":
+			return http.StatusOK, publicKeys
+		case "POST":
+			return addKey(req, stmt, person, publicKeys)
+		}
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	id, valid := req.Id()
+	if !valid || len(req.Path) > 1 {
+		return V1Error(http.StatusNotFound, INVALID_ID)
+	}
+
+	if req.Request.Method != "DELETE" {
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	for _, pk := range publicKeys {
+		if pk.Id == id {
+			// sessions are created by encrypting to the person's keys
+			if len(publicKeys) == 1 {
+				return V1Error(http.StatusConflict, LAST_KEY)
+			}
+			if err := pk.Delete(stmt[database.PK_DELETE]); err != nil {
+				logging.FromRequest(req.Request).Error("Cannot delete public key", "key_id", pk.Id, "error", err)
+				return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+			}
+			ui.LogKeyChange(req.Request, stmt, transparency.ACTION_DELETE, person.Email, pk)
+			ui.RecordAuditEvent(req.Request, stmt, person, database.AUDIT_KEY_DELETE, pk.Id, person.Email+" "+pk.Nickname)
+			return http.StatusNoContent, nil
+		}
+	}
+
+	return V1Error(http.StatusNotFound, INVALID_ID)
+}
+
+// Add a new public key for this person
+func addKey(req *V1Request, stmt map[string]*sql.Stmt, person *database.PERSON, publicKeys []*database.PUBLIC_KEY) (int, interface{}) {
+	newKey := new(NewPublicKey)
+	if err := req.Decode(newKey); err != nil {
+		return V1Error(http.StatusBadRequest, err.Error())
+	}
+
+	if _, err := cryptutil.DecodeArmoredKey(newKey.Key); err != nil {
+		return V1Error(http.StatusBadRequest, INVALID_KEY)
+	}
+
+	for _, priorKey := range publicKeys {
+		if newKey.Key == priorKey.Key {
+			return V1Error(http.StatusConflict, DUPLICATE_KEY)
+		}
+	}
+
+	publicKey := new(database.PUBLIC_KEY)
+	publicKey.Key = newKey.Key
+	publicKey.Source = API_KEY_SOURCE
+	publicKey.Nickname = strings.TrimSpace(newKey.Name)
+	if len(publicKey.Nickname) == 0 {
+		publicKey.Nickname = fmt.Sprintf("%s (%s)", API_KEY_SOURCE, time.Now().UTC().Format(time.RFC3339))
+	}
+
+	pkId, pkErr := publicKey.Add(stmt[database.PK_INSERT], person.Id)
+	if pkErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot add public key", "person_id", person.Id, "error", pkErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+	publicKey.Id = pkId
+	publicKey.Added = time.Now().UTC()
+	ui.LogKeyChange(req.Request, stmt, transparency.ACTION_ADD, person.Email, publicKey)
+	ui.RecordAuditEvent(req.Request, stmt, person, database.AUDIT_KEY_ADD, pkId, person.Email+" "+publicKey.Nickname)
+
+	return http.StatusCreated, publicKey
+}
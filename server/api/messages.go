@@ -0,0 +1,238 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/emailer"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"net/http"
+	"strings"
+)
+
+const (
+	EMPTY_MESSAGE     = "The message is empty"
+	NO_RECIPIENTS     = "The message needs at least one recipient"
+	UNKNOWN_RECIPIENT = "Unknown or disabled recipient: "
+	NOT_AUTHOR        = "Only the author can delete this message"
+)
+
+// A message, as seen through the api
+type MessageResource struct {
+	*database.MESSAGE
+	Preview    string             `json:"preview"`
+	Sender     *database.PERSON   `json:"sender"`
+	Recipients []*database.PERSON `json:"recipients"`
+}
+
+// The body of a new message request: the (already encrypted) message, and
+// the email addresses of its recipients
+type NewMessage struct {
+	Message    string   `json:"message"`
+	Recipients []string `json:"recipients"`
+}
+
+func AsMessageResource(digest *database.MESSAGE_DIGEST) *MessageResource {
+	return &MessageResource{MESSAGE: digest.Message, Preview: digest.Preview, Sender: digest.Sender, Recipients: digest.Recipients}
+}
+
+// GET /messages, POST /messages, GET /messages/{id},
+// GET /messages/{id}/recipients, DELETE /messages/{id}
+func MessagesResource(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{}) {
+	_, person, authStatus, authErr := req.Authenticate(stmt, methodScope(req.Request, SCOPE_MESSAGES_READ, SCOPE_MESSAGES_WRITE))
+	if authErr != nil {
+		return authStatus, authErr
+	}
+
+	if len(req.Path) == 0 {
+		switch req.Request.Method {
+		case "GET":
+			return listMessages(req, stmt, person)
+		case "POST":
+			return createMessage(req, stmt, person)
+		}
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	id, valid := req.Id()
+	if !valid || len(req.Path) > 2 || (len(req.Path) == 2 && req.Path[1] != "recipients") {
+		return V1Error(http.StatusNotFound, INVALID_ID)
+	}
+
+	message, status, err := findMessage(req, stmt, id, person)
+	if err != nil {
+		return status, err
+	}
+
+	if len(req.Path) == 2 {
+		if req.Request.Method != "GET" {
+			return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+		}
+		return http.StatusOK, message.Recipients
+	}
+
+	switch req.Request.Method {
+	case "GET":
+		return http.StatusOK, message
+	case "DELETE":
+		if message.PersonId != person.Id {
+			return V1Error(http.StatusForbidden, NOT_AUTHOR)
+		}
+		if err := message.DeleteWithRecipients(stmt[database.RECIPIENT_CLEANUP], stmt[database.MESSAGE_DELETE]); err != nil {
+			logging.FromRequest(req.Request).Error("Cannot delete message", "message_id", message.Id, "error", err)
+			return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		}
+		ui.RecordAuditEvent(req.Request, stmt, person, database.AUDIT_MESSAGE_DELETE, message.Id, "posted by "+person.Email)
+		return http.StatusNoContent, nil
+	}
+	return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+}
+
+// Find this message and its digest
+func findMessage(req *V1Request, stmt map[string]*sql.Stmt, id string, person *database.PERSON) (*MessageResource, int, interface{}) {
+	messages, err := database.RetrieveMessages(stmt[database.MESSAGE_BY_ID], id, 1, 0)
+	if err != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up message", "message_id", id, "error", err)
+		status, result := V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		return nil, status, result
+	}
+
+	if len(messages) == 0 {
+		status, result := V1Error(http.StatusNotFound, INVALID_ID)
+		return nil, status, result
+	}
+
+	digest, digestErr := messages[0].GetDigest(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], person.Id)
+	if digestErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot read message digest", "message_id", id, "error", digestErr)
+		status, result := V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		return nil, status, result
+	}
+
+	return AsMessageResource(digest), 0, nil
+}
+
+// The latest messages (or those the person received, authored or was
+// involved in), one page at a time: from the cursor of a previous page, or
+// (for older clients) at an offset, without cursors
+func listMessages(req *V1Request, stmt map[string]*sql.Stmt, person *database.PERSON) (int, interface{}) {
+	limit, offset, pageErr := req.Pagination()
+	if pageErr != nil {
+		return V1Error(http.StatusBadRequest, pageErr.Error())
+	}
+	view, viewErr := req.View()
+	if viewErr != nil {
+		return V1Error(http.StatusBadRequest, viewErr.Error())
+	}
+	cursor, cursorErr := req.Cursor()
+	if cursorErr != nil {
+		return V1Error(http.StatusBadRequest, cursorErr.Error())
+	}
+	if cursor != nil && offset > 0 {
+		return V1Error(http.StatusBadRequest, CURSOR_AND_OFFSET)
+	}
+
+	var (
+		messages []*database.MESSAGE
+		err      error
+	)
+	page := &ListPage{Limit: limit, Offset: offset}
+	if offset > 0 {
+		messages, err = view.Messages(stmt, person, limit, offset)
+	} else {
+		var found *database.MESSAGE_PAGE
+		found, err = view.Page(stmt, person, cursor, limit)
+		messages = found.Messages
+		if found.Newer != nil {
+			page.Newer = found.Newer.String()
+		}
+		if found.Older != nil {
+			page.Older = found.Older.String()
+		}
+	}
+	if err != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up messages", "person_id", person.Id, "error", err)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	digests, digestErrs := database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages, person.Id)
+	for _, digestErr := range digestErrs {
+		if digestErr != nil {
+			logging.FromRequest(req.Request).Error("Cannot read message digest", "error", digestErr)
+			return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		}
+	}
+
+	items := make([]*MessageResource, 0)
+	for _, digest := range digests {
+		items = append(items, AsMessageResource(digest))
+	}
+	page.Items = items
+
+	return http.StatusOK, page
+}
+
+// Post a new message from this person to the given recipients
+func createMessage(req *V1Request, stmt map[string]*sql.Stmt, person *database.PERSON) (int, interface{}) {
+	newMessage := new(NewMessage)
+	if err := req.Decode(newMessage); err != nil {
+		return V1Error(http.StatusBadRequest, err.Error())
+	}
+
+	if len(strings.TrimSpace(newMessage.Message)) == 0 {
+		return V1Error(http.StatusBadRequest, EMPTY_MESSAGE)
+	}
+
+	if len(newMessage.Recipients) == 0 {
+		return V1Error(http.StatusBadRequest, NO_RECIPIENTS)
+	}
+
+	recipients := make([]*database.PERSON, 0)
+	for _, r := range newMessage.Recipients {
+		email := strings.ToLower(strings.TrimSpace(r))
+		if !emailer.IsPossibleEmail(email) {
+			return V1Error(http.StatusBadRequest, INVALID_EMAIL)
+		}
+
+		recipient, recipientErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], email)
+		if recipientErr != nil {
+			logging.FromRequest(req.Request).Error("Cannot look up recipient", "error", recipientErr)
+			return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		}
+
+		if len(recipient.Id) == 0 || !recipient.Enabled {
+			return V1Error(http.StatusBadRequest, UNKNOWN_RECIPIENT+email)
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	message := new(database.MESSAGE)
+	message.PersonId = person.Id
+	message.Message = newMessage.Message
+
+	msgId, msgIdErr := message.Add(stmt[database.MESSAGE_INSERT], ui.CurrentSettings().MessageDuration)
+	if msgIdErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot add message", "person_id", person.Id, "error", msgIdErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+	message.Id = msgId
+	ui.RecordAuditEvent(req.Request, stmt, person, database.AUDIT_MESSAGE_POST, msgId, fmt.Sprintf("%d recipient(s)", len(recipients)))
+
+	for _, recipientErr := range message.AddRecipients(stmt[database.RECIPIENT_INSERT], recipients) {
+		if recipientErr != nil {
+			logging.FromRequest(req.Request).Error("Cannot add message recipient", "message_id", msgId, "error", recipientErr)
+			return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		}
+	}
+
+	created, status, err := findMessage(req, stmt, msgId, person)
+	if err != nil {
+		return status, err
+	}
+	return http.StatusCreated, created
+}
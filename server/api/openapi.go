@@ -0,0 +1,401 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// served at API_V1_PREFIX + OPENAPI_DOCUMENT
+	OPENAPI_DOCUMENT = "openapi.json"
+	OPENAPI_VERSION  = "3.0.3"
+	API_VERSION      = "1"
+
+	// the security scheme names
+	SESSION_SCHEME = "session"
+	TOKEN_SCHEME   = "token"
+)
+
+// A query parameter, documented as a string or an integer
+type V1Parameter struct {
+	Name        string
+	Integer     bool
+	Required    bool
+	Values      []string // the only values allowed, if any
+	Description string
+}
+
+// One api operation: the request body and each possible response are given
+// as example values, whose types define the schemas (nil means no content)
+type V1Operation struct {
+	Id        string
+	Method    string
+	Path      string
+	Summary   string
+	Public    bool   // no authentication needed
+	Scope     string // the api token scope, or empty if only sessions will do
+	Query     []*V1Parameter
+	Form      bool // the request body is form-encoded, rather than json
+	Request   interface{}
+	Responses map[int]interface{}
+}
+
+// The body of a public key search (the only form-encoded request)
+type SearchPublicKeysForm struct {
+	SessionId string `json:"sessionId"`
+	PersonId  string `json:"personId"`
+	Email     string `json:"email"`
+	TreeSize  int64  `json:"treeSize,omitempty"`
+}
+
+// Response values which are pages of items, or one of several types
+type openAPIPage struct {
+	item interface{}
+}
+
+type openAPIOneOf []interface{}
+
+var (
+	// the error object, used for every error response
+	errorResponse = &SimpleMessage{}
+
+	paginationParameters = []*V1Parameter{
+		&V1Parameter{Name: "limit", Integer: true, Description: fmt.Sprintf("How many items to return (default %d, at most %d)", DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE)},
+		&V1Parameter{Name: "offset", Integer: true, Description: "How many items to skip"}}
+
+	cursorParameter = &V1Parameter{Name: "cursor", Description: "The newer or older cursor of the previous page, for the page after it (instead of an offset, which returns no cursors)"}
+
+	viewParameter = &V1Parameter{Name: "view", Values: []string{database.VIEW_ALL, database.VIEW_RECEIVED, database.VIEW_AUTHORED, database.VIEW_INVOLVED},
+		Description: "Which messages to list: all of them (the default), or those you received, authored or were involved in either way"}
+
+	treeSizeParameter = &V1Parameter{Name: "tree_size", Integer: true, Description: "The size of the last key log tree the client saw, for a consistency proof"}
+
+	// every operation handled under API_V1_PREFIX, plus the public key
+	// search and the key log under KEY_LOG_PREFIX
+	V1Operations = []*V1Operation{
+		&V1Operation{Id: "createSession", Method: "POST", Path: "/api/v1/sessions", Summary: "Email a new session code, encrypted with the person's public keys", Public: true,
+			Request:   &SessionRequest{},
+			Responses: map[int]interface{}{http.StatusAccepted: &SimpleMessage{}, http.StatusBadRequest: errorResponse, http.StatusForbidden: errorResponse, http.StatusNotFound: errorResponse, http.StatusConflict: errorResponse, http.StatusTooManyRequests: errorResponse}},
+		&V1Operation{Id: "confirmSession", Method: "POST", Path: "/api/v1/sessions/confirm", Summary: "Confirm a decrypted session code", Public: true,
+			Request:   &SessionRequest{},
+			Responses: map[int]interface{}{http.StatusOK: &SessionResource{}, http.StatusBadRequest: errorResponse, http.StatusUnauthorized: errorResponse, http.StatusForbidden: errorResponse, http.StatusTooManyRequests: errorResponse}},
+		&V1Operation{Id: "listSessions", Method: "GET", Path: "/api/v1/sessions", Summary: "List your sessions",
+			Responses: map[int]interface{}{http.StatusOK: []*SessionResource{}}},
+		&V1Operation{Id: "revokeSessions", Method: "DELETE", Path: "/api/v1/sessions", Summary: "Revoke all of your sessions",
+			Responses: map[int]interface{}{http.StatusNoContent: nil}},
+		&V1Operation{Id: "revokeSession", Method: "DELETE", Path: "/api/v1/sessions/{handle}", Summary: "Revoke one of your sessions, by its handle",
+			Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusNotFound: errorResponse}},
+
+		&V1Operation{Id: "listMessages", Method: "GET", Path: "/api/v1/messages", Summary: "List the latest messages", Scope: SCOPE_MESSAGES_READ,
+			Query:     append([]*V1Parameter{viewParameter, cursorParameter}, paginationParameters...),
+			Responses: map[int]interface{}{http.StatusOK: &openAPIPage{&MessageResource{}}, http.StatusBadRequest: errorResponse}},
+		&V1Operation{Id: "createMessage", Method: "POST", Path: "/api/v1/messages", Summary: "Post an encrypted message to its recipients", Scope: SCOPE_MESSAGES_WRITE,
+			Request:   &NewMessage{},
+			Responses: map[int]interface{}{http.StatusCreated: &MessageResource{}, http.StatusBadRequest: errorResponse}},
+		&V1Operation{Id: "getMessage", Method: "GET", Path: "/api/v1/messages/{id}", Summary: "Get one message", Scope: SCOPE_MESSAGES_READ,
+			Responses: map[int]interface{}{http.StatusOK: &MessageResource{}, http.StatusNotFound: errorResponse}},
+		&V1Operation{Id: "deleteMessage", Method: "DELETE", Path: "/api/v1/messages/{id}", Summary: "Delete one of your messages", Scope: SCOPE_MESSAGES_WRITE,
+			Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusNotFound: errorResponse}},
+		&V1Operation{Id: "listRecipients", Method: "GET", Path: "/api/v1/messages/{id}/recipients", Summary: "List the recipients of one message", Scope: SCOPE_MESSAGES_READ,
+			Responses: map[int]interface{}{http.StatusOK: []*database.PERSON{}, http.StatusNotFound: errorResponse}},
+
+		&V1Operation{Id: "listKeys", Method: "GET", Path: "/api/v1/keys", Summary: "List your public keys", Scope: SCOPE_KEYS_READ,
+			Responses: map[int]interface{}{http.StatusOK: []*database.PUBLIC_KEY{}}},
+		&V1Operation{Id: "addKey", Method: "POST", Path: "/api/v1/keys", Summary: "Add an armored public key", Scope: SCOPE_KEYS_WRITE,
+			Request:   &NewPublicKey{},
+			Responses: map[int]interface{}{http.StatusCreated: &database.PUBLIC_KEY{}, http.StatusBadRequest: errorResponse, http.StatusConflict: errorResponse}},
+		&V1Operation{Id: "deleteKey", Method: "DELETE", Path: "/api/v1/keys/{id}", Summary: "Remove one of your public keys", Scope: SCOPE_KEYS_WRITE,
+			Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusNotFound: errorResponse, http.StatusConflict: errorResponse}},
+
+		&V1Operation{Id: "findPerson", Method: "GET", Path: "/api/v1/people", Summary: "Find the public keys for an email address", Scope: SCOPE_PEOPLE_READ,
+			Query:     []*V1Parameter{&V1Parameter{Name: "email", Required: true, Description: "The email address"}, treeSizeParameter},
+			Responses: map[int]interface{}{http.StatusOK: &PersonResource{}, http.StatusBadRequest: errorResponse}},
+		&V1Operation{Id: "getPerson", Method: "GET", Path: "/api/v1/people/{id}", Summary: "Get the public keys for one person", Scope: SCOPE_PEOPLE_READ,
+			Query:     []*V1Parameter{treeSizeParameter},
+			Responses: map[int]interface{}{http.StatusOK: &PersonResource{}, http.StatusBadRequest: errorResponse, http.StatusNotFound: errorResponse}},
+
+		&V1Operation{Id: "listTokens", Method: "GET", Path: "/api/v1/tokens", Summary: "List your api tokens",
+			Responses: map[int]interface{}{http.StatusOK: []*database.API_TOKEN{}}},
+		&V1Operation{Id: "createToken", Method: "POST", Path: "/api/v1/tokens", Summary: "Create an api token (the token itself is only returned this once)",
+			Request:   &NewAPIToken{},
+			Responses: map[int]interface{}{http.StatusCreated: &APITokenResource{}, http.StatusBadRequest: errorResponse}},
+		&V1Operation{Id: "revokeToken", Method: "DELETE", Path: "/api/v1/tokens/{id}", Summary: "Revoke one of your api tokens",
+			Responses: map[int]interface{}{http.StatusNoContent: nil, http.StatusNotFound: errorResponse}},
+
+		&V1Operation{Id: "getOpenAPI", Method: "GET", Path: "/api/v1/openapi.json", Summary: "This document", Public: true,
+			Responses: map[int]interface{}{http.StatusOK: map[string]interface{}{}}},
+
+		&V1Operation{Id: "searchPublicKeys", Method: "POST", Path: "/searchPublicKeys", Summary: "Find the public keys for an email address (errors are also returned with a 200 status)", Public: true,
+			Form:      true,
+			Request:   &SearchPublicKeysForm{},
+			Responses: map[int]interface{}{http.StatusOK: openAPIOneOf{[]*LoggedKey{}, errorResponse}}},
+
+		&V1Operation{Id: "getTreeHead", Method: "GET", Path: KEY_LOG_PREFIX + TREE_HEAD_PATH, Summary: "The latest signed tree head of the key transparency log", Public: true,
+			Responses: map[int]interface{}{http.StatusOK: &transparency.SignedTreeHead{}}},
+		&V1Operation{Id: "getConsistencyProof", Method: "GET", Path: KEY_LOG_PREFIX + CONSISTENCY_PATH, Summary: "Prove that the key log tree of the first size is a prefix of the tree of the second", Public: true,
+			Query: []*V1Parameter{&V1Parameter{Name: "first", Integer: true, Required: true, Description: "The size of the earlier tree"},
+				&V1Parameter{Name: "second", Integer: true, Required: true, Description: "The size of the later tree"}},
+			Responses: map[int]interface{}{http.StatusOK: &transparency.Consistency{}, http.StatusBadRequest: errorResponse}},
+		&V1Operation{Id: "getLogEntries", Method: "GET", Path: KEY_LOG_PREFIX + ENTRIES_PATH, Summary: fmt.Sprintf("List the key log entries from start up to end (at most %d at once)", MAX_LOG_ENTRIES), Public: true,
+			Query: []*V1Parameter{&V1Parameter{Name: "start", Integer: true, Required: true, Description: "The first leaf index"},
+				&V1Parameter{Name: "end", Integer: true, Required: true, Description: "The leaf index after the last one"}},
+			Responses: map[int]interface{}{http.StatusOK: []*database.KEY_LOG_ENTRY{}, http.StatusBadRequest: errorResponse}},
+	}
+)
+
+// Generate the OpenAPI description of V1Operations, with the schemas taken
+// from the json encoding of their request and response types
+func OpenAPIDocument() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]interface{}{}
+
+	for _, op := range V1Operations {
+		item, exists := paths[op.Path].(map[string]interface{})
+		if !exists {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = op.document(schemas)
+	}
+
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "TeamWork.io",
+			"version": API_VERSION,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				SESSION_SCHEME: map[string]interface{}{"type": "apiKey", "in": "header", "name": SESSION_HEADER, "description": "The id of a verified session"},
+				TOKEN_SCHEME:   map[string]interface{}{"type": "http", "scheme": "bearer", "description": "An api token, limited to the scope given by each operation's x-token-scope"},
+			},
+		},
+	}
+}
+
+// The statuses this operation can respond with, including the ones which
+// apply to every operation
+func (op *V1Operation) Statuses() map[int]interface{} {
+	statuses := map[int]interface{}{http.StatusInternalServerError: errorResponse, http.StatusServiceUnavailable: errorResponse}
+	if !op.Public {
+		statuses[http.StatusUnauthorized] = errorResponse
+		statuses[http.StatusForbidden] = errorResponse
+	}
+	for status, response := range op.Responses {
+		statuses[status] = response
+	}
+	return statuses
+}
+
+// Does this operation match the given method and (actual) path?
+func (op *V1Operation) Matches(method, path string) bool {
+	if op.Method != method {
+		return false
+	}
+
+	expected := strings.Split(op.Path, "/")
+	actual := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(expected) != len(actual) {
+		return false
+	}
+	for i, segment := range expected {
+		if strings.HasPrefix(segment, "{") {
+			if len(actual[i]) == 0 {
+				return false
+			}
+		} else if segment != actual[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (op *V1Operation) document(schemas map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{
+		"operationId": op.Id,
+		"summary":     op.Summary,
+	}
+
+	if op.Public {
+		result["security"] = []interface{}{}
+	} else if len(op.Scope) == 0 {
+		result["security"] = []interface{}{map[string]interface{}{SESSION_SCHEME: []string{}}}
+	} else {
+		result["security"] = []interface{}{map[string]interface{}{SESSION_SCHEME: []string{}}, map[string]interface{}{TOKEN_SCHEME: []string{}}}
+		result["x-token-scope"] = op.Scope
+	}
+
+	parameters := make([]interface{}, 0)
+	if strings.Contains(op.Path, "{id}") {
+		parameters = append(parameters, map[string]interface{}{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string", "format": "uuid"}})
+	}
+	if strings.Contains(op.Path, "{handle}") {
+		parameters = append(parameters, map[string]interface{}{"name": "handle", "in": "path", "required": true, "description": "The session's handle, from the list of sessions", "schema": map[string]interface{}{"type": "string"}})
+	}
+	for _, p := range op.Query {
+		paramType := "string"
+		if p.Integer {
+			paramType = "integer"
+		}
+		schema := map[string]interface{}{"type": paramType}
+		if len(p.Values) > 0 {
+			schema["enum"] = p.Values
+		}
+		parameters = append(parameters, map[string]interface{}{"name": p.Name, "in": "query", "required": p.Required, "description": p.Description, "schema": schema})
+	}
+	if len(parameters) > 0 {
+		result["parameters"] = parameters
+	}
+
+	if op.Request != nil {
+		mediaType := "application/json"
+		if op.Form {
+			mediaType = "application/x-www-form-urlencoded"
+		}
+		result["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{mediaType: map[string]interface{}{"schema": openAPIValueSchema(op.Request, schemas)}},
+		}
+	}
+
+	statuses := op.Statuses()
+	codes := make([]int, 0)
+	for status := range statuses {
+		codes = append(codes, status)
+	}
+	sort.Ints(codes)
+
+	responses := map[string]interface{}{}
+	for _, status := range codes {
+		response := map[string]interface{}{"description": http.StatusText(status)}
+		if statuses[status] != nil {
+			response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": openAPIValueSchema(statuses[status], schemas)}}
+		}
+		responses[fmt.Sprintf("%d", status)] = response
+	}
+	result["responses"] = responses
+
+	return result
+}
+
+// The schema for this example value, handling pages and alternatives
+func openAPIValueSchema(v interface{}, schemas map[string]interface{}) map[string]interface{} {
+	switch value := v.(type) {
+	case *openAPIPage:
+		itemType := reflect.TypeOf(value.item)
+		for itemType.Kind() == reflect.Ptr {
+			itemType = itemType.Elem()
+		}
+		name := itemType.Name() + "Page"
+		if _, exists := schemas[name]; !exists {
+			page := openAPIStructSchema(reflect.TypeOf(ListPage{}), schemas)
+			page["properties"].(map[string]interface{})["items"] = openAPISchema(reflect.SliceOf(reflect.TypeOf(value.item)), schemas)
+			schemas[name] = page
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	case openAPIOneOf:
+		alternatives := make([]interface{}, 0)
+		for _, alternative := range value {
+			alternatives = append(alternatives, openAPIValueSchema(alternative, schemas))
+		}
+		return map[string]interface{}{"oneOf": alternatives}
+	}
+	return openAPISchema(reflect.TypeOf(v), schemas)
+}
+
+// The schema for the json encoding of this type, where named structs are
+// added to the shared schemas and referred to by name
+func openAPISchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if _, exists := schemas[t.Name()]; !exists {
+			schemas[t.Name()] = map[string]interface{}{} // placeholder, in case the type refers to itself
+			schemas[t.Name()] = openAPIStructSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{"type": "object"}
+}
+
+func openAPIStructSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := make([]string, 0)
+	openAPIFields(t, properties, &required, schemas)
+
+	result := map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+	if len(required) > 0 {
+		result["required"] = required
+	}
+	return result
+}
+
+// Add the json fields of this struct (and of any embedded structs)
+func openAPIFields(t reflect.Type, properties map[string]interface{}, required *[]string, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if field.Anonymous {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				openAPIFields(embedded, properties, required, schemas)
+				continue
+			}
+		}
+
+		if len(field.PkgPath) > 0 {
+			continue // unexported
+		}
+
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := tag[0]
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		properties[name] = openAPISchema(field.Type, schemas)
+
+		omitEmpty := false
+		for _, option := range tag[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+		}
+		if !omitEmpty {
+			*required = append(*required, name)
+		}
+	}
+}
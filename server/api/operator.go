@@ -0,0 +1,62 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	OPERATORS_ONLY = "This path is only served to operators"
+
+	// how long an operator request may take to arrive
+	OPERATOR_READ_TIMEOUT = 10 * time.Second
+)
+
+// Only serve this operator path (counters and metrics) to operators: in the
+// fcgi mode, the web server in front of this one restricts access to it,
+// but in the http and https modes, it is only served to loopback clients
+func OperatorOnly(mode string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if mode == MODE_FCGI {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			status, result := V1Error(http.StatusForbidden, OPERATORS_ONLY)
+			WriteJSON(w, status, result)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Serve the operator paths on their own plain http listener at this
+// address (e.g., on a private interface), apart from the public server
+func OperatorServer(address string, handlers map[string]func(http.ResponseWriter, *http.Request)) error {
+	mux := http.NewServeMux()
+	for pattern, handler := range handlers {
+		mux.Handle(pattern, http.HandlerFunc(handler))
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	logging.Info("Listening for operators", "address", address)
+
+	s := &http.Server{Handler: logging.Requests(mux), ReadTimeout: OPERATOR_READ_TIMEOUT}
+	go func() {
+		if err := s.Serve(listener); err != nil {
+			logging.Error("Stopped serving operators", "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/emailer"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A person, as seen through the api, with their public keys (each with the
+// proof that it is in the key transparency log)
+type PersonResource struct {
+	Email string       `json:"email"`
+	Id    string       `json:"id,omitempty"`
+	Keys  []*LoggedKey `json:"keys"`
+}
+
+// GET /people?email=, GET /people/{id}
+func PeopleResource(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{}) {
+	if req.Request.Method != "GET" {
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	if len(req.Path) > 1 {
+		return V1Error(http.StatusNotFound, INVALID_ID)
+	}
+
+	_, _, authStatus, authErr := req.Authenticate(stmt, SCOPE_PEOPLE_READ)
+	if authErr != nil {
+		return authStatus, authErr
+	}
+
+	if len(req.Path) == 1 {
+		id, valid := req.Id()
+		if !valid {
+			return V1Error(http.StatusNotFound, INVALID_ID)
+		}
+
+		person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], id)
+		if personErr != nil {
+			logging.FromRequest(req.Request).Error("Cannot look up person", "person_id", id, "error", personErr)
+			return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		}
+
+		if len(person.Id) == 0 || (req.PrivacyMode && !person.Enabled) {
+			return V1Error(http.StatusNotFound, INVALID_ID)
+		}
+
+		return lookupPerson(req, stmt, person.Email)
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Request.URL.Query().Get("email")))
+	if len(email) == 0 {
+		return V1Error(http.StatusBadRequest, MISSING_PARAMETER)
+	}
+	if !emailer.IsPossibleEmail(email) {
+		return V1Error(http.StatusBadRequest, INVALID_EMAIL)
+	}
+
+	return lookupPerson(req, stmt, email)
+}
+
+// Find the public keys for this email address, the same way as the ajax
+// search: known and unknown addresses only differ by their keys
+func lookupPerson(req *V1Request, stmt map[string]*sql.Stmt, email string) (int, interface{}) {
+	// the size of the last tree the client saw, if any, for a consistency proof
+	var treeSize int64
+	if t := req.Request.URL.Query().Get("tree_size"); len(t) > 0 {
+		parsed, parsedErr := strconv.ParseInt(t, 10, 64)
+		if parsedErr != nil || parsed < 0 {
+			return V1Error(http.StatusBadRequest, INVALID_TREE_SIZE)
+		}
+		treeSize = parsed
+	}
+
+	if req.PrivacyMode {
+		defer ui.EqualizeResponseTime(time.Now(), ui.PRIVACY_RESPONSE_TIME)
+	}
+
+	keys, keysErr := FindPublicKeys(req.Request, stmt, email, req.PrivacyMode)
+	if keysErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot find public keys", "error", keysErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	proven, proofErr := ProveKeys(stmt, email, keys, treeSize)
+	if proofErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot prove public keys", "error", proofErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	result := &PersonResource{Email: email, Keys: proven}
+	if len(keys) > 0 {
+		person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], email)
+		if personErr != nil {
+			logging.FromRequest(req.Request).Error("Cannot look up person", "error", personErr)
+			return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		}
+		result.Id = person.Id
+	}
+
+	return http.StatusOK, result
+}
@@ -10,18 +10,35 @@ import (
 	"github.com/Banrai/TeamWork.io/server/database"
 	"github.com/Banrai/TeamWork.io/server/emailer"
 	"github.com/Banrai/TeamWork.io/server/keyservers"
-	"log"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"github.com/Banrai/TeamWork.io/server/ui"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Respond to an ajax request: return all the public keys for this email,
-// on behalf of the particular registered person, with a valid session
-func SearchPersonPublicKeys(r *http.Request, db database.DBConnection) string {
-	// the result is a json representation of the list of public keys found
-	results := make([]*database.PUBLIC_KEY, 0)
+// on behalf of the particular registered person, with a valid session; in
+// privacy mode, disabled email addresses look the same as unknown ones
+// without any keys, and every response takes the same minimum time
+func SearchPersonPublicKeys(w http.ResponseWriter, r *http.Request, db database.DBConnection, privacyMode bool) string {
+	return SearchPublicKeys(w, r, DatabaseRunner(db), privacyMode)
+}
+
+// Search for the public keys, using the prepared statements from withDatabase
+// (if the database is unavailable, the response is a 503)
+func SearchPublicKeys(w http.ResponseWriter, r *http.Request, withDatabase StatementRunner, privacyMode bool) string {
+	// the result is a json representation of the list of public keys found,
+	// each with the proof that it is in the key transparency log
+	results := make([]*LoggedKey, 0)
 	valid := false
 
+	if privacyMode {
+		defer ui.EqualizeResponseTime(time.Now(), ui.PRIVACY_RESPONSE_TIME)
+	}
+
 	// this function only responds to POST requests
 	if "POST" == r.Method {
 		r.ParseForm()
@@ -49,6 +66,16 @@ func SearchPersonPublicKeys(r *http.Request, db database.DBConnection) string {
 			return GenerateSimpleMessage(INVALID_REQUEST, "Not a valid email address")
 		}
 
+		// the size of the last tree the client saw, if any, for a consistency proof
+		var treeSize int64
+		if t, tExists := r.PostForm["treeSize"]; tExists {
+			parsed, parsedErr := strconv.ParseInt(strings.Join(t, ""), 10, 64)
+			if parsedErr != nil || parsed < 0 {
+				return GenerateSimpleMessage(INVALID_REQUEST, INVALID_TREE_SIZE)
+			}
+			treeSize = parsed
+		}
+
 		fn := func(stmt map[string]*sql.Stmt) {
 			// remove any expired sessions
 			database.CleanupSessions(stmt[database.SESSION_CLEANUP])
@@ -76,50 +103,25 @@ func SearchPersonPublicKeys(r *http.Request, db database.DBConnection) string {
 			}
 
 			if valid {
-				// see if there any public keys for the given email address already in the db,
-				// based on existing person registrations
-				searchPerson, searchPersonErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], searchEmail)
-				if len(searchPerson.Id) == 0 && searchPersonErr == nil {
-					// person with this email is currently unknown
-					// see if the pk + email exist in the MIT key server
-					keys, keysErr := keyservers.MITSearch(searchEmail)
-					if keysErr != nil {
-						return
-					}
-
-					for i, key := range keys {
-						result := new(database.PUBLIC_KEY)
-						result.Key = key
-						result.Source = keyservers.MIT_SOURCE
-						result.Nickname = fmt.Sprintf("%s (%d)", keyservers.MIT_SOURCE, i)
-
-						results = append(results, result)
-					}
-
-					// add the PERSON and each corresponding PUBLIC_KEY to the database
-					if len(results) > 0 {
-						log.Println(fmt.Sprintf("AddPersonWithKeys(): %s", searchEmail))
-						err := database.AddPersonWithKeys(stmt[database.PERSON_INSERT], stmt[database.PK_INSERT], searchEmail, results)
-						if err != nil {
-							log.Println(err)
-						}
-					}
-
-				} else {
-					// email corresponds to an existing person in the db
-					personKeys, personKeysErr := searchPerson.LookupPublicKeys(stmt[database.PK_LOOKUP])
-					if personKeysErr != nil {
-						return
-					}
-
-					for _, pk := range personKeys {
-						results = append(results, pk)
-					}
+				keys, keysErr := FindPublicKeys(r, stmt, searchEmail, privacyMode)
+				if keysErr != nil {
+					logging.FromRequest(r).Error("Cannot find public keys", "error", keysErr)
+					return
 				}
+				proven, proofErr := ProveKeys(stmt, searchEmail, keys, treeSize)
+				if proofErr != nil {
+					logging.FromRequest(r).Error("Cannot prove public keys", "error", proofErr)
+					return
+				}
+				results = proven
 			}
 		}
 
-		database.WithDatabase(db, fn)
+		if err := withDatabase(r.Context(), fn); err != nil {
+			logging.FromRequest(r).Error("Cannot use the database", "error", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return GenerateSimpleMessage(http.StatusText(http.StatusServiceUnavailable), NO_DATABASE)
+		}
 	}
 
 	if !valid {
@@ -132,3 +134,64 @@ func SearchPersonPublicKeys(r *http.Request, db database.DBConnection) string {
 		return string(result)
 	}
 }
+
+// Find the public keys for this email address: those of an existing person
+// registration, or else any at the MIT key server (which are then added to
+// the database); in privacy mode, disabled persons have no keys
+func FindPublicKeys(r *http.Request, stmt map[string]*sql.Stmt, email string, privacyMode bool) ([]*database.PUBLIC_KEY, error) {
+	results := make([]*database.PUBLIC_KEY, 0)
+
+	// see if there any public keys for the given email address already in the db,
+	// based on existing person registrations
+	searchPerson, searchPersonErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], email)
+	if searchPersonErr != nil {
+		return results, searchPersonErr
+	}
+
+	if len(searchPerson.Id) == 0 {
+		// person with this email is currently unknown
+		// see if the pk + email exist in the MIT key server
+		// (the key server being unavailable just means there are no keys)
+		keys, keysErr := keyservers.MITSearch(r.Context(), email)
+		if keysErr != nil {
+			logging.FromRequest(r).Warn("Key server search failed", "keyserver", keyservers.MIT_SOURCE, "error", keysErr)
+			return results, nil
+		}
+
+		for i, key := range keys {
+			result := new(database.PUBLIC_KEY)
+			result.Key = key
+			result.Source = keyservers.MIT_SOURCE
+			result.Nickname = fmt.Sprintf("%s (%d)", keyservers.MIT_SOURCE, i)
+
+			results = append(results, result)
+		}
+
+		// add the PERSON and each corresponding PUBLIC_KEY to the database
+		if len(results) > 0 {
+			logging.FromRequest(r).Info("Adding person with keys from the key server", "email", email, "keys", len(results))
+			err := database.AddPersonWithKeys(stmt[database.PERSON_INSERT], stmt[database.PK_INSERT], email, results)
+			if err != nil {
+				logging.FromRequest(r).Error("Cannot add person with keys", "error", err)
+			} else {
+				for _, key := range results {
+					ui.LogKeyChange(r, stmt, transparency.ACTION_ADD, email, key)
+				}
+				ui.RecordAuditEvent(r, stmt, nil, database.AUDIT_KEY_ADD, email, fmt.Sprintf("%d key(s) imported from %s", len(results), keyservers.MIT_SOURCE))
+			}
+		}
+
+	} else if searchPerson.Enabled || !privacyMode {
+		// email corresponds to an existing person in the db
+		personKeys, personKeysErr := searchPerson.LookupPublicKeys(stmt[database.PK_LOOKUP])
+		if personKeysErr != nil {
+			return results, personKeysErr
+		}
+
+		for _, pk := range personKeys {
+			results = append(results, pk)
+		}
+	}
+
+	return results, nil
+}
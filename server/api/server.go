@@ -4,21 +4,36 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"github.com/Banrai/TeamWork.io/server/logging"
 	"net"
 	"net/http"
 	"net/http/fcgi"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Server struct {
 	mux       *http.ServeMux
 	s         *http.Server
-	Logger    *log.Logger
+	Logger    *logging.Logger
 	Transport string
+	mode      string
+	listener  net.Listener
+
+	// the requests in progress, and whether the server is shutting down
+	active   sync.Mutex
+	requests int
+	stopping bool
+	drained  chan struct{}
+	stopped  chan struct{}
 }
 
 type SimpleMessage struct {
@@ -30,14 +45,35 @@ const (
 	INVALID_REQUEST   = "Invalid Request"
 	INVALID_SESSION   = "Session is expired or invalid"
 	MISSING_PARAMETER = "Missing required parameter"
+
+	// how the server takes requests: as FastCGI, from a web server in front
+	// of it, or directly as plain HTTP or HTTPS
+	MODE_FCGI  = "fcgi"
+	MODE_HTTP  = "http"
+	MODE_HTTPS = "https"
+
+	UNKNOWN_MODE      = "The server mode must be one of fcgi, http or https"
+	MISSING_TLS_FILES = "The https mode needs both a certificate and a key file"
+	SHUTTING_DOWN     = "The server is shutting down"
 )
 
 var (
 	Srv                      *Server
-	DefaultServerReadTimeout = 30 // in seconds
+	DefaultServerReadTimeout = 30 * time.Second
 	DefaultServerTransport   = "tcp"
+	DefaultShutdownTimeout   = 30 * time.Second
+
+	// what to read again on SIGHUP
+	reloaders = make([]func() error, 0)
 )
 
+// Call fn whenever the server gets a SIGHUP, while requests go on: fn should
+// read and check everything first, and only then swap it in, so requests see
+// either all of the old or all of the new (and if it fails, the old stays)
+func OnReload(fn func() error) {
+	reloaders = append(reloaders, fn)
+}
+
 func GenerateSimpleMessage(msg string, errorMsg string) string {
 	ack := new(SimpleMessage)
 	ack.Ack = msg
@@ -55,7 +91,27 @@ func Respond(mediaType string, charset string, fn func(w http.ResponseWriter, r
 	}
 }
 
-func RequestServer(host, transport string, port, timeout int, statics map[string]http.Handler, handlers map[string]func(http.ResponseWriter, *http.Request)) {
+// Check that the server can run in this mode, with these certificate and
+// key files (which only the https mode uses)
+func ValidateServerMode(mode, certFile, keyFile string) error {
+	switch mode {
+	case MODE_FCGI, MODE_HTTP:
+		return nil
+	case MODE_HTTPS:
+		if len(certFile) == 0 || len(keyFile) == 0 {
+			return errors.New(MISSING_TLS_FILES)
+		}
+		return nil
+	}
+	return errors.New(UNKNOWN_MODE)
+}
+
+// Serve the static folders and handlers on the host and port, in this mode,
+// until the server gets a SIGTERM (or SIGINT): it then stops accepting
+// requests, and returns once the ones in progress are done, or after the
+// shutdown timeout; on SIGHUP, it runs the OnReload functions (and in the
+// https mode, reads the certificate and key files again)
+func RequestServer(mode, host, transport string, port int, timeout, shutdownTimeout time.Duration, certFile, keyFile string, statics map[string]http.Handler, handlers map[string]func(http.ResponseWriter, *http.Request)) {
 	mux := http.NewServeMux()
 	for pattern, staticHandler := range statics {
 		mux.Handle(pattern, staticHandler)
@@ -65,20 +121,149 @@ func RequestServer(host, transport string, port, timeout int, statics map[string
 	}
 	s := &http.Server{
 		Addr:        fmt.Sprintf("%s:%d", host, port),
-		Handler:     mux,
-		ReadTimeout: time.Duration(timeout) * time.Second, // to prevent abuse of "keep-alive" requests by clients
+		ReadTimeout: timeout, // to prevent abuse of "keep-alive" requests by clients
 	}
 	Srv = &Server{
 		mux:       mux,
 		s:         s,
-		Logger:    log.New(os.Stdout, "", log.Ldate|log.Ltime),
+		Logger:    logging.With("mode", mode),
 		Transport: transport,
+		mode:      mode,
+		drained:   make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	s.Handler = logging.Requests(Srv.track(mux))
+
+	if err := ValidateServerMode(mode, certFile, keyFile); err != nil {
+		Srv.Logger.Fatal("Cannot start the server", "error", err)
+	}
+
+	if mode == MODE_HTTPS {
+		certificates, err := NewCertificateReloader(certFile, keyFile)
+		if err != nil {
+			Srv.Logger.Fatal("Cannot read the certificate", "error", err)
+		}
+		s.TLSConfig = &tls.Config{GetCertificate: certificates.GetCertificate, MinVersion: tls.VersionTLS12}
+		OnReload(certificates.Reload)
 	}
 
-	// create a listener for the incoming FastCGI requests
+	// create a listener for the incoming requests
 	listener, err := net.Listen(Srv.Transport, Srv.s.Addr)
 	if err != nil {
-		Srv.Logger.Fatal(err)
+		Srv.Logger.Fatal("Cannot listen", "address", Srv.s.Addr, "error", err)
+	}
+	Srv.listener = listener
+	Srv.Logger.Info("Listening", "address", Srv.s.Addr)
+
+	go Srv.handleSignals(shutdownTimeout)
+
+	switch mode {
+	case MODE_FCGI:
+		err = fcgi.Serve(listener, s.Handler)
+	case MODE_HTTP:
+		err = s.Serve(listener)
+	case MODE_HTTPS:
+		err = s.ServeTLS(listener, "", "")
+	}
+
+	// closing the listener on shutdown also ends Serve
+	if Srv.isStopping() {
+		<-Srv.stopped
+		return
 	}
-	fcgi.Serve(listener, Srv.mux)
+	Srv.Logger.Fatal("Stopped serving", "error", err)
+}
+
+// Reload on SIGHUP, and shut down on SIGTERM or SIGINT
+func (srv *Server) handleSignals(shutdownTimeout time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			srv.Reload()
+			continue
+		}
+
+		srv.Logger.Info("Shutting down", "signal", sig, "timeout", shutdownTimeout)
+		if err := srv.Shutdown(shutdownTimeout); err != nil {
+			srv.Logger.Warn("Requests still in progress at shutdown", "error", err)
+		} else {
+			srv.Logger.Info("Stopped")
+		}
+		signal.Stop(signals)
+		close(srv.stopped)
+		return
+	}
+}
+
+// Run the OnReload functions, without waiting for the requests in progress
+func (srv *Server) Reload() {
+	failed := 0
+	for _, fn := range reloaders {
+		if err := fn(); err != nil {
+			srv.Logger.Error("Reload failed", "error", err)
+			failed++
+		}
+	}
+	srv.Logger.Info("Reloaded", "reloaders", len(reloaders), "failed", failed)
+}
+
+// Stop accepting requests, and wait for the ones in progress, up to the
+// timeout
+func (srv *Server) Shutdown(timeout time.Duration) error {
+	srv.active.Lock()
+	srv.stopping = true
+	if srv.requests == 0 {
+		close(srv.drained)
+	}
+	srv.active.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if srv.mode == MODE_FCGI {
+		// the fcgi package has no shutdown of its own
+		srv.listener.Close()
+	} else if err := srv.s.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case <-srv.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (srv *Server) isStopping() bool {
+	srv.active.Lock()
+	defer srv.active.Unlock()
+	return srv.stopping
+}
+
+// Count the requests in progress, and refuse new ones once shutting down
+func (srv *Server) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.active.Lock()
+		if srv.stopping {
+			srv.active.Unlock()
+			w.Header().Set("Connection", "close")
+			http.Error(w, SHUTTING_DOWN, http.StatusServiceUnavailable)
+			return
+		}
+		srv.requests++
+		srv.active.Unlock()
+
+		defer func() {
+			srv.active.Lock()
+			srv.requests--
+			if srv.stopping && srv.requests == 0 {
+				close(srv.drained)
+			}
+			srv.active.Unlock()
+		}()
+
+		handler.ServeHTTP(w, r)
+	})
 }
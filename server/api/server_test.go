@@ -0,0 +1,118 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A server in the http mode, whose handler waits for release
+func startTestServer(t *testing.T, started chan<- bool, release <-chan bool) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{s: &http.Server{},
+		Logger:   logging.With("test", t.Name()),
+		mode:     MODE_HTTP,
+		listener: listener,
+		drained:  make(chan struct{}),
+		stopped:  make(chan struct{})}
+	srv.s.Handler = srv.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("done"))
+	}))
+	go srv.s.Serve(listener)
+
+	return srv, "http://" + listener.Addr().String() + "/"
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	started, release := make(chan bool, 1), make(chan bool)
+	srv, url := startTestServer(t, started, release)
+
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.Shutdown(5 * time.Second)
+	}()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("shut down during a request: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// no new requests are accepted
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("a new request was accepted while shutting down: %d", resp.StatusCode)
+	}
+
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+	if status := <-responses; status != http.StatusOK {
+		t.Errorf("the request in progress got %d", status)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started, release := make(chan bool, 1), make(chan bool)
+	defer close(release)
+	srv, url := startTestServer(t, started, release)
+
+	go http.Get(url)
+	<-started
+
+	if err := srv.Shutdown(100 * time.Millisecond); err == nil {
+		t.Error("the shutdown did not time out")
+	}
+}
+
+func TestReloadDuringRequest(t *testing.T) {
+	started, release := make(chan bool, 1), make(chan bool)
+	defer close(release)
+	srv, url := startTestServer(t, started, release)
+
+	defer func(previous []func() error) { reloaders = previous }(reloaders)
+	reloaded := 0
+	reloaders = []func() error{func() error { reloaded++; return nil }}
+
+	go http.Get(url)
+	<-started
+
+	// the request in progress does not hold up the reload
+	done := make(chan bool)
+	go func() {
+		srv.Reload()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the reload waited for the request in progress")
+	}
+	if reloaded != 1 {
+		t.Errorf("reloaded %d times", reloaded)
+	}
+}
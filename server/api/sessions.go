@@ -0,0 +1,216 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/emailer"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SESSION_SENT     = "A session code has been sent to this email address, encrypted with its public keys"
+	UNKNOWN_EMAIL    = "This email address does not have any public keys associated with it"
+	DISABLED_EMAIL   = "This email address and all of its public keys has been disabled"
+	NO_PUBLIC_KEYS   = "This email address needs at least one public key"
+	SESSION_LIMITED  = "Too many sessions have been requested recently"
+	TOO_MANY_GUESSES = "Too many incorrect attempts"
+)
+
+// A session, as seen through the api: without its code, and without its id
+// (the credential) except when confirming it, but with a handle for
+// revoking it
+type SessionResource struct {
+	Id           string    `json:"id,omitempty"`
+	Handle       string    `json:"handle"`
+	Current      bool      `json:"current"`
+	PersonId     string    `json:"person_id"`
+	DateCreated  time.Time `json:"date_created"`
+	Verified     bool      `json:"verified"`
+	DateVerified time.Time `json:"date_verified"`
+	DateExpires  time.Time `json:"date_expires"`
+}
+
+// The body of the session requests: the email address, and (to confirm
+// it) the decrypted session code
+type SessionRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code,omitempty"`
+}
+
+func AsSessionResource(s *database.SESSION) *SessionResource {
+	return &SessionResource{Handle: s.Handle(), PersonId: s.PersonId, DateCreated: s.DateCreated, Verified: s.Verified, DateVerified: s.DateVerified, DateExpires: s.DateExpires}
+}
+
+// POST /sessions, POST /sessions/confirm, GET /sessions,
+// DELETE /sessions, DELETE /sessions/{handle}
+func SessionsResource(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{}) {
+	// creating and confirming sessions do not need one already
+	if req.Request.Method == "POST" {
+		if len(req.Path) == 0 {
+			return createSession(req, stmt)
+		}
+		if len(req.Path) == 1 && req.Path[0] == "confirm" {
+			return confirmSession(req, stmt)
+		}
+		return V1Error(http.StatusNotFound, UNKNOWN_RESOURCE)
+	}
+
+	current, person, authStatus, authErr := req.Authenticate(stmt, "")
+	if authErr != nil {
+		return authStatus, authErr
+	}
+
+	sessions, sessionsErr := person.LookupSessions(stmt[database.SESSION_LOOKUP_BY_PERSON])
+	if sessionsErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up sessions", "person_id", person.Id, "error", sessionsErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	if len(req.Path) == 0 {
+		switch req.Request.Method {
+		case "GET":
+			items := make([]*SessionResource, 0)
+			for _, s := range sessions {
+				item := AsSessionResource(s)
+				item.Current = current != nil && s.Id == current.Id
+				items = append(items, item)
+			}
+			return http.StatusOK, items
+		case "DELETE":
+			if err := person.DeleteSessions(stmt[database.SESSION_DELETE_BY_PERSON]); err != nil {
+				logging.FromRequest(req.Request).Error("Cannot delete sessions", "person_id", person.Id, "error", err)
+				return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+			}
+			return http.StatusNoContent, nil
+		}
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	if len(req.Path) > 1 {
+		return V1Error(http.StatusNotFound, INVALID_ID)
+	}
+	handle := strings.ToLower(req.Path[0])
+
+	if req.Request.Method != "DELETE" {
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	for _, s := range sessions {
+		if s.Handle() == handle {
+			if err := s.Delete(stmt[database.SESSION_DELETE]); err != nil {
+				logging.FromRequest(req.Request).Error("Cannot delete session", "person_id", person.Id, "error", err)
+				return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+			}
+			return http.StatusNoContent, nil
+		}
+	}
+
+	return V1Error(http.StatusNotFound, INVALID_ID)
+}
+
+// Read the email address from the session request body
+func readSessionRequest(req *V1Request) (*SessionRequest, int, interface{}) {
+	sessionReq := new(SessionRequest)
+	if err := req.Decode(sessionReq); err != nil {
+		status, result := V1Error(http.StatusBadRequest, err.Error())
+		return nil, status, result
+	}
+
+	sessionReq.Email = strings.ToLower(strings.TrimSpace(sessionReq.Email))
+	if !emailer.IsPossibleEmail(sessionReq.Email) {
+		status, result := V1Error(http.StatusBadRequest, INVALID_EMAIL)
+		return nil, status, result
+	}
+
+	return sessionReq, 0, nil
+}
+
+// Email a new session code to this address
+func createSession(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{}) {
+	sessionReq, status, err := readSessionRequest(req)
+	if err != nil {
+		return status, err
+	}
+
+	if req.PrivacyMode {
+		defer ui.EqualizeResponseTime(time.Now(), ui.PRIVACY_RESPONSE_TIME)
+		ui.CreatePrivateSession(req.Request, sessionReq.Email, stmt)
+		return http.StatusAccepted, &SimpleMessage{Ack: ui.PRIVATE_SESSION_SENT}
+	}
+
+	person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], sessionReq.Email)
+	if personErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up person", "error", personErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	if len(person.Id) == 0 {
+		return V1Error(http.StatusNotFound, UNKNOWN_EMAIL)
+	}
+
+	if !person.Enabled {
+		return V1Error(http.StatusForbidden, DISABLED_EMAIL)
+	}
+
+	publicKeys, publicKeysErr := person.LookupPublicKeys(stmt[database.PK_LOOKUP])
+	if publicKeysErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up public keys", "person_id", person.Id, "error", publicKeysErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	if len(publicKeys) == 0 {
+		return V1Error(http.StatusConflict, NO_PUBLIC_KEYS)
+	}
+
+	if !ui.AllowNewSession(req.Request, sessionReq.Email, stmt) {
+		return V1Error(http.StatusTooManyRequests, SESSION_LIMITED)
+	}
+
+	if sessionErr := ui.CreateNewSession(req.Request.Context(), person, publicKeys, stmt[database.SESSION_INSERT]); sessionErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot create session", "person_id", person.Id, "error", sessionErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+	ui.RecordAuditEvent(req.Request, stmt, nil, database.AUDIT_SESSION_CREATE, person.Id, person.Email)
+
+	return http.StatusAccepted, &SimpleMessage{Ack: SESSION_SENT}
+}
+
+// Confirm the decrypted session code for this email address
+func confirmSession(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{}) {
+	sessionReq, status, err := readSessionRequest(req)
+	if err != nil {
+		return status, err
+	}
+
+	code := ui.NormalizeSessionCode(sessionReq.Code)
+	if len(code) == 0 {
+		return V1Error(http.StatusBadRequest, MISSING_PARAMETER)
+	}
+
+	session, _, verifyErr := ui.VerifySessionCode(req.Request, sessionReq.Email, code, stmt)
+	if verifyErr != nil {
+		switch verifyErr.Error() {
+		case ui.TOO_MANY_ATTEMPTS:
+			return V1Error(http.StatusTooManyRequests, TOO_MANY_GUESSES)
+		case ui.INVALID_SESSION:
+			return V1Error(http.StatusUnauthorized, INVALID_SESSION)
+		case ui.DISABLED:
+			return V1Error(http.StatusForbidden, DISABLED_EMAIL)
+		}
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	// the only time the api returns a session's id is to the person who
+	// just confirmed it
+	resource := AsSessionResource(session)
+	resource.Id = session.Id
+	resource.Current = true
+	return http.StatusOK, resource
+}
@@ -0,0 +1,137 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	NO_TOKEN_NAME   = "The api token needs a name"
+	NO_TOKEN_SCOPES = "The api token needs at least one scope"
+	UNKNOWN_SCOPE   = "Unknown scope: "
+	INVALID_EXPIRY  = "The number of days until the api token expires must be from 0 to 3650"
+
+	// api tokens expire within ten years (longer ones overflow a
+	// time.Duration, or might as well never expire)
+	MAX_TOKEN_DAYS = 3650
+)
+
+// The body of a new api token request: it expires after the given number
+// of days (at most MAX_TOKEN_DAYS), or never, if zero
+type NewAPIToken struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in_days,omitempty"`
+}
+
+// A newly-created api token, including the plaintext token itself, which
+// is never available again
+type APITokenResource struct {
+	*database.API_TOKEN
+	Token string `json:"token"`
+}
+
+// GET /tokens, POST /tokens, DELETE /tokens/{id}: api tokens can only be
+// managed with a verified session
+func TokensResource(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{}) {
+	_, person, authStatus, authErr := req.Authenticate(stmt, "")
+	if authErr != nil {
+		return authStatus, authErr
+	}
+
+	if len(req.Path) == 0 {
+		switch req.Request.Method {
+		case "GET":
+			tokens, tokensErr := person.LookupAPITokens(stmt[database.API_TOKEN_LOOKUP_BY_PERSON])
+			if tokensErr != nil {
+				logging.FromRequest(req.Request).Error("Cannot look up api tokens", "person_id", person.Id, "error", tokensErr)
+				return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+			}
+			return http.StatusOK, tokens
+		case "POST":
+			return createToken(req, stmt, person)
+		}
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	id, valid := req.Id()
+	if !valid || len(req.Path) > 1 {
+		return V1Error(http.StatusNotFound, INVALID_ID)
+	}
+
+	if req.Request.Method != "DELETE" {
+		return V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+	}
+
+	token := &database.API_TOKEN{Id: id}
+	if err := token.Delete(stmt[database.API_TOKEN_DELETE], person.Id); err != nil {
+		logging.FromRequest(req.Request).Error("Cannot delete api token", "token_id", id, "error", err)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+	ui.RecordAuditEvent(req.Request, stmt, person, database.AUDIT_TOKEN_DELETE, id, person.Email)
+	return http.StatusNoContent, nil
+}
+
+// Create a new api token for this person, returning its plaintext
+func createToken(req *V1Request, stmt map[string]*sql.Stmt, person *database.PERSON) (int, interface{}) {
+	newToken := new(NewAPIToken)
+	if err := req.Decode(newToken); err != nil {
+		return V1Error(http.StatusBadRequest, err.Error())
+	}
+
+	name := strings.TrimSpace(newToken.Name)
+	if len(name) == 0 {
+		return V1Error(http.StatusBadRequest, NO_TOKEN_NAME)
+	}
+
+	if len(newToken.Scopes) == 0 {
+		return V1Error(http.StatusBadRequest, NO_TOKEN_SCOPES)
+	}
+
+	for _, scope := range newToken.Scopes {
+		known := false
+		for _, s := range API_TOKEN_SCOPES {
+			if scope == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return V1Error(http.StatusBadRequest, UNKNOWN_SCOPE+scope)
+		}
+	}
+
+	if newToken.ExpiresIn < 0 || newToken.ExpiresIn > MAX_TOKEN_DAYS {
+		return V1Error(http.StatusBadRequest, INVALID_EXPIRY)
+	}
+
+	plaintext, plaintextErr := database.GenerateAPIToken()
+	if plaintextErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot generate api token", "error", plaintextErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	token := &database.API_TOKEN{PersonId: person.Id, Name: name, Scopes: newToken.Scopes}
+	if newToken.ExpiresIn > 0 {
+		expires := time.Now().UTC().Add(time.Duration(newToken.ExpiresIn) * 24 * time.Hour)
+		token.DateExpires = &expires
+	}
+
+	tokenId, tokenErr := token.Add(stmt[database.API_TOKEN_INSERT], plaintext)
+	if tokenErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot add api token", "person_id", person.Id, "error", tokenErr)
+		return V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+	token.Id = tokenId
+	ui.RecordAuditEvent(req.Request, stmt, person, database.AUDIT_TOKEN_CREATE, tokenId, person.Email+" "+name+" ("+strings.Join(newToken.Scopes, ",")+")")
+
+	return http.StatusCreated, &APITokenResource{API_TOKEN: token, Token: plaintext}
+}
@@ -0,0 +1,331 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/ui"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	API_V1_PREFIX = "/api/v1/"
+
+	// requests are authenticated by a verified session id in this header, or
+	// by an api token in the Authorization header
+	SESSION_HEADER = "X-Session-Id"
+
+	// pagination parameters
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+
+	// json request bodies are limited to this many bytes
+	MAX_REQUEST_SIZE = 1 << 20
+
+	// error details
+	UNKNOWN_RESOURCE   = "Unknown resource"
+	UNSUPPORTED_METHOD = "Method not supported for this resource"
+	INVALID_ID         = "Not a valid id"
+	INVALID_BODY       = "The request body is not valid json"
+	INVALID_EMAIL      = "Not a valid email address"
+	INVALID_PAGINATION = "The limit and offset must be non-negative integers"
+	CURSOR_AND_OFFSET  = "Use either a cursor or an offset, not both"
+	INTERNAL_ERROR     = "There was an internal problem"
+	NO_DATABASE        = "The database is unavailable"
+	INVALID_TOKEN      = "The api token is expired or invalid"
+	SESSION_REQUIRED   = "This request needs a session, not an api token"
+	MISSING_SCOPE      = "The api token does not have this scope: "
+
+	// what api tokens may be allowed to do
+	SCOPE_MESSAGES_READ  = "messages:read"
+	SCOPE_MESSAGES_WRITE = "messages:write"
+	SCOPE_KEYS_READ      = "keys:read"
+	SCOPE_KEYS_WRITE     = "keys:write"
+	SCOPE_PEOPLE_READ    = "people:read"
+)
+
+var (
+	API_TOKEN_SCOPES = []string{SCOPE_MESSAGES_READ, SCOPE_MESSAGES_WRITE, SCOPE_KEYS_READ, SCOPE_KEYS_WRITE, SCOPE_PEOPLE_READ}
+
+	UUID_PATTERN = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+)
+
+// A paginated list of resources, with the cursors of the pages around it
+// (if any, for lists which have them)
+type ListPage struct {
+	Items  interface{} `json:"items"`
+	Limit  int64       `json:"limit"`
+	Offset int64       `json:"offset"`
+	Newer  string      `json:"newer,omitempty"`
+	Older  string      `json:"older,omitempty"`
+}
+
+// The details of a single api request: the path segments after the
+// resource name (e.g., the id), and the options the server was started with
+type V1Request struct {
+	Request     *http.Request
+	Path        []string
+	PrivacyMode bool
+}
+
+// A resource handler returns the http status code and the object to send
+// back as json (a *SimpleMessage for errors, or nil for no content)
+type V1Resource func(req *V1Request, stmt map[string]*sql.Stmt) (int, interface{})
+
+var (
+	V1Resources = map[string]V1Resource{
+		"messages": MessagesResource,
+		"keys":     KeysResource,
+		"sessions": SessionsResource,
+		"people":   PeopleResource,
+		"tokens":   TokensResource,
+	}
+)
+
+// Build an error object, using the standard text for the status code
+func V1Error(status int, detail string) (int, interface{}) {
+	return status, &SimpleMessage{Ack: http.StatusText(status), Err: detail}
+}
+
+// Runs the function with the prepared statements (for the request in ctx,
+// whose span their queries are traced under), or returns why it could not
+type StatementRunner func(context.Context, func(map[string]*sql.Stmt)) error
+
+// Run functions with the prepared statements for this database
+func DatabaseRunner(db database.DBConnection) StatementRunner {
+	return func(ctx context.Context, fn func(map[string]*sql.Stmt)) error {
+		return database.TryWithDatabase(ctx, db, fn)
+	}
+}
+
+// Respond to all requests under /api/v1/, dispatching them by resource name
+func V1Handler(db database.DBConnection, privacyMode bool) func(http.ResponseWriter, *http.Request) {
+	return V1Dispatcher(DatabaseRunner(db), privacyMode)
+}
+
+// Dispatch api requests to the resources, which get their prepared
+// statements from withDatabase
+func V1Dispatcher(withDatabase StatementRunner, privacyMode bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, API_V1_PREFIX), "/"), "/")
+
+		var (
+			status int
+			result interface{}
+		)
+
+		resource, exists := V1Resources[path[0]]
+		if path[0] == OPENAPI_DOCUMENT && len(path) == 1 {
+			if r.Method == "GET" {
+				status, result = http.StatusOK, OpenAPIDocument()
+			} else {
+				status, result = V1Error(http.StatusMethodNotAllowed, UNSUPPORTED_METHOD)
+			}
+		} else if !exists {
+			status, result = V1Error(http.StatusNotFound, UNKNOWN_RESOURCE)
+		} else {
+			req := &V1Request{Request: r, Path: path[1:], PrivacyMode: privacyMode}
+			fn := func(stmt map[string]*sql.Stmt) {
+				status, result = resource(req, stmt)
+			}
+			if err := withDatabase(r.Context(), fn); err != nil {
+				logging.FromRequest(r).Error("Cannot use the database", "error", err)
+				status, result = V1Error(http.StatusServiceUnavailable, NO_DATABASE)
+			}
+		}
+
+		WriteJSON(w, status, result)
+	}
+}
+
+// Send this object back as json, with the given status code
+func WriteJSON(w http.ResponseWriter, status int, result interface{}) {
+	if status == 0 {
+		status, result = V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+	}
+
+	if status == http.StatusNoContent || result == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logging.Error("Cannot encode the response", "error", err)
+		status = http.StatusInternalServerError
+		data = []byte(GenerateSimpleMessage(http.StatusText(status), INTERNAL_ERROR))
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Decode the json request body into this object
+func (req *V1Request) Decode(v interface{}) error {
+	if req.Request.Body == nil {
+		return errors.New(INVALID_BODY)
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Request.Body, MAX_REQUEST_SIZE)).Decode(v); err != nil {
+		return errors.New(INVALID_BODY)
+	}
+	return nil
+}
+
+// Read the limit and offset query parameters, using the defaults if missing
+func (req *V1Request) Pagination() (int64, int64, error) {
+	var (
+		limit  int64 = DEFAULT_PAGE_SIZE
+		offset int64 = 0
+	)
+
+	query := req.Request.URL.Query()
+	if l := query.Get("limit"); len(l) > 0 {
+		parsed, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || parsed < 0 {
+			return limit, offset, errors.New(INVALID_PAGINATION)
+		}
+		limit = parsed
+	}
+	if limit > MAX_PAGE_SIZE {
+		limit = MAX_PAGE_SIZE
+	}
+
+	if o := query.Get("offset"); len(o) > 0 {
+		parsed, err := strconv.ParseInt(o, 10, 64)
+		if err != nil || parsed < 0 {
+			return limit, offset, errors.New(INVALID_PAGINATION)
+		}
+		offset = parsed
+	}
+
+	return limit, offset, nil
+}
+
+// Read the cursor query parameter, if any (nil if missing)
+func (req *V1Request) Cursor() (*database.MESSAGE_CURSOR, error) {
+	token := req.Request.URL.Query().Get("cursor")
+	if len(token) == 0 {
+		return nil, nil
+	}
+	return database.ParseMessageCursor(token)
+}
+
+// Read the view query parameter (all messages, if missing)
+func (req *V1Request) View() (*database.MESSAGE_VIEW, error) {
+	return database.LookupMessageView(req.Request.URL.Query().Get("view"))
+}
+
+// Find the enabled person making this request, either from the verified
+// session in the SESSION_HEADER, or from an api token with the given scope
+// in the Authorization header (an empty scope means only sessions will do)
+func (req *V1Request) Authenticate(stmt map[string]*sql.Stmt, scope string) (*database.SESSION, *database.PERSON, int, interface{}) {
+	if authorization := req.Request.Header.Get("Authorization"); len(authorization) > 0 {
+		person, status, result := req.authenticateToken(stmt, authorization, scope)
+		return nil, person, status, result
+	}
+
+	sessionId := req.Request.Header.Get(SESSION_HEADER)
+	if !UUID_PATTERN.MatchString(sessionId) {
+		status, result := V1Error(http.StatusUnauthorized, INVALID_SESSION)
+		return nil, nil, status, result
+	}
+
+	session, sessionErr := ui.ConfirmSessionCode(sessionId, stmt[database.SESSION_CLEANUP], stmt[database.SESSION_LOOKUP_BY_ID])
+	if sessionErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up session", "error", sessionErr)
+		status, result := V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		return nil, nil, status, result
+	}
+
+	if len(session.Id) == 0 || !session.Verified {
+		status, result := V1Error(http.StatusUnauthorized, INVALID_SESSION)
+		return nil, nil, status, result
+	}
+
+	person, status, result := enabledPerson(req, stmt, session.PersonId)
+	return session, person, status, result
+}
+
+// Find the person for this bearer token, provided it has the given scope
+func (req *V1Request) authenticateToken(stmt map[string]*sql.Stmt, authorization, scope string) (*database.PERSON, int, interface{}) {
+	fields := strings.Fields(authorization)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "Bearer") {
+		status, result := V1Error(http.StatusUnauthorized, INVALID_TOKEN)
+		return nil, status, result
+	}
+
+	if len(scope) == 0 {
+		status, result := V1Error(http.StatusForbidden, SESSION_REQUIRED)
+		return nil, status, result
+	}
+
+	database.CleanupAPITokens(stmt[database.API_TOKEN_CLEANUP])
+	token, tokenErr := database.LookupAPIToken(stmt[database.API_TOKEN_LOOKUP_BY_HASH], fields[1])
+	if tokenErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up api token", "error", tokenErr)
+		status, result := V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		return nil, status, result
+	}
+
+	if len(token.Id) == 0 {
+		status, result := V1Error(http.StatusUnauthorized, INVALID_TOKEN)
+		return nil, status, result
+	}
+
+	if !token.HasScope(scope) {
+		status, result := V1Error(http.StatusForbidden, MISSING_SCOPE+scope)
+		return nil, status, result
+	}
+
+	if err := token.Touch(stmt[database.API_TOKEN_USED]); err != nil {
+		logging.FromRequest(req.Request).Error("Cannot record api token use", "token_id", token.Id, "error", err)
+	}
+
+	return enabledPerson(req, stmt, token.PersonId)
+}
+
+// Find this person, provided they are still enabled
+func enabledPerson(req *V1Request, stmt map[string]*sql.Stmt, personId string) (*database.PERSON, int, interface{}) {
+	person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], personId)
+	if personErr != nil {
+		logging.FromRequest(req.Request).Error("Cannot look up person", "person_id", personId, "error", personErr)
+		status, result := V1Error(http.StatusInternalServerError, INTERNAL_ERROR)
+		return nil, status, result
+	}
+
+	if len(person.Id) == 0 || !person.Enabled {
+		status, result := V1Error(http.StatusForbidden, INVALID_SESSION)
+		return nil, status, result
+	}
+
+	return person, 0, nil
+}
+
+// The scope needed to read (GET) or change (anything else) this resource
+func methodScope(r *http.Request, readScope, writeScope string) string {
+	if r.Method == "GET" {
+		return readScope
+	}
+	return writeScope
+}
+
+// The single id in the path after the resource name, if it is valid
+func (req *V1Request) Id() (string, bool) {
+	if len(req.Path) == 0 || !UUID_PATTERN.MatchString(req.Path[0]) {
+		return "", false
+	}
+	return strings.ToLower(req.Path[0]), true
+}
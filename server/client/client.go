@@ -0,0 +1,439 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package client wraps the TeamWork.io json api (see the api package), for
+// scripts and tools written in Go
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/cryptutil"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	API_PATH = "/api/v1/"
+
+	// how requests are authenticated
+	SESSION_HEADER = "X-Session-Id"
+
+	DEFAULT_TIMEOUT = 30 * time.Second
+
+	NOT_AUTHENTICATED = "The client needs a session or an api token"
+	NO_KEYS_FOUND     = "No public keys were found for this recipient: "
+	NO_RECIPIENTS     = "The message needs at least one recipient"
+	NO_MESSAGE        = "The server did not return the message"
+)
+
+// A server response with an error status, from its {"msg", "err"} object
+type Error struct {
+	StatusCode int
+	Message    string `json:"msg"`
+	Detail     string `json:"err"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Detail) > 0 {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Message, e.Detail)
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+// A session, as returned by the api (which never includes its code, and
+// only includes its id when confirming it)
+type Session struct {
+	Id           string    `json:"id"`
+	Handle       string    `json:"handle"`
+	Current      bool      `json:"current"`
+	PersonId     string    `json:"person_id"`
+	DateCreated  time.Time `json:"date_created"`
+	Verified     bool      `json:"verified"`
+	DateVerified time.Time `json:"date_verified"`
+	DateExpires  time.Time `json:"date_expires"`
+}
+
+// A message, along with its sender and recipients
+type Message struct {
+	*database.MESSAGE
+	Preview    string             `json:"preview"`
+	Sender     *database.PERSON   `json:"sender"`
+	Recipients []*database.PERSON `json:"recipients"`
+}
+
+// One page of the latest messages (in a view), with the cursors of the pages around it
+// (empty at either end, or when paging by offset)
+type MessagePage struct {
+	Items  []*Message `json:"items"`
+	Limit  int64      `json:"limit"`
+	Offset int64      `json:"offset"`
+	Newer  string     `json:"newer"`
+	Older  string     `json:"older"`
+}
+
+// A public key found by a key search, with the proof that it is in the
+// server's key transparency log
+type Key struct {
+	*database.PUBLIC_KEY
+	Proof *transparency.KeyProof `json:"proof,omitempty"`
+}
+
+// The result of a key search: the id is empty if no such person is known
+type Person struct {
+	Email string `json:"email"`
+	Id    string `json:"id"`
+	Keys  []*Key `json:"keys"`
+}
+
+// The person's public keys, without their proofs (e.g., for encryption)
+func (p *Person) PublicKeys() []*database.PUBLIC_KEY {
+	keys := make([]*database.PUBLIC_KEY, 0)
+	for _, key := range p.Keys {
+		keys = append(keys, key.PUBLIC_KEY)
+	}
+	return keys
+}
+
+// An api token; the token itself is only included when it is created, and
+// the dates it was last used and expires only when it has them
+type Token struct {
+	Id           string     `json:"id"`
+	PersonId     string     `json:"person_id"`
+	Name         string     `json:"name"`
+	Scopes       []string   `json:"scopes"`
+	DateCreated  time.Time  `json:"date_created"`
+	DateLastUsed *time.Time `json:"date_last_used,omitempty"`
+	DateExpires  *time.Time `json:"date_expires,omitempty"`
+	Token        string     `json:"token,omitempty"`
+}
+
+// A connection to one TeamWork.io server, authenticated by either an api
+// token or a verified session id (the token is used if both are set)
+type Client struct {
+	BaseURL    string
+	Token      string
+	SessionId  string
+	HTTPClient *http.Client
+
+	// if set, every key search is checked against the key transparency log
+	Verifier *KeyVerifier
+}
+
+// A client for the server at this url (e.g., https://teamwork.io)
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: &http.Client{Timeout: DEFAULT_TIMEOUT}}
+}
+
+// A client which authenticates with this api token
+func NewWithToken(baseURL, token string) *Client {
+	c := New(baseURL)
+	c.Token = token
+	return c
+}
+
+// Make the api request, sending the body (if any) as json, and decoding
+// the json response into result (if any)
+func (c *Client) do(method, path string, query url.Values, body, result interface{}) error {
+	resp, err := c.send(method, c.BaseURL+API_PATH+path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Send the request to this endpoint, returning the response unless it has
+// an error status (the caller closes its body)
+func (c *Client) send(method, endpoint string, query url.Values, body interface{}) (*http.Response, error) {
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if len(c.SessionId) > 0 {
+		req.Header.Set(SESSION_HEADER, c.SessionId)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
+
+func (c *Client) authenticated() error {
+	if len(c.Token) == 0 && len(c.SessionId) == 0 {
+		return errors.New(NOT_AUTHENTICATED)
+	}
+	return nil
+}
+
+// Ask the server to email a new session code to this address, encrypted
+// with its public keys
+func (c *Client) RequestSession(email string) error {
+	return c.do("POST", "sessions", nil, map[string]string{"email": email}, nil)
+}
+
+// Confirm the decrypted session code, and use the session from now on
+func (c *Client) ConfirmSession(email, code string) (*Session, error) {
+	session := new(Session)
+	if err := c.do("POST", "sessions/confirm", nil, map[string]string{"email": email, "code": code}, session); err != nil {
+		return nil, err
+	}
+	c.SessionId = session.Id
+	return session, nil
+}
+
+// List this person's sessions
+func (c *Client) Sessions() ([]*Session, error) {
+	sessions := make([]*Session, 0)
+	if err := c.authenticated(); err != nil {
+		return sessions, err
+	}
+	err := c.do("GET", "sessions", nil, nil, &sessions)
+	return sessions, err
+}
+
+// Revoke one of this person's sessions, by its handle
+func (c *Client) RevokeSession(handle string) error {
+	if err := c.authenticated(); err != nil {
+		return err
+	}
+	return c.do("DELETE", "sessions/"+url.PathEscape(handle), nil, nil, nil)
+}
+
+// Revoke the client's own session, and stop using it
+func (c *Client) Logout() error {
+	if len(c.SessionId) == 0 {
+		return errors.New(NOT_AUTHENTICATED)
+	}
+	own := &database.SESSION{Id: c.SessionId}
+	if err := c.RevokeSession(own.Handle()); err != nil {
+		return err
+	}
+	c.SessionId = ""
+	return nil
+}
+
+// Find the public keys for this email address (and if the client has a
+// Verifier, check that they are in the key transparency log, which only
+// grew since the last search)
+func (c *Client) SearchPublicKeys(email string) (*Person, error) {
+	if err := c.authenticated(); err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"email": {email}}
+	if c.Verifier != nil && c.Verifier.TreeHead != nil {
+		query.Set("tree_size", strconv.FormatInt(c.Verifier.TreeHead.TreeSize, 10))
+	}
+
+	person := new(Person)
+	err := c.do("GET", "people", query, nil, person)
+	if err == nil && c.Verifier != nil {
+		err = c.Verifier.Verify(person)
+	}
+	return person, err
+}
+
+// List this person's own public keys
+func (c *Client) Keys() ([]*database.PUBLIC_KEY, error) {
+	keys := make([]*database.PUBLIC_KEY, 0)
+	if err := c.authenticated(); err != nil {
+		return keys, err
+	}
+	err := c.do("GET", "keys", nil, nil, &keys)
+	return keys, err
+}
+
+// Add an armored public key for this person
+func (c *Client) AddKey(key, name string) (*database.PUBLIC_KEY, error) {
+	if err := c.authenticated(); err != nil {
+		return nil, err
+	}
+	publicKey := new(database.PUBLIC_KEY)
+	err := c.do("POST", "keys", nil, map[string]string{"key": key, "name": name}, publicKey)
+	return publicKey, err
+}
+
+// Remove one of this person's public keys
+func (c *Client) DeleteKey(id string) error {
+	if err := c.authenticated(); err != nil {
+		return err
+	}
+	return c.do("DELETE", "keys/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// List the latest messages (all of them if the view is empty, or those the
+// person received, authored or was involved in), one page at a time
+func (c *Client) Messages(view string, limit, offset int64) (*MessagePage, error) {
+	if err := c.authenticated(); err != nil {
+		return nil, err
+	}
+	page := new(MessagePage)
+	query := url.Values{"limit": {fmt.Sprintf("%d", limit)}, "offset": {fmt.Sprintf("%d", offset)}}
+	if len(view) > 0 {
+		query.Set("view", view)
+	}
+	err := c.do("GET", "messages", query, nil, page)
+	return page, err
+}
+
+// List the page of messages in the view at the newer or older cursor of
+// another page
+func (c *Client) MessagesAt(view, cursor string, limit int64) (*MessagePage, error) {
+	if err := c.authenticated(); err != nil {
+		return nil, err
+	}
+	page := new(MessagePage)
+	query := url.Values{"limit": {fmt.Sprintf("%d", limit)}, "cursor": {cursor}}
+	if len(view) > 0 {
+		query.Set("view", view)
+	}
+	err := c.do("GET", "messages", query, nil, page)
+	return page, err
+}
+
+// Get one message
+func (c *Client) Message(id string) (*Message, error) {
+	if err := c.authenticated(); err != nil {
+		return nil, err
+	}
+	message := new(Message)
+	err := c.do("GET", "messages/"+url.PathEscape(id), nil, nil, message)
+	return message, err
+}
+
+// Write the armored (still encrypted) message to w, e.g., to save it as a
+// file for decryption
+func (c *Client) Download(id string, w io.Writer) error {
+	message, err := c.Message(id)
+	if err != nil {
+		return err
+	}
+	if message.MESSAGE == nil {
+		return errors.New(NO_MESSAGE)
+	}
+	_, err = io.WriteString(w, message.Message)
+	return err
+}
+
+// Post an already encrypted message to these recipients (email addresses)
+func (c *Client) Post(encrypted string, recipients []string) (*Message, error) {
+	if err := c.authenticated(); err != nil {
+		return nil, err
+	}
+	message := new(Message)
+	body := map[string]interface{}{"message": encrypted, "recipients": recipients}
+	err := c.do("POST", "messages", nil, body, message)
+	return message, err
+}
+
+// Encrypt the message with all of the recipients' public keys, as found by
+// the server, and post it to them
+func (c *Client) PostEncrypted(plaintext string, recipients []string) (*Message, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New(NO_RECIPIENTS)
+	}
+
+	keys := make([]*database.PUBLIC_KEY, 0)
+	for _, recipient := range recipients {
+		person, err := c.SearchPublicKeys(recipient)
+		if err != nil {
+			return nil, err
+		}
+		if len(person.Keys) == 0 {
+			return nil, errors.New(NO_KEYS_FOUND + recipient)
+		}
+		keys = append(keys, person.PublicKeys()...)
+	}
+
+	encrypted, err := cryptutil.EncryptData(keys, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Post(encrypted, recipients)
+}
+
+// Delete one of this person's messages
+func (c *Client) DeleteMessage(id string) error {
+	if err := c.authenticated(); err != nil {
+		return err
+	}
+	return c.do("DELETE", "messages/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// List this person's api tokens (which needs a session)
+func (c *Client) Tokens() ([]*Token, error) {
+	tokens := make([]*Token, 0)
+	if err := c.authenticated(); err != nil {
+		return tokens, err
+	}
+	err := c.do("GET", "tokens", nil, nil, &tokens)
+	return tokens, err
+}
+
+// Create an api token with these scopes, which expires after the given
+// number of days (or never, if zero); the result includes the token itself
+func (c *Client) CreateToken(name string, scopes []string, expiresInDays int) (*Token, error) {
+	if err := c.authenticated(); err != nil {
+		return nil, err
+	}
+	token := new(Token)
+	body := map[string]interface{}{"name": name, "scopes": scopes, "expires_in_days": expiresInDays}
+	err := c.do("POST", "tokens", nil, body, token)
+	return token, err
+}
+
+// Revoke one of this person's api tokens
+func (c *Client) RevokeToken(id string) error {
+	if err := c.authenticated(); err != nil {
+		return err
+	}
+	return c.do("DELETE", "tokens/"+url.PathEscape(id), nil, nil, nil)
+}
@@ -0,0 +1,259 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testEmail     = "dev@example.org"
+	testSessionId = "33333333-3333-3333-3333-333333333333"
+	testMessageId = "44444444-4444-4444-4444-444444444444"
+	testToken     = "tw_test"
+)
+
+// A stand-in for the server's json api, which records the requests it gets
+type fakeServer struct {
+	entity   *openpgp.Entity
+	requests []*http.Request
+	bodies   []string
+	posted   string
+}
+
+func (f *fakeServer) armoredPublicKey() string {
+	var buf bytes.Buffer
+	w, _ := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	f.entity.Serialize(w)
+	w.Close()
+	return buf.String()
+}
+
+func (f *fakeServer) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, string(body))
+
+	authenticated := r.Header.Get("Authorization") == "Bearer "+testToken || r.Header.Get(SESSION_HEADER) == testSessionId
+	public := r.URL.Path == "/api/v1/sessions" && r.Method == "POST" || r.URL.Path == "/api/v1/sessions/confirm"
+	if !authenticated && !public {
+		f.reply(w, http.StatusUnauthorized, map[string]string{"msg": "Unauthorized", "err": "Session is expired or invalid"})
+		return
+	}
+
+	now := time.Now().UTC()
+	message := map[string]interface{}{"id": testMessageId, "person_id": "p", "message": "-----BEGIN PGP MESSAGE-----\narmored\n-----END PGP MESSAGE-----", "date_posted": now, "date_expires": now, "preview": "armored", "sender": map[string]interface{}{"email": testEmail}, "recipients": []interface{}{}}
+
+	switch r.Method + " " + r.URL.Path {
+	case "POST /api/v1/sessions":
+		f.reply(w, http.StatusAccepted, map[string]string{"msg": "sent"})
+	case "POST /api/v1/sessions/confirm":
+		request := map[string]string{}
+		json.Unmarshal(body, &request)
+		if request["code"] != "correct horse" {
+			f.reply(w, http.StatusUnauthorized, map[string]string{"msg": "Unauthorized", "err": "Session is expired or invalid"})
+			return
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"id": testSessionId, "person_id": "p", "verified": true, "date_created": now, "date_verified": now, "date_expires": now})
+	case "DELETE /api/v1/sessions/" + (&database.SESSION{Id: testSessionId}).Handle():
+		w.WriteHeader(http.StatusNoContent)
+	case "GET /api/v1/people":
+		keys := []interface{}{}
+		if r.URL.Query().Get("email") == testEmail {
+			keys = append(keys, map[string]string{"id": "k", "key": f.armoredPublicKey()})
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"email": r.URL.Query().Get("email"), "keys": keys})
+	case "GET /api/v1/messages":
+		f.reply(w, http.StatusOK, map[string]interface{}{"items": []interface{}{message}, "limit": 5, "offset": 10, "older": "b2xkZXI"})
+	case "GET /api/v1/messages/" + testMessageId:
+		f.reply(w, http.StatusOK, message)
+	case "POST /api/v1/messages":
+		request := map[string]interface{}{}
+		json.Unmarshal(body, &request)
+		f.posted, _ = request["message"].(string)
+		message["message"] = f.posted
+		f.reply(w, http.StatusCreated, message)
+	case "POST /api/v1/tokens":
+		f.reply(w, http.StatusCreated, map[string]interface{}{"id": "t", "name": "ci", "scopes": []string{"messages:write"}, "date_created": now, "token": testToken})
+	default:
+		f.reply(w, http.StatusNotFound, map[string]string{"msg": "Not Found", "err": "Unknown resource"})
+	}
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, *httptest.Server) {
+	entity, err := openpgp.NewEntity("Dev", "", testEmail, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// state a hash preference, as real keys do (otherwise RIPEMD160 is assumed)
+	for _, id := range entity.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA256
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &fakeServer{entity: entity}
+	return f, httptest.NewServer(f)
+}
+
+func TestSessions(t *testing.T) {
+	f, server := newFakeServer(t)
+	defer server.Close()
+
+	c := New(server.URL + "/")
+	if _, err := c.Sessions(); err == nil || err.Error() != NOT_AUTHENTICATED {
+		t.Errorf("expected %q, got %v", NOT_AUTHENTICATED, err)
+	}
+
+	if err := c.RequestSession(testEmail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.bodies[len(f.bodies)-1]; !strings.Contains(got, testEmail) {
+		t.Errorf("unexpected session request %s", got)
+	}
+
+	_, err := c.ConfirmSession(testEmail, "wrong")
+	apiErr, isAPIErr := err.(*Error)
+	if !isAPIErr || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Detail != "Session is expired or invalid" {
+		t.Errorf("expected an api error, got %v", err)
+	}
+
+	session, err := c.ConfirmSession(testEmail, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Id != testSessionId || c.SessionId != testSessionId {
+		t.Errorf("the session was not kept: %v", session)
+	}
+
+	if _, err := c.Message(testMessageId); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.requests[len(f.requests)-1].Header.Get(SESSION_HEADER); got != testSessionId {
+		t.Errorf("expected the session header, got %q", got)
+	}
+
+	if err := c.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if c.SessionId != "" {
+		t.Errorf("the session was not forgotten")
+	}
+	if last := f.requests[len(f.requests)-1]; last.Method != "DELETE" || strings.Contains(last.URL.Path, testSessionId) {
+		t.Errorf("unexpected logout request %s %s", last.Method, last.URL.Path)
+	}
+}
+
+func TestListAndDownload(t *testing.T) {
+	f, server := newFakeServer(t)
+	defer server.Close()
+
+	c := NewWithToken(server.URL, testToken)
+	page, err := c.Messages("", 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Id != testMessageId || page.Limit != 5 || page.Offset != 10 {
+		t.Errorf("unexpected page %+v", page)
+	}
+	if query := f.requests[0].URL.Query(); query.Get("limit") != "5" || query.Get("offset") != "10" || len(query.Get("view")) > 0 {
+		t.Errorf("unexpected query %v", query)
+	}
+	if got := f.requests[0].Header.Get("Authorization"); got != "Bearer "+testToken {
+		t.Errorf("expected the bearer token, got %q", got)
+	}
+
+	older, err := c.MessagesAt(database.VIEW_RECEIVED, page.Older, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query := f.requests[1].URL.Query(); query.Get("cursor") != "b2xkZXI" || query.Get("view") != database.VIEW_RECEIVED || len(query.Get("offset")) > 0 || older.Older != "b2xkZXI" || len(older.Newer) > 0 {
+		t.Errorf("unexpected query %v for page %+v", query, older)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Download(testMessageId, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "-----BEGIN PGP MESSAGE-----") {
+		t.Errorf("unexpected download %q", buf.String())
+	}
+
+	if _, err := c.Message("nothing"); err == nil {
+		t.Errorf("expected an error for an unknown message")
+	}
+}
+
+func TestPostEncrypted(t *testing.T) {
+	f, server := newFakeServer(t)
+	defer server.Close()
+
+	c := NewWithToken(server.URL, testToken)
+	if _, err := c.PostEncrypted("release notes", []string{"nobody@example.org"}); err == nil || !strings.HasPrefix(err.Error(), NO_KEYS_FOUND) {
+		t.Errorf("expected %q, got %v", NO_KEYS_FOUND, err)
+	}
+	if len(f.posted) > 0 {
+		t.Fatalf("nothing should have been posted")
+	}
+
+	message, err := c.PostEncrypted("release notes", []string{testEmail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Id != testMessageId {
+		t.Errorf("unexpected message %+v", message)
+	}
+
+	// only the recipient's private key can read what was posted
+	block, err := armor.Decode(strings.NewReader(f.posted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{f.entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, _ := ioutil.ReadAll(md.UnverifiedBody)
+	if string(plaintext) != "release notes" {
+		t.Errorf("unexpected plaintext %q", plaintext)
+	}
+}
+
+func TestCreateToken(t *testing.T) {
+	f, server := newFakeServer(t)
+	defer server.Close()
+
+	c := New(server.URL)
+	c.SessionId = testSessionId
+	token, err := c.CreateToken("ci", []string{"messages:write"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != testToken {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	request := map[string]interface{}{}
+	json.Unmarshal([]byte(f.bodies[0]), &request)
+	if request["name"] != "ci" || request["expires_in_days"] != float64(0) {
+		t.Errorf("unexpected token request %v", request)
+	}
+}
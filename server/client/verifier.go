@@ -0,0 +1,149 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// where the server publishes its key transparency log
+	KEY_LOG_PATH = "/.well-known/key-transparency/"
+
+	NO_PROOF             = "The server did not prove that this key is in the key log: "
+	WRONG_ENTRY          = "The key log entry does not match this key: "
+	DIFFERENT_TREE_HEADS = "The keys were proven against different tree heads"
+	TREE_SHRANK          = "The key log is smaller than it was at the last search"
+	NO_CONSISTENCY       = "The server did not prove that the key log only grew since the last search"
+)
+
+// Checks key search results against the server's key transparency log: the
+// log's public key is pinned, and so is the latest tree head seen, so that
+// a server which forks or rewrites the log is caught at the next search
+type KeyVerifier struct {
+	PublicKey *ecdsa.PublicKey
+	TreeHead  *transparency.SignedTreeHead
+}
+
+// A verifier for the log signed by the key in this PEM data (as published
+// at /.well-known/key-transparency/public-key)
+func NewKeyVerifier(publicKey []byte) (*KeyVerifier, error) {
+	key, err := transparency.ReadPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyVerifier{PublicKey: key}, nil
+}
+
+// Check that each of the person's keys was added to the log for their email
+// address, in the tree of a signed tree head which is consistent with the
+// last one seen, which it then replaces (there is nothing to check if no
+// keys were found, since the log cannot prove their absence)
+func (v *KeyVerifier) Verify(person *Person) error {
+	var head *transparency.SignedTreeHead
+	for _, key := range person.Keys {
+		if key.PUBLIC_KEY == nil || key.Proof == nil || key.Proof.Entry == nil || key.Proof.TreeHead == nil {
+			return errors.New(NO_PROOF + person.Email)
+		}
+
+		proof := key.Proof
+		entry := proof.Entry
+		if entry.Action != transparency.ACTION_ADD || !strings.EqualFold(entry.Email, person.Email) || entry.KeyId != key.Id || entry.KeyHash != transparency.KeyHash(key.Key) {
+			return errors.New(WRONG_ENTRY + key.Id)
+		}
+
+		if head == nil {
+			head = proof.TreeHead
+			if err := v.verifyTreeHead(head, proof.Consistency); err != nil {
+				return err
+			}
+		} else if *proof.TreeHead != *head {
+			return errors.New(DIFFERENT_TREE_HEADS)
+		}
+
+		root, err := head.Root()
+		if err != nil {
+			return err
+		}
+		path, err := transparency.DecodeHashes(proof.AuditPath)
+		if err != nil {
+			return err
+		}
+		if err := transparency.VerifyInclusion(entry.LeafHash(), proof.LeafIndex, head.TreeSize, path, root); err != nil {
+			return err
+		}
+	}
+
+	if head != nil {
+		v.TreeHead = head
+	}
+	return nil
+}
+
+// Check the tree head's signature, and that its tree extends the one of
+// the last tree head seen
+func (v *KeyVerifier) verifyTreeHead(head *transparency.SignedTreeHead, consistency *transparency.Consistency) error {
+	if err := head.Verify(v.PublicKey); err != nil {
+		return err
+	}
+	if v.TreeHead == nil {
+		return nil
+	}
+
+	if head.TreeSize < v.TreeHead.TreeSize {
+		return errors.New(TREE_SHRANK)
+	}
+
+	var proof [][]byte
+	if head.TreeSize > v.TreeHead.TreeSize {
+		if consistency == nil || consistency.First != v.TreeHead.TreeSize || consistency.Second != head.TreeSize {
+			return errors.New(NO_CONSISTENCY)
+		}
+		var err error
+		proof, err = transparency.DecodeHashes(consistency.Proof)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldRoot, err := v.TreeHead.Root()
+	if err != nil {
+		return err
+	}
+	newRoot, err := head.Root()
+	if err != nil {
+		return err
+	}
+	return transparency.VerifyConsistency(v.TreeHead.TreeSize, head.TreeSize, oldRoot, newRoot, proof)
+}
+
+// Fetch the server's latest signed tree head (which is not verified: see
+// KeyVerifier)
+func (c *Client) TreeHead() (*transparency.SignedTreeHead, error) {
+	resp, err := c.send("GET", c.BaseURL+KEY_LOG_PATH+"sth", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	head := new(transparency.SignedTreeHead)
+	err = json.NewDecoder(resp.Body).Decode(head)
+	return head, err
+}
+
+// Fetch the PEM-encoded public key which signs the server's tree heads
+// (to pin it, compare it with one obtained out of band)
+func (c *Client) LogPublicKey() ([]byte, error) {
+	resp, err := c.send("GET", c.BaseURL+KEY_LOG_PATH+"public-key", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
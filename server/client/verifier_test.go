@@ -0,0 +1,148 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"strings"
+	"testing"
+)
+
+const testArmoredKey = "-----BEGIN PGP PUBLIC KEY BLOCK-----\ntest\n-----END PGP PUBLIC KEY BLOCK-----"
+
+// A log of other people's keys, with the test key added at this index
+func testLog(size, index int) ([][]byte, []*transparency.KeyEntry) {
+	leaves := make([][]byte, 0)
+	entries := make([]*transparency.KeyEntry, 0)
+	for i := 0; i < size; i++ {
+		entry := transparency.NewKeyEntry(transparency.ACTION_ADD, fmt.Sprintf("person%d@example.org", i), fmt.Sprintf("key%d", i), fmt.Sprintf("armored %d", i))
+		if i == index {
+			entry = transparency.NewKeyEntry(transparency.ACTION_ADD, testEmail, "k", testArmoredKey)
+		}
+		leaves = append(leaves, entry.LeafHash())
+		entries = append(entries, entry)
+	}
+	return leaves, entries
+}
+
+// The search result for the test key, proven in the tree of these leaves,
+// and (if since is positive) consistent with the tree of that size
+func testPerson(t *testing.T, key *ecdsa.PrivateKey, leaves [][]byte, entry *transparency.KeyEntry, index, since int64) *Person {
+	head, err := transparency.NewSignedTreeHead(leaves, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := transparency.InclusionProof(leaves, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := &transparency.KeyProof{LeafIndex: index, Entry: entry, AuditPath: transparency.EncodeHashes(path), TreeHead: head}
+	if since > 0 {
+		consistency, err := transparency.ConsistencyProof(leaves, since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof.Consistency = &transparency.Consistency{First: since, Second: head.TreeSize, Proof: transparency.EncodeHashes(consistency)}
+	}
+
+	found := &Key{PUBLIC_KEY: &database.PUBLIC_KEY{Id: "k", Key: testArmoredKey}, Proof: proof}
+	return &Person{Email: testEmail, Id: "p", Keys: []*Key{found}}
+}
+
+func expectError(t *testing.T, err error, expected string) {
+	if err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+}
+
+func TestVerifyKeys(t *testing.T) {
+	key, _ := transparency.GenerateKey()
+	other, _ := transparency.GenerateKey()
+	leaves, entries := testLog(7, 4)
+
+	v := &KeyVerifier{PublicKey: &key.PublicKey}
+	if err := v.Verify(testPerson(t, key, leaves, entries[4], 4, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if v.TreeHead == nil || v.TreeHead.TreeSize != 7 {
+		t.Fatalf("the tree head was not kept: %+v", v.TreeHead)
+	}
+
+	// a key which is not the logged one
+	tampered := testPerson(t, key, leaves, entries[4], 4, 0)
+	tampered.Keys[0].Key = "-----BEGIN PGP PUBLIC KEY BLOCK-----\nmitm\n-----END PGP PUBLIC KEY BLOCK-----"
+	expectError(t, v.Verify(tampered), WRONG_ENTRY)
+
+	// the logged key, served for someone else
+	tampered = testPerson(t, key, leaves, entries[4], 4, 0)
+	tampered.Email = "someone@example.org"
+	expectError(t, v.Verify(tampered), WRONG_ENTRY)
+
+	// an entry which is not in the tree
+	expectError(t, v.Verify(testPerson(t, key, leaves, entries[4], 3, 0)), transparency.ROOT_MISMATCH)
+
+	// a tree head signed by another key
+	expectError(t, v.Verify(testPerson(t, other, leaves, entries[4], 4, 0)), transparency.INVALID_SIGNATURE)
+
+	// no proof at all
+	unproven := testPerson(t, key, leaves, entries[4], 4, 0)
+	unproven.Keys[0].Proof = nil
+	expectError(t, v.Verify(unproven), NO_PROOF)
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	key, _ := transparency.GenerateKey()
+	leaves, entries := testLog(12, 4)
+
+	v := &KeyVerifier{PublicKey: &key.PublicKey}
+	if err := v.Verify(testPerson(t, key, leaves[:6], entries[4], 4, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the log grew, but the server did not prove it
+	expectError(t, v.Verify(testPerson(t, key, leaves, entries[4], 4, 0)), NO_CONSISTENCY)
+
+	// a log with a different history
+	forked, _ := testLog(12, 5)
+	expectError(t, v.Verify(testPerson(t, key, forked, entries[4], 4, 6)), transparency.ROOT_MISMATCH)
+
+	// a log which shrank
+	expectError(t, v.Verify(testPerson(t, key, leaves[:5], entries[4], 4, 0)), TREE_SHRANK)
+
+	if v.TreeHead.TreeSize != 6 {
+		t.Fatalf("a rejected tree head replaced the last one: %+v", v.TreeHead)
+	}
+	if err := v.Verify(testPerson(t, key, leaves, entries[4], 4, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if v.TreeHead.TreeSize != 12 {
+		t.Errorf("the larger tree head was not kept: %+v", v.TreeHead)
+	}
+
+	// the same tree, signed again
+	if err := v.Verify(testPerson(t, key, leaves, entries[4], 4, 0)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSearchWithVerifier(t *testing.T) {
+	_, server := newFakeServer(t)
+	defer server.Close()
+
+	key, _ := transparency.GenerateKey()
+	c := NewWithToken(server.URL, testToken)
+	c.Verifier = &KeyVerifier{PublicKey: &key.PublicKey}
+
+	// the fake server does not prove its keys
+	_, err := c.SearchPublicKeys(testEmail)
+	expectError(t, err, NO_PROOF)
+
+	// nor can absent keys be proven
+	if _, err := c.SearchPublicKeys("nobody@example.org"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// twadmin is the operators' tool for managing a TeamWork.io instance
+// directly in its database: finding, enabling and disabling persons,
+// removing keys, purging messages, inspecting sessions, statistics, and
+// checking the audit log; every change is itself recorded in the audit log
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/config"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	DATE_FORMAT = "2006-01-02 15:04"
+
+	USAGE = `Usage: twadmin [options] command [arguments]
+
+Commands:
+  persons [-limit n] [-offset n] [text]  list persons whose email contains text
+  person email|id                        show one person, with keys and sessions
+  enable email|id                        allow a person to log in again
+  disable email|id                       stop a person from logging in, and
+                                         revoke their sessions
+  role email|id admin|member             grant or remove the admin role (for
+                                         the web admin console)
+  keys email|id                          list a person's public keys
+  delete-key id                          remove a public key
+  purge -yes email|id                    delete every message a person posted
+  sessions [-revoke] email|id            list (or revoke) a person's sessions
+  stats [-json]                          print instance statistics
+  audit [-limit n] [-offset n]           list the latest audit events
+  verify-audit [-head hash]              check the audit log's hash chain (and
+                                         that an earlier head is still in it)
+
+Options:
+`
+
+	UNKNOWN_COMMAND = "Unknown command: "
+	NO_PERSON       = "An email address or person id is required"
+	NO_KEY          = "A public key id is required"
+	UNKNOWN_KEY     = "No such public key: "
+	UNKNOWN_PERSON  = "No such person: "
+	CONFIRM_PURGE   = "Purging cannot be undone: add -yes to confirm"
+	UNKNOWN_ROLE    = "The role must be " + database.ROLE_ADMIN + " or " + database.ROLE_MEMBER
+	AUDIT_INVALID   = "The audit log has been tampered with"
+
+	// how twadmin identifies itself in the audit log
+	USER_AGENT = "twadmin"
+)
+
+var (
+	UUID = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+
+	COMMANDS = map[string]func(stmt map[string]*sql.Stmt, args []string) error{
+		"persons":      persons,
+		"person":       person,
+		"enable":       enable,
+		"disable":      disable,
+		"role":         role,
+		"keys":         keys,
+		"delete-key":   deleteKey,
+		"purge":        purge,
+		"sessions":     sessions,
+		"stats":        stats,
+		"audit":        audit,
+		"verify-audit": verifyAudit,
+	}
+)
+
+// Find the person by id or email address
+func findPerson(stmt map[string]*sql.Stmt, args []string) (*database.PERSON, error) {
+	if len(args) != 1 {
+		return nil, errors.New(NO_PERSON)
+	}
+
+	var (
+		p   *database.PERSON
+		err error
+	)
+	if UUID.MatchString(args[0]) {
+		p, err = database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], args[0])
+	} else {
+		p, err = database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], strings.ToLower(args[0]))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Id) == 0 {
+		return nil, errors.New(UNKNOWN_PERSON + args[0])
+	}
+	return p, nil
+}
+
+// Record this change in the audit log: there is no actor or ip address,
+// so the operator's login and host stand in for the user agent
+func record(stmt map[string]*sql.Stmt, action, target, detail string) error {
+	operator := os.Getenv("USER")
+	if host, err := os.Hostname(); err == nil {
+		operator = operator + "@" + host
+	}
+	event := &database.AUDIT_EVENT{Action: action, Target: target, Detail: detail, UserAgent: fmt.Sprintf("%s (%s)", USER_AGENT, operator)}
+	_, err := event.Add(stmt[database.AUDIT_LATEST], stmt[database.AUDIT_INSERT])
+	return err
+}
+
+// Format the time, or show a dash if it was never set
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(DATE_FORMAT)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+// twadmin persons [-limit n] [-offset n] [text]
+func persons(stmt map[string]*sql.Stmt, args []string) error {
+	var limit, offset int64
+	flags := flag.NewFlagSet("persons", flag.ExitOnError)
+	flags.Int64Var(&limit, "limit", 50, "How many persons to list")
+	flags.Int64Var(&offset, "offset", 0, "How many persons to skip")
+	flags.Parse(args)
+
+	found, err := database.SearchPersons(stmt[database.PERSON_SEARCH], flags.Arg(0), limit, offset)
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "ID\tEMAIL\tJOINED\tVERIFIED\tENABLED\tROLE")
+	for _, p := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\t%s\n", p.Id, p.Email, formatDate(p.DateAdded), p.Verified, p.Enabled, p.Role)
+	}
+	return w.Flush()
+}
+
+// twadmin person email|id
+func person(stmt map[string]*sql.Stmt, args []string) error {
+	p, err := findPerson(stmt, args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Id:        %s\n", p.Id)
+	fmt.Printf("Email:     %s\n", p.Email)
+	fmt.Printf("Joined:    %s\n", formatDate(p.DateAdded))
+	fmt.Printf("Verified:  %t (%s)\n", p.Verified, formatDate(p.DateVerified))
+	fmt.Printf("Enabled:   %t\n", p.Enabled)
+	fmt.Printf("Role:      %s\n", p.Role)
+
+	publicKeys, err := p.LookupPublicKeys(stmt[database.PK_LOOKUP])
+	if err != nil {
+		return err
+	}
+	personSessions, err := p.LookupSessions(stmt[database.SESSION_LOOKUP_BY_PERSON])
+	if err != nil {
+		return err
+	}
+	tokens, err := p.LookupAPITokens(stmt[database.API_TOKEN_LOOKUP_BY_PERSON])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Keys:      %d\n", len(publicKeys))
+	fmt.Printf("Sessions:  %d\n", len(personSessions))
+	fmt.Printf("Tokens:    %d\n", len(tokens))
+	return nil
+}
+
+// twadmin enable email|id
+func enable(stmt map[string]*sql.Stmt, args []string) error {
+	p, err := findPerson(stmt, args)
+	if err != nil {
+		return err
+	}
+	if err := p.SetEnabled(stmt[database.PERSON_ENABLE], true); err != nil {
+		return err
+	}
+	return record(stmt, database.AUDIT_PERSON_ENABLE, p.Id, p.Email)
+}
+
+// twadmin disable email|id
+func disable(stmt map[string]*sql.Stmt, args []string) error {
+	p, err := findPerson(stmt, args)
+	if err != nil {
+		return err
+	}
+	if err := p.SetEnabled(stmt[database.PERSON_ENABLE], false); err != nil {
+		return err
+	}
+	if err := p.DeleteSessions(stmt[database.SESSION_DELETE_BY_PERSON]); err != nil {
+		return err
+	}
+	return record(stmt, database.AUDIT_PERSON_DISABLE, p.Id, p.Email)
+}
+
+// twadmin role email|id admin|member
+func role(stmt map[string]*sql.Stmt, args []string) error {
+	if len(args) != 2 {
+		return errors.New(NO_PERSON)
+	}
+	if args[1] != database.ROLE_ADMIN && args[1] != database.ROLE_MEMBER {
+		return errors.New(UNKNOWN_ROLE)
+	}
+	p, err := findPerson(stmt, args[:1])
+	if err != nil {
+		return err
+	}
+	if err := p.SetRole(stmt[database.PERSON_ROLE], args[1]); err != nil {
+		return err
+	}
+	return record(stmt, database.AUDIT_PERSON_ROLE, p.Id, p.Email+" "+args[1])
+}
+
+// twadmin keys email|id
+func keys(stmt map[string]*sql.Stmt, args []string) error {
+	p, err := findPerson(stmt, args)
+	if err != nil {
+		return err
+	}
+
+	publicKeys, err := p.LookupPublicKeys(stmt[database.PK_LOOKUP])
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "ID\tADDED\tNICKNAME\tSOURCE")
+	for _, key := range publicKeys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Id, formatDate(key.Added), key.Nickname, key.Source)
+	}
+	return w.Flush()
+}
+
+// twadmin delete-key id
+func deleteKey(stmt map[string]*sql.Stmt, args []string) error {
+	if len(args) != 1 || !UUID.MatchString(args[0]) {
+		return errors.New(NO_KEY)
+	}
+	key, email, err := database.LookupPublicKey(stmt[database.PK_LOOKUP_BY_ID], args[0])
+	if err != nil {
+		return err
+	}
+	if len(key.Id) == 0 {
+		return errors.New(UNKNOWN_KEY + args[0])
+	}
+
+	// as the server does, the key log and the audit log record the removal
+	if err := key.Delete(stmt[database.PK_DELETE]); err != nil {
+		return err
+	}
+	if _, err := database.LogKeyChange(stmt[database.KEY_LOG_INSERT], transparency.ACTION_DELETE, email, key); err != nil {
+		return err
+	}
+	return record(stmt, database.AUDIT_KEY_DELETE, key.Id, email+" "+key.Nickname)
+}
+
+// twadmin purge -yes email|id
+func purge(stmt map[string]*sql.Stmt, args []string) error {
+	var confirmed bool
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	flags.BoolVar(&confirmed, "yes", false, "Really delete the messages?")
+	flags.Parse(args)
+
+	p, err := findPerson(stmt, flags.Args())
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return errors.New(CONFIRM_PURGE)
+	}
+
+	purged, err := p.PurgeMessages(stmt[database.MESSAGE_PURGE], stmt[database.RECIPIENT_CLEANUP], stmt[database.MESSAGE_DELETE])
+	fmt.Printf("Deleted %d messages posted by %s\n", purged, p.Email)
+	if purged > 0 {
+		if recordErr := record(stmt, database.AUDIT_MESSAGES_PURGE, p.Id, fmt.Sprintf("%s %d message(s)", p.Email, purged)); err == nil {
+			err = recordErr
+		}
+	}
+	return err
+}
+
+// twadmin sessions [-revoke] email|id
+func sessions(stmt map[string]*sql.Stmt, args []string) error {
+	var revoke bool
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	flags.BoolVar(&revoke, "revoke", false, "Revoke all of the person's sessions?")
+	flags.Parse(args)
+
+	p, err := findPerson(stmt, flags.Args())
+	if err != nil {
+		return err
+	}
+	if revoke {
+		if err := p.DeleteSessions(stmt[database.SESSION_DELETE_BY_PERSON]); err != nil {
+			return err
+		}
+		return record(stmt, database.AUDIT_SESSIONS_REVOKE, p.Id, p.Email)
+	}
+
+	personSessions, err := p.LookupSessions(stmt[database.SESSION_LOOKUP_BY_PERSON])
+	if err != nil {
+		return err
+	}
+
+	// the session codes themselves are never shown
+	w := newTable()
+	fmt.Fprintln(w, "ID\tCREATED\tVERIFIED\tEXPIRES")
+	for _, s := range personSessions {
+		verified := "-"
+		if s.Verified {
+			verified = formatDate(s.DateVerified)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Id, formatDate(s.DateCreated), verified, formatDate(s.DateExpires))
+	}
+	return w.Flush()
+}
+
+// twadmin stats [-json]
+func stats(stmt map[string]*sql.Stmt, args []string) error {
+	var asJSON bool
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	flags.BoolVar(&asJSON, "json", false, "Print the statistics as json?")
+	flags.Parse(args)
+
+	s, err := database.LookupStatistics(stmt[database.INSTANCE_STATISTICS])
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(s)
+	}
+
+	w := newTable()
+	fmt.Fprintf(w, "Persons\t%d\n", s.Persons)
+	fmt.Fprintf(w, "  enabled\t%d\n", s.EnabledPersons)
+	fmt.Fprintf(w, "  verified\t%d\n", s.VerifiedPersons)
+	fmt.Fprintf(w, "Public keys\t%d\n", s.PublicKeys)
+	fmt.Fprintf(w, "Messages\t%d\n", s.Messages)
+	fmt.Fprintf(w, "  expired\t%d\n", s.ExpiredMessages)
+	fmt.Fprintf(w, "Recipients\t%d\n", s.Recipients)
+	fmt.Fprintf(w, "Sessions (active)\t%d\n", s.ActiveSessions)
+	fmt.Fprintf(w, "Sessions (pending)\t%d\n", s.PendingSessions)
+	fmt.Fprintf(w, "Api tokens\t%d\n", s.APITokens)
+	return w.Flush()
+}
+
+// twadmin audit [-limit n] [-offset n]
+func audit(stmt map[string]*sql.Stmt, args []string) error {
+	var limit, offset int64
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	flags.Int64Var(&limit, "limit", 50, "How many events to list")
+	flags.Int64Var(&offset, "offset", 0, "How many events to skip")
+	flags.Parse(args)
+
+	events, err := database.LookupAuditEvents(stmt[database.AUDIT_LOOKUP], limit, offset)
+	if err != nil {
+		return err
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "WHEN\tACTOR\tACTION\tTARGET\tDETAIL\tIP\tUSER AGENT")
+	for _, e := range events {
+		actor := e.ActorEmail
+		if len(actor) == 0 {
+			actor = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", formatDate(e.DateCreated), actor, e.Action, e.Target, e.Detail, e.IPAddress, e.UserAgent)
+	}
+	return w.Flush()
+}
+
+// twadmin verify-audit [-head hash]
+func verifyAudit(stmt map[string]*sql.Stmt, args []string) error {
+	var head string
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	flags.StringVar(&head, "head", "", "A head hash from an earlier run, which must still be in the chain")
+	flags.Parse(args)
+
+	v, err := database.VerifyAuditChain(stmt[database.AUDIT_CHAIN], head)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Events:     %d\n", v.Events)
+	fmt.Printf("Unchained:  %d\n", v.Unchained)
+	fmt.Printf("Head:       %s\n", v.Head)
+	if !v.Valid {
+		if v.FailedAt > 0 {
+			fmt.Printf("Failed at:  event #%d\n", v.FailedAt)
+		}
+		fmt.Printf("Reason:     %s\n", v.Reason)
+		return errors.New(AUDIT_INVALID)
+	}
+	fmt.Println("Valid:      true")
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, USAGE)
+		flag.PrintDefaults()
+	}
+
+	// the same database settings as the server, from its configuration
+	// file, the environment and the command line args (except for the
+	// password and the connection string, which are not read from args)
+	settings, configErr := config.LoadDatabase(flag.CommandLine, os.Args[1:])
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command, known := COMMANDS[flag.Arg(0)]
+	if !known {
+		fmt.Fprintln(os.Stderr, UNKNOWN_COMMAND+flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if configErr != nil {
+		fmt.Fprintln(os.Stderr, "twadmin:", configErr)
+		os.Exit(2)
+	}
+	coords := settings.Database.Connection()
+	err := coords.Validate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "twadmin:", err)
+		os.Exit(2)
+	}
+	// each command's changes (and their audit events) are made together,
+	// or not at all
+	err = database.TransactWithDatabase(context.Background(), coords, func(stmt map[string]*sql.Stmt) error {
+		return command(stmt, flag.Args()[1:])
+	})
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "twadmin:", err)
+		os.Exit(1)
+	}
+}
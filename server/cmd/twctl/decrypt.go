@@ -0,0 +1,106 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	PASSPHRASE_ENV = "TWCTL_PASSPHRASE"
+
+	NO_PASSPHRASE  = "The private key is encrypted: set -passphraseFile or $" + PASSPHRASE_ENV
+	BAD_PASSPHRASE = "The passphrase does not unlock the private key"
+	NOT_ENCRYPTED  = "The input is not an armored PGP message"
+)
+
+// Decrypt the armored message, either with the private key file given by
+// -key, or else by handing it to gpg (which uses gpg-agent, and so prompts
+// for the passphrase only if the agent needs it)
+func decrypt(armored []byte) ([]byte, error) {
+	if len(keyFile) > 0 {
+		return decryptWithKeyFile(armored)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(gpgPath, "--quiet", "--decrypt")
+	cmd.Stdin = bytes.NewReader(armored)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if detail := strings.TrimSpace(stderr.String()); len(detail) > 0 {
+			return nil, errors.New(detail)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// The passphrase for the private key, from -passphraseFile or the environment
+func passphrase() ([]byte, error) {
+	if len(passphraseFile) > 0 {
+		data, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if value := os.Getenv(PASSPHRASE_ENV); len(value) > 0 {
+		return []byte(value), nil
+	}
+	return nil, errors.New(NO_PASSPHRASE)
+}
+
+// Decrypt the armored message with the (armored) private key file
+func decryptWithKeyFile(armored []byte) ([]byte, error) {
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := armor.Decode(bytes.NewReader(armored))
+	if err != nil || block == nil {
+		return nil, errors.New(NOT_ENCRYPTED)
+	}
+
+	// called only if the private key needed is encrypted; a second call
+	// means the passphrase was wrong
+	tried := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if tried || symmetric {
+			return nil, errors.New(BAD_PASSPHRASE)
+		}
+		tried = true
+
+		secret, secretErr := passphrase()
+		if secretErr != nil {
+			return nil, secretErr
+		}
+		for _, key := range keys {
+			if key.PrivateKey != nil && key.PrivateKey.Encrypted {
+				key.PrivateKey.Decrypt(secret)
+			}
+		}
+		return nil, nil
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, keyring, prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
@@ -0,0 +1,545 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// twctl is a command-line client for the TeamWork.io json api: it logs in,
+// lists, downloads and decrypts posts, encrypts and posts new messages to
+// recipients or teams, and manages one's own public keys
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/client"
+	"github.com/Banrai/TeamWork.io/server/cryptutil"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// default settings, which can also come from the environment
+	defaultServer = "https://teamwork.io"
+	defaultGPG    = "gpg"
+	SERVER_ENV    = "TWCTL_SERVER"
+	TOKEN_ENV     = "TWCTL_TOKEN"
+	STATE_ENV     = "TWCTL_HOME"
+	LOG_KEY_ENV   = "TWCTL_LOG_KEY"
+
+	// where the session id, team definitions and the latest key log tree
+	// head are kept
+	STATE_FOLDER   = ".twctl"
+	SESSION_FILE   = "session"
+	TEAMS_FILE     = "teams"
+	TREE_HEAD_FILE = "tree_head"
+
+	DATE_FORMAT = "2006-01-02 15:04"
+
+	USAGE = `Usage: twctl [options] command [arguments]
+
+Commands:
+  login -email address             email a new (encrypted) session code
+  login -email address -code file  decrypt the session code and log in
+  logout                           revoke the current session
+  list [-view v] [-limit n] [-cursor c]
+                                   list the latest posts (or older ones):
+                                   all, or those received, authored or
+                                   involving you
+  fetch [-o file] [-decrypt] id    download (and optionally decrypt) a post
+  post [-to a,b] [-team name] [-file f]
+                                   encrypt and post a message (from stdin
+                                   by default) to the recipients
+  keys                             list your public keys
+  keys add [-name n] file          add an armored public key
+  keys delete id                   remove one of your public keys
+  teams                            list the teams defined in the teams file
+
+Options:
+`
+
+	UNKNOWN_COMMAND = "Unknown command: "
+	NO_EMAIL        = "An -email address is required"
+	NO_ID           = "A message or key id is required"
+	NO_KEY_FILE     = "An armored public key file is required"
+	UNKNOWN_TEAM    = "Unknown team: "
+	INVALID_TEAM    = "Invalid team definition: "
+)
+
+var (
+	serverURL, token, gpgPath, keyFile, passphraseFile, stateFolder, logKeyFile string
+
+	COMMANDS = map[string]func(c *client.Client, args []string) error{
+		"login":  login,
+		"logout": logout,
+		"list":   list,
+		"fetch":  fetch,
+		"post":   post,
+		"keys":   keys,
+		"teams":  teams,
+	}
+)
+
+// The value of this environment variable, or the fallback if it is unset
+func fromEnv(name, fallback string) string {
+	if value := os.Getenv(name); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
+
+// The folder where the session id and teams file are kept: $TWCTL_HOME, or
+// ~/.twctl by default
+func defaultStateFolder() string {
+	if folder := os.Getenv(STATE_ENV); len(folder) > 0 {
+		return folder
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return STATE_FOLDER
+	}
+	return filepath.Join(home, STATE_FOLDER)
+}
+
+// Read the saved session id (if any)
+func loadSession() string {
+	data, err := ioutil.ReadFile(filepath.Join(stateFolder, SESSION_FILE))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Save the session id, readable only by this user
+func saveSession(id string) error {
+	if err := os.MkdirAll(stateFolder, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(stateFolder, SESSION_FILE), []byte(id+"\n"), 0600)
+}
+
+// A verifier for key searches, with the log public key in this file, and
+// the tree head saved by the last search (if any)
+func loadVerifier(file string) (*client.KeyVerifier, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := client.NewKeyVerifier(data)
+	if err != nil {
+		return nil, err
+	}
+
+	saved, err := ioutil.ReadFile(filepath.Join(stateFolder, TREE_HEAD_FILE))
+	if err == nil {
+		head := new(transparency.SignedTreeHead)
+		if err := json.Unmarshal(saved, head); err != nil {
+			return nil, err
+		}
+		verifier.TreeHead = head
+	}
+	return verifier, nil
+}
+
+// Save the latest verified tree head, so the next search can check that the
+// log only grew since
+func saveTreeHead(head *transparency.SignedTreeHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateFolder, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(stateFolder, TREE_HEAD_FILE), data, 0600)
+}
+
+// Read the whole file, or stdin if the name is empty or "-"
+func readInput(name string) ([]byte, error) {
+	if len(name) == 0 || name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// Split a comma-separated list, ignoring empty entries
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Read the team definitions, one per line, as "name: a@example.org, b@example.org"
+// (blank lines and lines starting with # are ignored)
+func loadTeams() (map[string][]string, error) {
+	teams := map[string][]string{}
+	data, err := ioutil.ReadFile(filepath.Join(stateFolder, TEAMS_FILE))
+	if os.IsNotExist(err) {
+		return teams, nil
+	}
+	if err != nil {
+		return teams, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return teams, errors.New(INVALID_TEAM + line)
+		}
+		teams[strings.TrimSpace(parts[0])] = splitList(parts[1])
+	}
+	return teams, nil
+}
+
+// twctl login -email address [-code file]
+func login(c *client.Client, args []string) error {
+	var email, codeFile string
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	flags.StringVar(&email, "email", "", "Your email address")
+	flags.StringVar(&codeFile, "code", "", "The encrypted session code attachment (- for stdin); if empty, a new code is emailed")
+	flags.Parse(args)
+
+	if len(email) == 0 {
+		return errors.New(NO_EMAIL)
+	}
+
+	if len(codeFile) == 0 {
+		if err := c.RequestSession(email); err != nil {
+			return err
+		}
+		fmt.Printf("A session code was sent to %s: log in with twctl login -email %s -code <attachment>\n", email, email)
+		return nil
+	}
+
+	encrypted, err := readInput(codeFile)
+	if err != nil {
+		return err
+	}
+	code, err := decrypt(encrypted)
+	if err != nil {
+		return err
+	}
+
+	session, err := c.ConfirmSession(email, strings.TrimSpace(string(code)))
+	if err != nil {
+		return err
+	}
+	if err := saveSession(session.Id); err != nil {
+		return err
+	}
+	fmt.Printf("Logged in until %s\n", session.DateExpires.Local().Format(DATE_FORMAT))
+	return nil
+}
+
+// twctl logout
+func logout(c *client.Client, args []string) error {
+	if err := c.Logout(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(stateFolder, SESSION_FILE))
+}
+
+// twctl list [-view v] [-limit n] [-cursor c | -offset n]
+func list(c *client.Client, args []string) error {
+	var (
+		limit, offset int64
+		view, cursor  string
+	)
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	flags.StringVar(&view, "view", "", "Which posts to list: all (the default), received, authored or involved")
+	flags.Int64Var(&limit, "limit", 20, "How many posts to list")
+	flags.StringVar(&cursor, "cursor", "", "The newer or older cursor of a previous list, for the page after it")
+	flags.Int64Var(&offset, "offset", 0, "How many posts to skip")
+	flags.Parse(args)
+
+	var (
+		page *client.MessagePage
+		err  error
+	)
+	if len(cursor) > 0 {
+		page, err = c.MessagesAt(view, cursor, limit)
+	} else {
+		page, err = c.Messages(view, limit, offset)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPOSTED\tFROM\tTO")
+	for _, message := range page.Items {
+		if message.MESSAGE == nil {
+			continue
+		}
+		from := ""
+		if message.Sender != nil {
+			from = message.Sender.Email
+		}
+		to := make([]string, 0, len(message.Recipients))
+		for _, recipient := range message.Recipients {
+			to = append(to, recipient.Email)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", message.Id, message.DatePosted.Local().Format(DATE_FORMAT), from, strings.Join(to, ", "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// the flags for the pages around this one, in the same view
+	paging := ""
+	if len(view) > 0 {
+		paging = "-view " + view + " "
+	}
+	if len(page.Newer) > 0 {
+		fmt.Printf("\nnewer: %s-cursor %s\n", paging, page.Newer)
+	}
+	if len(page.Older) > 0 {
+		fmt.Printf("older: %s-cursor %s\n", paging, page.Older)
+	}
+	return nil
+}
+
+// twctl fetch [-o file] [-decrypt] id
+func fetch(c *client.Client, args []string) error {
+	var output string
+	var decrypted bool
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	flags.StringVar(&output, "o", "", "Write the post to this file instead of stdout")
+	flags.BoolVar(&decrypted, "decrypt", false, "Decrypt the post?")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New(NO_ID)
+	}
+
+	message, err := c.Message(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if message.MESSAGE == nil {
+		return errors.New(client.NO_MESSAGE)
+	}
+
+	data := []byte(message.Message)
+	if decrypted {
+		if data, err = decrypt(data); err != nil {
+			return err
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if len(output) > 0 {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// twctl post [-to a,b] [-team name] [-file f]
+func post(c *client.Client, args []string) error {
+	var to, team, file string
+	var self bool
+	flags := flag.NewFlagSet("post", flag.ExitOnError)
+	flags.StringVar(&to, "to", "", "Comma-separated recipient email addresses")
+	flags.StringVar(&team, "team", "", "Comma-separated team names, from the teams file")
+	flags.StringVar(&file, "file", "", "Read the message from this file instead of stdin")
+	flags.BoolVar(&self, "self", true, "Also encrypt the message with your own keys, so you can read it later?")
+	flags.Parse(args)
+
+	recipients := splitList(to)
+	if len(team) > 0 {
+		teams, err := loadTeams()
+		if err != nil {
+			return err
+		}
+		for _, name := range splitList(team) {
+			members, known := teams[name]
+			if !known {
+				return errors.New(UNKNOWN_TEAM + name)
+			}
+			recipients = append(recipients, members...)
+		}
+	}
+
+	// each recipient only once
+	unique := make([]string, 0, len(recipients))
+	seen := map[string]bool{}
+	for _, recipient := range recipients {
+		if !seen[strings.ToLower(recipient)] {
+			seen[strings.ToLower(recipient)] = true
+			unique = append(unique, recipient)
+		}
+	}
+	if len(unique) == 0 {
+		return errors.New(client.NO_RECIPIENTS)
+	}
+
+	plaintext, err := readInput(file)
+	if err != nil {
+		return err
+	}
+
+	// as in the web form, the author's own keys are included along with
+	// the recipients'
+	publicKeys := make([]*database.PUBLIC_KEY, 0)
+	if self {
+		own, err := c.Keys()
+		if err != nil {
+			return err
+		}
+		publicKeys = append(publicKeys, own...)
+	}
+	for _, recipient := range unique {
+		person, err := c.SearchPublicKeys(recipient)
+		if err != nil {
+			return err
+		}
+		if len(person.Keys) == 0 {
+			return errors.New(client.NO_KEYS_FOUND + recipient)
+		}
+		publicKeys = append(publicKeys, person.PublicKeys()...)
+	}
+
+	encrypted, err := cryptutil.EncryptData(publicKeys, string(plaintext))
+	if err != nil {
+		return err
+	}
+
+	message, err := c.Post(encrypted, unique)
+	if err != nil {
+		return err
+	}
+	fmt.Println(message.Id)
+	return nil
+}
+
+// twctl keys [add [-name n] file | delete id]
+func keys(c *client.Client, args []string) error {
+	if len(args) == 0 || args[0] == "list" {
+		publicKeys, err := c.Keys()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tADDED\tNICKNAME\tSOURCE")
+		for _, key := range publicKeys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Id, key.Added.Local().Format(DATE_FORMAT), key.Nickname, key.Source)
+		}
+		return w.Flush()
+	}
+
+	switch args[0] {
+	case "add":
+		var name string
+		flags := flag.NewFlagSet("keys add", flag.ExitOnError)
+		flags.StringVar(&name, "name", "", "A nickname for the key")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return errors.New(NO_KEY_FILE)
+		}
+		armored, err := readInput(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		key, err := c.AddKey(string(armored), name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(key.Id)
+		return nil
+	case "delete":
+		if len(args) != 2 {
+			return errors.New(NO_ID)
+		}
+		return c.DeleteKey(args[1])
+	}
+	return errors.New(UNKNOWN_COMMAND + "keys " + args[0])
+}
+
+// twctl teams
+func teams(c *client.Client, args []string) error {
+	definitions, err := loadTeams()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, strings.Join(definitions[name], ", "))
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, USAGE)
+		flag.PrintDefaults()
+	}
+
+	flag.StringVar(&serverURL, "server", fromEnv(SERVER_ENV, defaultServer), "The TeamWork.io server (or $"+SERVER_ENV+")")
+	flag.StringVar(&token, "token", os.Getenv(TOKEN_ENV), "An api token to use instead of a session (or $"+TOKEN_ENV+")")
+	flag.StringVar(&gpgPath, "gpg", defaultGPG, "The gpg binary, for decrypting with the keys in gpg-agent")
+	flag.StringVar(&keyFile, "key", "", "An armored private key file to decrypt with, instead of gpg")
+	flag.StringVar(&passphraseFile, "passphraseFile", "", "A file containing the private key's passphrase (or $"+PASSPHRASE_ENV+")")
+	flag.StringVar(&stateFolder, "home", defaultStateFolder(), "Where the session id and teams file are kept (or $"+STATE_ENV+")")
+	flag.StringVar(&logKeyFile, "logKey", os.Getenv(LOG_KEY_ENV), "The server's key transparency log public key (PEM), to verify every key search against the log (or $"+LOG_KEY_ENV+")")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	command, known := COMMANDS[flag.Arg(0)]
+	if !known {
+		fmt.Fprintln(os.Stderr, UNKNOWN_COMMAND+flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := client.NewWithToken(serverURL, token)
+	c.SessionId = loadSession()
+
+	if len(logKeyFile) > 0 {
+		verifier, err := loadVerifier(logKeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "twctl:", err)
+			os.Exit(1)
+		}
+		c.Verifier = verifier
+	}
+
+	err := command(c, flag.Args()[1:])
+	if c.Verifier != nil && c.Verifier.TreeHead != nil {
+		// keep the newest verified tree head, even if the command failed
+		if saveErr := saveTreeHead(c.Verifier.TreeHead); saveErr != nil {
+			fmt.Fprintln(os.Stderr, "twctl:", saveErr)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "twctl:", err)
+		os.Exit(1)
+	}
+}
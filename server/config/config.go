@@ -0,0 +1,491 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package config reads the server's settings from a TOML file, environment
+// variables and command line flags, in increasing order of precedence.
+//
+// Each setting is a field of one of the sections below: its toml tag is its
+// key in the file (under the section's [table]), the environment variable
+// is TEAMWORK_<SECTION>_<KEY> (e.g., TEAMWORK_DATABASE_PASSWORD), and its
+// flag tag is the command line flag. Secrets can also be read from a file,
+// named by the key with a _file suffix (e.g., password_file, or
+// TEAMWORK_DATABASE_PASSWORD_FILE), so they need not appear in the file,
+// the environment or the process list.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/tracing"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the libpq sslmode values (space-delimited, for matching)
+	SSL_MODES = " disable allow prefer require verify-ca verify-full "
+
+	// environment variables are named with this prefix
+	ENV_PREFIX = "TEAMWORK_"
+
+	// where to find the configuration file, if not given by -config
+	CONFIG_ENV = ENV_PREFIX + "CONFIG"
+
+	// secrets can be read from a file named by the key with this suffix
+	FILE_SUFFIX = "_file"
+
+	// the most messages listed at once (as for the json api)
+	MAX_POSTS_PER_PAGE = 100
+)
+
+type ServerConfig struct {
+	Host            string        `toml:"host" flag:"host" usage:"The (externally-facing) name of the server"`
+	IP              string        `toml:"ip" flag:"ip" usage:"The hostname or IP address of the server"`
+	Port            int           `toml:"port" flag:"port" usage:"The server port"`
+	Mode            string        `toml:"mode" flag:"mode" usage:"How the server takes requests: \"fcgi\" (behind a web server), \"http\" or \"https\""`
+	CertFile        string        `toml:"cert_file" flag:"certFile" usage:"PEM file with the TLS certificate (chain), for the https mode (re-read on SIGHUP)"`
+	KeyFile         string        `toml:"key_file" flag:"keyFile" usage:"PEM file with the TLS private key, for the https mode (re-read on SIGHUP)"`
+	SSL             bool          `toml:"ssl" flag:"ssl" usage:"Does the server use SSL?"`
+	Templates       string        `toml:"templates" flag:"templates" usage:"Path to html templates and static resources"`
+	ReadTimeout     time.Duration `toml:"read_timeout" flag:"readTimeout" usage:"How long a client may take to send a request"`
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout" flag:"shutdownTimeout" usage:"How long to wait for the requests in progress on SIGTERM"`
+	OperatorAddress string        `toml:"operator_address" flag:"operatorAddress" usage:"The host:port of a separate plain http listener for /debug/vars, /metrics and /readyz (if unset, the http and https modes only serve them to loopback clients)"`
+	Privacy         bool          `toml:"privacy" flag:"privacy" usage:"Respond identically to session and key search requests for known and unknown email addresses? (outcomes are sent only by email)"`
+	LogLevel        string        `toml:"log_level" flag:"logLevel" usage:"The lowest level logged: debug, info, warn or error"`
+	LogFormat       string        `toml:"log_format" flag:"logFormat" usage:"The log line format: logfmt or json"`
+}
+
+type DatabaseConfig struct {
+	Name           string        `toml:"name" flag:"dbName" usage:"The database name"`
+	User           string        `toml:"user" flag:"dbUser" usage:"The database user"`
+	Password       string        `toml:"password" flag:"dbPass" usage:"The database password (better set in the configuration file, as password_file, or in $TEAMWORK_DATABASE_PASSWORD)" secret:"true"`
+	Host           string        `toml:"host" flag:"dbHost" usage:"The database host name or IP address, or the folder of its unix socket (if empty, localhost)"`
+	Port           int           `toml:"port" flag:"dbPort" usage:"The database port (if 0, 5432)"`
+	SSL            bool          `toml:"ssl" flag:"dbSSL" usage:"Does the database use SSL mode? (sslmode require if so, or disable; -dbSSLMode overrides this)"`
+	SSLMode        string        `toml:"sslmode" flag:"dbSSLMode" usage:"The database sslmode: disable, allow, prefer, require, verify-ca or verify-full"`
+	SSLRootCert    string        `toml:"sslrootcert" flag:"dbSSLRootCert" usage:"PEM file with the CA certificate(s) which the database certificate must be signed by (for verify-ca and verify-full)"`
+	SSLCert        string        `toml:"sslcert" flag:"dbSSLCert" usage:"PEM file with the client certificate, if the database asks for one"`
+	SSLKey         string        `toml:"sslkey" flag:"dbSSLKey" usage:"PEM file with the client certificate's private key"`
+	ConnectTimeout time.Duration `toml:"connect_timeout" flag:"dbConnectTimeout" usage:"How long to wait for a database connection (if 0, forever)"`
+	DSN            string        `toml:"dsn" flag:"dbDSN" usage:"A complete libpq connection string or postgres:// url, used instead of the other database settings (better set in the configuration file, as dsn_file, or in $TEAMWORK_DATABASE_DSN)" secret:"true"`
+}
+
+type SessionConfig struct {
+	Words       string        `toml:"words" flag:"words" usage:"Dictionary file, one word per line (for generating random session codes; if empty, the built-in EFF list is used)"`
+	Duration    time.Duration `toml:"duration" flag:"sessionDuration" usage:"How long a new session lasts"`
+	PerEmail    int           `toml:"per_email" flag:"sessionsPerEmail" usage:"How many session emails can be sent to the same address within the limit period (0 for no limit)"`
+	PerIP       int           `toml:"per_ip" flag:"sessionsPerIP" usage:"How many session emails can be requested from the same IP address within the limit period (0 for no limit)"`
+	LimitPeriod time.Duration `toml:"limit_period" flag:"sessionLimitPeriod" usage:"The session email limit period"`
+	LimitDB     bool          `toml:"limit_db" flag:"sessionLimitDB" usage:"Keep the session email limits in the database, to share them among multiple server instances?"`
+}
+
+type MessageConfig struct {
+	Duration       time.Duration `toml:"duration" flag:"messageDuration" usage:"How long a new message is kept"`
+	PerPage        int           `toml:"per_page" flag:"postsPerPage" usage:"How many messages are listed on each page"`
+	ExpiryInterval time.Duration `toml:"expiry_interval" flag:"expiryInterval" usage:"How often the server removes expired messages and sessions (0 to leave that to another process)"`
+}
+
+type MailConfig struct {
+	Server string `toml:"server" flag:"mailServer" usage:"The SMTP server which sends the session emails"`
+	Port   int    `toml:"port" flag:"mailPort" usage:"The SMTP server port"`
+	Sender string `toml:"sender" flag:"mailSender" usage:"The sender address of the session emails"`
+}
+
+type StripeConfig struct {
+	PublicKey string `toml:"public_key" flag:"stripePK" usage:"The Stripe Public Key"`
+	SecretKey string `toml:"secret_key" flag:"stripeSK" usage:"The Stripe Secret Key (better set in the configuration file, as secret_key_file, or in $TEAMWORK_STRIPE_SECRET_KEY)" secret:"true"`
+}
+
+type KeyLogConfig struct {
+	KeyFile string `toml:"key_file" flag:"keyLogKey" usage:"PEM file with the ECDSA (P-256) private key which signs the key transparency log's tree heads (if empty, a temporary key is generated)"`
+}
+
+type TracingConfig struct {
+	Endpoint      string `toml:"endpoint" flag:"tracingEndpoint" usage:"The OTLP/HTTP collector url which spans are exported to, e.g., http://localhost:4318/v1/traces (if empty, nothing is traced)"`
+	ServiceName   string `toml:"service_name" flag:"tracingService" usage:"The service.name of the exported spans"`
+	SamplePercent int    `toml:"sample_percent" flag:"tracingSamplePercent" usage:"The percentage of new traces recorded (requests which continue a trace follow its sampling decision)"`
+}
+
+// All of the server's settings
+type Config struct {
+	Server   ServerConfig   `toml:"server"`
+	Database DatabaseConfig `toml:"database"`
+	Sessions SessionConfig  `toml:"sessions"`
+	Messages MessageConfig  `toml:"messages"`
+	Mail     MailConfig     `toml:"mail"`
+	Stripe   StripeConfig   `toml:"stripe"`
+	KeyLog   KeyLogConfig   `toml:"key_log"`
+	Tracing  TracingConfig  `toml:"tracing"`
+
+	// where the settings came from, to read them again
+	File     string
+	explicit map[string]string
+}
+
+// The settings used when nothing else is given
+func Defaults() *Config {
+	return &Config{
+		Server: ServerConfig{Host: "teamwork.io",
+			IP:              "localhost",
+			Port:            8080,
+			Mode:            "fcgi",
+			SSL:             true,
+			Templates:       "/opt/data/html/templates",
+			ReadTimeout:     30 * time.Second, // to prevent abuse of "keep-alive" requests by clients
+			ShutdownTimeout: 30 * time.Second,
+			LogLevel:        logging.LEVEL_INFO,
+			LogFormat:       logging.FORMAT_LOGFMT},
+		Database: DatabaseConfig{Name: "db", User: "user", Password: "pass", SSL: true},
+		Sessions: SessionConfig{Duration: 30 * time.Minute,
+			PerEmail:    5,
+			PerIP:       20,
+			LimitPeriod: time.Hour},
+		Messages: MessageConfig{Duration: 30 * 24 * time.Hour, PerPage: 20},
+		Mail:     MailConfig{Server: "localhost", Port: 25, Sender: "noreply@teamwork.io"},
+		Stripe:   StripeConfig{PublicKey: "pk_test_", SecretKey: "sk_test_"},
+		Tracing:  TracingConfig{ServiceName: tracing.DEFAULT_SERVICE_NAME, SamplePercent: 100},
+	}
+}
+
+// One setting, found by walking the sections' fields
+type setting struct {
+	key, env, flag, usage string
+	secret                bool
+	value                 reflect.Value
+}
+
+func (c *Config) settings() []*setting {
+	results := make([]*setting, 0)
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		sectionName := sections.Type().Field(i).Tag.Get("toml")
+		if len(sectionName) == 0 {
+			continue
+		}
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			key := sectionName + "." + field.Tag.Get("toml")
+			results = append(results, &setting{key: key,
+				env:    ENV_PREFIX + strings.ToUpper(strings.Replace(key, ".", "_", -1)),
+				flag:   field.Tag.Get("flag"),
+				usage:  field.Tag.Get("usage"),
+				secret: field.Tag.Get("secret") == "true",
+				value:  section.Field(j)})
+		}
+	}
+	return results
+}
+
+// Set the setting from its text form
+func (s *setting) set(text string) error {
+	switch target := s.value.Addr().Interface().(type) {
+	case *string:
+		*target = text
+	case *int:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer, not %q", s.key, text)
+		}
+		*target = n
+	case *bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, not %q", s.key, text)
+		}
+		*target = b
+	case *time.Duration:
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("%s must be a duration (e.g., \"30m\"), not %q", s.key, text)
+		}
+		*target = d
+	}
+	return nil
+}
+
+// Read a secret from this file, without any trailing newline
+func readSecret(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Bind each setting (or only those for which flagged is true, if given) to
+// its flag, with the current value as the default, along with -config
+func (c *Config) bind(fs *flag.FlagSet, flagged func(*setting) bool) {
+	fs.StringVar(&c.File, "config", os.Getenv(CONFIG_ENV), "The TOML configuration file (or $"+CONFIG_ENV+"); the environment overrides it, and these flags override both")
+	for _, s := range c.settings() {
+		if len(s.flag) == 0 || (flagged != nil && !flagged(s)) {
+			continue
+		}
+		switch target := s.value.Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(target, s.flag, *target, s.usage)
+		case *int:
+			fs.IntVar(target, s.flag, *target, s.usage)
+		case *bool:
+			fs.BoolVar(target, s.flag, *target, s.usage)
+		case *time.Duration:
+			fs.DurationVar(target, s.flag, *target, s.usage)
+		}
+	}
+}
+
+// Read the settings from the configuration file (if any) and then the
+// environment, over the current ones
+func (c *Config) read() error {
+	fileValues := make(map[string]string)
+	if len(c.File) > 0 {
+		file, err := os.Open(c.File)
+		if err != nil {
+			return err
+		}
+		fileValues, err = parseTOML(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.File, err)
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, s := range c.settings() {
+		known[s.key] = true
+		if value, found := fileValues[s.key]; found {
+			if err := s.set(value); err != nil {
+				return fmt.Errorf("%s: %v", c.File, err)
+			}
+		}
+		if s.secret {
+			known[s.key+FILE_SUFFIX] = true
+			if secretFile, found := fileValues[s.key+FILE_SUFFIX]; found {
+				secret, err := readSecret(secretFile)
+				if err != nil {
+					return err
+				}
+				s.set(secret)
+			}
+		}
+
+		if value, found := os.LookupEnv(s.env); found {
+			if err := s.set(value); err != nil {
+				return fmt.Errorf("$%s: %v", s.env, err)
+			}
+		}
+		if secretFile := os.Getenv(s.env + strings.ToUpper(FILE_SUFFIX)); s.secret && len(secretFile) > 0 {
+			secret, err := readSecret(secretFile)
+			if err != nil {
+				return err
+			}
+			s.set(secret)
+		}
+	}
+
+	// anything else is a typo, or a setting this version does not have
+	unknown := make([]string, 0)
+	for key := range fileValues {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown settings: %s", c.File, strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// Read the settings from the defaults, the configuration file (given by
+// -config or $TEAMWORK_CONFIG), the environment and the command line args,
+// defining the flags in fs, and check them
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	c, err := loadSettings(fs, args, nil)
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// Read the settings from the same sources as Load, for tools which only
+// use the database (e.g., twadmin): the flags in fs are only the database
+// ones, without the password and the connection string (which would show
+// in the process list), and only the database settings are checked
+func LoadDatabase(fs *flag.FlagSet, args []string) (*Config, error) {
+	c, err := loadSettings(fs, args, func(s *setting) bool {
+		return strings.HasPrefix(s.key, "database.") && !s.secret
+	})
+	if err != nil {
+		return c, err
+	}
+	return c, c.ValidateDatabase()
+}
+
+func loadSettings(fs *flag.FlagSet, args []string, flagged func(*setting) bool) (*Config, error) {
+	c := Defaults()
+	c.bind(fs, flagged)
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	// the flags on the command line override everything else, so keep
+	// them to apply again after the file and the environment
+	c.explicit = make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		c.explicit[f.Name] = f.Value.String()
+	})
+
+	if err := c.read(); err != nil {
+		return c, err
+	}
+	for name, value := range c.explicit {
+		fs.Set(name, value)
+	}
+	return c, nil
+}
+
+// Read the settings again from the same sources (e.g., on SIGHUP)
+func (c *Config) Reload() (*Config, error) {
+	n := Defaults()
+	n.File = c.File
+	n.explicit = c.explicit
+
+	if err := n.read(); err != nil {
+		return n, err
+	}
+
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	n.bind(fs, nil)
+	for name, value := range n.explicit {
+		if err := fs.Set(name, value); err != nil {
+			return n, err
+		}
+	}
+	return n, n.Validate()
+}
+
+// The problems found in the settings
+type problems []string
+
+// Note the problem described by format and args, unless ok
+func (p *problems) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		*p = append(*p, fmt.Sprintf(format, args...))
+	}
+}
+
+// Note the setting name as a problem if the file (or folder) is given, but
+// cannot be found
+func (p *problems) exists(name, file string, folder bool) {
+	if len(file) == 0 {
+		return
+	}
+	info, err := os.Stat(file)
+	p.check(err == nil && info.IsDir() == folder, "%s: %s is not a readable %s", name, file, map[bool]string{true: "folder", false: "file"}[folder])
+}
+
+// All of the problems as one error, if there are any
+func (p problems) err() error {
+	if len(p) > 0 {
+		return fmt.Errorf("Invalid configuration:\n  %s", strings.Join(p, "\n  "))
+	}
+	return nil
+}
+
+// Check that the settings are usable, listing every problem found
+func (c *Config) Validate() error {
+	p := new(problems)
+	check, exists := p.check, p.exists
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	if len(c.Server.OperatorAddress) > 0 {
+		_, _, addressErr := net.SplitHostPort(c.Server.OperatorAddress)
+		check(addressErr == nil, "server.operator_address must be a host:port")
+	}
+	exists("server.templates", c.Server.Templates, true)
+	_, knownLevel := logging.LEVELS[c.Server.LogLevel]
+	check(knownLevel, "server.log_level must be one of debug, info, warn or error")
+	check(c.Server.LogFormat == logging.FORMAT_LOGFMT || c.Server.LogFormat == logging.FORMAT_JSON, "server.log_format must be logfmt or json")
+	exists("server.cert_file", c.Server.CertFile, false)
+	exists("server.key_file", c.Server.KeyFile, false)
+
+	c.Database.validate(p)
+
+	exists("sessions.words", c.Sessions.Words, false)
+	check(c.Sessions.Duration > 0, "sessions.duration must be positive")
+	check(c.Sessions.PerEmail >= 0 && c.Sessions.PerIP >= 0, "sessions.per_email and sessions.per_ip cannot be negative")
+	check(c.Sessions.LimitPeriod > 0, "sessions.limit_period must be positive")
+
+	check(c.Messages.Duration > 0, "messages.duration must be positive")
+	check(c.Messages.PerPage > 0 && c.Messages.PerPage <= MAX_POSTS_PER_PAGE, "messages.per_page must be between 1 and %d", MAX_POSTS_PER_PAGE)
+	check(c.Messages.ExpiryInterval >= 0, "messages.expiry_interval must not be negative")
+
+	check(len(c.Mail.Server) > 0, "mail.server is required")
+	check(c.Mail.Port > 0 && c.Mail.Port < 65536, "mail.port must be between 1 and 65535")
+	check(strings.Contains(c.Mail.Sender, "@"), "mail.sender must be an email address")
+
+	exists("key_log.key_file", c.KeyLog.KeyFile, false)
+
+	if len(c.Tracing.Endpoint) > 0 {
+		endpoint, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (endpoint.Scheme == "http" || endpoint.Scheme == "https") && len(endpoint.Host) > 0, "tracing.endpoint must be an http or https url")
+	}
+	check(c.Tracing.SamplePercent >= 0 && c.Tracing.SamplePercent <= 100, "tracing.sample_percent must be between 0 and 100")
+
+	return p.err()
+}
+
+// Check only the database settings (for tools which need nothing else)
+func (c *Config) ValidateDatabase() error {
+	p := new(problems)
+	c.Database.validate(p)
+	return p.err()
+}
+
+func (d *DatabaseConfig) validate(p *problems) {
+	check, exists := p.check, p.exists
+	if len(d.DSN) == 0 {
+		check(len(d.Name) > 0, "database.name is required")
+		check(len(d.User) > 0, "database.user is required")
+	}
+	check(d.Port >= 0 && d.Port < 65536, "database.port must be between 1 and 65535 (or 0 for the default)")
+	check(d.ConnectTimeout >= 0, "database.connect_timeout cannot be negative")
+	check(len(d.SSLMode) == 0 || strings.Contains(SSL_MODES, " "+d.SSLMode+" "), "database.sslmode must be one of%s", strings.TrimRight(SSL_MODES, " "))
+	check((len(d.SSLCert) == 0) == (len(d.SSLKey) == 0), "database.sslcert and database.sslkey must be given together")
+	exists("database.sslrootcert", d.SSLRootCert, false)
+	exists("database.sslcert", d.SSLCert, false)
+	exists("database.sslkey", d.SSLKey, false)
+}
+
+// The connection coordinates for these settings (with the sslmode from
+// the older ssl setting, unless it is given)
+func (d *DatabaseConfig) Connection() database.DBConnection {
+	coords := database.DBConnection{DBName: d.Name,
+		User:           d.User,
+		Pass:           d.Password,
+		Host:           d.Host,
+		Port:           d.Port,
+		SSLMode:        d.SSLMode,
+		SSLRootCert:    d.SSLRootCert,
+		SSLCert:        d.SSLCert,
+		SSLKey:         d.SSLKey,
+		ConnectTimeout: d.ConnectTimeout,
+		DSN:            d.DSN}
+	if len(coords.SSLMode) == 0 {
+		coords.SSLMode = database.SSLModeFromBool(d.SSL)
+	}
+	return coords
+}
@@ -0,0 +1,177 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, folder, name, contents string) string {
+	file := filepath.Join(folder, name)
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func load(args ...string) (*Config, error) {
+	return Load(flag.NewFlagSet("test", flag.ContinueOnError), args)
+}
+
+func TestParseTOML(t *testing.T) {
+	values, err := parseTOML(strings.NewReader(`
+# the server
+[server]
+host = "teamwork.example.org" # where it is
+port = 8_443
+ssl = false
+templates = 'C:\templates'
+
+[mail]
+sender = "TeamWork \"#1\" <noreply@example.org>"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"server.host": "teamwork.example.org",
+		"server.port":      "8443",
+		"server.ssl":       "false",
+		"server.templates": `C:\templates`,
+		"mail.sender":      `TeamWork "#1" <noreply@example.org>`}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("%s: expected %q, got %q", key, value, values[key])
+		}
+	}
+	if len(values) != len(expected) {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	for _, invalid := range []string{"host = \"x\"", "[server]\nhosts = [\"a\", \"b\"]", "[server]\nhost = \"x", "[server]\nport = 1\nport = 2", "[server]\nhost"} {
+		if _, err := parseTOML(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q was accepted", invalid)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	folder := t.TempDir()
+	secret := writeFile(t, folder, "db_password", "from a file\n")
+	file := writeFile(t, folder, "teamwork.toml", `
+[server]
+templates = "`+folder+`"
+port = 8001
+mode = "http"
+
+[database]
+user = "from_the_file"
+password_file = "`+secret+`"
+
+[sessions]
+duration = "10m"
+
+[messages]
+per_page = 50
+`)
+
+	t.Setenv("TEAMWORK_SERVER_PORT", "8002")
+	t.Setenv("TEAMWORK_DATABASE_USER", "from_the_environment")
+	t.Setenv("TEAMWORK_MAIL_SERVER", "smtp.example.org")
+
+	c, err := load("-config", file, "-dbUser", "from_a_flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Server.Mode != "http" || c.Server.Port != 8002 || c.Database.User != "from_a_flag" || c.Mail.Server != "smtp.example.org" {
+		t.Errorf("the file, environment and flags were not applied in order: %+v %+v %+v", c.Server, c.Database, c.Mail)
+	}
+	if c.Database.Password != "from a file" {
+		t.Errorf("the password was not read from its file: %q", c.Database.Password)
+	}
+	if c.Sessions.Duration != 10*time.Minute || c.Messages.PerPage != 50 || c.Mail.Port != 25 {
+		t.Errorf("unexpected settings %+v %+v %+v", c.Sessions, c.Messages, c.Mail)
+	}
+
+	// the environment changes, but the flag still wins
+	t.Setenv("TEAMWORK_SERVER_PORT", "8003")
+	reloaded, err := c.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Server.Port != 8003 || reloaded.Database.User != "from_a_flag" || reloaded.Database.Password != "from a file" {
+		t.Errorf("unexpected reload %+v %+v", reloaded.Server, reloaded.Database)
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	folder := t.TempDir()
+
+	file := writeFile(t, folder, "typo.toml", "[server]\ntemplates = \""+folder+"\"\nprot = 8080\n")
+	if _, err := load("-config", file); err == nil || !strings.Contains(err.Error(), "server.prot") {
+		t.Errorf("expected the unknown setting to be named, got %v", err)
+	}
+
+	file = writeFile(t, folder, "type.toml", "[server]\nport = \"http\"\n")
+	if _, err := load("-config", file); err == nil || !strings.Contains(err.Error(), "server.port") {
+		t.Errorf("expected the invalid port to be named, got %v", err)
+	}
+
+	_, err := load("-templates", folder, "-port", "0", "-postsPerPage", "500", "-mailSender", "nobody", "-tracingEndpoint", "localhost:4318", "-tracingSamplePercent", "101", "-operatorAddress", "9090", "-expiryInterval", "-1m")
+	for _, problem := range []string{"server.port", "server.operator_address", "messages.expiry_interval", "messages.per_page", "mail.sender", "tracing.endpoint", "tracing.sample_percent"} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %s to be invalid, got %v", problem, err)
+		}
+	}
+
+	if _, err := load("-templates", folder); err != nil {
+		t.Errorf("the defaults are invalid: %v", err)
+	}
+}
+
+func TestLoadDatabase(t *testing.T) {
+	folder := t.TempDir()
+	secret := writeFile(t, folder, "db_password", "from a file\n")
+	file := writeFile(t, folder, "teamwork.toml", `
+[server]
+templates = "/nowhere"
+
+[database]
+name = "teamworkdb"
+sslmode = "verify-full"
+`)
+	t.Setenv("TEAMWORK_DATABASE_USER", "from_the_environment")
+	t.Setenv("TEAMWORK_DATABASE_PASSWORD_FILE", secret)
+
+	// only the database settings are checked (the templates are elsewhere)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c, err := LoadDatabase(fs, []string{"-config", file, "-dbHost", "db.example.org", "stats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coords := c.Database.Connection()
+	if coords.DBName != "teamworkdb" || coords.User != "from_the_environment" || coords.Pass != "from a file" || coords.Host != "db.example.org" || coords.SSLMode != "verify-full" {
+		t.Errorf("unexpected database settings %+v", coords)
+	}
+	if fs.Arg(0) != "stats" {
+		t.Errorf("unexpected args %v", fs.Args())
+	}
+
+	// nor are there flags for the secrets, or for anything else
+	for _, name := range []string{"dbPass", "dbDSN", "port", "templates", "stripeSK"} {
+		if fs.Lookup(name) != nil {
+			t.Errorf("-%s is defined", name)
+		}
+	}
+
+	if _, err := LoadDatabase(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", file, "-dbPort", "70000"}); err == nil || !strings.Contains(err.Error(), "database.port") {
+		t.Errorf("expected the invalid port to be named, got %v", err)
+	}
+}
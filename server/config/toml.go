@@ -0,0 +1,107 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// [section] headers, and key = value pairs
+	SECTION  = regexp.MustCompile(`^\[\s*([A-Za-z0-9_-]+)\s*\]$`)
+	KEYVALUE = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*=\s*(.+)$`)
+	INTEGER  = regexp.MustCompile(`^[+-]?[0-9][0-9_]*$`)
+)
+
+// Read the subset of TOML which configuration files need: [section] tables
+// of key = value pairs, where the values are strings (basic or literal),
+// integers or booleans; the result maps "section.key" to the value (without
+// its quotes)
+func parseTOML(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if len(line) == 0 {
+			continue
+		}
+
+		if match := SECTION.FindStringSubmatch(line); match != nil {
+			section = match[1]
+			continue
+		}
+
+		match := KEYVALUE.FindStringSubmatch(line)
+		if match == nil {
+			return values, fmt.Errorf("line %d: expected [section] or key = value", lineNumber)
+		}
+		if len(section) == 0 {
+			return values, fmt.Errorf("line %d: %s is not in a [section]", lineNumber, match[1])
+		}
+
+		value, err := parseValue(strings.TrimSpace(match[2]))
+		if err != nil {
+			return values, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		key := section + "." + match[1]
+		if _, exists := values[key]; exists {
+			return values, fmt.Errorf("line %d: %s is defined twice", lineNumber, key)
+		}
+		values[key] = value
+	}
+
+	return values, scanner.Err()
+}
+
+// Remove any comment, i.e., from a # which is not inside a string
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	case INTEGER.MatchString(raw):
+		return strings.Replace(raw, "_", "", -1), nil
+	}
+	return "", fmt.Errorf("unsupported value %s (use a string, an integer or a boolean)", raw)
+}
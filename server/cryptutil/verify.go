@@ -0,0 +1,39 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package cryptutil
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"strings"
+)
+
+// Confirm the clear-signed text (e.g., from "gpg --clearsign") was signed
+// by one of the PGP keys in the list, returning its plaintext if so
+func VerifyClearSigned(keys []*database.PUBLIC_KEY, signed string) (string, error) {
+	block, _ := clearsign.Decode([]byte(strings.Replace(signed, "\r\n", "\n", -1)))
+	if nil == block {
+		return "", errors.New("Invalid clear-signed text")
+	}
+
+	keyring := openpgp.EntityList{}
+	for _, key := range keys {
+		pgpKey, pgpKeyErr := AsEntity(key.Key)
+		if pgpKeyErr != nil {
+			// skip any keys which cannot be parsed
+			continue
+		}
+		keyring = append(keyring, pgpKey)
+	}
+
+	_, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(block.Plaintext), nil
+}
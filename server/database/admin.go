@@ -0,0 +1,146 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	// persons, with their key, message and active session counts
+	ADMIN_PERSONS = `select p.id, p.email, p.date_added, p.verified, p.date_verified, p.enabled, p.role,
+ (select count(*) from public_key k where k.person_id = p.id),
+ (select count(*) from message m where m.person_id = p.id),
+ (select count(*) from session s where s.person_id = p.id and s.verified and s.date_expires > (now() at time zone 'UTC'))
+ from person p where strpos(p.email, lower($1)) > 0 order by p.email limit $2 offset $3`
+
+	// messages posted per day, over the given number of days
+	ADMIN_MESSAGE_VOLUME = `select date_trunc('day', date_posted), count(*), count(distinct person_id)
+ from message where date_posted > (now() at time zone 'UTC') - $1 * interval '1 day'
+ group by 1 order by 1 desc`
+
+	// every open session, newest first
+	ADMIN_SESSIONS = `select s.id, p.id, p.email, s.date_created, s.verified, s.date_verified, s.date_expires
+ from session s, person p where s.person_id = p.id and s.date_expires > (now() at time zone 'UTC')
+ order by s.date_created desc limit $1`
+)
+
+type PERSON_SUMMARY struct {
+	*PERSON
+	Keys     int64
+	Messages int64
+	Sessions int64
+}
+
+type MESSAGE_VOLUME struct {
+	Day      time.Time
+	Messages int64
+	Authors  int64
+}
+
+type SESSION_ACTIVITY struct {
+	*SESSION
+	Email string
+}
+
+// Return the persons whose email address contains the given text (or
+// everyone, if it is empty), along with their activity counts
+func SummarizePersons(stmt *sql.Stmt, text string, limit, offset int64) ([]*PERSON_SUMMARY, error) {
+	results := make([]*PERSON_SUMMARY, 0)
+
+	rows, err := stmt.Query(text, limit, offset)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id, email, role           sql.NullString
+			date_added, date_verified pq.NullTime
+			verified, enabled         sql.NullBool
+			keys, messages, sessions  sql.NullInt64
+		)
+
+		err := rows.Scan(&id, &email, &date_added, &verified, &date_verified, &enabled, &role, &keys, &messages, &sessions)
+		if err != nil {
+			return results, err
+		} else {
+			person := new(PERSON)
+			person.Id = id.String
+			person.Email = email.String
+			person.DateAdded = date_added.Time
+			person.Verified = verified.Bool
+			person.DateVerified = date_verified.Time
+			person.Enabled = enabled.Bool
+			person.Role = role.String
+			results = append(results, &PERSON_SUMMARY{PERSON: person, Keys: keys.Int64, Messages: messages.Int64, Sessions: sessions.Int64})
+		}
+	}
+
+	return results, nil
+}
+
+// Return the number of messages posted on each of the last few days (days
+// without any are left out)
+func LookupMessageVolume(stmt *sql.Stmt, days int) ([]*MESSAGE_VOLUME, error) {
+	results := make([]*MESSAGE_VOLUME, 0)
+
+	rows, err := stmt.Query(days)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			day               pq.NullTime
+			messages, authors sql.NullInt64
+		)
+		err := rows.Scan(&day, &messages, &authors)
+		if err != nil {
+			return results, err
+		} else {
+			results = append(results, &MESSAGE_VOLUME{Day: day.Time, Messages: messages.Int64, Authors: authors.Int64})
+		}
+	}
+
+	return results, nil
+}
+
+// Return the open sessions across all persons, newest first
+func LookupSessionActivity(stmt *sql.Stmt, limit int64) ([]*SESSION_ACTIVITY, error) {
+	results := make([]*SESSION_ACTIVITY, 0)
+
+	rows, err := stmt.Query(limit)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id, person_id, email                      sql.NullString
+			verified                                  sql.NullBool
+			date_created, date_verified, date_expires pq.NullTime
+		)
+		err := rows.Scan(&id, &person_id, &email, &date_created, &verified, &date_verified, &date_expires)
+		if err != nil {
+			return results, err
+		} else {
+			session := new(SESSION)
+			session.Id = id.String
+			session.PersonId = person_id.String
+			session.DateCreated = date_created.Time
+			session.Verified = verified.Bool
+			session.DateVerified = date_verified.Time
+			session.DateExpires = date_expires.Time
+			results = append(results, &SESSION_ACTIVITY{SESSION: session, Email: email.String})
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,167 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+const (
+	// api token a/u/d
+	API_TOKEN_INSERT  = "insert into api_token (person_id, name, token_hash, scopes, date_expires) values ($1, $2, $3, $4, $5) returning id, date_created"
+	API_TOKEN_USED    = "update api_token set date_last_used = (now() at time zone 'UTC') where id = $1"
+	API_TOKEN_DELETE  = "delete from api_token where id = $1 and person_id = $2"
+	API_TOKEN_CLEANUP = "delete from api_token where date_expires <= (now() at time zone 'UTC')"
+
+	// api token lookup
+	API_TOKEN_LOOKUP_BY_HASH   = "select id, person_id, name, scopes, date_created, date_last_used, date_expires from api_token where token_hash = $1 and (date_expires is null or date_expires > (now() at time zone 'UTC'))"
+	API_TOKEN_LOOKUP_BY_PERSON = "select id, person_id, name, scopes, date_created, date_last_used, date_expires from api_token where person_id = $1 order by date_created desc"
+
+	// the plaintext token is this prefix (so that leaked tokens are easy to
+	// recognize) followed by this many random bytes
+	API_TOKEN_PREFIX = "tw_"
+	API_TOKEN_BYTES  = 32
+)
+
+// A long-lived credential for the json api, limited to its scopes; only a
+// hash of the token itself is stored (DateLastUsed and DateExpires are nil
+// for a token which was never used, or never expires)
+type API_TOKEN struct {
+	Id           string     `json:"id"`
+	PersonId     string     `json:"person_id"`
+	Name         string     `json:"name"`
+	Scopes       []string   `json:"scopes"`
+	DateCreated  time.Time  `json:"date_created"`
+	DateLastUsed *time.Time `json:"date_last_used,omitempty"`
+	DateExpires  *time.Time `json:"date_expires,omitempty"`
+}
+
+// Generate a new random plaintext token
+func GenerateAPIToken() (string, error) {
+	b := make([]byte, API_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return API_TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// The stored form of the plaintext token
+func HashAPIToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// Store this token (for the given plaintext) for its person, with no
+// expiration if DateExpires is nil
+func (t *API_TOKEN) Add(stmt *sql.Stmt, token string) (string, error) {
+	var (
+		id           sql.NullString
+		date_created pq.NullTime
+		expires      interface{}
+	)
+
+	if t.DateExpires != nil {
+		expires = t.DateExpires.UTC()
+	}
+
+	err := stmt.QueryRow(t.PersonId, t.Name, HashAPIToken(token), strings.Join(t.Scopes, ","), expires).Scan(&id, &date_created)
+	t.DateCreated = date_created.Time
+
+	return id.String, err
+}
+
+// Record that the token has just been used
+func (t *API_TOKEN) Touch(stmt *sql.Stmt) error {
+	_, err := stmt.Exec(t.Id)
+
+	return err
+}
+
+// Revoke this token, provided it belongs to the given person
+func (t *API_TOKEN) Delete(stmt *sql.Stmt, personId string) error {
+	_, err := stmt.Exec(t.Id, personId)
+
+	return err
+}
+
+// Is this token allowed to act within the given scope?
+func (t *API_TOKEN) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the unexpired token matching this plaintext
+func LookupAPIToken(stmt *sql.Stmt, token string) (*API_TOKEN, error) {
+	result := new(API_TOKEN)
+
+	tokens, err := retrieveAPITokens(stmt, HashAPIToken(token))
+	if err != nil || len(tokens) == 0 {
+		return result, err
+	}
+
+	return tokens[0], nil
+}
+
+// Return all of this person's tokens, including any that have expired
+func (p *PERSON) LookupAPITokens(stmt *sql.Stmt) ([]*API_TOKEN, error) {
+	return retrieveAPITokens(stmt, p.Id)
+}
+
+func retrieveAPITokens(stmt *sql.Stmt, param string) ([]*API_TOKEN, error) {
+	results := make([]*API_TOKEN, 0)
+
+	rows, err := stmt.Query(param)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id, person_id, name, scopes                sql.NullString
+			date_created, date_last_used, date_expires pq.NullTime
+		)
+		err := rows.Scan(&id, &person_id, &name, &scopes, &date_created, &date_last_used, &date_expires)
+		if err != nil {
+			return results, err
+		} else {
+			result := new(API_TOKEN)
+			result.Id = id.String
+			result.PersonId = person_id.String
+			result.Name = name.String
+			result.Scopes = strings.Split(scopes.String, ",")
+			result.DateCreated = date_created.Time
+			result.DateLastUsed = optionalTime(date_last_used)
+			result.DateExpires = optionalTime(date_expires)
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// The time, or nil if it is null
+func optionalTime(t pq.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Remove the tokens which have expired
+func CleanupAPITokens(stmt *sql.Stmt) error {
+	_, err := stmt.Exec()
+
+	return err
+}
@@ -0,0 +1,240 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	// audit event a (the table is append-only: a trigger refuses updates
+	// and deletes, and each event is chained to the one before it by hash)
+	AUDIT_INSERT = `insert into audit_event (actor_id, action, target, detail, ip_address, user_agent, date_created, prev_hash, hash)
+ values (nullif($1, '')::uuid, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	AUDIT_LATEST = "select hash from audit_event where hash is not null order by seq desc limit 1"
+
+	// audit event lookup, newest first
+	AUDIT_LOOKUP = `select a.id, coalesce(a.actor_id::text, ''), coalesce(p.email, ''), a.action, a.target, a.detail, a.ip_address, a.user_agent, a.date_created
+ from audit_event a left join person p on a.actor_id = p.id
+ order by a.seq desc limit $1 offset $2`
+
+	// the whole chain, oldest first, for verification
+	AUDIT_CHAIN = `select id, seq, coalesce(actor_id::text, ''), action, target, detail, ip_address, user_agent, date_created, prev_hash, hash
+ from audit_event order by seq`
+
+	// concurrent events can race for the same previous hash, in which case
+	// all but one are retried
+	AUDIT_RETRIES = 5
+
+	// sessions
+	AUDIT_SESSION_CREATE  = "session.create"
+	AUDIT_SESSION_VERIFY  = "session.verify"
+	AUDIT_SESSIONS_REVOKE = "sessions.revoke"
+
+	// public keys
+	AUDIT_KEY_ADD    = "key.add"
+	AUDIT_KEY_DELETE = "key.delete"
+
+	// persons
+	AUDIT_PERSON_ENABLE  = "person.enable"
+	AUDIT_PERSON_DISABLE = "person.disable"
+	AUDIT_PERSON_ROLE    = "person.role"
+
+	// messages
+	AUDIT_MESSAGE_POST   = "message.post"
+	AUDIT_MESSAGE_DELETE = "message.delete"
+	AUDIT_MESSAGES_PURGE = "messages.purge"
+
+	// api tokens
+	AUDIT_TOKEN_CREATE = "token.create"
+	AUDIT_TOKEN_DELETE = "token.delete"
+)
+
+type AUDIT_EVENT struct {
+	Id          string    `json:"id"`
+	ActorId     string    `json:"actor_id"`    // empty when nobody was logged in, or for operator tools
+	ActorEmail  string    `json:"actor_email"` // only filled in by lookups
+	Action      string    `json:"action"`
+	Target      string    `json:"target"`
+	Detail      string    `json:"detail"`
+	IPAddress   string    `json:"ip_address"`
+	UserAgent   string    `json:"user_agent"`
+	DateCreated time.Time `json:"date_created"`
+	PrevHash    string    `json:"prev_hash"`
+	Hash        string    `json:"hash"`
+}
+
+// The result of checking the whole audit chain: if it is not valid,
+// FailedAt is the sequence number of the first event which does not match
+type AUDIT_VERIFICATION struct {
+	Events    int64
+	Unchained int64 // recorded before the chain existed
+	Head      string
+	Valid     bool
+	FailedAt  int64
+	Reason    string
+	FoundHead bool // the expected head (if any) is part of the chain
+}
+
+// The hash which chains this event to the previous one: sha256 over the
+// previous hash and every recorded field
+func (a *AUDIT_EVENT) ComputeHash() string {
+	fields, _ := json.Marshal([]string{a.PrevHash,
+		a.ActorId,
+		a.Action,
+		a.Target,
+		a.Detail,
+		a.IPAddress,
+		a.UserAgent,
+		a.DateCreated.UTC().Format(time.RFC3339Nano)})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// Append this event to the end of the chain
+func (a *AUDIT_EVENT) Add(latestStmt, insertStmt *sql.Stmt) (string, error) {
+	var err error
+	for attempt := 0; attempt < AUDIT_RETRIES; attempt++ {
+		var prev sql.NullString
+		err = latestStmt.QueryRow().Scan(&prev)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+
+		// postgres keeps microseconds, which is what the verifier will see
+		a.PrevHash = prev.String
+		a.DateCreated = time.Now().UTC().Truncate(time.Microsecond)
+		a.Hash = a.ComputeHash()
+
+		var id sql.NullString
+		err = insertStmt.QueryRow(a.ActorId, a.Action, a.Target, a.Detail, a.IPAddress, a.UserAgent, a.DateCreated, a.PrevHash, a.Hash).Scan(&id)
+		if err == nil {
+			a.Id = id.String
+			return a.Id, nil
+		}
+
+		// another event took this place in the chain (prev_hash is unique)
+		if pqErr, isPqErr := err.(*pq.Error); !isPqErr || pqErr.Code != "23505" {
+			return "", err
+		}
+	}
+
+	return "", err
+}
+
+// Return the latest audit events, newest first
+func LookupAuditEvents(stmt *sql.Stmt, limit, offset int64) ([]*AUDIT_EVENT, error) {
+	results := make([]*AUDIT_EVENT, 0)
+
+	rows, err := stmt.Query(limit, offset)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id, actor_id, actor_email, action, target, detail, ip_address, user_agent sql.NullString
+			date_created                                                              pq.NullTime
+		)
+		err := rows.Scan(&id, &actor_id, &actor_email, &action, &target, &detail, &ip_address, &user_agent, &date_created)
+		if err != nil {
+			return results, err
+		} else {
+			result := new(AUDIT_EVENT)
+			result.Id = id.String
+			result.ActorId = actor_id.String
+			result.ActorEmail = actor_email.String
+			result.Action = action.String
+			result.Target = target.String
+			result.Detail = detail.String
+			result.IPAddress = ip_address.String
+			result.UserAgent = user_agent.String
+			result.DateCreated = date_created.Time
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// Walk the whole audit chain, oldest first, recomputing each event's hash
+// and checking its link to the previous one; expectedHead, if not empty, is
+// a head hash recorded earlier (e.g., by an operator), which must still be
+// part of the chain, since truncating the newest events leaves a valid
+// (but shorter) chain
+func VerifyAuditChain(stmt *sql.Stmt, expectedHead string) (*AUDIT_VERIFICATION, error) {
+	result := &AUDIT_VERIFICATION{Valid: true}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id, actor_id, action, target, detail, ip_address, user_agent, prev_hash, hash sql.NullString
+			seq                                                                           sql.NullInt64
+			date_created                                                                  pq.NullTime
+		)
+		err := rows.Scan(&id, &seq, &actor_id, &action, &target, &detail, &ip_address, &user_agent, &date_created, &prev_hash, &hash)
+		if err != nil {
+			return result, err
+		}
+		result.Events++
+
+		if !hash.Valid {
+			// events from before the chain can only come first
+			if len(result.Head) > 0 {
+				result.fail(seq.Int64, "unchained event after the start of the chain")
+				return result, nil
+			}
+			result.Unchained++
+			continue
+		}
+
+		event := &AUDIT_EVENT{ActorId: actor_id.String,
+			Action:      action.String,
+			Target:      target.String,
+			Detail:      detail.String,
+			IPAddress:   ip_address.String,
+			UserAgent:   user_agent.String,
+			DateCreated: date_created.Time,
+			PrevHash:    prev_hash.String}
+
+		if event.PrevHash != result.Head {
+			result.fail(seq.Int64, "previous hash does not match (an event was removed or reordered)")
+			return result, nil
+		}
+		if event.ComputeHash() != hash.String {
+			result.fail(seq.Int64, fmt.Sprintf("hash does not match the contents of event %s (it was modified)", id.String))
+			return result, nil
+		}
+
+		result.Head = hash.String
+		if hash.String == expectedHead {
+			result.FoundHead = true
+		}
+	}
+
+	if len(expectedHead) > 0 && !result.FoundHead {
+		result.Valid = false
+		result.Reason = "the expected head is not part of the chain (events were removed)"
+	}
+
+	return result, rows.Err()
+}
+
+func (v *AUDIT_VERIFICATION) fail(seq int64, reason string) {
+	v.Valid = false
+	v.FailedAt = seq
+	v.Reason = reason
+}
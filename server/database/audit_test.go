@@ -0,0 +1,128 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+// A chain of audit events, as AUDIT_CHAIN returns them
+func auditChain(n int) [][]driver.Value {
+	rows := make([][]driver.Value, 0)
+	prev := ""
+	for i := 1; i <= n; i++ {
+		event := &AUDIT_EVENT{ActorId: "11111111-1111-1111-1111-111111111111",
+			Action:      AUDIT_KEY_ADD,
+			Target:      fmt.Sprintf("key-%d", i),
+			Detail:      "dev@example.org laptop",
+			IPAddress:   "192.0.2.7",
+			UserAgent:   "test",
+			DateCreated: time.Date(2026, 10, 19, 12, i, 0, 123456000, time.UTC),
+			PrevHash:    prev}
+		event.Hash = event.ComputeHash()
+		rows = append(rows, []driver.Value{fmt.Sprintf("event-%d", i), int64(i), event.ActorId, event.Action, event.Target, event.Detail, event.IPAddress, event.UserAgent, event.DateCreated, event.PrevHash, event.Hash})
+		prev = event.Hash
+	}
+	return rows
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	stmt := fakeStatements(t)[AUDIT_CHAIN]
+	intact := auditChain(5)
+	head := intact[4][10].(string)
+
+	tests := []struct {
+		name     string
+		rows     func([][]driver.Value) [][]driver.Value
+		head     string
+		valid    bool
+		failedAt int64
+	}{
+		{"intact", func(rows [][]driver.Value) [][]driver.Value { return rows }, "", true, 0},
+		{"intact, with the expected head", func(rows [][]driver.Value) [][]driver.Value { return rows }, head, true, 0},
+		{"intact, with an earlier head", func(rows [][]driver.Value) [][]driver.Value { return rows }, intact[2][10].(string), true, 0},
+		{"edited", func(rows [][]driver.Value) [][]driver.Value {
+			rows[2][5] = "someone else's laptop"
+			return rows
+		}, "", false, 3},
+		{"edited, with its hash recomputed", func(rows [][]driver.Value) [][]driver.Value {
+			rows[2][3] = AUDIT_KEY_DELETE
+			event := &AUDIT_EVENT{ActorId: rows[2][2].(string), Action: AUDIT_KEY_DELETE, Target: rows[2][4].(string), Detail: rows[2][5].(string), IPAddress: rows[2][6].(string), UserAgent: rows[2][7].(string), DateCreated: rows[2][8].(time.Time), PrevHash: rows[2][9].(string)}
+			rows[2][10] = event.ComputeHash()
+			return rows
+		}, "", false, 4},
+		{"deleted", func(rows [][]driver.Value) [][]driver.Value {
+			return append(rows[:2], rows[3:]...)
+		}, "", false, 4},
+		{"reordered", func(rows [][]driver.Value) [][]driver.Value {
+			rows[1], rows[2] = rows[2], rows[1]
+			return rows
+		}, "", false, 3},
+		{"truncated", func(rows [][]driver.Value) [][]driver.Value { return rows[:4] }, head, false, 0},
+		{"unchained events first", func(rows [][]driver.Value) [][]driver.Value {
+			old := []driver.Value{"event-0", int64(0), "", AUDIT_SESSION_CREATE, "", "", "", "", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), nil, nil}
+			return append([][]driver.Value{old}, rows...)
+		}, "", true, 0},
+		{"unchained event inserted later", func(rows [][]driver.Value) [][]driver.Value {
+			forged := []driver.Value{"event-9", int64(9), "", AUDIT_SESSION_CREATE, "", "", "", "", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), nil, nil}
+			return append(rows, forged)
+		}, "", false, 9},
+	}
+
+	for _, test := range tests {
+		currentResults = fakeResults{AUDIT_CHAIN: test.rows(auditChain(5))}
+		v, err := VerifyAuditChain(stmt, test.head)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if v.Valid != test.valid || v.FailedAt != test.failedAt {
+			t.Errorf("%s: valid %v at %d (%s), expected %v at %d", test.name, v.Valid, v.FailedAt, v.Reason, test.valid, test.failedAt)
+		}
+		if test.valid && v.Head != head {
+			t.Errorf("%s: head %s, expected %s", test.name, v.Head, head)
+		}
+	}
+}
+
+func TestAddAuditEvent(t *testing.T) {
+	statements := fakeStatements(t)
+	latest := auditChain(1)[0][10].(string)
+	currentResults = fakeResults{AUDIT_LATEST: {{latest}}, AUDIT_INSERT: {{"event-2"}}}
+
+	// another event took the place in the chain, twice, before this one
+	taken := &pq.Error{Code: "23505"}
+	currentErrors = map[string][]error{AUDIT_INSERT: {taken, taken}}
+	event := &AUDIT_EVENT{Action: AUDIT_KEY_DELETE, Target: "key-1", UserAgent: "test"}
+	id, err := event.Add(statements[AUDIT_LATEST], statements[AUDIT_INSERT])
+	if err != nil || id != "event-2" {
+		t.Fatalf("Add() = %q, %v", id, err)
+	}
+
+	// the event is chained to the latest one, by a hash of what was stored
+	args := currentArgs[AUDIT_INSERT]
+	if event.PrevHash != latest || args[7] != latest || args[8] != event.Hash || event.Hash != event.ComputeHash() {
+		t.Errorf("unexpected chaining %+v, inserted with %v", event, args)
+	}
+	if stored := args[6].(time.Time); !stored.Equal(event.DateCreated) || stored.Nanosecond()%1000 != 0 {
+		t.Errorf("the date %v is not stored to the microsecond", stored)
+	}
+
+	// other errors are not retried, and the chain cannot be won forever
+	for _, errs := range [][]error{{errors.New("connection reset")}, {taken, taken, taken, taken, taken}} {
+		currentErrors = map[string][]error{AUDIT_INSERT: errs}
+		if _, err := event.Add(statements[AUDIT_LATEST], statements[AUDIT_INSERT]); err == nil {
+			t.Errorf("no error after %v", errs)
+		}
+		if len(currentErrors[AUDIT_INSERT]) != 0 {
+			t.Errorf("%d errors left after %v", len(currentErrors[AUDIT_INSERT]), errs)
+		}
+	}
+	currentErrors = map[string][]error{}
+}
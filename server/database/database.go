@@ -4,75 +4,282 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
 	"log"
+	"sort"
+	"strings"
+	"time"
 )
 
+const (
+	// the libpq sslmode values, from least to most secure
+	SSL_DISABLE     = "disable"
+	SSL_ALLOW       = "allow"
+	SSL_PREFER      = "prefer"
+	SSL_REQUIRE     = "require"
+	SSL_VERIFY_CA   = "verify-ca"
+	SSL_VERIFY_FULL = "verify-full"
+
+	INVALID_SSL_MODE = "The database sslmode must be one of disable, allow, prefer, require, verify-ca or verify-full"
+	INVALID_PORT     = "The database port must be between 1 and 65535"
+	INCOMPLETE_CERT  = "The database client certificate needs its key, and the key its certificate"
+)
+
+// How to connect to the database: either a complete DSN (a libpq key=value
+// connection string, or a postgres:// url), or the settings to build one
+// from (any left empty use the libpq defaults, e.g., localhost:5432)
 type DBConnection struct {
-	DBName  string
-	User    string
-	Pass    string
-	SSLMode bool
+	DBName         string
+	User           string
+	Pass           string
+	Host           string // name, IP address, or folder of the unix socket
+	Port           int
+	SSLMode        string
+	SSLRootCert    string // the CA certificate(s), for verify-ca and verify-full
+	SSLCert        string // the client certificate and its key, if the
+	SSLKey         string // server asks for one
+	ConnectTimeout time.Duration
+	DSN            string
+}
+
+// The sslmode for the older on/off setting
+func SSLModeFromBool(useSSL bool) string {
+	if useSSL {
+		return SSL_REQUIRE
+	}
+	return SSL_DISABLE
+}
+
+// Check the settings which libpq would only reject when connecting
+func (c DBConnection) Validate() error {
+	if len(c.DSN) > 0 {
+		return nil
+	}
+	switch c.SSLMode {
+	case "", SSL_DISABLE, SSL_ALLOW, SSL_PREFER, SSL_REQUIRE, SSL_VERIFY_CA, SSL_VERIFY_FULL:
+	default:
+		return errors.New(INVALID_SSL_MODE)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return errors.New(INVALID_PORT)
+	}
+	if (len(c.SSLCert) == 0) != (len(c.SSLKey) == 0) {
+		return errors.New(INCOMPLETE_CERT)
+	}
+	return nil
+}
+
+// Quote a connection string value, if it needs it
+func dsnValue(value string) string {
+	if len(value) > 0 && !strings.ContainsAny(value, " \t\n\\'") {
+		return value
+	}
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(value) + "'"
+}
+
+// The connection string for these settings (the DSN, if given)
+func (c DBConnection) DataSourceName() string {
+	if len(c.DSN) > 0 {
+		return c.DSN
+	}
+
+	type setting struct{ key, value string }
+	settings := []setting{{"host", c.Host},
+		{"user", c.User},
+		{"dbname", c.DBName},
+		{"password", c.Pass},
+		{"sslmode", c.SSLMode},
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey}}
+	if c.Port > 0 {
+		settings = append(settings, setting{"port", fmt.Sprintf("%d", c.Port)})
+	}
+	if c.ConnectTimeout > 0 {
+		// libpq counts whole seconds (and 0 means forever)
+		seconds := (c.ConnectTimeout + time.Second - 1) / time.Second
+		settings = append(settings, setting{"connect_timeout", fmt.Sprintf("%d", seconds)})
+	}
+
+	pairs := make([]string, 0)
+	for _, s := range settings {
+		if len(s.value) > 0 {
+			pairs = append(pairs, s.key+"="+dsnValue(s.value))
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+var (
+	// every statement used by the server and its tools, prepared on each
+	// connection, with the name its timings are recorded under
+	StatementNames = map[string]string{
+		PERSON_INSERT:                    "person_insert",
+		PERSON_UPDATE:                    "person_update",
+		PERSON_DELETE:                    "person_delete",
+		PERSON_ENABLE:                    "person_enable",
+		PERSON_ROLE:                      "person_role",
+		PERSON_LOOKUP_BY_ID:              "person_lookup_by_id",
+		PERSON_LOOKUP_BY_EMAIL:           "person_lookup_by_email",
+		PERSON_SEARCH:                    "person_search",
+		SESSION_INSERT:                   "session_insert",
+		SESSION_INSERT_CHALLENGE:         "session_insert_challenge",
+		SESSION_UPDATE:                   "session_update",
+		SESSION_CLEANUP:                  "session_cleanup",
+		SESSION_DELETE:                   "session_delete",
+		SESSION_DELETE_BY_PERSON:         "session_delete_by_person",
+		SESSION_FAILED_ATTEMPT:           "session_failed_attempt",
+		SESSION_INVALIDATE:               "session_invalidate",
+		SESSION_LOOKUP_CODES_BY_PERSON:   "session_lookup_codes_by_person",
+		SESSION_LOOKUP_BY_CHALLENGE:      "session_lookup_by_challenge",
+		SESSION_LOOKUP_BY_ID:             "session_lookup_by_id",
+		SESSION_LOOKUP_BY_PERSON:         "session_lookup_by_person",
+		PK_INSERT:                        "pk_insert",
+		PK_UPDATE:                        "pk_update",
+		PK_DELETE:                        "pk_delete",
+		PK_LOOKUP:                        "pk_lookup",
+		PK_LOOKUP_BY_ID:                  "pk_lookup_by_id",
+		MESSAGE_INSERT:                   "message_insert",
+		MESSAGE_DELETE:                   "message_delete",
+		MESSAGE_CLEANUP:                  "message_cleanup",
+		MESSAGE_PURGE:                    "message_purge",
+		RECIPIENT_INSERT:                 "recipient_insert",
+		RECIPIENT_DELETE:                 "recipient_delete",
+		RECIPIENT_CLEANUP:                "recipient_cleanup",
+		MESSAGES_BY_AUTHOR:               "messages_by_author",
+		MESSAGES_BY_RECIPIENT:            "messages_by_recipient",
+		LATEST_MESSAGES:                  "latest_messages",
+		LATEST_MESSAGES_OLDER:            "latest_messages_older",
+		LATEST_MESSAGES_NEWER:            "latest_messages_newer",
+		LATEST_MESSAGES_INVOLVING_PERSON: "latest_messages_involving_person",
+		MESSAGES_BY_AUTHOR_OLDER:         "messages_by_author_older",
+		MESSAGES_BY_AUTHOR_NEWER:         "messages_by_author_newer",
+		MESSAGES_BY_RECIPIENT_OLDER:      "messages_by_recipient_older",
+		MESSAGES_BY_RECIPIENT_NEWER:      "messages_by_recipient_newer",
+		MESSAGES_INVOLVING_PERSON_OLDER:  "messages_involving_person_older",
+		MESSAGES_INVOLVING_PERSON_NEWER:  "messages_involving_person_newer",
+		MESSAGE_BY_ID:                    "message_by_id",
+		RECIPIENTS_BY_MESSAGE:            "recipients_by_message",
+		RATE_LIMIT_TAKE:                  "rate_limit_take",
+		RATE_LIMIT_CLEANUP:               "rate_limit_cleanup",
+		API_TOKEN_INSERT:                 "api_token_insert",
+		API_TOKEN_USED:                   "api_token_used",
+		API_TOKEN_DELETE:                 "api_token_delete",
+		API_TOKEN_CLEANUP:                "api_token_cleanup",
+		API_TOKEN_LOOKUP_BY_HASH:         "api_token_lookup_by_hash",
+		API_TOKEN_LOOKUP_BY_PERSON:       "api_token_lookup_by_person",
+		INSTANCE_STATISTICS:              "instance_statistics",
+		ADMIN_PERSONS:                    "admin_persons",
+		ADMIN_MESSAGE_VOLUME:             "admin_message_volume",
+		ADMIN_SESSIONS:                   "admin_sessions",
+		AUDIT_INSERT:                     "audit_insert",
+		AUDIT_LATEST:                     "audit_latest",
+		AUDIT_LOOKUP:                     "audit_lookup",
+		AUDIT_CHAIN:                      "audit_chain",
+		KEY_LOG_INSERT:                   "key_log_insert",
+		KEY_LOG_LEAVES:                   "key_log_leaves",
+		KEY_LOG_BY_KEY:                   "key_log_by_key",
+		KEY_LOG_ENTRIES:                  "key_log_entries"}
+
+	PreparedStatements = preparedStatements()
+)
+
+// The statements to prepare, in the order of their names
+func preparedStatements() []string {
+	statements := make([]string, 0)
+	for statement := range StatementNames {
+		statements = append(statements, statement)
+	}
+	sort.Slice(statements, func(i, j int) bool {
+		return StatementNames[statements[i]] < StatementNames[statements[j]]
+	})
+	return statements
+}
+
+// Check that the database accepts connections, within the timeout
+func Ping(dbCoords DBConnection, timeout time.Duration) error {
+	db, err := sql.Open(TIMED_DRIVER, dbCoords.DataSourceName())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return db.PingContext(ctx)
 }
 
 // Connect to the database with the given coordinates, and invoke the
 // function, which gets passed a map of all the prepared statements
 func WithDatabase(dbCoords DBConnection, fn func(map[string]*sql.Stmt)) {
-	preparedStatements := []string{PERSON_INSERT,
-		PERSON_UPDATE,
-		PERSON_DELETE,
-		PERSON_LOOKUP_BY_ID,
-		PERSON_LOOKUP_BY_EMAIL,
-		SESSION_INSERT,
-		SESSION_UPDATE,
-		SESSION_CLEANUP,
-		SESSION_LOOKUP_BY_CODE,
-		SESSION_LOOKUP_BY_ID,
-		SESSION_LOOKUP_BY_PERSON,
-		PK_INSERT,
-		PK_UPDATE,
-		PK_DELETE,
-		PK_LOOKUP,
-		MESSAGE_INSERT,
-		MESSAGE_DELETE,
-		MESSAGE_CLEANUP,
-		RECIPIENT_INSERT,
-		RECIPIENT_DELETE,
-		RECIPIENT_CLEANUP,
-		MESSAGES_BY_AUTHOR,
-		MESSAGES_BY_RECIPIENT,
-		LATEST_MESSAGES,
-		LATEST_MESSAGES_INVOLVING_PERSON,
-		MESSAGE_BY_ID,
-		RECIPIENTS_BY_MESSAGE}
-
-	sslMode := "disable"
-	if dbCoords.SSLMode {
-		sslMode = "enable"
-	}
-
-	db, dbErr := sql.Open("postgres",
-		fmt.Sprintf("user=%s dbname=%s password=%s sslmode=%s",
-			dbCoords.User,
-			dbCoords.DBName,
-			dbCoords.Pass,
-			sslMode))
-	if dbErr != nil {
-		log.Fatal(dbErr)
+	WithDatabaseContext(context.Background(), dbCoords, fn)
+}
+
+// Like WithDatabase, tracing the statements' queries as children of the
+// span in ctx (e.g., the request's)
+func WithDatabaseContext(ctx context.Context, dbCoords DBConnection, fn func(map[string]*sql.Stmt)) {
+	if err := TryWithDatabase(ctx, dbCoords, fn); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Like WithDatabaseContext, but return any connection error instead of
+// exiting (without invoking the function), e.g., for requests, which answer
+// 503, or background work which can try again later
+func TryWithDatabase(ctx context.Context, dbCoords DBConnection, fn func(map[string]*sql.Stmt)) error {
+	db := sql.OpenDB(timedConnector{dbCoords.DataSourceName(), ctx})
+	defer db.Close()
+
+	statements, err := prepareStatements(db)
+	if err != nil {
+		return err
 	}
+
+	fn(statements)
+	return nil
+}
+
+// Like TryWithDatabase, but with the statements bound to one transaction,
+// which is committed if the function succeeds, and rolled back if it
+// returns an error (e.g., so that a change and its log entries are made
+// together, or not at all)
+func TransactWithDatabase(ctx context.Context, dbCoords DBConnection, fn func(map[string]*sql.Stmt) error) error {
+	db := sql.OpenDB(timedConnector{dbCoords.DataSourceName(), ctx})
 	defer db.Close()
 
+	statements, err := prepareStatements(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for p, stmt := range statements {
+		statements[p] = tx.StmtContext(ctx, stmt)
+	}
+
+	if err := fn(statements); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Prepare every statement on this connection pool
+func prepareStatements(db *sql.DB) (map[string]*sql.Stmt, error) {
 	statements := map[string]*sql.Stmt{}
-	for _, p := range preparedStatements {
+	for _, p := range PreparedStatements {
 		stmt, err := db.Prepare(p)
 		if err != nil {
-			log.Fatal(err)
-		} else {
-			statements[p] = stmt
+			return statements, err
 		}
+		statements[p] = stmt
 	}
-
-	fn(statements)
+	return statements, nil
 }
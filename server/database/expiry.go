@@ -0,0 +1,84 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/metrics"
+	"github.com/Banrai/TeamWork.io/server/tracing"
+	"time"
+)
+
+var (
+	ExpiryRuns      = metrics.NewCounter("expiry_runs_total", "Runs of the worker which removes expired messages and sessions, by outcome (ok or failed)", "outcome")
+	ExpiryDuration  = metrics.NewHistogram("expiry_run_duration_seconds", "How long each run of the expiry worker took")
+	MessagesExpired = metrics.NewCounter("messages_expired_total", "Expired messages removed by the expiry worker")
+)
+
+// Invoke the function with the prepared statements, or return why they
+// could not be prepared (as TryWithDatabase does)
+type StatementTrier func(context.Context, func(map[string]*sql.Stmt)) error
+
+// Remove the expired messages (with their recipient lists) and sessions
+func RemoveExpired(stmt map[string]*sql.Stmt) error {
+	start := time.Now()
+	defer ExpiryDuration.Since(start)
+
+	removed, err := CleanupMessages(stmt[MESSAGE_CLEANUP], stmt[MESSAGE_DELETE], stmt[RECIPIENT_CLEANUP])
+	MessagesExpired.Add(float64(removed))
+	if err == nil {
+		err = CleanupSessions(stmt[SESSION_CLEANUP])
+	}
+	return err
+}
+
+// One traced run of the expiry worker, recording its outcome
+func runExpiry(try StatementTrier) error {
+	var err error
+	ctx, span := tracing.Start(context.Background(), "remove expired", tracing.KIND_INTERNAL)
+	defer span.End()
+
+	dbErr := try(ctx, func(stmt map[string]*sql.Stmt) {
+		err = RemoveExpired(stmt)
+	})
+	if dbErr != nil {
+		err = dbErr
+	}
+
+	if err != nil {
+		ExpiryRuns.Inc("failed")
+		logging.Error("Cannot remove expired messages and sessions", "error", err)
+	} else {
+		ExpiryRuns.Inc("ok")
+	}
+	span.Fail(err)
+	return err
+}
+
+// Remove the expired messages and sessions now, and then at every interval,
+// until the returned function is called (or for as long as the server runs)
+func StartExpiryWorker(dbCoords DBConnection, interval time.Duration) (stop func()) {
+	return startExpiryWorker(func(ctx context.Context, fn func(map[string]*sql.Stmt)) error {
+		return TryWithDatabase(ctx, dbCoords, fn)
+	}, interval)
+}
+
+func startExpiryWorker(try StatementTrier, interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runExpiry(try)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,145 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// A database/sql driver which answers each prepared statement with canned
+// rows (as in the api tests), so that statements can run without PostgreSQL
+
+type fakeResults map[string][][]driver.Value
+
+var (
+	currentResults fakeResults
+
+	// the arguments each statement was last queried with
+	currentArgs = map[string][]driver.Value{}
+
+	// errors returned by the next queries of each statement, in turn
+	currentErrors = map[string][]error{}
+)
+
+type fakeDriver struct{}
+
+type fakeConn struct{}
+
+type fakeStmt struct {
+	query string
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return &fakeConn{}, nil }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{query: query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	currentArgs[s.query] = args
+	if errs := currentErrors[s.query]; len(errs) > 0 {
+		currentErrors[s.query] = errs[1:]
+		return nil, errs[0]
+	}
+	return &fakeRows{rows: currentResults[s.query]}, nil
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{}
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+func init() {
+	sql.Register("teamwork-fake", fakeDriver{})
+}
+
+// Every statement, prepared on the fake driver
+func fakeStatements(t *testing.T) map[string]*sql.Stmt {
+	db, err := sql.Open("teamwork-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statements := map[string]*sql.Stmt{}
+	for _, p := range PreparedStatements {
+		stmt, err := db.Prepare(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		statements[p] = stmt
+	}
+	return statements
+}
+
+// Invoke functions with the statements prepared on the fake driver
+func fakeTrier(t *testing.T) StatementTrier {
+	statements := fakeStatements(t)
+	return func(ctx context.Context, fn func(map[string]*sql.Stmt)) error {
+		fn(statements)
+		return nil
+	}
+}
+
+// Wait (up to a second) for the counter to reach this value
+func waitFor(t *testing.T, what string, value func() float64, expected float64) {
+	deadline := time.Now().Add(time.Second)
+	for value() < expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %v, expected %v", what, value(), expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestExpiryWorker(t *testing.T) {
+	currentResults = fakeResults{MESSAGE_CLEANUP: {{"44444444-4444-4444-4444-444444444444"}}}
+	ok, removed := ExpiryRuns.Value("ok"), MessagesExpired.Value()
+
+	// it runs at once, and then again at every interval
+	stop := startExpiryWorker(fakeTrier(t), 5*time.Millisecond)
+	waitFor(t, "expiry_runs_total{outcome=\"ok\"}", func() float64 { return ExpiryRuns.Value("ok") }, ok+2)
+	stop()
+	if MessagesExpired.Value() < removed+2 {
+		t.Errorf("%v messages expired, expected at least 2", MessagesExpired.Value()-removed)
+	}
+
+	// a run which cannot reach the database is recorded as failed
+	failed := ExpiryRuns.Value("failed")
+	unreachable := func(ctx context.Context, fn func(map[string]*sql.Stmt)) error {
+		return errors.New("connection refused")
+	}
+	if err := runExpiry(unreachable); err == nil {
+		t.Error("expected the connection error")
+	}
+	if ExpiryRuns.Value("failed") != failed+1 {
+		t.Errorf("expiry_runs_total{outcome=\"failed\"} is %v, expected %v", ExpiryRuns.Value("failed"), failed+1)
+	}
+}
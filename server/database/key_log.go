@@ -0,0 +1,150 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"github.com/lib/pq"
+)
+
+const (
+	// key log entries (the table is append-only, and each entry takes the next
+	// leaf index, so the merkle tree has no gaps)
+	KEY_LOG_INSERT = `insert into key_log (leaf_index, action, email, key_id, key_hash, date_logged, leaf_hash)
+ values ((select coalesce(max(leaf_index) + 1, 0) from key_log), $1, $2, $3, $4, $5, $6) returning leaf_index`
+
+	// key log lookups
+	KEY_LOG_LEAVES  = "select leaf_index, leaf_hash from key_log where leaf_index >= $1 order by leaf_index"
+	KEY_LOG_BY_KEY  = "select leaf_index, action, email, key_id, key_hash, date_logged from key_log where key_id = $1 order by leaf_index desc limit 1"
+	KEY_LOG_ENTRIES = "select leaf_index, action, email, key_id, key_hash, date_logged from key_log where leaf_index >= $1 and leaf_index < $2 order by leaf_index"
+
+	// concurrent entries can race for the same leaf index, in which case
+	// all but one are retried
+	KEY_LOG_RETRIES = 5
+)
+
+// One entry of the key transparency log, at its position in the tree
+type KEY_LOG_ENTRY struct {
+	LeafIndex int64 `json:"leaf_index"`
+	*transparency.KeyEntry
+}
+
+// Append this entry to the end of the log
+func (e *KEY_LOG_ENTRY) Add(stmt *sql.Stmt) (int64, error) {
+	leafHash := hex.EncodeToString(e.LeafHash())
+
+	var err error
+	for attempt := 0; attempt < KEY_LOG_RETRIES; attempt++ {
+		var index sql.NullInt64
+		err = stmt.QueryRow(e.Action, e.Email, e.KeyId, e.KeyHash, e.Timestamp, leafHash).Scan(&index)
+		if err == nil {
+			e.LeafIndex = index.Int64
+			return e.LeafIndex, nil
+		}
+
+		// another entry took this leaf index (it is the primary key)
+		if pqErr, isPqErr := err.(*pq.Error); !isPqErr || pqErr.Code != "23505" {
+			return 0, err
+		}
+	}
+
+	return 0, err
+}
+
+// Append the change to this person's public key to the log
+func LogKeyChange(stmt *sql.Stmt, action, email string, key *PUBLIC_KEY) (*KEY_LOG_ENTRY, error) {
+	entry := &KEY_LOG_ENTRY{KeyEntry: transparency.NewKeyEntry(action, email, key.Id, key.Key)}
+	_, err := entry.Add(stmt)
+	return entry, err
+}
+
+// Return the leaf hashes from this index on, stopping at the first gap
+// (which can only be an entry still being added)
+func LookupKeyLogLeaves(stmt *sql.Stmt, from int64) ([][]byte, error) {
+	results := make([][]byte, 0)
+
+	rows, err := stmt.Query(from)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			leaf_index sql.NullInt64
+			leaf_hash  sql.NullString
+		)
+		err := rows.Scan(&leaf_index, &leaf_hash)
+		if err != nil {
+			return results, err
+		}
+
+		expected := from + int64(len(results))
+		if leaf_index.Int64 < expected {
+			continue
+		}
+		if leaf_index.Int64 > expected {
+			break
+		}
+
+		leaf, leafErr := hex.DecodeString(leaf_hash.String)
+		if leafErr != nil {
+			return results, leafErr
+		}
+		results = append(results, leaf)
+	}
+
+	return results, nil
+}
+
+func scanKeyLogEntries(rows *sql.Rows) ([]*KEY_LOG_ENTRY, error) {
+	results := make([]*KEY_LOG_ENTRY, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			leaf_index, date_logged         sql.NullInt64
+			action, email, key_id, key_hash sql.NullString
+		)
+		err := rows.Scan(&leaf_index, &action, &email, &key_id, &key_hash, &date_logged)
+		if err != nil {
+			return results, err
+		} else {
+			entry := &transparency.KeyEntry{Action: action.String,
+				Email:     email.String,
+				KeyId:     key_id.String,
+				KeyHash:   key_hash.String,
+				Timestamp: date_logged.Int64}
+			results = append(results, &KEY_LOG_ENTRY{LeafIndex: leaf_index.Int64, KeyEntry: entry})
+		}
+	}
+
+	return results, nil
+}
+
+// Return the latest log entry for this public key (with an empty KeyId if
+// the key was never logged)
+func LookupKeyLogEntry(stmt *sql.Stmt, keyId string) (*KEY_LOG_ENTRY, error) {
+	rows, err := stmt.Query(keyId)
+	if err != nil {
+		return &KEY_LOG_ENTRY{KeyEntry: new(transparency.KeyEntry)}, err
+	}
+
+	entries, err := scanKeyLogEntries(rows)
+	if len(entries) == 0 {
+		return &KEY_LOG_ENTRY{KeyEntry: new(transparency.KeyEntry)}, err
+	}
+	return entries[0], err
+}
+
+// Return the log entries from start up to (but not including) end
+func LookupKeyLogEntries(stmt *sql.Stmt, start, end int64) ([]*KEY_LOG_ENTRY, error) {
+	rows, err := stmt.Query(start, end)
+	if err != nil {
+		return make([]*KEY_LOG_ENTRY, 0), err
+	}
+	return scanKeyLogEntries(rows)
+}
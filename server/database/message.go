@@ -5,7 +5,12 @@ package database
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/lib/pq"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,23 +20,86 @@ const (
 	MESSAGE_INSERT  = "insert into message (person_id, message, date_expires) values ($1, $2, $3 at time zone 'UTC') returning id"
 	MESSAGE_DELETE  = "delete from message where id = $1"
 	MESSAGE_CLEANUP = "select id from message where date_expires <= (now() at time zone 'UTC')"
+	MESSAGE_PURGE   = "select id from message where person_id = $1"
 
 	RECIPIENT_INSERT  = "insert into message_recipient (message_id, person_id) values ($1, $2)"
 	RECIPIENT_DELETE  = "delete from message_recipient where message_id = $1 and person_id = $2"
 	RECIPIENT_CLEANUP = "delete from message_recipient where message_id = $1"
 
 	// lookups
-	MESSAGES_BY_AUTHOR               = "select id, person_id, message, date_posted, date_expires from message where person_id = $1"
-	MESSAGES_BY_RECIPIENT            = "select m.id, m.person_id, m.message, m.date_posted, m.date_expires from message m, message_recipient mr where m.id = mr.message_id and mr.person_id = $1"
+	MESSAGES_BY_AUTHOR = `select id, person_id, message, date_posted, date_expires from message
+	where person_id = $1
+	order by date_posted desc, id desc limit $2 offset $3`
+	MESSAGES_BY_RECIPIENT = `select m.id, m.person_id, m.message, m.date_posted, m.date_expires from message m, message_recipient mr
+	where m.id = mr.message_id and mr.person_id = $1
+	order by m.date_posted desc, m.id desc limit $2 offset $3`
 	RECIPIENTS_BY_MESSAGE            = "select person_id from message_recipient where message_id = $1"
-	LATEST_MESSAGES                  = "select id, person_id, message, date_posted, date_expires from message order by date_posted desc limit $1 offset $2"
-	LATEST_MESSAGES_INVOLVING_PERSON = `select distinct m.id, m.person_id, m.date_posted, m.date_expires
-	from message m, message_recipient mr
-	where m.id = mr.message_id
-	and (m.person_id = $1 or mr.person_id = $1)
-	order by m.date_posted desc
-	limit $2 offset $3`
+	LATEST_MESSAGES                  = "select id, person_id, message, date_posted, date_expires from message order by date_posted desc, id desc limit $1 offset $2"
+	LATEST_MESSAGES_INVOLVING_PERSON = `select m.id, m.person_id, m.message, m.date_posted, m.date_expires from message m
+	where m.person_id = $1 or exists (select 1 from message_recipient mr where mr.message_id = m.id and mr.person_id = $1)
+	order by m.date_posted desc, m.id desc limit $2 offset $3`
 	MESSAGE_BY_ID = "select id, person_id, message, date_posted, date_expires from message where id = $1 limit $2 offset $3"
+
+	// the pages of LATEST_MESSAGES before (older) and after (newer) a
+	// cursor's message, newest first
+	LATEST_MESSAGES_OLDER = `select id, person_id, message, date_posted, date_expires from message
+	where (date_posted, id) < ($1, $2)
+	order by date_posted desc, id desc limit $3`
+	LATEST_MESSAGES_NEWER = `select * from (select id, person_id, message, date_posted, date_expires from message
+	where (date_posted, id) > ($1, $2)
+	order by date_posted, id limit $3) newer
+	order by date_posted desc, id desc`
+
+	// likewise, for the person's messages
+	MESSAGES_BY_AUTHOR_OLDER = `select id, person_id, message, date_posted, date_expires from message
+	where person_id = $1 and (date_posted, id) < ($2, $3)
+	order by date_posted desc, id desc limit $4`
+	MESSAGES_BY_AUTHOR_NEWER = `select * from (select id, person_id, message, date_posted, date_expires from message
+	where person_id = $1 and (date_posted, id) > ($2, $3)
+	order by date_posted, id limit $4) newer
+	order by date_posted desc, id desc`
+	MESSAGES_BY_RECIPIENT_OLDER = `select m.id, m.person_id, m.message, m.date_posted, m.date_expires from message m, message_recipient mr
+	where m.id = mr.message_id and mr.person_id = $1 and (m.date_posted, m.id) < ($2, $3)
+	order by m.date_posted desc, m.id desc limit $4`
+	MESSAGES_BY_RECIPIENT_NEWER = `select * from (select m.id, m.person_id, m.message, m.date_posted, m.date_expires from message m, message_recipient mr
+	where m.id = mr.message_id and mr.person_id = $1 and (m.date_posted, m.id) > ($2, $3)
+	order by m.date_posted, m.id limit $4) newer
+	order by date_posted desc, id desc`
+	MESSAGES_INVOLVING_PERSON_OLDER = `select m.id, m.person_id, m.message, m.date_posted, m.date_expires from message m
+	where (m.person_id = $1 or exists (select 1 from message_recipient mr where mr.message_id = m.id and mr.person_id = $1))
+	and (m.date_posted, m.id) < ($2, $3)
+	order by m.date_posted desc, m.id desc limit $4`
+	MESSAGES_INVOLVING_PERSON_NEWER = `select * from (select m.id, m.person_id, m.message, m.date_posted, m.date_expires from message m
+	where (m.person_id = $1 or exists (select 1 from message_recipient mr where mr.message_id = m.id and mr.person_id = $1))
+	and (m.date_posted, m.id) > ($2, $3)
+	order by m.date_posted, m.id limit $4) newer
+	order by date_posted desc, id desc`
+
+	// the lists of messages a person can view
+	VIEW_ALL      = "all"
+	VIEW_RECEIVED = "received"
+	VIEW_AUTHORED = "authored"
+	VIEW_INVOLVED = "involved"
+
+	INVALID_VIEW = "Invalid view"
+
+	// which way a cursor pages
+	CURSOR_OLDER = "o"
+	CURSOR_NEWER = "n"
+
+	INVALID_CURSOR = "Invalid cursor"
+)
+
+var (
+	UUID_PATTERN = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+	// the statements behind each view
+	MESSAGE_VIEWS = map[string]*MESSAGE_VIEW{
+		VIEW_ALL:      {VIEW_ALL, LATEST_MESSAGES, LATEST_MESSAGES_OLDER, LATEST_MESSAGES_NEWER, (*PERSON).LookupLatestMessages},
+		VIEW_RECEIVED: {VIEW_RECEIVED, MESSAGES_BY_RECIPIENT, MESSAGES_BY_RECIPIENT_OLDER, MESSAGES_BY_RECIPIENT_NEWER, (*PERSON).LookupRecipientMessages},
+		VIEW_AUTHORED: {VIEW_AUTHORED, MESSAGES_BY_AUTHOR, MESSAGES_BY_AUTHOR_OLDER, MESSAGES_BY_AUTHOR_NEWER, (*PERSON).LookupAuthoredMessages},
+		VIEW_INVOLVED: {VIEW_INVOLVED, LATEST_MESSAGES_INVOLVING_PERSON, MESSAGES_INVOLVING_PERSON_OLDER, MESSAGES_INVOLVING_PERSON_NEWER, (*PERSON).LookupInvolvedMessages},
+	}
 )
 
 type MESSAGE struct {
@@ -42,6 +110,33 @@ type MESSAGE struct {
 	DateExpires time.Time `json:"date_expires"`
 }
 
+// The position of a message in the (date_posted, id) order of a list, and
+// which way to page from it
+type MESSAGE_CURSOR struct {
+	Direction  string
+	DatePosted time.Time
+	Id         string
+}
+
+// One page of a list of messages, newest first, with the cursors of the
+// pages around it (nil at either end)
+type MESSAGE_PAGE struct {
+	Messages []*MESSAGE
+	Newer    *MESSAGE_CURSOR
+	Older    *MESSAGE_CURSOR
+}
+
+// A list of messages, by the sql of its first page and of the pages older
+// and newer than a cursor, and the PERSON method which looks up its
+// messages at an offset (with the statement of its first page)
+type MESSAGE_VIEW struct {
+	Name   string
+	First  string
+	Older  string
+	Newer  string
+	Lookup func(*PERSON, map[string]*sql.Stmt, int64, int64) ([]*MESSAGE, error)
+}
+
 type MESSAGE_DIGEST struct {
 	Message           *MESSAGE
 	Preview           string
@@ -79,6 +174,14 @@ func (m *MESSAGE) Delete(stmt *sql.Stmt) error {
 	return err
 }
 
+// Remove this message along with its list of recipients
+func (m *MESSAGE) DeleteWithRecipients(recipientStmt, msgStmt *sql.Stmt) error {
+	if _, err := recipientStmt.Exec(m.Id); err != nil {
+		return err
+	}
+	return m.Delete(msgStmt)
+}
+
 func (m *MESSAGE) DeleteRecipients(stmt *sql.Stmt, recipients []*PERSON) []error {
 	return m.ProcessRecipients(stmt, recipients)
 }
@@ -106,38 +209,185 @@ func ExpiredMessages(stmt *sql.Stmt) ([]string, error) {
 	return results, nil
 }
 
-// Identify all expired messages, and remove them and their recipient list
-func CleanupMessages(idStmt, msgStmt, recipientStmt *sql.Stmt) []error {
-	results := make([]error, 0)
+// Remove all of the messages this person has posted, along with their
+// recipient lists, returning how many were removed
+func (p *PERSON) PurgeMessages(idStmt, recipientStmt, msgStmt *sql.Stmt) (int, error) {
+	ids := make([]string, 0)
+
+	rows, err := idStmt.Query(p.Id)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id sql.NullString
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id.String)
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		m := &MESSAGE{Id: id}
+		if err := m.DeleteWithRecipients(recipientStmt, msgStmt); err != nil {
+			return i, err
+		}
+	}
+
+	return len(ids), nil
+}
 
+// Identify all expired messages, and remove them and their recipient lists,
+// returning how many were removed
+func CleanupMessages(idStmt, msgStmt, recipientStmt *sql.Stmt) (int, error) {
 	expired, err := ExpiredMessages(idStmt)
-	results = append(results, err)
 	if err != nil {
-		for _, id := range expired {
-			_, recipientErr := recipientStmt.Exec(id)
-			results = append(results, recipientErr)
+		return 0, err
+	}
 
-			_, msgErr := msgStmt.Exec(id)
-			results = append(results, msgErr)
+	for i, id := range expired {
+		m := &MESSAGE{Id: id}
+		if err := m.DeleteWithRecipients(recipientStmt, msgStmt); err != nil {
+			return i, err
 		}
 	}
 
-	return results
+	return len(expired), nil
 }
 
 // Return a list of messages for the given query limit/offset criteria
 func RetrieveMessages(stmt *sql.Stmt, uniqueId string, limit, offset int64) ([]*MESSAGE, error) {
-	results := make([]*MESSAGE, 0)
+	if len(uniqueId) > 0 {
+		return queryMessages(stmt, uniqueId, limit, offset)
+	}
+	return queryMessages(stmt, limit, offset)
+}
+
+// The cursor for paging from this message
+func (m *MESSAGE) Cursor(direction string) *MESSAGE_CURSOR {
+	return &MESSAGE_CURSOR{Direction: direction, DatePosted: m.DatePosted, Id: m.Id}
+}
+
+// The cursor, as an opaque url-safe token
+func (c *MESSAGE_CURSOR) String() string {
+	token := fmt.Sprintf("%s.%d.%s", c.Direction, c.DatePosted.UnixNano(), c.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// Read a cursor token
+func ParseMessageCursor(token string) (*MESSAGE_CURSOR, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New(INVALID_CURSOR)
+	}
+	fields := strings.SplitN(string(decoded), ".", 3)
+	if len(fields) != 3 || (fields[0] != CURSOR_OLDER && fields[0] != CURSOR_NEWER) || !UUID_PATTERN.MatchString(fields[2]) {
+		return nil, errors.New(INVALID_CURSOR)
+	}
+	posted, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errors.New(INVALID_CURSOR)
+	}
+	return &MESSAGE_CURSOR{Direction: fields[0], DatePosted: time.Unix(0, posted).UTC(), Id: fields[2]}, nil
+}
+
+// Return a page of up to limit messages, newest first: the first page of
+// the list (from the first statement, as for RetrieveMessages) if cursor is
+// nil, or else the one after it (from the older or newer statement), for
+// the person with the uniqueId (if the statements take one)
+func RetrieveMessagePage(first, older, newer *sql.Stmt, uniqueId string, cursor *MESSAGE_CURSOR, limit int64) (*MESSAGE_PAGE, error) {
+	page := &MESSAGE_PAGE{Messages: make([]*MESSAGE, 0)}
+
+	// one more than the limit, to see if there is another page
+	args := make([]interface{}, 0)
+	if len(uniqueId) > 0 {
+		args = append(args, uniqueId)
+	}
+	if cursor != nil {
+		args = append(args, cursor.DatePosted, cursor.Id, limit+1)
+	}
 
 	var (
-		rows *sql.Rows
-		err  error
+		messages []*MESSAGE
+		err      error
 	)
-	if len(uniqueId) > 0 {
-		rows, err = stmt.Query(uniqueId, limit, offset)
-	} else {
-		rows, err = stmt.Query(limit, offset)
+	switch {
+	case cursor == nil:
+		messages, err = RetrieveMessages(first, uniqueId, limit+1, 0)
+	case cursor.Direction == CURSOR_NEWER:
+		messages, err = queryMessages(newer, args...)
+		if err == nil && int64(len(messages)) <= limit {
+			// back at the top: show a full first page instead
+			cursor = nil
+			messages, err = RetrieveMessages(first, uniqueId, limit+1, 0)
+		}
+	default:
+		messages, err = queryMessages(older, args...)
+	}
+	if err != nil {
+		return page, err
+	}
+
+	more := int64(len(messages)) > limit
+	if more {
+		if cursor != nil && cursor.Direction == CURSOR_NEWER {
+			messages = messages[1:]
+		} else {
+			messages = messages[:limit]
+		}
 	}
+	page.Messages = messages
+
+	if len(messages) > 0 {
+		if cursor != nil && (cursor.Direction == CURSOR_OLDER || more) {
+			page.Newer = messages[0].Cursor(CURSOR_NEWER)
+		}
+		if more || (cursor != nil && cursor.Direction == CURSOR_NEWER) {
+			page.Older = messages[len(messages)-1].Cursor(CURSOR_OLDER)
+		}
+	}
+	return page, nil
+}
+
+// Find the view with this name (VIEW_ALL if empty)
+func LookupMessageView(name string) (*MESSAGE_VIEW, error) {
+	if len(name) == 0 {
+		name = VIEW_ALL
+	}
+	view, exists := MESSAGE_VIEWS[name]
+	if !exists {
+		return nil, errors.New(INVALID_VIEW)
+	}
+	return view, nil
+}
+
+// Whether the view's statements take the person's id
+func (v *MESSAGE_VIEW) Personal() bool {
+	return v.Name != VIEW_ALL
+}
+
+// Return the messages in this view of the person (for older clients which
+// page by offset)
+func (v *MESSAGE_VIEW) Messages(stmt map[string]*sql.Stmt, p *PERSON, limit, offset int64) ([]*MESSAGE, error) {
+	return v.Lookup(p, stmt, limit, offset)
+}
+
+// Return the page of messages in this view of the person at the cursor (the
+// first page, if nil), as for RetrieveMessagePage
+func (v *MESSAGE_VIEW) Page(stmt map[string]*sql.Stmt, p *PERSON, cursor *MESSAGE_CURSOR, limit int64) (*MESSAGE_PAGE, error) {
+	uniqueId := ""
+	if v.Personal() {
+		uniqueId = p.Id
+	}
+	return RetrieveMessagePage(stmt[v.First], stmt[v.Older], stmt[v.Newer], uniqueId, cursor, limit)
+}
+
+// Run the query, and read the messages it returns
+func queryMessages(stmt *sql.Stmt, args ...interface{}) ([]*MESSAGE, error) {
+	results := make([]*MESSAGE, 0)
+
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		return results, err
 	}
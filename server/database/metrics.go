@@ -0,0 +1,134 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/Banrai/TeamWork.io/server/metrics"
+	"github.com/Banrai/TeamWork.io/server/tracing"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	// the postgres driver, timing each prepared statement it runs
+	TIMED_DRIVER = "postgres-timed"
+
+	// the db.system.name of the database spans
+	DB_SYSTEM = "postgresql"
+
+	// the name for statements missing from StatementNames
+	OTHER_STATEMENT = "other"
+)
+
+var (
+	QueryDuration = metrics.NewHistogram("db_query_duration_seconds", "Database query latency, by prepared statement", "statement")
+	QueryErrors   = metrics.NewCounter("db_query_errors_total", "Database queries which failed, by prepared statement", "statement")
+)
+
+func init() {
+	sql.Register(TIMED_DRIVER, timedDriver{})
+}
+
+// Opens postgres connections whose statements are timed
+type timedDriver struct{}
+
+func (d timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := pq.Driver{}.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn, context.Background()}, nil
+}
+
+// Opens timed connections whose statements are also traced, as children of
+// the span in ctx (database/sql gives statements prepared in advance no
+// context of their own)
+type timedConnector struct {
+	name string
+	ctx  context.Context
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := pq.Driver{}.Open(c.name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn, c.ctx}, nil
+}
+
+func (c timedConnector) Driver() driver.Driver {
+	return timedDriver{}
+}
+
+type timedConn struct {
+	driver.Conn
+	ctx context.Context
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	name, known := StatementNames[query]
+	if !known {
+		name = OTHER_STATEMENT
+	}
+	return &timedStmt{stmt, name, query, c.ctx}, nil
+}
+
+// Check the connection, for database/sql to drop broken ones
+func (c *timedConn) Ping(ctx context.Context) error {
+	if pinger, isPinger := c.Conn.(driver.Pinger); isPinger {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+type timedStmt struct {
+	driver.Stmt
+	name, query string
+	ctx         context.Context
+}
+
+// Start the statement's span, if it runs within a trace (so that, e.g.,
+// the statistics queried for each metrics scrape are not traced)
+func (s *timedStmt) start() *tracing.Span {
+	if _, inTrace := tracing.SpanContextFrom(s.ctx); !inTrace {
+		return nil
+	}
+	_, span := tracing.Start(s.ctx, s.name, tracing.KIND_CLIENT,
+		"db.system.name", DB_SYSTEM,
+		"db.query.summary", s.name,
+		"db.query.text", s.query)
+	return span
+}
+
+// Record how long the statement took (queries until their first results
+// arrive, not until all their rows are read), and whether it failed
+func (s *timedStmt) record(start time.Time, span *tracing.Span, err error) {
+	QueryDuration.Since(start, s.name)
+	if err != nil && err != driver.ErrBadConn {
+		QueryErrors.Inc(s.name)
+		span.Fail(err)
+	}
+	span.End()
+}
+
+func (s *timedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start, span := time.Now(), s.start()
+	result, err := s.Stmt.Exec(args)
+	s.record(start, span, err)
+	return result, err
+}
+
+func (s *timedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start, span := time.Now(), s.start()
+	rows, err := s.Stmt.Query(args)
+	s.record(start, span, err)
+	return rows, err
+}
@@ -15,10 +15,17 @@ const (
 	PERSON_INSERT = "insert into person (email) values ($1) returning id"
 	PERSON_UPDATE = "update person set email = $1, verified = $2, date_verified = (now() at time zone 'UTC'), enabled = $3 where id = $4"
 	PERSON_DELETE = "delete from person where id = $1"
+	PERSON_ENABLE = "update person set enabled = $1 where id = $2"
+	PERSON_ROLE   = "update person set role = $1 where id = $2"
 
 	// person lookup
-	PERSON_LOOKUP_BY_ID    = "select id, email, date_added, verified, date_verified, enabled from person where id = $1"
-	PERSON_LOOKUP_BY_EMAIL = "select id, email, date_added, verified, date_verified, enabled from person where email = $1"
+	PERSON_LOOKUP_BY_ID    = "select id, email, date_added, verified, date_verified, enabled, role from person where id = $1"
+	PERSON_LOOKUP_BY_EMAIL = "select id, email, date_added, verified, date_verified, enabled, role from person where email = $1"
+	PERSON_SEARCH          = "select id, email, date_added, verified, date_verified, enabled, role from person where strpos(email, lower($1)) > 0 order by email limit $2 offset $3"
+
+	// person roles
+	ROLE_MEMBER = "member"
+	ROLE_ADMIN  = "admin" // can use the admin console
 )
 
 type PERSON struct {
@@ -28,6 +35,7 @@ type PERSON struct {
 	Verified     bool      `json:"verified"`
 	DateVerified time.Time `json:"date_verified,omitempty"`
 	Enabled      bool      `json:"enabled"`
+	Role         string    `json:"-"`
 }
 
 func (p *PERSON) Add(stmt *sql.Stmt) (string, error) {
@@ -49,6 +57,31 @@ func (p *PERSON) Update(stmt *sql.Stmt) error {
 	return err
 }
 
+// Change this person's role (ROLE_MEMBER or ROLE_ADMIN)
+func (p *PERSON) SetRole(stmt *sql.Stmt, role string) error {
+	_, err := stmt.Exec(role, p.Id)
+	if err == nil {
+		p.Role = role
+	}
+
+	return err
+}
+
+func (p *PERSON) IsAdmin() bool {
+	return p.Role == ROLE_ADMIN
+}
+
+// Enable or disable this person (disabled persons cannot log in or use
+// the api)
+func (p *PERSON) SetEnabled(stmt *sql.Stmt, enabled bool) error {
+	_, err := stmt.Exec(enabled, p.Id)
+	if err == nil {
+		p.Enabled = enabled
+	}
+
+	return err
+}
+
 func LookupPerson(stmt *sql.Stmt, param string) (*PERSON, error) {
 	result := new(PERSON)
 
@@ -60,12 +93,12 @@ func LookupPerson(stmt *sql.Stmt, param string) (*PERSON, error) {
 
 	for rows.Next() {
 		var (
-			id, email                 sql.NullString
+			id, email, role           sql.NullString
 			date_added, date_verified pq.NullTime
 			verified, enabled         sql.NullBool
 		)
 
-		err := rows.Scan(&id, &email, &date_added, &verified, &date_verified, &enabled)
+		err := rows.Scan(&id, &email, &date_added, &verified, &date_verified, &enabled, &role)
 		if err != nil {
 			return result, err
 		} else {
@@ -75,6 +108,7 @@ func LookupPerson(stmt *sql.Stmt, param string) (*PERSON, error) {
 			result.Verified = verified.Bool
 			result.DateVerified = date_verified.Time
 			result.Enabled = enabled.Bool
+			result.Role = role.String
 
 			break
 		}
@@ -83,6 +117,43 @@ func LookupPerson(stmt *sql.Stmt, param string) (*PERSON, error) {
 	return result, nil
 }
 
+// Return a list of persons whose email address contains the given text (or
+// everyone, if it is empty), ordered by email address
+func SearchPersons(stmt *sql.Stmt, text string, limit, offset int64) ([]*PERSON, error) {
+	results := make([]*PERSON, 0)
+
+	rows, err := stmt.Query(text, limit, offset)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id, email, role           sql.NullString
+			date_added, date_verified pq.NullTime
+			verified, enabled         sql.NullBool
+		)
+
+		err := rows.Scan(&id, &email, &date_added, &verified, &date_verified, &enabled, &role)
+		if err != nil {
+			return results, err
+		} else {
+			result := new(PERSON)
+			result.Id = id.String
+			result.Email = email.String
+			result.DateAdded = date_added.Time
+			result.Verified = verified.Bool
+			result.DateVerified = date_verified.Time
+			result.Enabled = enabled.Bool
+			result.Role = role.String
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
 func (p *PERSON) LookupSessions(stmt *sql.Stmt) ([]*SESSION, error) {
 	results := make([]*SESSION, 0)
 
@@ -117,6 +188,26 @@ func (p *PERSON) LookupSessions(stmt *sql.Stmt) ([]*SESSION, error) {
 	return results, nil
 }
 
+// Remove all of this person's sessions, regardless of whether or not they
+// have expired
+func (p *PERSON) DeleteSessions(stmt *sql.Stmt) error {
+	_, err := stmt.Exec(p.Id)
+
+	return err
+}
+
+// Count a wrong session code guess against all of this person's unverified
+// sessions, and remove any which have now had maxAttempts wrong guesses
+func (p *PERSON) FailSessionAttempt(attemptStmt, invalidateStmt *sql.Stmt, maxAttempts int) error {
+	_, err := attemptStmt.Exec(p.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = invalidateStmt.Exec(p.Id, maxAttempts)
+	return err
+}
+
 func (p *PERSON) LookupPublicKeys(stmt *sql.Stmt) ([]*PUBLIC_KEY, error) {
 	results := make([]*PUBLIC_KEY, 0)
 
@@ -161,23 +252,24 @@ func (p *PERSON) LookupMessages(stmt *sql.Stmt, usePersonId bool, limit, offset
 }
 
 // Return a list of all messages, regardless of involvement by this person
-func (p *PERSON) LookupLatestMessages(stmt *sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
-	return p.LookupMessages(stmt, false, limit, offset)
+func (p *PERSON) LookupLatestMessages(stmt map[string]*sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
+	return p.LookupMessages(stmt[LATEST_MESSAGES], false, limit, offset)
 }
 
 // Return a list of messages originated by this person
-func (p *PERSON) LookupAuthoredMessages(stmt *sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
-	return p.LookupMessages(stmt, true, limit, offset)
+func (p *PERSON) LookupAuthoredMessages(stmt map[string]*sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
+	return p.LookupMessages(stmt[MESSAGES_BY_AUTHOR], true, limit, offset)
 }
 
 // Return a list of messages in which this person was a recipient
-func (p *PERSON) LookupRecipientMessages(stmt *sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
-	return p.LookupMessages(stmt, true, limit, offset)
+func (p *PERSON) LookupRecipientMessages(stmt map[string]*sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
+	return p.LookupMessages(stmt[MESSAGES_BY_RECIPIENT], true, limit, offset)
 }
 
-// Return a list of messages in which this person was involved, either as an origniator or a recipient
-func (p *PERSON) LookupInvolvedMessages(stmt *sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
-	return p.LookupMessages(stmt, true, limit, offset)
+// Return a list of messages in which this person was involved, either as an
+// originator or a recipient
+func (p *PERSON) LookupInvolvedMessages(stmt map[string]*sql.Stmt, limit, offset int64) ([]*MESSAGE, error) {
+	return p.LookupMessages(stmt[LATEST_MESSAGES_INVOLVING_PERSON], true, limit, offset)
 }
 
 // create a new Person in the db, and associate these public keys
@@ -190,10 +282,11 @@ func AddPersonWithKeys(pStmt, pkStmt *sql.Stmt, email string, pkList []*PUBLIC_K
 	}
 
 	for _, key := range pkList {
-		_, keyErr := key.Add(pkStmt, pId)
+		keyId, keyErr := key.Add(pkStmt, pId)
 		if keyErr != nil {
 			return keyErr
 		}
+		key.Id = keyId
 	}
 
 	return nil
@@ -5,6 +5,7 @@ package database
 
 import (
 	"database/sql"
+	"github.com/lib/pq"
 	"time"
 )
 
@@ -16,6 +17,11 @@ const (
 
 	// public key lookup
 	PK_LOOKUP = "select id, key, date_added, nickname, source from public_key where person_id = $1"
+
+	// one key, with its person's email address (locked until the end of
+	// the transaction, if any, e.g., to delete it)
+	PK_LOOKUP_BY_ID = `select k.id, k.key, k.date_added, k.nickname, k.source, p.email
+ from public_key k join person p on k.person_id = p.id where k.id = $1 for update of k`
 )
 
 type PUBLIC_KEY struct {
@@ -44,3 +50,25 @@ func (pk *PUBLIC_KEY) Update(stmt *sql.Stmt) error {
 
 	return err
 }
+
+// Find the key with this id, and the email address of the person it
+// belongs to (the key's id is empty if there is none)
+func LookupPublicKey(stmt *sql.Stmt, id string) (*PUBLIC_KEY, string, error) {
+	var (
+		public_key_id, public_key, nickname, source, email sql.NullString
+		date_added                                         pq.NullTime
+	)
+
+	result := new(PUBLIC_KEY)
+	err := stmt.QueryRow(id).Scan(&public_key_id, &public_key, &date_added, &nickname, &source, &email)
+	if err == sql.ErrNoRows {
+		return result, "", nil
+	}
+
+	result.Id = public_key_id.String
+	result.Key = public_key.String
+	result.Added = date_added.Time
+	result.Nickname = nickname.String
+	result.Source = source.String
+	return result, email.String, err
+}
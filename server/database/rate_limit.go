@@ -0,0 +1,50 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// token buckets shared by all the server instances using this database:
+	// refill the bucket for the time elapsed since its last update (at $3
+	// tokens per second, up to $2 tokens), then take one token, if available
+	RATE_LIMIT_TAKE = `insert into rate_limit as rl (key, tokens, allowed, date_updated)
+	values ($1, $2::float8 - 1, true, (now() at time zone 'UTC'))
+	on conflict (key) do update set
+	tokens = least($2::float8, rl.tokens + extract(epoch from ((now() at time zone 'UTC') - rl.date_updated)) * $3::float8)
+	- case when least($2::float8, rl.tokens + extract(epoch from ((now() at time zone 'UTC') - rl.date_updated)) * $3::float8) >= 1 then 1 else 0 end,
+	allowed = least($2::float8, rl.tokens + extract(epoch from ((now() at time zone 'UTC') - rl.date_updated)) * $3::float8) >= 1,
+	date_updated = (now() at time zone 'UTC')
+	returning allowed`
+
+	// a bucket left alone for its whole period ($1, in seconds) has refilled
+	// completely, which is the same as not having one
+	RATE_LIMIT_CLEANUP = "delete from rate_limit where date_updated <= (now() at time zone 'UTC') - $1::float8 * interval '1 second'"
+)
+
+// Take one token from the bucket for this key, which holds up to capacity
+// tokens and refills at rate tokens per second, reporting whether or not
+// a token was available; keys are hashed, so that email addresses and IP
+// addresses are not stored as-is
+func TakeRateLimitToken(stmt *sql.Stmt, key string, capacity, rate float64) (bool, error) {
+	var allowed sql.NullBool
+
+	hashedKey := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+	err := stmt.QueryRow(hashedKey, capacity, rate).Scan(&allowed)
+
+	return allowed.Bool, err
+}
+
+// Remove the buckets which have not been used for this long (the longest
+// period of the limits sharing the table, so that they are full)
+func CleanupRateLimits(stmt *sql.Stmt, age time.Duration) error {
+	_, err := stmt.Exec(age.Seconds())
+
+	return err
+}
@@ -4,27 +4,40 @@
 package database
 
 import (
-	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"github.com/lib/pq"
-	"math/rand"
-	"os"
-	"strings"
 	"time"
 )
 
-var WordTokens []string
-
 const (
 	// session a/u/d
-	SESSION_INSERT  = "insert into session (session_code, person_id, date_expires) values ($1, $2, $3 at time zone 'UTC') returning id"
-	SESSION_UPDATE  = "update session set verified = $1, date_verified = (now() at time zone 'UTC') where id = $2"
-	SESSION_CLEANUP = "delete from session where date_expires <= (now() at time zone 'UTC')"
+	SESSION_INSERT           = "insert into session (session_code, person_id, date_expires) values ($1, $2, $3 at time zone 'UTC') returning id"
+	SESSION_INSERT_CHALLENGE = "insert into session (session_code, person_id, date_expires, challenge) values ($1, $2, $3 at time zone 'UTC', true) returning id"
+	SESSION_UPDATE           = "update session set verified = $1, date_verified = (now() at time zone 'UTC') where id = $2"
+	SESSION_CLEANUP          = "delete from session where date_expires <= (now() at time zone 'UTC')"
+
+	// session revocation
+	SESSION_DELETE           = "delete from session where id = $1"
+	SESSION_DELETE_BY_PERSON = "delete from session where person_id = $1"
+
+	// wrong guesses count against all of the person's unverified sessions
+	SESSION_FAILED_ATTEMPT = "update session set failed_attempts = failed_attempts + 1 where person_id = $1 and not verified"
+	SESSION_INVALIDATE     = "delete from session where person_id = $1 and not verified and failed_attempts >= $2"
 
 	// session lookup
-	SESSION_LOOKUP_BY_CODE   = "select id, person_id, session_code, date_created, verified, date_verified, date_expires from session where session_code = $1"
-	SESSION_LOOKUP_BY_ID     = "select id, person_id, session_code, date_created, verified, date_verified, date_expires from session where id = $1"
-	SESSION_LOOKUP_BY_PERSON = "select id, person_id, session_code, date_created, verified, date_verified, date_expires from session where person_id = $1"
+	SESSION_LOOKUP_BY_CHALLENGE = "select id, person_id, session_code, date_created, verified, date_verified, date_expires from session where session_code = $1 and challenge"
+	SESSION_LOOKUP_BY_ID        = "select id, person_id, session_code, date_created, verified, date_verified, date_expires from session where id = $1"
+	SESSION_LOOKUP_BY_PERSON    = "select id, person_id, session_code, date_created, verified, date_verified, date_expires from session where person_id = $1 order by date_created desc"
+
+	// the sessions whose codes are compared with a code entered by the
+	// person (in constant time, rather than by the database)
+	SESSION_LOOKUP_CODES_BY_PERSON = "select id, person_id, session_code, date_created, verified, date_verified, date_expires from session where person_id = $1 and not challenge and date_expires > (now() at time zone 'UTC')"
+
+	// session handles are hashed from the id under this prefix
+	SESSION_HANDLE_PREFIX = "TeamWork.io session handle:"
 )
 
 type SESSION struct {
@@ -38,9 +51,18 @@ type SESSION struct {
 }
 
 func (s *SESSION) Add(stmt *sql.Stmt, PersonId string, codeSize int, duration time.Duration) (string, error) {
+	code, codeErr := generateSessionCode(codeSize)
+	if codeErr != nil {
+		return "", codeErr
+	}
+	return s.AddCode(stmt, PersonId, code, duration)
+}
+
+// Add the session using the given code (e.g., a login challenge), instead
+// of a randomly-generated list of words
+func (s *SESSION) AddCode(stmt *sql.Stmt, PersonId string, code string, duration time.Duration) (string, error) {
 	var id sql.NullString
 
-	code := generateSessionCode(codeSize)
 	expires := time.Now().UTC().Add(duration)
 
 	err := stmt.QueryRow(code, PersonId, expires).Scan(&id)
@@ -60,6 +82,19 @@ func (s *SESSION) Update(stmt *sql.Stmt) error {
 	return err
 }
 
+// A handle for listing and revoking this session which, unlike its id (the
+// credential sent with each request), can be shown to anyone
+func (s *SESSION) Handle() string {
+	sum := sha256.Sum256([]byte(SESSION_HANDLE_PREFIX + s.Id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Compare the given code with this session's code in constant time, so
+// that the comparison does not leak how much of the code was correct
+func (s *SESSION) MatchesCode(code string) bool {
+	return len(s.Code) > 0 && subtle.ConstantTimeCompare([]byte(s.Code), []byte(code)) == 1
+}
+
 func LookupSession(stmt *sql.Stmt, code string) (*SESSION, error) {
 	result := new(SESSION)
 
@@ -93,42 +128,28 @@ func LookupSession(stmt *sql.Stmt, code string) (*SESSION, error) {
 	return result, nil
 }
 
-func CleanupSessions(stmt *sql.Stmt) error {
-	_, err := stmt.Exec()
-
-	return err
-}
-
-func generateSessionCode(size int) string {
-	var codes []string
-	l := len(WordTokens)
-	for i := 0; i < size; i++ {
-		codes = append(codes, WordTokens[rand.Intn(l)])
-	}
-	return strings.Join(codes, " ")
-}
+// Find the session with this code, among the ones requested by this person
+// (from SESSION_LOOKUP_CODES_BY_PERSON), comparing every one of their codes
+// with MatchesCode
+func LookupPersonSession(stmt *sql.Stmt, personId, code string) (*SESSION, error) {
+	result := new(SESSION)
 
-func readLines(path string) ([]string, error) {
-	file, err := os.Open(path)
+	sessions, err := (&PERSON{Id: personId}).LookupSessions(stmt)
 	if err != nil {
-		return nil, err
+		return result, err
 	}
-	defer file.Close()
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	for _, s := range sessions {
+		if s.MatchesCode(code) {
+			result = s
+		}
 	}
-	return lines, scanner.Err()
-}
 
-func InitializeWords(wordsFile string) error {
-	var err error
-	WordTokens, err = readLines(wordsFile)
-	return err
+	return result, nil
 }
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+func CleanupSessions(stmt *sql.Stmt) error {
+	_, err := stmt.Exec()
+
+	return err
 }
@@ -0,0 +1,52 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"database/sql"
+)
+
+const (
+	// instance-wide counts, for operators
+	INSTANCE_STATISTICS = `select
+ (select count(*) from person),
+ (select count(*) from person where enabled),
+ (select count(*) from person where verified),
+ (select count(*) from public_key),
+ (select count(*) from message),
+ (select count(*) from message where date_expires <= (now() at time zone 'UTC')),
+ (select count(*) from message_recipient),
+ (select count(*) from session where verified and date_expires > (now() at time zone 'UTC')),
+ (select count(*) from session where not verified and date_expires > (now() at time zone 'UTC')),
+ (select count(*) from api_token)`
+)
+
+type STATISTICS struct {
+	Persons         int64 `json:"persons"`
+	EnabledPersons  int64 `json:"enabled_persons"`
+	VerifiedPersons int64 `json:"verified_persons"`
+	PublicKeys      int64 `json:"public_keys"`
+	Messages        int64 `json:"messages"`
+	ExpiredMessages int64 `json:"expired_messages"`
+	Recipients      int64 `json:"recipients"`
+	ActiveSessions  int64 `json:"active_sessions"`
+	PendingSessions int64 `json:"pending_sessions"`
+	APITokens       int64 `json:"api_tokens"`
+}
+
+func LookupStatistics(stmt *sql.Stmt) (*STATISTICS, error) {
+	s := new(STATISTICS)
+	err := stmt.QueryRow().Scan(&s.Persons,
+		&s.EnabledPersons,
+		&s.VerifiedPersons,
+		&s.PublicKeys,
+		&s.Messages,
+		&s.ExpiredMessages,
+		&s.Recipients,
+		&s.ActiveSessions,
+		&s.PendingSessions,
+		&s.APITokens)
+
+	return s, err
+}
@@ -6,6 +6,7 @@ CREATE TABLE person (
 	verified      boolean DEFAULT false,
 	date_verified timestamp with time zone,
 	enabled       boolean DEFAULT true,
+	role          text DEFAULT 'member', -- or 'admin'
 	UNIQUE(email, id)
 );
 
@@ -36,12 +37,79 @@ CREATE TABLE message_recipient (
 );
 
 CREATE TABLE session (
-	id            uuid primary key DEFAULT uuid_generate_v4(),
-	person_id     uuid references person(id),
-	session_code  text NOT NULL,
-	date_created  timestamp with time zone DEFAULT (now() at time zone 'UTC'),
-	verified      boolean DEFAULT false,
-	date_verified timestamp with time zone,
-	date_expires  timestamp with time zone,
+	id              uuid primary key DEFAULT uuid_generate_v4(),
+	person_id       uuid references person(id),
+	session_code    text NOT NULL,
+	date_created    timestamp with time zone DEFAULT (now() at time zone 'UTC'),
+	verified        boolean DEFAULT false,
+	date_verified   timestamp with time zone,
+	date_expires    timestamp with time zone,
+	challenge       boolean DEFAULT false, -- signed by the person, instead of decrypted
+	failed_attempts integer DEFAULT 0,
 	UNIQUE(person_id, session_code)
 );
+
+CREATE TABLE rate_limit (
+	key          text primary key, -- sha256 of the limited email or ip address
+	tokens       double precision NOT NULL,
+	allowed      boolean DEFAULT true,
+	date_updated timestamp with time zone DEFAULT (now() at time zone 'UTC')
+);
+
+CREATE TABLE api_token (
+	id             uuid primary key DEFAULT uuid_generate_v4(),
+	person_id      uuid references person(id),
+	name           text NOT NULL,
+	token_hash     text NOT NULL, -- sha256 of the token itself
+	scopes         text NOT NULL, -- comma-separated
+	date_created   timestamp with time zone DEFAULT (now() at time zone 'UTC'),
+	date_last_used timestamp with time zone,
+	date_expires   timestamp with time zone, -- null for no expiration
+	UNIQUE(token_hash)
+);
+
+CREATE TABLE audit_event (
+	id           uuid primary key DEFAULT uuid_generate_v4(),
+	seq          bigserial, -- the order of the chain
+	actor_id     uuid references person(id), -- null if nobody was logged in, or for operator tools
+	action       text NOT NULL,
+	target       text NOT NULL,
+	detail       text NOT NULL,
+	ip_address   text NOT NULL,
+	user_agent   text NOT NULL DEFAULT '',
+	date_created timestamp with time zone DEFAULT (now() at time zone 'UTC'),
+	prev_hash    text, -- the hash of the previous event ('' for the first one)
+	hash         text, -- sha256 of prev_hash and this event's fields
+	UNIQUE(seq),
+	UNIQUE(prev_hash)
+);
+
+CREATE FUNCTION audit_event_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_event_append_only BEFORE UPDATE OR DELETE ON audit_event
+	FOR EACH ROW EXECUTE PROCEDURE audit_event_append_only();
+
+CREATE TABLE key_log (
+	leaf_index  bigint primary key, -- the position in the merkle tree
+	action      text NOT NULL, -- 'add' or 'delete'
+	email       text NOT NULL,
+	key_id      uuid NOT NULL, -- not a reference: deleted keys stay in the log
+	key_hash    text NOT NULL, -- sha256 of the armored key
+	date_logged bigint NOT NULL, -- milliseconds since the epoch, as in the leaf
+	leaf_hash   text NOT NULL -- sha256 of 0x00 and the entry's json
+);
+
+CREATE INDEX key_log_key_id ON key_log (key_id);
+
+CREATE FUNCTION key_log_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'key_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER key_log_append_only BEFORE UPDATE OR DELETE ON key_log
+	FOR EACH ROW EXECUTE PROCEDURE key_log_append_only();
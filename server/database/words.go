@@ -0,0 +1,167 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// refuse to generate session codes which are easier to guess than this
+	MIN_SESSION_CODE_ENTROPY = 64 // bits
+
+	WORDS_NOT_LOADED = "The session code word list is not loaded"
+)
+
+// the session code word list in use, which a reload replaces
+var wordList struct {
+	sync.RWMutex
+	tokens []string
+}
+
+// The EFF large word list, used when no other dictionary file is given
+// (https://www.eff.org/deeplinks/2016/07/new-wordlists-random-passphrases)
+//
+//go:embed eff_large_wordlist.txt
+var defaultWords []byte
+
+// Pick size words from the list at random, using the cryptographically
+// secure random number generator
+func generateSessionCode(size int) (string, error) {
+	var codes []string
+	tokens := wordTokens()
+	l := big.NewInt(int64(len(tokens)))
+	for i := 0; i < size; i++ {
+		n, err := rand.Int(rand.Reader, l)
+		if err != nil {
+			return "", err
+		}
+		codes = append(codes, tokens[n.Int64()])
+	}
+	return strings.Join(codes, " "), nil
+}
+
+// Return the number of bits of entropy in a session code of the given size,
+// based on the number of words currently available
+func SessionCodeEntropy(size int) float64 {
+	return codeEntropy(size, len(wordTokens()))
+}
+
+// The words session codes are made of
+func wordTokens() []string {
+	wordList.RLock()
+	defer wordList.RUnlock()
+	return wordList.tokens
+}
+
+// Check that the word list makes session codes of the given size hard
+// enough to guess
+func CheckWords(size int) error {
+	if SessionCodeEntropy(size) < MIN_SESSION_CODE_ENTROPY {
+		return errors.New(WORDS_NOT_LOADED)
+	}
+	return nil
+}
+
+func codeEntropy(size, words int) float64 {
+	if words < 2 {
+		return 0
+	}
+	return float64(size) * math.Log2(float64(words))
+}
+
+// Accept only plain, lower case words: this skips possessives, proper
+// nouns and anything else which is easy to mistype
+func isUsableWord(word string) bool {
+	if len(word) == 0 {
+		return false
+	}
+	for _, r := range word {
+		if !unicode.IsLower(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Read the words, one per line, from the reader; lines in diceware format
+// (e.g., "11111 abacus") use the last field as the word
+func readWords(in io.Reader) ([]string, error) {
+	var words []string
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		word := fields[len(fields)-1]
+		if isUsableWord(word) && !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// Read the session code word list from the given file (or the built-in EFF
+// list, if the file is empty), refusing any list too small to produce codes
+// of the given size with at least MIN_SESSION_CODE_ENTROPY bits
+func LoadWords(wordsFile string, codeSize int) ([]string, error) {
+	var (
+		words []string
+		err   error
+	)
+
+	if len(wordsFile) == 0 {
+		words, err = readWords(bytes.NewReader(defaultWords))
+	} else {
+		file, fileErr := os.Open(wordsFile)
+		if fileErr != nil {
+			return nil, fileErr
+		}
+		defer file.Close()
+		words, err = readWords(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entropy := codeEntropy(codeSize, len(words))
+	if entropy < MIN_SESSION_CODE_ENTROPY {
+		return nil, fmt.Errorf("The word list has only %d unique words, so %d-word session codes have %.1f bits of entropy (the minimum is %d)", len(words), codeSize, entropy, MIN_SESSION_CODE_ENTROPY)
+	}
+	return words, nil
+}
+
+// Make new session codes from these words (as read by LoadWords)
+func UseWords(words []string) {
+	wordList.Lock()
+	defer wordList.Unlock()
+	wordList.tokens = words
+}
+
+// Load the session code word list, and use it only if it is usable (keeping
+// the current list otherwise, e.g., when reloading)
+func InitializeWords(wordsFile string, codeSize int) error {
+	words, err := LoadWords(wordsFile, codeSize)
+	if err != nil {
+		return err
+	}
+	UseWords(words)
+	return nil
+}
@@ -5,18 +5,33 @@ package emailer
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"github.com/Banrai/TeamWork.io/server/metrics"
+	"github.com/Banrai/TeamWork.io/server/tracing"
 	"io/ioutil"
+	"net"
 	"net/smtp"
 	"os"
+	"sync"
 	"text/template"
+	"time"
 )
 
-const (
-	MAIL_SERVER = "localhost"
-	MAIL_PORT   = 25
+// the SMTP server (see Configure, which main calls at startup and on reload)
+var mailServer = struct {
+	sync.RWMutex
+	host string
+	port int
+}{host: "localhost", port: 25}
+
+var (
+	EmailsSent    = metrics.NewCounter("emails_total", "Emails sent through the SMTP server, by outcome (sent or failed)", "outcome")
+	EmailDuration = metrics.NewHistogram("email_send_duration_seconds", "How long the SMTP server took to accept each email")
+)
 
+const (
 	LINE_MAX_LEN = 500 // for splitting encoded attachment data
 
 	// templates for generating the message components
@@ -194,8 +209,57 @@ func SendFromServer(subject, messageText, messageHtml, server string, sender, re
 	return err
 }
 
+// Send the emails through the SMTP server at this host and port
+func Configure(host string, port int) {
+	mailServer.Lock()
+	defer mailServer.Unlock()
+	mailServer.host = host
+	mailServer.port = port
+}
+
+// The SMTP server the emails are sent through
+func server() (string, int) {
+	mailServer.RLock()
+	defer mailServer.RUnlock()
+	return mailServer.host, mailServer.port
+}
+
+// Check that the mail server answers with its greeting, within the timeout
+func Ping(timeout time.Duration) error {
+	host, port := server()
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return c.Quit()
+}
+
 // Send transmits the given message, with optional attachments, via the
-// default mail server (localhost) and port (25)
-func Send(subject, messageText, messageHtml string, sender, recipient *EmailAddress, attachments []*EmailAttachment) error {
-	return SendFromServer(subject, messageText, messageHtml, MAIL_SERVER, sender, recipient, attachments, MAIL_PORT)
+// configured mail server (by default, localhost on port 25), traced as a
+// child of the span in ctx
+func Send(ctx context.Context, subject, messageText, messageHtml string, sender, recipient *EmailAddress, attachments []*EmailAttachment) error {
+	host, port := server()
+	_, span := tracing.Start(ctx, "smtp send", tracing.KIND_CLIENT,
+		"server.address", host,
+		"server.port", port,
+		"attachments", len(attachments))
+	defer span.End()
+
+	start := time.Now()
+	err := SendFromServer(subject, messageText, messageHtml, host, sender, recipient, attachments, port)
+	EmailDuration.Since(start)
+	span.Fail(err)
+	if err != nil {
+		EmailsSent.Inc("failed")
+	} else {
+		EmailsSent.Inc("sent")
+	}
+	return err
 }
@@ -5,8 +5,10 @@ package httputil
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/Banrai/TeamWork.io/server/tracing"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -14,8 +16,8 @@ import (
 
 const USER_AGENT = "TeamWork.io/0.2"
 
-// For accessing URLs via HTTP GET
-func getUrl(url string) ([]byte, error) {
+// For accessing URLs via HTTP GET (traced as a child of the span in ctx)
+func getUrl(ctx context.Context, url string) ([]byte, error) {
 	noData := []byte{} // default, in case of error
 
 	client := &http.Client{}
@@ -26,18 +28,26 @@ func getUrl(url string) ([]byte, error) {
 
 	request.Header.Set("User-Agent", USER_AGENT)
 
+	_, span := tracing.StartRequest(ctx, request)
+	defer span.End()
+
 	response, respErr := client.Do(request)
 	if respErr != nil {
+		span.Fail(respErr)
 		return noData, respErr
 	}
 	defer response.Body.Close()
+	span.SetAttributes("http.response.status_code", response.StatusCode)
 
 	if response.StatusCode != http.StatusOK {
-		return noData, errors.New(fmt.Sprintf("Error retrieving '%s' via HTTP GET: %s", url, response.Status))
+		err := errors.New(fmt.Sprintf("Error retrieving '%s' via HTTP GET: %s", url, response.Status))
+		span.Fail(err)
+		return noData, err
 	}
 
 	contents, err := ioutil.ReadAll(response.Body)
 	if err != nil {
+		span.Fail(err)
 		return noData, err
 	}
 
@@ -46,10 +56,10 @@ func getUrl(url string) ([]byte, error) {
 
 // Retrieve the public key from the given url, and return its contents as a
 // string, if it is valid
-func URLFetchAsString(url string) (string, error) {
+func URLFetchAsString(ctx context.Context, url string) (string, error) {
 	noKey := "" // default response
 
-	b, err := getUrl(url)
+	b, err := getUrl(ctx, url)
 	if err != nil {
 		return noKey, err
 	}
@@ -59,7 +69,7 @@ func URLFetchAsString(url string) (string, error) {
 
 // fetch the contents of the given url using http get, and return the
 // contents as an io.Reader object
-func URLFetchAsReader(url string) (io.Reader, error) {
-	b, err := getUrl(url)
+func URLFetchAsReader(ctx context.Context, url string) (io.Reader, error) {
+	b, err := getUrl(ctx, url)
 	return bytes.NewReader(b), err
 }
@@ -12,24 +12,20 @@
 case "$1" in
   start)
     echo "Starting TeamWorkServer"
-    /opt/src/github.com/Banrai/TeamWork.io/server/TeamWorkServer -dbName=teamworkdb \
-      -dbUser=teamworkio \
-      -dbPass=dbPassGoesHere \
-      -dbSSL=true \
-      -host=TeamWork.io \
-      -ip=127.0.0.1 \
-      -port=8001 \
-      -ssl=true \
-      -templates=/opt/src/github.com/Banrai/TeamWork.io/html/templates \
-      -stripePK=pk_live_GoesHere \
-      -stripeSK=sk_live_GoesHere >> /opt/TeamWorkServer.log 2>&1 &
+    # the settings (including the database password and the Stripe secret
+    # key, which should not be on the command line) are in the config file
+    /opt/src/github.com/Banrai/TeamWork.io/server/TeamWorkServer -config=/etc/teamwork/teamwork.toml >> /opt/TeamWorkServer.log 2>&1 &
     ;;
   stop)
     echo "Stopping TeamWorkServer"
     killall TeamWorkServer
     ;;
+  reload)
+    echo "Reloading TeamWorkServer"
+    killall -HUP TeamWorkServer
+    ;;
   *)
-    echo "Usage: /etc/init.d/teamwork-server.sh {start|stop}"
+    echo "Usage: /etc/init.d/teamwork-server.sh {start|stop|reload}"
     exit 1
     ;;
 esac
@@ -4,12 +4,16 @@
 package keyservers
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"github.com/Banrai/TeamWork.io/server/httputil"
+	"github.com/Banrai/TeamWork.io/server/metrics"
+	"github.com/Banrai/TeamWork.io/server/tracing"
 	"html"
 	"io"
 	"strings"
+	"time"
 )
 
 /* For accessing public keys from the
@@ -19,6 +23,24 @@ import (
 
 const MIT_SOURCE = "http://pgp.mit.edu/"
 
+var (
+	Lookups        = metrics.NewCounter("keyserver_lookups_total", "Key server searches, by key server and outcome (found, not_found or error)", "keyserver", "outcome")
+	LookupDuration = metrics.NewHistogram("keyserver_lookup_duration_seconds", "Key server search latency, by key server", "keyserver")
+)
+
+// Count this key server search, by its outcome, and time it
+func recordLookup(keyserver string, start time.Time, keys []string, err error) {
+	LookupDuration.Since(start, keyserver)
+	switch {
+	case err != nil:
+		Lookups.Inc(keyserver, "error")
+	case len(keys) == 0:
+		Lookups.Inc(keyserver, "not_found")
+	default:
+		Lookups.Inc(keyserver, "found")
+	}
+}
+
 // parse the specific key links from a request of the form:
 // http://pgp.mit.edu/pks/lookup?search=me@example.org excluding revoked/not
 // verified keys
@@ -92,10 +114,22 @@ func parseMatchResult(in io.Reader) ([]string, error) {
 // search the MIT PGP Server for all public keys corresponding to this
 // email address, returning them as armored strings, excluding revoked/not
 // verified keys
-func MITSearch(email string) ([]string, error) {
+func MITSearch(ctx context.Context, email string) ([]string, error) {
+	ctx, span := tracing.Start(ctx, "keyserver search", tracing.KIND_INTERNAL, "keyserver", "mit")
+	defer span.End()
+
+	start := time.Now()
+	keys, err := mitSearch(ctx, email)
+	recordLookup("mit", start, keys, err)
+	span.SetAttributes("keys", len(keys))
+	span.Fail(err)
+	return keys, err
+}
+
+func mitSearch(ctx context.Context, email string) ([]string, error) {
 	var keys []string
 
-	in, inErr := httputil.URLFetchAsReader(fmt.Sprintf("http://pgp.mit.edu/pks/lookup?search=%s", email))
+	in, inErr := httputil.URLFetchAsReader(ctx, fmt.Sprintf("http://pgp.mit.edu/pks/lookup?search=%s", email))
 	if inErr != nil {
 		return keys, inErr
 	}
@@ -106,7 +140,7 @@ func MITSearch(email string) ([]string, error) {
 	}
 
 	for _, link := range links {
-		pkIn, pkInErr := httputil.URLFetchAsReader(fmt.Sprintf("http://pgp.mit.edu%s", link))
+		pkIn, pkInErr := httputil.URLFetchAsReader(ctx, fmt.Sprintf("http://pgp.mit.edu%s", link))
 		if pkInErr != nil {
 			return keys, pkInErr
 		}
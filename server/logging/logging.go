@@ -0,0 +1,237 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package logging writes leveled, structured log lines (as logfmt or json),
+// tagged with the request they belong to, and with email addresses, session
+// ids and session codes redacted
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the log levels, from the most verbose
+	LEVEL_DEBUG = "debug"
+	LEVEL_INFO  = "info"
+	LEVEL_WARN  = "warn"
+	LEVEL_ERROR = "error"
+
+	// the line formats
+	FORMAT_LOGFMT = "logfmt"
+	FORMAT_JSON   = "json"
+
+	// what redacted values are replaced with
+	REDACTED       = "[redacted]"
+	REDACTED_EMAIL = "[email]"
+
+	TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+	UNKNOWN_LEVEL  = "The log level must be one of debug, info, warn or error"
+	UNKNOWN_FORMAT = "The log format must be logfmt or json"
+)
+
+var (
+	LEVELS = map[string]int{LEVEL_DEBUG: 0, LEVEL_INFO: 1, LEVEL_WARN: 2, LEVEL_ERROR: 3}
+
+	// the values of these keys are never logged
+	REDACTED_KEYS = map[string]bool{"session": true,
+		"session_id":    true,
+		"session_code":  true,
+		"code":          true,
+		"password":      true,
+		"token":         true,
+		"authorization": true}
+
+	// email addresses, also when url-encoded, anywhere in a message or value
+	EMAIL = regexp.MustCompile(`[A-Za-z0-9._%+\-]+(@|%40)[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+
+	// where, and how, lines are written (see Configure)
+	output = struct {
+		sync.Mutex
+		w      io.Writer
+		level  int
+		format string
+	}{w: os.Stdout, level: LEVELS[LEVEL_INFO], format: FORMAT_LOGFMT}
+
+	root = new(Logger)
+)
+
+// Writes lines with its own key/value pairs (e.g., the request id), along
+// with those of each line
+type Logger struct {
+	fields []interface{}
+}
+
+// Set the lowest level which is logged, and the line format
+func Configure(level, format string) error {
+	threshold, known := LEVELS[level]
+	if !known {
+		return errors.New(UNKNOWN_LEVEL)
+	}
+	if format != FORMAT_LOGFMT && format != FORMAT_JSON {
+		return errors.New(UNKNOWN_FORMAT)
+	}
+
+	output.Lock()
+	defer output.Unlock()
+	output.level = threshold
+	output.format = format
+	return nil
+}
+
+// Write the lines here, instead of stdout
+func SetOutput(w io.Writer) {
+	output.Lock()
+	defer output.Unlock()
+	output.w = w
+}
+
+// A logger which adds these key/value pairs to each line
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	return &Logger{fields: append(fields, keyvals...)}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.write(LEVEL_DEBUG, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.write(LEVEL_INFO, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.write(LEVEL_WARN, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.write(LEVEL_ERROR, msg, keyvals) }
+
+// Log at the error level, and exit
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.write(LEVEL_ERROR, msg, keyvals)
+	os.Exit(1)
+}
+
+// The same, with no request
+func With(keyvals ...interface{}) *Logger      { return root.With(keyvals...) }
+func Debug(msg string, keyvals ...interface{}) { root.write(LEVEL_DEBUG, msg, keyvals) }
+func Info(msg string, keyvals ...interface{})  { root.write(LEVEL_INFO, msg, keyvals) }
+func Warn(msg string, keyvals ...interface{})  { root.write(LEVEL_WARN, msg, keyvals) }
+func Error(msg string, keyvals ...interface{}) { root.write(LEVEL_ERROR, msg, keyvals) }
+func Fatal(msg string, keyvals ...interface{}) { root.Fatal(msg, keyvals...) }
+
+// Replace any email addresses in the text
+func Redact(text string) string {
+	return EMAIL.ReplaceAllString(text, REDACTED_EMAIL)
+}
+
+// The value as a string, or for json, as a number or boolean if it is one
+func formatValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, false
+	case error:
+		return v.Error(), false
+	case time.Duration:
+		return v.String(), false
+	case bool:
+		return strconv.FormatBool(v), true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", v), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprint(v), false
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return fmt.Sprint(value), false
+}
+
+// Quote a logfmt value, if it needs it
+func logfmtValue(value string) string {
+	if len(value) > 0 && !strings.ContainsAny(value, " =\"\\\t\n\r") {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+func (l *Logger) write(level, msg string, keyvals []interface{}) {
+	output.Lock()
+	defer output.Unlock()
+	if LEVELS[level] < output.level {
+		return
+	}
+
+	all := append([]interface{}{"time", time.Now().UTC().Format(TIME_FORMAT), "level", level, "msg", msg}, l.fields...)
+	all = append(all, keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, nil)
+	}
+
+	var line bytes.Buffer
+	if output.format == FORMAT_JSON {
+		line.WriteString("{")
+	}
+	for i := 0; i < len(all); i += 2 {
+		key, _ := formatValue(all[i])
+		value, literal := formatValue(all[i+1])
+		if REDACTED_KEYS[key] && len(value) > 0 {
+			value, literal = REDACTED, false
+		} else if !literal {
+			value = Redact(value)
+		}
+
+		if output.format == FORMAT_JSON {
+			if i > 0 {
+				line.WriteString(",")
+			}
+			encodedKey, _ := json.Marshal(key)
+			line.Write(encodedKey)
+			line.WriteString(":")
+			if literal {
+				line.WriteString(value)
+			} else {
+				encoded, _ := json.Marshal(value)
+				line.Write(encoded)
+			}
+		} else {
+			if i > 0 {
+				line.WriteString(" ")
+			}
+			line.WriteString(key)
+			line.WriteString("=")
+			line.WriteString(logfmtValue(value))
+		}
+	}
+	if output.format == FORMAT_JSON {
+		line.WriteString("}")
+	}
+	line.WriteString("\n")
+
+	output.w.Write(line.Bytes())
+}
+
+// Writes each line it gets (e.g., from the standard library's log package)
+// as a message at this level
+type lineWriter struct {
+	level string
+}
+
+func (w lineWriter) Write(data []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		root.write(w.level, line, nil)
+	}
+	return len(data), nil
+}
+
+// A writer for the log package (with no flags), so that its lines are
+// structured too
+func Writer(level string) io.Writer {
+	return lineWriter{level}
+}
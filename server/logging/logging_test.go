@@ -0,0 +1,106 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Capture the lines written at this level and format
+func capture(t *testing.T, level, format string) *bytes.Buffer {
+	var buffer bytes.Buffer
+	if err := Configure(level, format); err != nil {
+		t.Fatal(err)
+	}
+	SetOutput(&buffer)
+	t.Cleanup(func() {
+		Configure(LEVEL_INFO, FORMAT_LOGFMT)
+		SetOutput(os.Stdout)
+	})
+	return &buffer
+}
+
+func TestLogfmt(t *testing.T) {
+	buffer := capture(t, LEVEL_INFO, FORMAT_LOGFMT)
+
+	logger := With("request_id", "abc")
+	logger.Debug("not logged")
+	logger.Info("Session created", "email", "someone@example.org", "session_code", "correct horse", "status", 201)
+	logger.Error("Failed", "error", errors.New("lookup of me%40example.org failed"))
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buffer.String())
+	}
+	for i, expected := range []string{`level=info msg="Session created" request_id=abc email=[email] session_code=[redacted] status=201`,
+		`level=error msg=Failed request_id=abc error="lookup of [email] failed"`} {
+		if !strings.HasPrefix(lines[i], "time=") || !strings.HasSuffix(lines[i], expected) {
+			t.Errorf("line %d is %q, expected it to end with %q", i, lines[i], expected)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buffer := capture(t, LEVEL_DEBUG, FORMAT_JSON)
+
+	Debug("Checked", "session", "0f8a", "count", 3, "ok", true, "path", "/api/v1/people/a@b.io")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &line); err != nil {
+		t.Fatalf("invalid json %q: %v", buffer.String(), err)
+	}
+	expected := map[string]interface{}{"level": "debug", "msg": "Checked", "session": REDACTED, "count": 3.0, "ok": true, "path": "/api/v1/people/" + REDACTED_EMAIL}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("%s is %v, expected %v", key, line[key], value)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	if Configure("verbose", FORMAT_JSON) == nil || Configure(LEVEL_INFO, "xml") == nil {
+		t.Error("unknown levels and formats should be refused")
+	}
+}
+
+func TestRequests(t *testing.T) {
+	buffer := capture(t, LEVEL_INFO, FORMAT_LOGFMT)
+
+	handler := Requests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromRequest(r).Warn("Inside")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request := httptest.NewRequest("DELETE", "/api/v1/sessions/5e0b6f2a", nil)
+	request.Header.Set(REQUEST_ID_HEADER, "upstream-42")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if id := recorder.Header().Get(REQUEST_ID_HEADER); id != "upstream-42" {
+		t.Errorf("echoed request id %q, expected upstream-42", id)
+	}
+	output := buffer.String()
+	for _, expected := range []string{`level=warn msg=Inside request_id=upstream-42`,
+		`level=info msg=request request_id=upstream-42 method=DELETE path=/api/v1/sessions/[redacted] status=204 bytes=0 duration_ms=`} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("missing %q in:\n%s", expected, output)
+		}
+	}
+
+	// ids which do not look like one are replaced
+	request = httptest.NewRequest("GET", "/posts", nil)
+	request.Header.Set(REQUEST_ID_HEADER, "bad id\nwith a newline")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if id := recorder.Header().Get(REQUEST_ID_HEADER); !REQUEST_ID.MatchString(id) || strings.Contains(id, " ") {
+		t.Errorf("unexpected request id %q", id)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// the request id is taken from, and echoed in, this header
+	REQUEST_ID_HEADER = "X-Request-Id"
+)
+
+var (
+	// the request ids accepted from a proxy in front of the server (others
+	// are replaced)
+	REQUEST_ID = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+)
+
+type contextKey int
+
+const loggerKey contextKey = 0
+
+// Records the status code and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.size += n
+	return n, err
+}
+
+// A new random request id
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The logger for this request, which tags each line with its id (or the
+// plain logger, outside of Requests)
+func FromRequest(r *http.Request) *Logger {
+	if r != nil {
+		if l, exists := r.Context().Value(loggerKey).(*Logger); exists {
+			return l
+		}
+	}
+	return root
+}
+
+// The request, with a logger which also adds these key/value pairs to each
+// line (e.g., the trace id)
+func WithFields(r *http.Request, keyvals ...interface{}) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerKey, FromRequest(r).With(keyvals...)))
+}
+
+// The path, without the session ids in api paths (e.g., when revoking one)
+// or any email addresses
+func RedactPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i := 1; i < len(segments); i++ {
+		if segments[i-1] == "sessions" && len(segments[i]) > 0 && segments[i] != "confirm" {
+			segments[i] = REDACTED
+		}
+	}
+	return Redact(strings.Join(segments, "/"))
+}
+
+// The client's address, without the port
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Give each request an id (the one in the X-Request-Id header, if it looks
+// like one), echoed in the response's X-Request-Id header and added to each
+// of its log lines, and log it once done, with its status and latency
+func Requests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !REQUEST_ID.MatchString(id) {
+			id = NewRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+
+		logger := root.With("request_id", id)
+		recorder := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			logger.Info("request",
+				"method", r.Method,
+				"path", RedactPath(r.URL.Path),
+				"status", recorder.status,
+				"bytes", recorder.size,
+				"duration_ms", float64(time.Since(start).Microseconds())/1000,
+				"remote", remoteAddress(r))
+		}()
+
+		handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), loggerKey, logger)))
+	})
+}
@@ -5,122 +5,208 @@ package main
 
 import (
 	"bytes"
+	"expvar"
 	"flag"
 	"github.com/Banrai/TeamWork.io/server/api"
+	"github.com/Banrai/TeamWork.io/server/config"
 	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/emailer"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/metrics"
+	"github.com/Banrai/TeamWork.io/server/tracing"
 	"github.com/Banrai/TeamWork.io/server/ui"
 	"log"
 	"net/http"
+	"os"
 )
 
 const (
-	// default server definitions
-	hostname  = "teamwork.io"
-	server    = "localhost"
-	port      = 8080
-	useSSL    = true
-	templates = "/opt/data/html/templates"
-
-	// default database coordinates
-	DBName = "db"
-	DBUser = "user"
-	DBPass = "pass"
-	DBSSL  = true
-	WORDS  = "/usr/share/dict/words"
-
-	// process donations with stripe.com
-	stripeDefaultPK = "pk_test_"
-	stripeDefaultSK = "sk_test_"
-
 	// generate the static HTML files?
 	statics      = false
 	staticFolder = "/tmp"
 )
 
+// the handlers which are not traced
+var untraced = map[string]bool{api.HEALTH_PATH: true}
+
+// Apply the settings which can change while the server runs (on SIGHUP):
+// the templates and the word list are read first, and only if both can be
+// read, are they used, along with the log, tracing, session, message and
+// mail settings (which the config package has already checked), so a
+// failed reload changes nothing
+func configure(settings *config.Config) error {
+	templates, err := ui.ParseTemplates(settings.Server.Templates)
+	if err != nil {
+		return err
+	}
+	words, err := database.LoadWords(settings.Sessions.Words, ui.SESSION_WORDS)
+	if err != nil {
+		return err
+	}
+
+	ui.UseTemplates(templates)
+	database.UseWords(words)
+	ui.Configure(ui.Settings{SessionDuration: settings.Sessions.Duration,
+		MessageDuration: settings.Messages.Duration,
+		ContactSender:   settings.Mail.Sender,
+		PostsPerPage:    int64(settings.Messages.PerPage)})
+	emailer.Configure(settings.Mail.Server, settings.Mail.Port)
+	logging.Configure(settings.Server.LogLevel, settings.Server.LogFormat)
+	tracing.Configure(settings.Tracing.Endpoint, settings.Tracing.ServiceName, settings.Tracing.SamplePercent)
+	return nil
+}
+
 func main() {
 	var (
-		dbName, dbUser, dbPass, hostName, serverHost, wordsFile, templatesFolder, staticOutputFolder, stripePK, stripeSK string
-		serverPort                                                                                                       int
-		dbSSLMode, useServerSSL, makeStaticFiles                                                                         bool
+		staticOutputFolder string
+		makeStaticFiles    bool
 	)
 
-	// get server settings from the command line args
-	flag.StringVar(&hostName, "host", hostname, "The (externally-facing) name of the server")
-	flag.StringVar(&serverHost, "ip", server, "The hostname or IP address of the server")
-	flag.IntVar(&serverPort, "port", port, "The server port")
-	flag.BoolVar(&useServerSSL, "ssl", useSSL, "Does the server use SSL?")
-	flag.StringVar(&templatesFolder, "templates", templates, "Path to html templates and static resources")
-
-	// get database settings from the command line args
-	flag.StringVar(&dbUser, "dbUser", DBUser, "The database user")
-	flag.StringVar(&dbPass, "dbPass", DBPass, "The database password")
-	flag.StringVar(&dbName, "dbName", DBName, "The database name")
-	flag.BoolVar(&dbSSLMode, "dbSSL", DBSSL, "Does the database use SSL mode?")
-	flag.StringVar(&wordsFile, "words", WORDS, "Dictionary file (for generating random session codes)")
-
-	// get the payment coordinates
-	flag.StringVar(&stripePK, "stripePK", stripeDefaultPK, "The Stripe Public Key")
-	flag.StringVar(&stripeSK, "stripeSK", stripeDefaultSK, "The Stripe Secret Key")
-
 	// versus static file generation and exit
 	flag.BoolVar(&makeStaticFiles, "staticHtml", statics, "Generate the static HTML files? (if yes, does not start the server)")
 	flag.StringVar(&staticOutputFolder, "staticHtmlFolder", staticFolder, "Output folder for the static HTML files")
 
-	flag.Parse()
+	// the server settings, from the configuration file, the environment
+	// and the command line args
+	settings, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// anything still written with the log package (e.g., by net/http) is
+	// structured too
+	log.SetFlags(0)
+	log.SetOutput(logging.Writer(logging.LEVEL_ERROR))
+	configErr := configure(settings)
+	if configErr != nil {
+		logging.Fatal("Cannot configure the server", "error", configErr)
+	}
+
+	modeErr := api.ValidateServerMode(settings.Server.Mode, settings.Server.CertFile, settings.Server.KeyFile)
+	if modeErr != nil {
+		logging.Fatal("Invalid server mode", "error", modeErr)
+	}
 
-	coords := database.DBConnection{DBName: dbName, User: dbUser, Pass: dbPass, SSLMode: dbSSLMode}
-	wordsInit := database.InitializeWords(wordsFile)
-	if wordsInit != nil {
-		log.Fatal(wordsInit)
+	coords := settings.Database.Connection()
+	dbErr := coords.Validate()
+	if dbErr != nil {
+		logging.Fatal("Invalid database settings", "error", dbErr)
 	}
 
 	// define the external-facing server link
 	// for email confirmations, etc.
 	var buffer bytes.Buffer
 	buffer.WriteString("http")
-	if useServerSSL {
+	if settings.Server.SSL {
 		buffer.WriteString("s")
 	}
 	buffer.WriteString("://")
-	buffer.WriteString(hostName)
+	buffer.WriteString(settings.Server.Host)
 
 	serverLink := make([]interface{}, 1)
 	serverLink[0] = buffer.String()
 
 	statics := map[string]http.Handler{}
-	statics["/css/"] = ui.StaticFolder("css", templatesFolder)
-	statics["/js/"] = ui.StaticFolder("js", templatesFolder)
-	statics["/fonts/"] = ui.StaticFolder("fonts", templatesFolder)
-	statics["/images/"] = ui.StaticFolder("images", templatesFolder)
-
-	ui.InitializeTemplates(templatesFolder)
+	statics["/css/"] = ui.StaticFolder("css", settings.Server.Templates)
+	statics["/js/"] = ui.StaticFolder("js", settings.Server.Templates)
+	statics["/fonts/"] = ui.StaticFolder("fonts", settings.Server.Templates)
+	statics["/images/"] = ui.StaticFolder("images", settings.Server.Templates)
+
+	// (each reload reads the same sources as at startup, so the startup
+	// settings, which everything else here uses, stay as they are)
+	api.OnReload(func() error {
+		reloaded, reloadErr := settings.Reload()
+		if reloadErr != nil {
+			return reloadErr
+		}
+		return configure(reloaded)
+	})
+	ui.InitializeRateLimits(settings.Sessions.PerEmail, settings.Sessions.PerIP, settings.Sessions.LimitPeriod, settings.Sessions.LimitDB)
+	keyLogInit := api.InitializeKeyLog(settings.KeyLog.KeyFile)
+	if keyLogInit != nil {
+		logging.Fatal("Cannot start the key log", "error", keyLogInit)
+	}
 
 	handlers := map[string]func(http.ResponseWriter, *http.Request){}
-	handlers["/browser/"] = ui.UnsupportedBrowserHandler(templatesFolder)
+	handlers["/browser/"] = ui.UnsupportedBrowserHandler(settings.Server.Templates)
 	handlers["/addpost"] = ui.MakeHTMLHandler(ui.PostMessage, coords)
-	handlers["/session"] = ui.MakeHTMLHandler(ui.CreateSession, coords)
-	handlers["/confirm"] = ui.MakeHTMLHandler(ui.ConfirmSession, coords)
+	handlers["/session"] = ui.MakeHTMLHandler(ui.CreateSession, coords, settings.Server.Privacy)
+	handlers["/confirm"] = ui.MakeHTMLHandler(ui.ConfirmSession, coords, settings.Server.Privacy)
+	handlers["/challenge"] = ui.MakeHTMLHandler(ui.ChallengeSession, coords, settings.Server.Privacy)
+	handlers["/logout"] = ui.MakeHTMLHandler(ui.Logout, coords)
+	handlers["/sessions"] = ui.MakeHTMLHandler(ui.ManageSessions, coords)
 	handlers["/upload"] = ui.MakeHTMLHandler(ui.UploadKey, coords)
 	handlers["/posts"] = ui.MakeHTMLHandler(ui.DisplayPosts, coords)
 	handlers["/download"] = ui.MakeHTMLHandler(ui.DownloadMessage, coords, serverLink[0])
+	handlers["/admin"] = ui.MakeHTMLHandler(ui.Admin, coords)
 
 	// payment processing requires some additional parameters
 	stripeVals := make([]interface{}, 2)
-	stripeVals[0] = stripePK
-	stripeVals[1] = stripeSK
+	stripeVals[0] = settings.Stripe.PublicKey
+	stripeVals[1] = settings.Stripe.SecretKey
 	handlers["/donate"] = ui.MakeHTMLHandler(ui.ProcessDonation, coords, stripeVals[0], stripeVals[1])
 
+	// operator counters, Prometheus metrics and readiness (which connects
+	// to the database and the mail server, and reports their errors), on
+	// their own listener if there is one, or else only for operators
+	// (restrict access to them at the web server, in the fcgi mode)
+	operator := map[string]func(http.ResponseWriter, *http.Request){}
+	operator["/debug/vars"] = expvar.Handler().ServeHTTP
+	metrics.OnScrape(ui.RecordStatistics(coords))
+	operator["/metrics"] = metrics.Handler()
+	operator[api.READINESS_PATH] = api.ReadinessHandler(api.ReadinessChecks(coords))
+
+	// liveness, for the orchestrator
+	handlers[api.HEALTH_PATH] = api.HealthHandler()
+
 	handlers["/searchPublicKeys"] = func(w http.ResponseWriter, r *http.Request) {
 		lookup := func(w http.ResponseWriter, r *http.Request) string {
-			return api.SearchPersonPublicKeys(r, coords)
+			return api.SearchPersonPublicKeys(w, r, coords, settings.Server.Privacy)
 		}
 		api.Respond("application/json", "utf-8", lookup)(w, r)
 	}
 
+	// the versioned json api
+	handlers[api.API_V1_PREFIX] = api.V1Handler(coords, settings.Server.Privacy)
+
+	// the published key transparency log
+	handlers[api.KEY_LOG_PREFIX] = api.KeyLogHandler(coords)
+
 	if makeStaticFiles {
-		ui.GenerateStaticFiles(templatesFolder, staticFolder)
+		ui.GenerateStaticFiles(settings.Server.Templates, staticOutputFolder)
 	} else {
-		api.RequestServer(serverHost, api.DefaultServerTransport, serverPort, api.DefaultServerReadTimeout, statics, handlers)
+		// count and time the requests to each handler, and trace them
+		// (except for the health checks and operator paths, which are polled)
+		for pattern, handler := range handlers {
+			handler = metrics.InstrumentFunc(pattern, handler)
+			if !untraced[pattern] {
+				handler = tracing.HandlerFunc(pattern, handler)
+			}
+			handlers[pattern] = handler
+		}
+		for pattern, handler := range statics {
+			statics[pattern] = metrics.Instrument(pattern, handler)
+		}
+		for pattern, handler := range operator {
+			operator[pattern] = metrics.InstrumentFunc(pattern, handler)
+		}
+		if len(settings.Server.OperatorAddress) > 0 {
+			if err := api.OperatorServer(settings.Server.OperatorAddress, operator); err != nil {
+				logging.Fatal("Cannot listen for operators", "address", settings.Server.OperatorAddress, "error", err)
+			}
+		} else {
+			for pattern, handler := range operator {
+				handlers[pattern] = api.OperatorOnly(settings.Server.Mode, handler)
+			}
+		}
+
+		if settings.Messages.ExpiryInterval > 0 {
+			database.StartExpiryWorker(coords, settings.Messages.ExpiryInterval)
+		}
+		api.RequestServer(settings.Server.Mode, settings.Server.IP, api.DefaultServerTransport, settings.Server.Port, settings.Server.ReadTimeout, settings.Server.ShutdownTimeout, settings.Server.CertFile, settings.Server.KeyFile, statics, handlers)
+
+		// send the spans of the last requests
+		tracing.Flush(tracing.EXPORT_TIMEOUT)
 	}
 
 }
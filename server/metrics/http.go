@@ -0,0 +1,74 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	HTTPRequests        = NewCounter("http_requests_total", "HTTP requests, by handler, method and status code", "handler", "method", "code")
+	HTTPRequestDuration = NewHistogram("http_request_duration_seconds", "HTTP request latency, by handler and method", "handler", "method")
+	HTTPInFlight        = NewGauge("http_requests_in_flight", "HTTP requests in progress")
+)
+
+// Records the status code written by a handler (200 if it only writes a
+// body)
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// The method, as a label (any client can send others, which would make
+// new series without limit)
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// Count the requests to this handler, by method and status code, and time
+// them, under this name (its pattern, so that the labels stay few)
+func Instrument(name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		HTTPInFlight.Add(1)
+		defer func() {
+			HTTPInFlight.Add(-1)
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			method := methodLabel(r.Method)
+			HTTPRequests.Inc(name, method, strconv.Itoa(recorder.status))
+			HTTPRequestDuration.Since(start, name, method)
+		}()
+
+		handler.ServeHTTP(recorder, r)
+	})
+}
+
+// Instrument this handler function
+func InstrumentFunc(name string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return Instrument(name, http.HandlerFunc(handler)).ServeHTTP
+}
@@ -0,0 +1,252 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package metrics keeps the server's counters, gauges and histograms, and
+// publishes them in the Prometheus text format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the version of the Prometheus text format written by Handler
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+	// every metric name starts with this
+	NAMESPACE = "teamwork_"
+
+	COUNTER   = "counter"
+	GAUGE     = "gauge"
+	HISTOGRAM = "histogram"
+)
+
+var (
+	// the default histogram buckets (in seconds), from 5ms to 10s
+	DEFAULT_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	// every metric, in the order created, and the functions which refresh
+	// the gauges before each scrape
+	registry = struct {
+		sync.Mutex
+		metrics  []*Metric
+		scrapers []func()
+	}{}
+)
+
+// A counter, gauge or histogram, with one series for each combination of
+// its label values
+type Metric struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+// The values for one combination of label values (for a histogram, the
+// count in each bucket, along with the overall sum and count)
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newMetric(name, help, kind string, buckets []float64, labels []string) *Metric {
+	m := &Metric{name: NAMESPACE + name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series)}
+
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics = append(registry.metrics, m)
+	return m
+}
+
+// A counter with these label names, e.g., NewCounter("emails_total",
+// "Session emails", "outcome")
+func NewCounter(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, COUNTER, nil, labels)
+}
+
+// A gauge with these label names
+func NewGauge(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, GAUGE, nil, labels)
+}
+
+// A histogram of durations with these label names, using the
+// DEFAULT_BUCKETS
+func NewHistogram(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, HISTOGRAM, DEFAULT_BUCKETS, labels)
+}
+
+// Call fn before each scrape, e.g., to set gauges from the database
+func OnScrape(fn func()) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.scrapers = append(registry.scrapers, fn)
+}
+
+// Find (or start) the series for these label values, which must be given
+// in the order of the metric's label names (missing ones are empty)
+func (m *Metric) find(values []string) *series {
+	labels := make([]string, len(m.labels))
+	copy(labels, values)
+	key := strings.Join(labels, "\xff")
+
+	s, exists := m.series[key]
+	if !exists {
+		s = &series{labels: labels, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add one to the counter
+func (m *Metric) Inc(values ...string) {
+	m.Add(1, values...)
+}
+
+// Add this amount to the counter (never negative) or gauge
+func (m *Metric) Add(amount float64, values ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.find(values).value += amount
+}
+
+// Set the gauge
+func (m *Metric) Set(value float64, values ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.find(values).value = value
+}
+
+// The counter's or gauge's value (or the histogram's sum), e.g., for tests
+func (m *Metric) Value(values ...string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.find(values).value
+}
+
+// Record one observation in the histogram
+func (m *Metric) Observe(value float64, values ...string) {
+	m.Lock()
+	defer m.Unlock()
+	s := m.find(values)
+	for i, upper := range m.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.value += value
+	s.count++
+}
+
+// Record the time since start in the histogram, in seconds
+func (m *Metric) Since(start time.Time, values ...string) {
+	m.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Escape a label value (or, without the quotes, help text)
+func escape(value string, quotes bool) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	if quotes {
+		replacer = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+	}
+	return replacer.Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// The {name="value",...} part of a sample, with an extra label if given
+func (m *Metric) labelPairs(values []string, extra, extraValue string) string {
+	pairs := make([]string, 0)
+	for i, label := range m.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escape(values[i], true)))
+	}
+	if len(extra) > 0 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Write the metric in the text format, with its series sorted by their
+// label values
+func (m *Metric) write(buffer *bytes.Buffer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(buffer, "# HELP %s %s\n", m.name, escape(m.help, false))
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0)
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != HISTOGRAM {
+			fmt.Fprintf(buffer, "%s%s %s\n", m.name, m.labelPairs(s.labels, "", ""), formatValue(s.value))
+			continue
+		}
+		for i, upper := range m.buckets {
+			fmt.Fprintf(buffer, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labels, "le", formatValue(upper)), s.counts[i])
+		}
+		fmt.Fprintf(buffer, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(buffer, "%s_sum%s %s\n", m.name, m.labelPairs(s.labels, "", ""), formatValue(s.value))
+		fmt.Fprintf(buffer, "%s_count%s %d\n", m.name, m.labelPairs(s.labels, "", ""), s.count)
+	}
+}
+
+// Write every metric in the text format
+func Write(buffer *bytes.Buffer) {
+	registry.Lock()
+	metrics := registry.metrics
+	scrapers := registry.scrapers
+	registry.Unlock()
+
+	for _, fn := range scrapers {
+		fn()
+	}
+	for _, m := range metrics {
+		m.write(buffer)
+	}
+}
+
+// Serve every metric in the text format, for Prometheus to scrape
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buffer bytes.Buffer
+		Write(&buffer)
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", buffer.Len()))
+		buffer.WriteTo(w)
+	}
+}
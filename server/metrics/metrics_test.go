@@ -0,0 +1,94 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounter("test_events_total", "Test events, by kind", "kind")
+	counter.Inc("b")
+	counter.Add(2, "a \"quoted\"\nvalue")
+
+	gauge := NewGauge("test_level", "A test level")
+	gauge.Set(1.5)
+
+	histogram := NewHistogram("test_duration_seconds", "Test durations", "name")
+	histogram.Observe(0.02, "x")
+	histogram.Observe(3, "x")
+
+	if counter.Value("b") != 1 || gauge.Value() != 1.5 || histogram.Value("x") != 3.02 {
+		t.Errorf("unexpected values %v, %v and %v", counter.Value("b"), gauge.Value(), histogram.Value("x"))
+	}
+
+	var buffer bytes.Buffer
+	for _, m := range []*Metric{counter, gauge, histogram} {
+		m.write(&buffer)
+	}
+
+	expected := `# HELP teamwork_test_events_total Test events, by kind
+# TYPE teamwork_test_events_total counter
+teamwork_test_events_total{kind="a \"quoted\"\nvalue"} 2
+teamwork_test_events_total{kind="b"} 1
+# HELP teamwork_test_level A test level
+# TYPE teamwork_test_level gauge
+teamwork_test_level 1.5
+# HELP teamwork_test_duration_seconds Test durations
+# TYPE teamwork_test_duration_seconds histogram
+teamwork_test_duration_seconds_bucket{name="x",le="0.005"} 0
+teamwork_test_duration_seconds_bucket{name="x",le="0.01"} 0
+teamwork_test_duration_seconds_bucket{name="x",le="0.025"} 1
+teamwork_test_duration_seconds_bucket{name="x",le="0.05"} 1
+teamwork_test_duration_seconds_bucket{name="x",le="0.1"} 1
+teamwork_test_duration_seconds_bucket{name="x",le="0.25"} 1
+teamwork_test_duration_seconds_bucket{name="x",le="0.5"} 1
+teamwork_test_duration_seconds_bucket{name="x",le="1"} 1
+teamwork_test_duration_seconds_bucket{name="x",le="2.5"} 1
+teamwork_test_duration_seconds_bucket{name="x",le="5"} 2
+teamwork_test_duration_seconds_bucket{name="x",le="10"} 2
+teamwork_test_duration_seconds_bucket{name="x",le="+Inf"} 2
+teamwork_test_duration_seconds_sum{name="x"} 3.02
+teamwork_test_duration_seconds_count{name="x"} 2
+`
+	if buffer.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buffer.String(), expected)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	handler := Instrument("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/test/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	for _, path := range []string{"/test", "/test", "/test/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/test", nil))
+
+	recorder := httptest.NewRecorder()
+	Handler()(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Header().Get("Content-Type") != CONTENT_TYPE {
+		t.Errorf("unexpected content type %q", recorder.Header().Get("Content-Type"))
+	}
+
+	output := recorder.Body.String()
+	for _, sample := range []string{`teamwork_http_requests_total{handler="/test",method="GET",code="200"} 2`,
+		`teamwork_http_requests_total{handler="/test",method="GET",code="404"} 1`,
+		`teamwork_http_requests_total{handler="/test",method="other",code="200"} 1`,
+		`teamwork_http_request_duration_seconds_count{handler="/test",method="GET"} 3`,
+		`teamwork_http_requests_in_flight 0`} {
+		if !strings.Contains(output, sample+"\n") {
+			t.Errorf("missing %s in:\n%s", sample, output)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/metrics"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// spans are sent when this many are waiting, or every interval
+	BATCH_SIZE      = 256
+	EXPORT_INTERVAL = 5 * time.Second
+	EXPORT_TIMEOUT  = 10 * time.Second
+
+	// spans ended while this many are waiting are dropped
+	QUEUE_SIZE = 2048
+
+	// the instrumentation scope of every span
+	SCOPE_NAME = "github.com/Banrai/TeamWork.io/server/tracing"
+)
+
+var (
+	SpansExported = metrics.NewCounter("tracing_spans_total", "Recorded spans, by outcome (exported, failed or dropped)", "outcome")
+
+	// the spans waiting for export, and the requests to send them now
+	spans   = make(chan *Span, QUEUE_SIZE)
+	flushes = make(chan chan struct{})
+	started sync.Once
+)
+
+// The OTLP/HTTP json encoding (see opentelemetry-proto's trace.proto)
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// Start the export goroutine, once
+func startExporter() {
+	started.Do(func() {
+		go export()
+	})
+}
+
+// Queue the span for the next batch, unless the queue is full
+func queue(s *Span) {
+	select {
+	case spans <- s:
+	default:
+		SpansExported.Inc("dropped")
+	}
+}
+
+// Send the waiting spans in batches, until the process ends
+func export() {
+	batch := make([]*Span, 0, BATCH_SIZE)
+	ticker := time.NewTicker(EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case s := <-spans:
+			batch = append(batch, s)
+			if len(batch) >= BATCH_SIZE {
+				batch = send(batch)
+			}
+		case <-ticker.C:
+			batch = send(batch)
+		case done := <-flushes:
+			for waiting := true; waiting; {
+				select {
+				case s := <-spans:
+					batch = append(batch, s)
+				default:
+					waiting = false
+				}
+			}
+			batch = send(batch)
+			close(done)
+		}
+	}
+}
+
+// Send the spans waiting for export now (e.g., before exiting), returning
+// once they are sent, or after the timeout
+func Flush(timeout time.Duration) {
+	if !Enabled() {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case flushes <- done:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// Post this batch to the collector, and return it emptied
+func send(batch []*Span) []*Span {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	settings.RLock()
+	endpoint, service := settings.endpoint, settings.service
+	settings.RUnlock()
+	if len(endpoint) == 0 {
+		// tracing was turned off (on reload) since these ended
+		SpansExported.Add(float64(len(batch)), "dropped")
+		return batch[:0]
+	}
+
+	err := post(endpoint, encode(batch, service))
+	if err != nil {
+		logging.Warn("Cannot export spans", "endpoint", endpoint, "spans", len(batch), "error", err)
+		SpansExported.Add(float64(len(batch)), "failed")
+	} else {
+		SpansExported.Add(float64(len(batch)), "exported")
+	}
+	return batch[:0]
+}
+
+func post(endpoint string, body []byte) error {
+	client := &http.Client{Timeout: EXPORT_TIMEOUT}
+	response, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("The collector responded %s", response.Status)
+	}
+	return nil
+}
+
+// The spans, as an OTLP/HTTP json request from this service
+func encode(batch []*Span, service string) []byte {
+	var scope otlpScopeSpans
+	scope.Scope.Name = SCOPE_NAME
+
+	for _, s := range batch {
+		s.Lock()
+		span := otlpSpan{TraceID: s.context.TraceIDString(),
+			SpanID:            s.context.SpanIDString(),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        attributes(s.attributes),
+			Status:            otlpStatus{Code: s.status, Message: logging.Redact(s.message)}}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = SpanContext{SpanID: s.parent}.SpanIDString()
+		}
+		s.Unlock()
+		scope.Spans = append(scope.Spans, span)
+	}
+
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = attributes([]interface{}{"service.name", service})
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+
+	data, _ := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{resource}})
+	return data
+}
+
+// The key/value pairs as OTLP attributes, with any email addresses in
+// their text, and the values of the logging package's REDACTED_KEYS,
+// redacted (as in the logs)
+func attributes(keyvals []interface{}) []otlpAttribute {
+	result := make([]otlpAttribute, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value map[string]interface{}
+		switch v := keyvals[i+1].(type) {
+		case nil:
+			continue
+		case string:
+			if logging.REDACTED_KEYS[key] {
+				v = logging.REDACTED
+			}
+			value = map[string]interface{}{"stringValue": logging.Redact(v)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			value = map[string]interface{}{"intValue": fmt.Sprintf("%d", v)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		case error:
+			value = map[string]interface{}{"stringValue": logging.Redact(v.Error())}
+		default:
+			value = map[string]interface{}{"stringValue": logging.Redact(fmt.Sprint(v))}
+		}
+		result = append(result, otlpAttribute{Key: key, Value: value})
+	}
+	return result
+}
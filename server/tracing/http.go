@@ -0,0 +1,86 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"context"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"net/http"
+)
+
+// Records the status code written by a handler (200 if it only writes a
+// body)
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Record a server span for each request to this handler, named by its
+// pattern, which continues the trace in the request's traceparent header:
+// the handler gets the span in the request's context, and its log lines
+// are tagged with the trace id
+func Handler(name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Enabled() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, span := Start(Extract(r.Context(), r.Header), r.Method+" "+name, KIND_SERVER,
+			"http.request.method", r.Method,
+			"http.route", name,
+			"url.path", logging.RedactPath(r.URL.Path))
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			span.SetAttributes("http.response.status_code", recorder.status)
+			if recorder.status >= http.StatusInternalServerError {
+				span.Fail(httpError(recorder.status))
+			}
+			span.End()
+		}()
+
+		r = logging.WithFields(r.WithContext(ctx), "trace_id", span.TraceID())
+		handler.ServeHTTP(recorder, r)
+	})
+}
+
+// Trace this handler function
+func HandlerFunc(name string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return Handler(name, http.HandlerFunc(handler)).ServeHTTP
+}
+
+// Start a client span for this outgoing request, and add its traceparent
+// header
+func StartRequest(ctx context.Context, request *http.Request) (context.Context, *Span) {
+	ctx, span := Start(ctx, request.Method, KIND_CLIENT,
+		"http.request.method", request.Method,
+		"server.address", request.URL.Hostname(),
+		"url.full", request.URL.String())
+	Inject(ctx, request.Header)
+	return ctx, span
+}
+
+// An unsuccessful status code, as an error
+type httpError int
+
+func (e httpError) Error() string {
+	return http.StatusText(int(e))
+}
@@ -0,0 +1,249 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package tracing records OpenTelemetry spans (around the handlers,
+// database statements, url fetches, key server searches and emails), and
+// exports them, in batches, to an OTLP/HTTP collector (json encoded).
+//
+// Tracing is off until Configure is given a collector endpoint: Start then
+// returns a nil *Span, whose methods do nothing, so callers need not check.
+// Trace context arrives and leaves in the W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// the span kinds, as numbered by OTLP
+	KIND_INTERNAL = 1
+	KIND_SERVER   = 2
+	KIND_CLIENT   = 3
+
+	// the span status codes, as numbered by OTLP
+	STATUS_UNSET = 0
+	STATUS_ERROR = 2
+
+	// the W3C trace context header
+	TRACEPARENT_HEADER = "traceparent"
+
+	DEFAULT_SERVICE_NAME = "teamwork"
+
+	INVALID_ENDPOINT       = "The tracing endpoint must be an http or https url (e.g., http://localhost:4318/v1/traces)"
+	INVALID_SAMPLE_PERCENT = "The tracing sample percent must be between 0 and 100"
+)
+
+var (
+	// version-trace id-parent id-flags (later versions may add fields)
+	TRACEPARENT = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+	// what Configure set
+	settings = struct {
+		sync.RWMutex
+		endpoint      string
+		service       string
+		samplePercent int
+	}{}
+)
+
+// Identifies a span, and whether its trace is recorded
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// A unit of work, from Start until End
+type Span struct {
+	sync.Mutex
+	name       string
+	kind       int
+	context    SpanContext
+	parent     [8]byte
+	start, end time.Time
+	attributes []interface{}
+	status     int
+	message    string
+	ended      bool
+}
+
+// Export spans to the OTLP/HTTP collector at this url (none, if empty),
+// naming this service, and record this percentage of the traces started
+// here (the others follow the sampling decision of the incoming request)
+func Configure(endpoint, serviceName string, samplePercent int) error {
+	if len(endpoint) > 0 {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errors.New(INVALID_ENDPOINT)
+		}
+	}
+	if samplePercent < 0 || samplePercent > 100 {
+		return errors.New(INVALID_SAMPLE_PERCENT)
+	}
+	if len(serviceName) == 0 {
+		serviceName = DEFAULT_SERVICE_NAME
+	}
+
+	settings.Lock()
+	settings.endpoint = endpoint
+	settings.service = serviceName
+	settings.samplePercent = samplePercent
+	settings.Unlock()
+
+	if len(endpoint) > 0 {
+		startExporter()
+	}
+	return nil
+}
+
+// Are spans exported?
+func Enabled() bool {
+	settings.RLock()
+	defer settings.RUnlock()
+	return len(settings.endpoint) > 0
+}
+
+// Record a new trace, started here?
+func sample() bool {
+	settings.RLock()
+	percent := settings.samplePercent
+	settings.RUnlock()
+
+	var n [2]byte
+	rand.Read(n[:])
+	return int(binary.BigEndian.Uint16(n[:])%100) < percent
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+func (sc SpanContext) TraceIDString() string { return hex.EncodeToString(sc.TraceID[:]) }
+func (sc SpanContext) SpanIDString() string  { return hex.EncodeToString(sc.SpanID[:]) }
+
+// The traceparent header value for this span
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceIDString() + "-" + sc.SpanIDString() + "-" + flags
+}
+
+// Read a traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := TRACEPARENT.FindStringSubmatch(value)
+	if parts == nil || parts[1] == "ff" || (parts[1] == "00" && len(parts[5]) > 0) {
+		return sc, false
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[2]))
+	hex.Decode(sc.SpanID[:], []byte(parts[3]))
+	flags, _ := hex.DecodeString(parts[4])
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// The span in progress in this context (or the remote one it continues)
+func SpanContextFrom(ctx context.Context) (SpanContext, bool) {
+	sc, exists := ctx.Value(spanKey).(SpanContext)
+	return sc, exists && sc.IsValid()
+}
+
+// A context continuing the trace in these (incoming) headers, if any
+func Extract(ctx context.Context, header http.Header) context.Context {
+	if sc, valid := ParseTraceparent(header.Get(TRACEPARENT_HEADER)); valid {
+		return context.WithValue(ctx, spanKey, sc)
+	}
+	return ctx
+}
+
+// Add the span in progress in this context to these (outgoing) headers
+func Inject(ctx context.Context, header http.Header) {
+	if sc, exists := SpanContextFrom(ctx); exists && Enabled() {
+		header.Set(TRACEPARENT_HEADER, sc.Traceparent())
+	}
+}
+
+// Start a span, a child of the one in this context (if any), with these
+// attributes (as key/value pairs, like log lines): the context returned
+// holds it, for its own children
+func Start(ctx context.Context, name string, kind int, keyvals ...interface{}) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+
+	span := &Span{name: name, kind: kind, start: time.Now(), attributes: keyvals}
+	if parent, exists := SpanContextFrom(ctx); exists {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = sample()
+	}
+	rand.Read(span.context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey, span.context), span
+}
+
+// The span's trace id, as hex (empty if there is no span)
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.context.TraceIDString()
+}
+
+// Add these attributes (as key/value pairs)
+func (s *Span) SetAttributes(keyvals ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attributes = append(s.attributes, keyvals...)
+}
+
+// Mark the span as failed with this error (if not nil)
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.status = STATUS_ERROR
+	s.message = err.Error()
+}
+
+// End the span, and queue it for export if its trace is recorded
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.Unlock()
+
+	if s.context.Sampled {
+		queue(s)
+	}
+}
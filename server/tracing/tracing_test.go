@@ -0,0 +1,150 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceparent(t *testing.T) {
+	sc, valid := ParseTraceparent(parent)
+	if !valid || !sc.Sampled || sc.TraceIDString() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanIDString() != "00f067aa0ba902b7" {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v", parent, sc, valid)
+	}
+	if sc.Traceparent() != parent {
+		t.Errorf("Traceparent() = %q, expected %q", sc.Traceparent(), parent)
+	}
+
+	for _, invalid := range []string{"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"} {
+		if _, valid := ParseTraceparent(invalid); valid {
+			t.Errorf("ParseTraceparent(%q) accepted an invalid header", invalid)
+		}
+	}
+
+	// later versions may add fields
+	if _, valid := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !valid {
+		t.Error("a later version was refused")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	if err := Configure("", "", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := Start(context.Background(), "nothing", KIND_INTERNAL)
+	if span != nil || ctx != context.Background() {
+		t.Error("a span was started with tracing disabled")
+	}
+	span.SetAttributes("key", "value")
+	span.Fail(errors.New("ignored"))
+	span.End()
+
+	header := http.Header{}
+	Inject(Extract(context.Background(), http.Header{TRACEPARENT_HEADER: {parent}}), header)
+	if len(header) > 0 {
+		t.Errorf("trace context was propagated with tracing disabled: %v", header)
+	}
+
+	if Configure("localhost:4318", "", 100) == nil || Configure("", "", 101) == nil {
+		t.Error("invalid settings were accepted")
+	}
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan otlpRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpRequest
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("invalid request %s: %v", body, err)
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+
+	if err := Configure(collector.URL+"/v1/traces", "teamwork-test", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure("", "", 100)
+
+	// the incoming trace is continued (even if new ones are not sampled),
+	// and its context sent on to the fetch
+	var outgoing string
+	handler := Handler("/posts", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := httptest.NewRequest("GET", "http://pgp.mit.edu/pks/lookup?search=me@example.org", nil)
+		_, fetch := StartRequest(r.Context(), request)
+		outgoing = request.Header.Get(TRACEPARENT_HEADER)
+		fetch.Fail(errors.New("no route to me@example.org"))
+		fetch.End()
+		http.Error(w, "failed", http.StatusBadGateway)
+	}))
+	request := httptest.NewRequest("POST", "/posts", nil)
+	request.Header.Set(TRACEPARENT_HEADER, parent)
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	// new traces are not recorded at 0 percent
+	_, unsampled := Start(context.Background(), "unsampled", KIND_INTERNAL)
+	unsampled.End()
+
+	Flush(time.Second)
+
+	var exported []otlpSpan
+	select {
+	case request := <-requests:
+		resource := request.ResourceSpans[0]
+		if resource.Resource.Attributes[0].Value["stringValue"] != "teamwork-test" || resource.ScopeSpans[0].Scope.Name != SCOPE_NAME {
+			t.Errorf("unexpected resource %+v", resource)
+		}
+		exported = resource.ScopeSpans[0].Spans
+	case <-time.After(time.Second):
+		t.Fatal("nothing was exported")
+	}
+	if len(exported) != 2 {
+		t.Fatalf("%d spans exported, expected 2", len(exported))
+	}
+
+	fetch, server := exported[0], exported[1]
+	if server.Name != "POST /posts" || server.Kind != KIND_SERVER || server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" || server.Status.Code != STATUS_ERROR {
+		t.Errorf("unexpected server span %+v", server)
+	}
+	if fetch.Kind != KIND_CLIENT || fetch.TraceID != server.TraceID || fetch.ParentSpanID != server.SpanID || fetch.Status.Message != "no route to [email]" {
+		t.Errorf("unexpected client span %+v", fetch)
+	}
+	if outgoing != "00-"+server.TraceID+"-"+fetch.SpanID+"-01" {
+		t.Errorf("sent traceparent %q", outgoing)
+	}
+
+	values := map[string]interface{}{}
+	for _, a := range append(fetch.Attributes, server.Attributes...) {
+		for _, v := range a.Value {
+			values[a.Key] = v
+		}
+	}
+	for key, expected := range map[string]interface{}{"http.route": "/posts",
+		"http.response.status_code": "502",
+		"url.full":                  "http://pgp.mit.edu/pks/lookup?search=[email]"} {
+		if values[key] != expected {
+			t.Errorf("%s is %v, expected %v", key, values[key], expected)
+		}
+	}
+	if strings.Contains(server.StartTimeUnixNano, "-") || server.EndTimeUnixNano < server.StartTimeUnixNano {
+		t.Errorf("unexpected times %s to %s", server.StartTimeUnixNano, server.EndTimeUnixNano)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package transparency implements the append-only Merkle tree log of public
+// key changes (in the style of Certificate Transparency, RFC 6962): the
+// tree hashes, inclusion and consistency proofs and their verification, and
+// the signed tree heads which the server publishes
+package transparency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+const (
+	// the domain separation prefixes of RFC 6962, section 2.1
+	LEAF_PREFIX = 0x00
+	NODE_PREFIX = 0x01
+
+	INVALID_INDEX       = "The leaf index is not within the tree"
+	INVALID_SIZES       = "The first tree is larger than the second"
+	INVALID_PROOF       = "The proof does not have the expected length"
+	ROOT_MISMATCH       = "The proof does not lead to the expected root hash"
+	EMPTY_CONSISTENCY   = "A consistency proof is needed between different trees"
+	DIFFERENT_SAME_SIZE = "Two trees of the same size have different root hashes"
+)
+
+// The hash of one leaf: sha256 of 0x00 followed by the leaf data
+func LeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{LEAF_PREFIX})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// The hash of an interior node: sha256 of 0x01 followed by both children
+func NodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{NODE_PREFIX})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// The largest power of two smaller than n (for n > 1)
+func split(n int64) int64 {
+	k := int64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// The Merkle tree hash of these leaf hashes, in order
+func RootHash(leaves [][]byte) []byte {
+	n := int64(len(leaves))
+	switch n {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return leaves[0]
+	}
+	k := split(n)
+	return NodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// The audit path for the leaf at this index, in the tree of these leaf
+// hashes (PATH(m, D[n]) in RFC 6962)
+func InclusionProof(leaves [][]byte, index int64) ([][]byte, error) {
+	n := int64(len(leaves))
+	if index < 0 || index >= n {
+		return nil, errors.New(INVALID_INDEX)
+	}
+	return inclusionPath(leaves, index), nil
+}
+
+func inclusionPath(leaves [][]byte, index int64) [][]byte {
+	n := int64(len(leaves))
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := split(n)
+	if index < k {
+		return append(inclusionPath(leaves[:k], index), RootHash(leaves[k:]))
+	}
+	return append(inclusionPath(leaves[k:], index-k), RootHash(leaves[:k]))
+}
+
+// The proof that the tree of the first size leaves is a prefix of the tree
+// of all these leaf hashes (PROOF(m, D[n]) in RFC 6962)
+func ConsistencyProof(leaves [][]byte, size int64) ([][]byte, error) {
+	n := int64(len(leaves))
+	if size < 0 || size > n {
+		return nil, errors.New(INVALID_SIZES)
+	}
+	if size == 0 || size == n {
+		return [][]byte{}, nil
+	}
+	return subproof(leaves, size, true), nil
+}
+
+func subproof(leaves [][]byte, m int64, complete bool) [][]byte {
+	n := int64(len(leaves))
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(subproof(leaves[:k], m, complete), RootHash(leaves[k:]))
+	}
+	return append(subproof(leaves[k:], m-k, false), RootHash(leaves[:k]))
+}
+
+// Check that the leaf with this hash is at the given index of the tree with
+// this size and root hash (RFC 9162, section 2.1.3.2)
+func VerifyInclusion(leafHash []byte, index, size int64, proof [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return errors.New(INVALID_INDEX)
+	}
+
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return errors.New(INVALID_PROOF)
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New(INVALID_PROOF)
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New(ROOT_MISMATCH)
+	}
+	return nil
+}
+
+// Check that the tree with the first size and root hash is a prefix of the
+// tree with the second (RFC 9162, section 2.1.4.2)
+func VerifyConsistency(size1, size2 int64, root1, root2 []byte, proof [][]byte) error {
+	if size1 < 0 || size1 > size2 {
+		return errors.New(INVALID_SIZES)
+	}
+	if size1 == size2 {
+		if len(proof) > 0 {
+			return errors.New(INVALID_PROOF)
+		}
+		if !bytes.Equal(root1, root2) {
+			return errors.New(DIFFERENT_SAME_SIZE)
+		}
+		return nil
+	}
+	if size1 == 0 {
+		// the empty tree is a prefix of every tree
+		if len(proof) > 0 {
+			return errors.New(INVALID_PROOF)
+		}
+		return nil
+	}
+	if len(proof) == 0 {
+		return errors.New(EMPTY_CONSISTENCY)
+	}
+
+	// when the first tree is complete, its root is the start of the path
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+
+	fn, sn := size1-1, size2-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New(INVALID_PROOF)
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New(INVALID_PROOF)
+	}
+	if !bytes.Equal(fr, root1) || !bytes.Equal(sr, root2) {
+		return errors.New(ROOT_MISMATCH)
+	}
+	return nil
+}
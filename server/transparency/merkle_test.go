@@ -0,0 +1,130 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package transparency
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, 0)
+	for i := 0; i < n; i++ {
+		leaves = append(leaves, LeafHash([]byte(fmt.Sprintf("leaf %d", i))))
+	}
+	return leaves
+}
+
+func TestInclusion(t *testing.T) {
+	leaves := testLeaves(20)
+	for n := 1; n <= len(leaves); n++ {
+		root := RootHash(leaves[:n])
+		for i := int64(0); i < int64(n); i++ {
+			proof, err := InclusionProof(leaves[:n], i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyInclusion(leaves[i], i, int64(n), proof, root); err != nil {
+				t.Errorf("leaf %d of %d: %v", i, n, err)
+			}
+			if n > 1 {
+				if err := VerifyInclusion(leaves[(i+1)%int64(n)], i, int64(n), proof, root); err == nil {
+					t.Errorf("leaf %d of %d: the wrong leaf verified", i, n)
+				}
+			}
+		}
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	leaves := testLeaves(20)
+	for n := 1; n <= len(leaves); n++ {
+		root2 := RootHash(leaves[:n])
+		for m := 0; m <= n; m++ {
+			root1 := RootHash(leaves[:m])
+			proof, err := ConsistencyProof(leaves[:n], int64(m))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyConsistency(int64(m), int64(n), root1, root2, proof); err != nil {
+				t.Errorf("%d to %d: %v", m, n, err)
+			}
+			if m > 0 && m < n {
+				if err := VerifyConsistency(int64(m), int64(n), root1, RootHash(leaves[1:n+1]), proof); err == nil {
+					t.Errorf("%d to %d: a different tree verified", m, n)
+				}
+			}
+		}
+	}
+}
+
+func TestSignedTreeHead(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := NewSignedTreeHead(testLeaves(5), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := head.Verify(&key.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := ReadPublicKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := head.Verify(published); err != nil {
+		t.Error(err)
+	}
+
+	head.TreeSize++
+	if err := head.Verify(&key.PublicKey); err == nil {
+		t.Error("a modified tree head verified")
+	}
+}
+
+func TestTree(t *testing.T) {
+	leaves := testLeaves(40)
+	tree := NewTree(leaves[:1])
+	for _, leaf := range leaves[1:] {
+		tree.Append(leaf)
+	}
+
+	// the stored nodes give the same roots and proofs as hashing the leaves
+	for n := int64(0); n <= tree.Size(); n++ {
+		root, err := tree.RootHash(n)
+		if err != nil || !bytes.Equal(root, RootHash(leaves[:n])) {
+			t.Fatalf("root of %d: %v", n, err)
+		}
+		for i := int64(0); i < n; i++ {
+			proof, err := tree.InclusionProof(i, n)
+			expected, _ := InclusionProof(leaves[:n], i)
+			if err != nil || !reflect.DeepEqual(proof, expected) {
+				t.Errorf("inclusion of %d in %d: %v", i, n, err)
+			}
+		}
+		for m := int64(0); m <= n; m++ {
+			proof, err := tree.ConsistencyProof(m, n)
+			expected, _ := ConsistencyProof(leaves[:n], m)
+			if err != nil || !reflect.DeepEqual(proof, expected) {
+				t.Errorf("consistency of %d with %d: %v", m, n, err)
+			}
+		}
+	}
+
+	if _, err := tree.InclusionProof(3, 41); err == nil {
+		t.Error("a proof was made beyond the tree")
+	}
+	if _, err := tree.ConsistencyProof(5, 4); err == nil {
+		t.Error("a proof was made from a larger tree")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package transparency
+
+import (
+	"errors"
+)
+
+// A Merkle tree which keeps the hash of every complete subtree, so that
+// appending a leaf hashes O(log n) nodes, and root hashes and proofs are
+// built from the stored nodes in O(log² n), rather than by hashing all of
+// the leaves each time; it is not safe for concurrent use
+type Tree struct {
+	// levels[h][i] is the hash of the 2^h leaves from i * 2^h on
+	levels [][][]byte
+}
+
+// A tree of these leaf hashes, in order
+func NewTree(leaves [][]byte) *Tree {
+	t := new(Tree)
+	for _, leaf := range leaves {
+		t.Append(leaf)
+	}
+	return t
+}
+
+// Add the leaf with this hash to the end of the tree, along with the
+// subtrees it completes
+func (t *Tree) Append(leafHash []byte) {
+	if len(t.levels) == 0 {
+		t.levels = append(t.levels, make([][]byte, 0))
+	}
+	t.levels[0] = append(t.levels[0], leafHash)
+
+	for h, i := 0, len(t.levels[0])-1; i&1 == 1; h, i = h+1, i>>1 {
+		if len(t.levels) == h+1 {
+			t.levels = append(t.levels, make([][]byte, 0))
+		}
+		t.levels[h+1] = append(t.levels[h+1], NodeHash(t.levels[h][i-1], t.levels[h][i]))
+	}
+}
+
+// The number of leaves
+func (t *Tree) Size() int64 {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return int64(len(t.levels[0]))
+}
+
+// The hash of the subtree of the leaves from lo up to (not including) hi:
+// a stored node if it is complete, or else its complete left part and the
+// (smaller) rest
+func (t *Tree) hash(lo, hi int64) []byte {
+	n := hi - lo
+	if n == 0 {
+		return RootHash(nil)
+	}
+	if n&(n-1) == 0 && lo%n == 0 {
+		h := 0
+		for int64(1)<<uint(h) < n {
+			h++
+		}
+		return t.levels[h][lo>>uint(h)]
+	}
+	k := split(n)
+	return NodeHash(t.hash(lo, lo+k), t.hash(lo+k, hi))
+}
+
+// The root hash of the tree of its first size leaves
+func (t *Tree) RootHash(size int64) ([]byte, error) {
+	if size < 0 || size > t.Size() {
+		return nil, errors.New(INVALID_SIZES)
+	}
+	return t.hash(0, size), nil
+}
+
+// The audit path for the leaf at this index, in the tree of the first size
+// leaves (as for InclusionProof)
+func (t *Tree) InclusionProof(index, size int64) ([][]byte, error) {
+	if size < 0 || size > t.Size() {
+		return nil, errors.New(INVALID_SIZES)
+	}
+	if index < 0 || index >= size {
+		return nil, errors.New(INVALID_INDEX)
+	}
+	return t.inclusionPath(0, size, index), nil
+}
+
+func (t *Tree) inclusionPath(lo, hi, index int64) [][]byte {
+	n := hi - lo
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := split(n)
+	if index < k {
+		return append(t.inclusionPath(lo, lo+k, index), t.hash(lo+k, hi))
+	}
+	return append(t.inclusionPath(lo+k, hi, index-k), t.hash(lo, lo+k))
+}
+
+// The proof that the tree of the first size leaves is a prefix of the tree
+// of the second size leaves (as for ConsistencyProof)
+func (t *Tree) ConsistencyProof(first, second int64) ([][]byte, error) {
+	if first < 0 || first > second || second > t.Size() {
+		return nil, errors.New(INVALID_SIZES)
+	}
+	if first == 0 || first == second {
+		return [][]byte{}, nil
+	}
+	return t.subproof(0, second, first, true), nil
+}
+
+func (t *Tree) subproof(lo, hi, m int64, complete bool) [][]byte {
+	n := hi - lo
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{t.hash(lo, hi)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(t.subproof(lo, lo+k, m, complete), t.hash(lo+k, hi))
+	}
+	return append(t.subproof(lo+k, hi, m-k, false), t.hash(lo, lo+k))
+}
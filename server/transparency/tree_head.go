@@ -0,0 +1,249 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package transparency
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
+const (
+	// what a log entry records about the key
+	ACTION_ADD    = "add"
+	ACTION_DELETE = "delete"
+
+	// the TreeHeadSignature fields of RFC 6962, section 3.5
+	SIGNATURE_VERSION = 0 // v1
+	TREE_HASH_TYPE    = 1
+
+	INVALID_PEM       = "Not a PEM-encoded key"
+	NOT_ECDSA         = "The log key must be an ECDSA key"
+	INVALID_ROOT      = "The root hash is not a base64-encoded sha256 hash"
+	INVALID_SIGNATURE = "The tree head signature does not verify with the log's public key"
+)
+
+// One change to a public key, as recorded by a leaf of the log: the leaf
+// data is the json encoding of these fields, in this order
+type KeyEntry struct {
+	Action    string `json:"action"`
+	Email     string `json:"email"`
+	KeyId     string `json:"key_id"`
+	KeyHash   string `json:"key_hash"`  // hex sha256 of the armored key
+	Timestamp int64  `json:"timestamp"` // milliseconds since the epoch
+}
+
+// A signed statement of the log's size and root hash at one time
+type SignedTreeHead struct {
+	TreeSize  int64  `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"`           // milliseconds since the epoch
+	RootHash  string `json:"sha256_root_hash"`    // base64
+	Signature string `json:"tree_head_signature"` // base64 ASN.1 ECDSA signature
+}
+
+// The proof that a tree is an extension of an earlier one
+type Consistency struct {
+	First  int64    `json:"first"`
+	Second int64    `json:"second"`
+	Proof  []string `json:"proof"` // base64 hashes
+}
+
+// The proof that a public key, as served, is in the log: its entry, the
+// audit path from that entry's leaf to the root of the signed tree head,
+// and (if the client named the size of a tree it saw earlier) the proof
+// that the tree only grew since then
+type KeyProof struct {
+	LeafIndex   int64           `json:"leaf_index"`
+	Entry       *KeyEntry       `json:"entry"`
+	AuditPath   []string        `json:"audit_path"` // base64 hashes
+	TreeHead    *SignedTreeHead `json:"tree_head"`
+	Consistency *Consistency    `json:"consistency,omitempty"`
+}
+
+// The hex sha256 of the armored key, as recorded in its log entries
+func KeyHash(armoredKey string) string {
+	sum := sha256.Sum256([]byte(armoredKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// A new entry for this change to the key, as of now
+func NewKeyEntry(action, email, keyId, armoredKey string) *KeyEntry {
+	return &KeyEntry{Action: action,
+		Email:     email,
+		KeyId:     keyId,
+		KeyHash:   KeyHash(armoredKey),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond)}
+}
+
+// The leaf data for this entry
+func (e *KeyEntry) Leaf() []byte {
+	leaf, _ := json.Marshal(e)
+	return leaf
+}
+
+// The leaf hash for this entry
+func (e *KeyEntry) LeafHash() []byte {
+	return LeafHash(e.Leaf())
+}
+
+// Encode these hashes for json
+func EncodeHashes(hashes [][]byte) []string {
+	encoded := make([]string, 0)
+	for _, h := range hashes {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(h))
+	}
+	return encoded
+}
+
+// Decode these hashes from json
+func DecodeHashes(encoded []string) ([][]byte, error) {
+	hashes := make([][]byte, 0)
+	for _, e := range encoded {
+		h, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return hashes, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// A new tree head for the tree of these leaf hashes, signed with the key
+func NewSignedTreeHead(leaves [][]byte, key *ecdsa.PrivateKey) (*SignedTreeHead, error) {
+	return signTreeHead(int64(len(leaves)), RootHash(leaves), key)
+}
+
+// A new tree head for the whole tree, signed with the key
+func (t *Tree) SignedTreeHead(key *ecdsa.PrivateKey) (*SignedTreeHead, error) {
+	root, err := t.RootHash(t.Size())
+	if err != nil {
+		return nil, err
+	}
+	return signTreeHead(t.Size(), root, key)
+}
+
+func signTreeHead(size int64, root []byte, key *ecdsa.PrivateKey) (*SignedTreeHead, error) {
+	sth := &SignedTreeHead{TreeSize: size,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		RootHash:  base64.StdEncoding.EncodeToString(root)}
+	return sth, sth.Sign(key)
+}
+
+// The root hash, decoded
+func (h *SignedTreeHead) Root() ([]byte, error) {
+	root, err := base64.StdEncoding.DecodeString(h.RootHash)
+	if err != nil || len(root) != sha256.Size {
+		return nil, errors.New(INVALID_ROOT)
+	}
+	return root, nil
+}
+
+// The TreeHeadSignature structure which is signed: version, signature
+// type, timestamp, tree size and root hash
+func (h *SignedTreeHead) signedData() ([]byte, error) {
+	root, err := h.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 2+8+8, 2+8+8+len(root))
+	data[0] = SIGNATURE_VERSION
+	data[1] = TREE_HASH_TYPE
+	binary.BigEndian.PutUint64(data[2:10], uint64(h.Timestamp))
+	binary.BigEndian.PutUint64(data[10:18], uint64(h.TreeSize))
+	return append(data, root...), nil
+}
+
+// Sign the tree head with the log's private key
+func (h *SignedTreeHead) Sign(key *ecdsa.PrivateKey) error {
+	data, err := h.signedData()
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	signature, err := key.Sign(rand.Reader, digest[:], nil)
+	if err != nil {
+		return err
+	}
+	h.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// Check the tree head's signature with the log's public key
+func (h *SignedTreeHead) Verify(key *ecdsa.PublicKey) error {
+	data, err := h.signedData()
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(h.Signature)
+	if err != nil {
+		return errors.New(INVALID_SIGNATURE)
+	}
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(key, digest[:], signature) {
+		return errors.New(INVALID_SIGNATURE)
+	}
+	return nil
+}
+
+// A new (P-256) log key, e.g., for a server started without one
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// Read the log's private key from PEM (as written by "openssl ecparam
+// -genkey", or in PKCS #8 form)
+func ReadPrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(INVALID_PEM)
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, isEC := key.(*ecdsa.PrivateKey)
+	if !isEC {
+		return nil, errors.New(NOT_ECDSA)
+	}
+	return ecKey, nil
+}
+
+// Read the log's public key from PEM
+func ReadPublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(INVALID_PEM)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, isEC := key.(*ecdsa.PublicKey)
+	if !isEC {
+		return nil, errors.New(NOT_ECDSA)
+	}
+	return ecKey, nil
+}
+
+// Encode the log's public key as PEM, for publishing
+func EncodePublicKey(key *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,226 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/transparency"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	NOT_ADMIN           = "This page is only available to administrators"
+	CANNOT_DISABLE_SELF = "Administrators cannot disable their own account"
+	UNKNOWN_TARGET      = "That person, key or post no longer exists"
+	PERSON_DISABLED     = "The account has been disabled, and all of its sessions revoked"
+	PERSON_ENABLED      = "The account has been enabled"
+	PERSON_SESSIONS     = "All of the account's sessions have been revoked"
+	KEY_REVOKED         = "The public key has been removed"
+	POST_REMOVED        = "The post has been removed"
+
+	// how much of each list is shown
+	ADMIN_PAGE_SIZE   = 50
+	ADMIN_VOLUME_DAYS = 30
+	ADMIN_AUDIT_SIZE  = 50
+)
+
+type AdminPage struct {
+	Title      string
+	Alert      *Alert
+	Session    *database.SESSION
+	Person     *database.PERSON
+	Authorized bool
+
+	// the overview
+	Query      string
+	Offset     int64
+	NextOffset int64
+	Statistics *database.STATISTICS
+	Persons    []*database.PERSON_SUMMARY
+	Volume     []*database.MESSAGE_VOLUME
+	Sessions   []*database.SESSION_ACTIVITY
+	Posts      []*database.MESSAGE_DIGEST
+	Events     []*database.AUDIT_EVENT
+
+	// the details for one person
+	Target         *database.PERSON
+	TargetKeys     []*database.PUBLIC_KEY
+	TargetSessions []*database.SESSION
+}
+
+// The admin console: an overview of persons, message volumes, session
+// activity and recent posts, or the details of one person ("target"), for
+// persons with the admin role, who can also disable or enable accounts,
+// revoke sessions and keys, and remove posts ("action"); every action is
+// recorded in the audit table
+func Admin(w http.ResponseWriter, r *http.Request, db database.DBConnection, opts ...interface{}) {
+	var (
+		s *database.SESSION
+		p *database.PERSON
+	)
+	alert := new(Alert)
+	page := &AdminPage{Title: TITLE_ADMIN, Alert: alert}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		sessionId := strings.Join(r.PostForm["session"], "")
+		personId := strings.Join(r.PostForm["person"], "")
+		if len(sessionId) > 0 && len(personId) > 0 {
+
+			fn := func(stmt map[string]*sql.Stmt) {
+				session, person, sessionErr := ConfirmPersonSession(sessionId, personId, stmt)
+				if sessionErr != nil {
+					alert.AsError(sessionErr.Error())
+					return
+				}
+
+				s = session
+				p = person
+				if !person.IsAdmin() {
+					alert.AsError(NOT_ADMIN)
+					return
+				}
+				page.Authorized = true
+
+				targetId := strings.Join(r.PostForm["target"], "")
+				if action := strings.Join(r.PostForm["action"], ""); len(action) > 0 {
+					adminAction(r, stmt, person, action, targetId, alert)
+				}
+
+				if len(targetId) > 0 {
+					target, targetErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], targetId)
+					if targetErr == nil && len(target.Id) > 0 {
+						page.Target = target
+						page.TargetKeys, _ = target.LookupPublicKeys(stmt[database.PK_LOOKUP])
+						page.TargetSessions, _ = target.LookupSessions(stmt[database.SESSION_LOOKUP_BY_PERSON])
+						return
+					}
+				}
+
+				page.Query = strings.TrimSpace(strings.Join(r.PostForm["q"], ""))
+				if offset, offsetErr := strconv.ParseInt(strings.Join(r.PostForm["offset"], ""), 10, 64); offsetErr == nil && offset > 0 {
+					page.Offset = offset
+				}
+
+				page.Statistics, _ = database.LookupStatistics(stmt[database.INSTANCE_STATISTICS])
+				page.Persons, _ = database.SummarizePersons(stmt[database.ADMIN_PERSONS], page.Query, ADMIN_PAGE_SIZE, page.Offset)
+				if len(page.Persons) == ADMIN_PAGE_SIZE {
+					page.NextOffset = page.Offset + ADMIN_PAGE_SIZE
+				}
+				page.Volume, _ = database.LookupMessageVolume(stmt[database.ADMIN_MESSAGE_VOLUME], ADMIN_VOLUME_DAYS)
+				page.Sessions, _ = database.LookupSessionActivity(stmt[database.ADMIN_SESSIONS], ADMIN_PAGE_SIZE)
+				messages, _ := database.RetrieveMessages(stmt[database.LATEST_MESSAGES], "", CurrentSettings().PostsPerPage, 0)
+				page.Posts, _ = database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages, "")
+				page.Events, _ = database.LookupAuditEvents(stmt[database.AUDIT_LOOKUP], ADMIN_AUDIT_SIZE, 0)
+			}
+			if !withDatabase(w, r, db, fn) {
+				return
+			}
+		}
+	}
+
+	if s == nil && p == nil {
+		s = new(database.SESSION)
+		p = new(database.PERSON)
+
+		if "alert-danger" != alert.AlertType {
+			alert.AsError(INVALID_SESSION)
+		}
+
+		sessionForm := &CreateSessionPage{Title: TITLE_CREATE_SESSION, Alert: alert, Session: s, Person: p}
+		CREATE_SESSION_TEMPLATE.Execute(w, sessionForm)
+		return
+	}
+
+	page.Session = s
+	page.Person = p
+	if page.Target != nil {
+		ADMIN_PERSON_TEMPLATE.Execute(w, page)
+	} else {
+		ADMIN_TEMPLATE.Execute(w, page)
+	}
+}
+
+// Carry out the admin's action on the target person (or the key or post
+// named by the "key" and "message" form values), and record it
+func adminAction(r *http.Request, stmt map[string]*sql.Stmt, admin *database.PERSON, action, targetId string, alert *Alert) {
+	if action == "removePost" {
+		messageId := strings.Join(r.PostForm["message"], "")
+		messages, messagesErr := database.RetrieveMessages(stmt[database.MESSAGE_BY_ID], messageId, 1, 0)
+		if messagesErr != nil || len(messages) == 0 {
+			alert.AsError(UNKNOWN_TARGET)
+			return
+		}
+		message := messages[0]
+		if message.DeleteWithRecipients(stmt[database.RECIPIENT_CLEANUP], stmt[database.MESSAGE_DELETE]) != nil {
+			alert.AsError(OTHER_ERROR)
+			return
+		}
+		author, _ := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], message.PersonId)
+		RecordAuditEvent(r, stmt, admin, database.AUDIT_MESSAGE_DELETE, message.Id, "posted by "+author.Email)
+		alert.Update("alert-success", "fa-check", POST_REMOVED)
+		return
+	}
+
+	target, targetErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], targetId)
+	if targetErr != nil || len(target.Id) == 0 {
+		alert.AsError(UNKNOWN_TARGET)
+		return
+	}
+
+	switch action {
+	case "disable":
+		if target.Id == admin.Id {
+			alert.AsError(CANNOT_DISABLE_SELF)
+			return
+		}
+		if target.SetEnabled(stmt[database.PERSON_ENABLE], false) != nil || target.DeleteSessions(stmt[database.SESSION_DELETE_BY_PERSON]) != nil {
+			alert.AsError(OTHER_ERROR)
+			return
+		}
+		RecordAuditEvent(r, stmt, admin, database.AUDIT_PERSON_DISABLE, target.Id, target.Email)
+		alert.Update("alert-success", "fa-check", PERSON_DISABLED)
+	case "enable":
+		if target.SetEnabled(stmt[database.PERSON_ENABLE], true) != nil {
+			alert.AsError(OTHER_ERROR)
+			return
+		}
+		RecordAuditEvent(r, stmt, admin, database.AUDIT_PERSON_ENABLE, target.Id, target.Email)
+		alert.Update("alert-success", "fa-check", PERSON_ENABLED)
+	case "revokeSessions":
+		if target.DeleteSessions(stmt[database.SESSION_DELETE_BY_PERSON]) != nil {
+			alert.AsError(OTHER_ERROR)
+			return
+		}
+		RecordAuditEvent(r, stmt, admin, database.AUDIT_SESSIONS_REVOKE, target.Id, target.Email)
+		alert.Update("alert-success", "fa-check", PERSON_SESSIONS)
+	case "revokeKey":
+		// only keys belonging to the target person can be revoked
+		keyId := strings.Join(r.PostForm["key"], "")
+		keys, keysErr := target.LookupPublicKeys(stmt[database.PK_LOOKUP])
+		if keysErr != nil {
+			alert.AsError(OTHER_ERROR)
+			return
+		}
+		for _, key := range keys {
+			if key.Id == keyId {
+				if key.Delete(stmt[database.PK_DELETE]) != nil {
+					alert.AsError(OTHER_ERROR)
+					return
+				}
+				LogKeyChange(r, stmt, transparency.ACTION_DELETE, target.Email, key)
+				RecordAuditEvent(r, stmt, admin, database.AUDIT_KEY_DELETE, key.Id, target.Email+" "+key.Nickname)
+				alert.Update("alert-success", "fa-check", KEY_REVOKED)
+				return
+			}
+		}
+		alert.AsError(UNKNOWN_TARGET)
+	default:
+		alert.AsError(INVALID_REQUEST)
+	}
+}
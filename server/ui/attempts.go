@@ -0,0 +1,162 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// brute-force protection for session confirmation
+	ATTEMPTS_ALLOWED     = 3  // wrong guesses before any lockout applies
+	MAX_SESSION_ATTEMPTS = 10 // wrong guesses before a person's pending sessions are invalidated
+	LOCKOUT_BASE         = 30 * time.Second
+	LOCKOUT_MAX          = time.Hour
+	ATTEMPTS_FORGOTTEN   = 24 * time.Hour // since the last wrong guess
+	ATTEMPTS_PRUNED      = time.Minute    // how often forgotten keys are removed
+
+	TOO_MANY_ATTEMPTS = "Too many incorrect attempts: please wait a while before trying again"
+)
+
+type attemptRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Count wrong guesses by key (e.g., an IP address or person id), locking
+// the key out for progressively longer periods as the guesses mount
+type AttemptTracker struct {
+	mu        sync.Mutex
+	records   map[string]*attemptRecord
+	lastPrune time.Time
+
+	// the clock (replaced in tests)
+	now func() time.Time
+}
+
+func NewAttemptTracker() *AttemptTracker {
+	return &AttemptTracker{records: map[string]*attemptRecord{}, now: time.Now}
+}
+
+// Is this key currently locked out, and if so, for how much longer?
+func (t *AttemptTracker) Locked(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, exists := t.records[key]
+	if !exists {
+		return false, 0
+	}
+
+	remaining := record.lockedUntil.Sub(t.now())
+	return remaining > 0, remaining
+}
+
+// Record a wrong guess for this key, returning its total number of failures
+func (t *AttemptTracker) Fail(key string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if now.Sub(t.lastPrune) >= ATTEMPTS_PRUNED {
+		t.prune(now)
+		t.lastPrune = now
+	}
+
+	record, exists := t.records[key]
+	if !exists {
+		record = new(attemptRecord)
+		t.records[key] = record
+	}
+	record.failures++
+	record.lastFailure = now
+
+	if record.failures > ATTEMPTS_ALLOWED {
+		// double the lockout with every wrong guess past the allowance
+		lockout := LOCKOUT_BASE
+		for i := ATTEMPTS_ALLOWED + 1; i < record.failures && lockout < LOCKOUT_MAX; i++ {
+			lockout *= 2
+		}
+		if lockout > LOCKOUT_MAX {
+			lockout = LOCKOUT_MAX
+		}
+		record.lockedUntil = now.Add(lockout)
+	}
+
+	return record.failures
+}
+
+// Clear the record of wrong guesses for this key
+func (t *AttemptTracker) Succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.records, key)
+}
+
+// Forget keys with no recent wrong guesses (the caller holds the lock, and
+// only does this every ATTEMPTS_PRUNED, since it visits every key)
+func (t *AttemptTracker) prune(now time.Time) {
+	for key, record := range t.records {
+		if now.Sub(record.lastFailure) > ATTEMPTS_FORGOTTEN && now.After(record.lockedUntil) {
+			delete(t.records, key)
+		}
+	}
+}
+
+var (
+	// wrong session code and challenge signature attempts
+	SessionAttempts = NewAttemptTracker()
+)
+
+// The client's IP address, without the port
+func ClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// The keys used to track attempts by client IP address and by person
+func ipAttemptKey(r *http.Request) string {
+	return "ip:" + ClientAddress(r)
+}
+
+func personAttemptKey(personId string) string {
+	return "person:" + personId
+}
+
+// Is either the client or the person currently locked out?
+func AttemptsLocked(r *http.Request, personId string) bool {
+	if locked, _ := SessionAttempts.Locked(ipAttemptKey(r)); locked {
+		return true
+	}
+	if len(personId) > 0 {
+		if locked, _ := SessionAttempts.Locked(personAttemptKey(personId)); locked {
+			return true
+		}
+	}
+	return false
+}
+
+// Record a wrong guess against both the client and the person
+func AttemptFailed(r *http.Request, personId string) {
+	SessionAttempts.Fail(ipAttemptKey(r))
+	if len(personId) > 0 {
+		SessionAttempts.Fail(personAttemptKey(personId))
+	}
+}
+
+// Clear the wrong guesses for both the client and the person
+func AttemptSucceeded(r *http.Request, personId string) {
+	SessionAttempts.Succeed(ipAttemptKey(r))
+	if len(personId) > 0 {
+		SessionAttempts.Succeed(personAttemptKey(personId))
+	}
+}
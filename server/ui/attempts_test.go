@@ -0,0 +1,239 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testPersonId = "11111111-1111-1111-1111-111111111111"
+	testCode     = "correct horse battery staple"
+)
+
+var testNow = time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+// A clock which only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time                 { return c.now }
+func (c *fakeClock) Advance(duration time.Duration) { c.now = c.now.Add(duration) }
+
+func newTestTracker() (*AttemptTracker, *fakeClock) {
+	clock := &fakeClock{now: testNow}
+	tracker := NewAttemptTracker()
+	tracker.now = clock.Now
+	return tracker, clock
+}
+
+func TestAttemptLockout(t *testing.T) {
+	tracker, clock := newTestTracker()
+
+	// the lockout after each wrong guess: none for the allowance, then
+	// doubling from LOCKOUT_BASE up to LOCKOUT_MAX
+	tests := []time.Duration{0, 0, 0,
+		30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute,
+		16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour, time.Hour}
+	for i, expected := range tests {
+		if failures := tracker.Fail("ip:192.0.2.7"); failures != i+1 {
+			t.Errorf("guess %d counted as %d failures", i+1, failures)
+		}
+		locked, remaining := tracker.Locked("ip:192.0.2.7")
+		if locked != (expected > 0) || (locked && remaining != expected) {
+			t.Errorf("after %d wrong guesses: locked %v for %v, expected %v", i+1, locked, remaining, expected)
+		}
+
+		// the lockout ends on time
+		clock.Advance(expected)
+		if locked, _ := tracker.Locked("ip:192.0.2.7"); locked {
+			t.Errorf("after %d wrong guesses: still locked after %v", i+1, expected)
+		}
+	}
+
+	// other keys are unaffected
+	if locked, _ := tracker.Locked("ip:192.0.2.8"); locked {
+		t.Error("an unrelated key was locked")
+	}
+}
+
+func TestAttemptSucceeded(t *testing.T) {
+	tracker, clock := newTestTracker()
+	for i := 0; i < ATTEMPTS_ALLOWED+2; i++ {
+		tracker.Fail("person:" + testPersonId)
+	}
+	if locked, _ := tracker.Locked("person:" + testPersonId); !locked {
+		t.Fatal("not locked after too many wrong guesses")
+	}
+
+	// a correct guess (once the lockout is over) starts the count again
+	clock.Advance(LOCKOUT_MAX)
+	tracker.Succeed("person:" + testPersonId)
+	for i := 1; i <= ATTEMPTS_ALLOWED; i++ {
+		if failures := tracker.Fail("person:" + testPersonId); failures != i {
+			t.Errorf("failure %d after success counted as %d", i, failures)
+		}
+	}
+	if locked, _ := tracker.Locked("person:" + testPersonId); locked {
+		t.Error("locked within the allowance after a success")
+	}
+}
+
+func TestAttemptsForgotten(t *testing.T) {
+	tracker, clock := newTestTracker()
+	tracker.Fail("ip:192.0.2.7")
+
+	// keys are only visited once per ATTEMPTS_PRUNED, however many guesses
+	clock.Advance(ATTEMPTS_FORGOTTEN + time.Second)
+	tracker.Fail("ip:192.0.2.8")
+	if _, exists := tracker.records["ip:192.0.2.7"]; exists {
+		t.Error("a key with no recent wrong guesses was kept")
+	}
+
+	clock.Advance(ATTEMPTS_FORGOTTEN + time.Second)
+	tracker.lastPrune = clock.Now()
+	clock.Advance(ATTEMPTS_PRUNED / 2)
+	tracker.Fail("ip:192.0.2.9")
+	if _, exists := tracker.records["ip:192.0.2.8"]; !exists {
+		t.Error("keys were pruned again within ATTEMPTS_PRUNED")
+	}
+	clock.Advance(ATTEMPTS_PRUNED)
+	tracker.Fail("ip:192.0.2.9")
+	if _, exists := tracker.records["ip:192.0.2.8"]; exists || len(tracker.records) != 1 {
+		t.Errorf("unexpected keys after pruning: %v", tracker.records)
+	}
+}
+
+// A database/sql driver standing in for the session table of one person,
+// with one pending session, counting wrong guesses as the database does
+// (and for the rate_limit table, in rate_limit_test.go)
+
+type sessionTable struct {
+	failedAttempts int64
+	invalidated    bool
+}
+
+var currentSessions *sessionTable
+
+type fakeDriver struct{}
+
+type fakeConn struct{}
+
+type fakeStmt struct {
+	query string
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return &fakeConn{}, nil }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{query: query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	switch s.query {
+	case database.SESSION_FAILED_ATTEMPT:
+		currentSessions.failedAttempts++
+	case database.SESSION_INVALIDATE:
+		if currentSessions.failedAttempts >= args[1].(int64) {
+			currentSessions.invalidated = true
+		}
+	case database.RATE_LIMIT_CLEANUP:
+		currentBuckets.cleanup(args)
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := [][]driver.Value{}
+	switch s.query {
+	case database.PERSON_LOOKUP_BY_EMAIL:
+		rows = append(rows, []driver.Value{testPersonId, "dev@example.org", testNow, true, testNow, true, database.ROLE_MEMBER})
+	case database.RATE_LIMIT_TAKE:
+		rows = append(rows, currentBuckets.take(args))
+	case database.AUDIT_INSERT:
+		rows = append(rows, []driver.Value{"77777777-7777-7777-7777-777777777777"})
+	case database.SESSION_LOOKUP_CODES_BY_PERSON:
+		if !currentSessions.invalidated {
+			rows = append(rows, []driver.Value{"33333333-3333-3333-3333-333333333333", testPersonId, testCode, testNow, false, nil, testNow.Add(time.Hour)})
+		}
+	}
+	return &fakeRows{rows: rows}, nil
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{}
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+func init() {
+	sql.Register("teamwork-ui-fake", fakeDriver{})
+}
+
+func TestSessionsInvalidated(t *testing.T) {
+	db, err := sql.Open("teamwork-ui-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := map[string]*sql.Stmt{}
+	for _, p := range database.PreparedStatements {
+		if stmt[p], err = db.Prepare(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker, clock := newTestTracker()
+	defer func(previous *AttemptTracker) { SessionAttempts = previous }(SessionAttempts)
+	SessionAttempts = tracker
+
+	// guess wrong this many times (waiting out each lockout), then right
+	confirm := func(wrongGuesses int) error {
+		currentSessions = new(sessionTable)
+		r := httptest.NewRequest("POST", "/confirm", nil)
+		for i := 0; i < wrongGuesses; i++ {
+			clock.Advance(LOCKOUT_MAX)
+			if _, _, err := VerifySessionCode(r, "dev@example.org", "correct horse battery", stmt); err == nil || err.Error() != INVALID_SESSION {
+				t.Fatalf("wrong guess %d: %v", i+1, err)
+			}
+		}
+		clock.Advance(LOCKOUT_MAX)
+		_, _, err := VerifySessionCode(r, "dev@example.org", testCode, stmt)
+		return err
+	}
+
+	if err := confirm(MAX_SESSION_ATTEMPTS - 1); err != nil {
+		t.Errorf("the right code was refused after %d wrong guesses: %v", MAX_SESSION_ATTEMPTS-1, err)
+	}
+	if err := confirm(MAX_SESSION_ATTEMPTS); err == nil || err.Error() != INVALID_SESSION {
+		t.Errorf("the right code was accepted after %d wrong guesses: %v", MAX_SESSION_ATTEMPTS, err)
+	}
+	// (the right code, once the sessions are gone, is one more wrong guess)
+	if !currentSessions.invalidated || currentSessions.failedAttempts != MAX_SESSION_ATTEMPTS+1 {
+		t.Errorf("%d wrong guesses counted, invalidated: %v", currentSessions.failedAttempts, currentSessions.invalidated)
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"net/http"
+)
+
+// Record what this person (or nobody, if actor is nil) did, and from
+// where, at the end of the audit chain; a failure is logged, but does not
+// stop the action itself
+func RecordAuditEvent(r *http.Request, stmt map[string]*sql.Stmt, actor *database.PERSON, action, target, detail string) {
+	event := &database.AUDIT_EVENT{Action: action, Target: target, Detail: detail, IPAddress: ClientAddress(r), UserAgent: r.UserAgent()}
+	if actor != nil {
+		event.ActorId = actor.Id
+	}
+	if _, err := event.Add(stmt[database.AUDIT_LATEST], stmt[database.AUDIT_INSERT]); err != nil {
+		logging.FromRequest(r).Error("Cannot record audit event", "action", action, "error", err)
+	}
+}
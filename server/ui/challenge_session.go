@@ -0,0 +1,236 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/Banrai/TeamWork.io/server/cryptutil"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/emailer"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	INVALID_SIGNATURE = "The signature could not be verified with any of the public keys associated with your email address"
+	CHALLENGE_ISSUED  = "Sign the challenge below with your private key, and submit the signed result"
+)
+
+type ChallengeSessionPage struct {
+	Title     string
+	Alert     *Alert
+	Session   *database.SESSION
+	Person    *database.PERSON
+	Email     string
+	Challenge string
+}
+
+// Produce a random, single-line challenge for the person to sign
+func generateChallenge() string {
+	return fmt.Sprintf("%s login %s %s", KEY_SOURCE, cryptutil.GenerateUUID(cryptutil.UndashedUUID), time.Now().UTC().Format(time.RFC3339))
+}
+
+// Log in by signing a random challenge with a private key, as an alternative
+// to decrypting an emailed session code: an email address ("userEmail")
+// produces a new challenge, and a clear-signed copy of it ("signature")
+// verifies the corresponding session
+func ChallengeSession(w http.ResponseWriter, r *http.Request, db database.DBConnection, opts ...interface{}) {
+	var (
+		s *database.SESSION
+		p *database.PERSON
+		k []*database.PUBLIC_KEY
+	)
+	confirmed := false
+	email := ""
+	challenge := ""
+
+	alert := new(Alert)
+	alert.Message = "Enter your email address to receive a challenge to sign with your private key"
+
+	// in privacy mode, unknown, disabled and keyless email addresses get a
+	// challenge which can never be verified, and every failure looks the same
+	privacyMode := privacyModeOption(opts, 0)
+	start := time.Now()
+	fail := func(msg string) {
+		if privacyMode {
+			msg = INVALID_SIGNATURE
+		}
+		alert.AsError(msg)
+	}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		challenge = strings.TrimSpace(strings.Join(r.PostForm["challenge"], ""))
+		signature := strings.Join(r.PostForm["signature"], "")
+		email = strings.ToLower(strings.Join(r.PostForm["userEmail"], ""))
+
+		if len(challenge) > 0 && len(signature) > 0 {
+			// confirm the signed challenge
+			fn := func(stmt map[string]*sql.Stmt) {
+				if AttemptsLocked(r, "") {
+					alert.AsError(TOO_MANY_ATTEMPTS)
+					return
+				}
+
+				session, sessionErr := ConfirmSessionCode(challenge, stmt[database.SESSION_CLEANUP], stmt[database.SESSION_LOOKUP_BY_CHALLENGE])
+				if sessionErr != nil {
+					alert.AsError(OTHER_ERROR)
+					return
+				}
+
+				if len(session.Id) == 0 || session.Verified {
+					AttemptFailed(r, "")
+					fail(INVALID_SESSION)
+					if !privacyMode {
+						challenge = ""
+					}
+					return
+				}
+
+				// attempt to find the person for this session
+				person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], session.PersonId)
+				if personErr != nil {
+					alert.AsError(OTHER_ERROR)
+					return
+				}
+
+				if len(person.Id) == 0 {
+					fail(UNKNOWN)
+					return
+				}
+
+				if !person.Enabled {
+					fail(DISABLED)
+					return
+				}
+
+				if AttemptsLocked(r, person.Id) {
+					fail(TOO_MANY_ATTEMPTS)
+					return
+				}
+
+				keys, keysErr := person.LookupPublicKeys(stmt[database.PK_LOOKUP])
+				if keysErr != nil {
+					alert.AsError(OTHER_ERROR)
+					return
+				}
+
+				if len(keys) == 0 {
+					fail(NO_KEYS)
+					return
+				}
+
+				// the signature has to come from one of this person's keys,
+				// and cover exactly the challenge that was issued
+				signed, signedErr := cryptutil.VerifyClearSigned(keys, signature)
+				if signedErr != nil || !session.MatchesCode(strings.TrimSpace(signed)) {
+					AttemptFailed(r, person.Id)
+					alert.AsError(INVALID_SIGNATURE)
+					return
+				}
+				AttemptSucceeded(r, person.Id)
+
+				session.Verified = true
+				if session.Update(stmt[database.SESSION_UPDATE]) != nil {
+					alert.AsError(OTHER_ERROR)
+					return
+				}
+
+				if !person.Verified {
+					person.Verified = true
+					if person.Update(stmt[database.PERSON_UPDATE]) != nil {
+						alert.AsError(OTHER_ERROR)
+						return
+					}
+				}
+
+				// success
+				RecordAuditEvent(r, stmt, person, database.AUDIT_SESSION_VERIFY, session.Id, "signed challenge")
+				s = session
+				p = person
+				k = keys
+				confirmed = true
+			}
+			if !withDatabase(w, r, db, fn) {
+				return
+			}
+
+		} else if len(email) > 0 {
+			// issue a new challenge for this email address
+			challenge = ""
+			if !emailer.IsPossibleEmail(email) {
+				alert.AsError(INVALID_EMAIL)
+			} else {
+				fn := func(stmt map[string]*sql.Stmt) {
+					person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], email)
+					if personErr != nil {
+						alert.AsError(OTHER_ERROR)
+						return
+					}
+
+					if len(person.Id) == 0 || !person.Enabled {
+						if privacyMode {
+							challenge = generateChallenge()
+							alert.Message = CHALLENGE_ISSUED
+						} else if len(person.Id) == 0 {
+							alert.AsError(UNKNOWN)
+						} else {
+							alert.AsError(DISABLED)
+						}
+						return
+					}
+
+					publicKeys, publicKeysErr := person.LookupPublicKeys(stmt[database.PK_LOOKUP])
+					if publicKeysErr != nil {
+						alert.AsError(OTHER_ERROR)
+						return
+					}
+
+					if len(publicKeys) == 0 {
+						if privacyMode {
+							challenge = generateChallenge()
+							alert.Message = CHALLENGE_ISSUED
+						} else {
+							alert.Update("alert-warning", "fa-hand-paper-o", NO_KEYS)
+						}
+						return
+					}
+
+					session := new(database.SESSION)
+					code, codeErr := session.AddCode(stmt[database.SESSION_INSERT_CHALLENGE], person.Id, generateChallenge(), CurrentSettings().SessionDuration)
+					if codeErr != nil {
+						alert.AsError(OTHER_ERROR)
+						return
+					}
+
+					RecordAuditEvent(r, stmt, nil, database.AUDIT_SESSION_CREATE, person.Id, email+" (challenge)")
+					challenge = code
+					alert.Message = CHALLENGE_ISSUED
+				}
+				if !withDatabase(w, r, db, fn) {
+					return
+				}
+			}
+		}
+	}
+
+	if privacyMode && "POST" == r.Method {
+		EqualizeResponseTime(start, PRIVACY_RESPONSE_TIME)
+	}
+
+	if confirmed {
+		recipients := make([]*Recipient, 0)
+		postForm := &NewPostPage{Title: TITLE_ADD_POST, Alert: alert, Session: s, Person: p, Recipients: recipients, Keys: k}
+		NEW_POST_TEMPLATE.Execute(w, postForm)
+	} else {
+		s = new(database.SESSION)
+		p = new(database.PERSON)
+
+		challengeForm := &ChallengeSessionPage{Title: TITLE_CHALLENGE_SESSION, Alert: alert, Session: s, Person: p, Email: email, Challenge: challenge}
+		CHALLENGE_SESSION_TEMPLATE.Execute(w, challengeForm)
+	}
+}
@@ -15,6 +15,7 @@ type ConfirmSessionPage struct {
 	Alert   *Alert
 	Session *database.SESSION
 	Person  *database.PERSON
+	Email   string
 }
 
 func ConfirmSession(w http.ResponseWriter, r *http.Request, db database.DBConnection, opts ...interface{}) {
@@ -26,59 +27,30 @@ func ConfirmSession(w http.ResponseWriter, r *http.Request, db database.DBConnec
 	confirmed := false
 	alert := new(Alert)
 
+	// the session code is only valid for the email address which requested it
+	email := strings.ToLower(r.URL.Query().Get("email"))
+
 	if "POST" == r.Method {
 		r.ParseForm()
 
+		if em, emExists := r.PostForm["userEmail"]; emExists {
+			email = strings.ToLower(strings.Join(em, ""))
+		}
+
 		sessionCode, sessionCodeExists := r.PostForm["sessionCode"]
 		if sessionCodeExists {
-			code := strings.Join(sessionCode, "")
-			if len(code) > 0 {
+			code := NormalizeSessionCode(strings.Join(sessionCode, " "))
+			if len(email) == 0 {
+				alert.AsError(NO_EMAIL)
+			} else if len(code) > 0 {
 
 				fn := func(stmt map[string]*sql.Stmt) {
-					session, sessionErr := ConfirmSessionCode(code, stmt[database.SESSION_CLEANUP], stmt[database.SESSION_LOOKUP_BY_CODE])
-					if sessionErr != nil {
-						alert.AsError(OTHER_ERROR)
-						return
-					}
-
-					if len(session.Id) == 0 {
-						alert.AsError(INVALID_SESSION)
+					session, person, verifyErr := VerifySessionCode(r, email, code, stmt)
+					if verifyErr != nil {
+						alert.AsError(verifyErr.Error())
 						return
 					}
 
-					if !session.Verified {
-						session.Verified = true
-						if session.Update(stmt[database.SESSION_UPDATE]) != nil {
-							alert.AsError(OTHER_ERROR)
-							return
-						}
-					}
-
-					// attempt to find the person for this session
-					person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], session.PersonId)
-					if personErr != nil {
-						alert.AsError(OTHER_ERROR)
-						return
-					}
-
-					if len(person.Id) == 0 {
-						alert.AsError(UNKNOWN)
-						return
-					}
-
-					if !person.Enabled {
-						alert.AsError(DISABLED)
-						return
-					}
-
-					if !person.Verified {
-						person.Verified = true
-						if person.Update(stmt[database.PERSON_UPDATE]) != nil {
-							alert.AsError(OTHER_ERROR)
-							return
-						}
-					}
-
 					keys, keysErr := person.LookupPublicKeys(stmt[database.PK_LOOKUP])
 					if keysErr != nil {
 						alert.AsError(OTHER_ERROR)
@@ -97,7 +69,9 @@ func ConfirmSession(w http.ResponseWriter, r *http.Request, db database.DBConnec
 					confirmed = true
 				}
 
-				database.WithDatabase(db, fn)
+				if !withDatabase(w, r, db, fn) {
+					return
+				}
 			}
 		}
 	}
@@ -108,13 +82,17 @@ func ConfirmSession(w http.ResponseWriter, r *http.Request, db database.DBConnec
 		NEW_POST_TEMPLATE.Execute(w, postForm)
 	} else {
 		if len(alert.Message) == 0 {
-			alert.Message = "If you did not get an email with a code to decrypt, you can <a href=\"/session\">request one here</a>"
+			if privacyModeOption(opts, 0) && "GET" == r.Method && len(email) > 0 {
+				alert.Message = PRIVATE_SESSION_SENT
+			} else {
+				alert.Message = "If you did not get an email with a code to decrypt, you can <a href=\"/session\">request one here</a>"
+			}
 		}
 
 		s = new(database.SESSION)
 		p = new(database.PERSON)
 
-		sessionForm := &ConfirmSessionPage{Title: TITLE_CONFIRM_SESSION, Alert: alert, Session: s, Person: p}
+		sessionForm := &ConfirmSessionPage{Title: TITLE_CONFIRM_SESSION, Alert: alert, Session: s, Person: p, Email: email}
 		CONFIRM_SESSION_TEMPLATE.Execute(w, sessionForm)
 	}
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/Banrai/TeamWork.io/server/emailer"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type CreateSessionPage struct {
@@ -26,6 +27,10 @@ func CreateSession(w http.ResponseWriter, r *http.Request, db database.DBConnect
 	alert := new(Alert)
 	alert.Message = "If you do not have a public key associated with your email address, you can <a href=\"/upload\">upload it here</a>"
 
+	// in privacy mode, do not reveal whether or not the email address is known
+	privacyMode := privacyModeOption(opts, 0)
+	start := time.Now()
+
 	if "POST" == r.Method {
 		r.ParseForm()
 
@@ -39,6 +44,19 @@ func CreateSession(w http.ResponseWriter, r *http.Request, db database.DBConnect
 					return
 				}
 
+				if privacyMode {
+					fn := func(stmt map[string]*sql.Stmt) {
+						CreatePrivateSession(r, email, stmt)
+					}
+					if !withDatabase(w, r, db, fn) {
+						return
+					}
+
+					EqualizeResponseTime(start, PRIVACY_RESPONSE_TIME)
+					Redirect(ConfirmSessionLink(email))(w, r)
+					return
+				}
+
 				fn := func(stmt map[string]*sql.Stmt) {
 					// attempt to find the person for this email address
 					person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], email)
@@ -69,17 +87,25 @@ func CreateSession(w http.ResponseWriter, r *http.Request, db database.DBConnect
 						return
 					}
 
-					sessionErr := CreateNewSession(person, publicKeys, stmt[database.SESSION_INSERT])
+					if !AllowNewSession(r, email, stmt) {
+						alert.Update("alert-warning", "fa-hand-paper-o", RATE_LIMITED)
+						return
+					}
+
+					sessionErr := CreateNewSession(r.Context(), person, publicKeys, stmt[database.SESSION_INSERT])
 					if sessionErr != nil {
 						alert.AsError(sessionErr.Error())
 						return
 					} else {
+						RecordAuditEvent(r, stmt, nil, database.AUDIT_SESSION_CREATE, person.Id, email)
 						// present the session code form
-						Redirect("/confirm")(w, r)
+						Redirect(ConfirmSessionLink(email))(w, r)
 					}
 				}
 
-				database.WithDatabase(db, fn)
+				if !withDatabase(w, r, db, fn) {
+					return
+				}
 			}
 		}
 	}
@@ -6,6 +6,7 @@ package ui
 import (
 	"database/sql"
 	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
 	"net/http"
 	"strings"
 )
@@ -15,17 +16,64 @@ type DisplayPostsPage struct {
 	Alert   *Alert
 	Session *database.SESSION
 	Person  *database.PERSON
+	View    string // which posts: all, or those received, authored or involving the person
 	Posts   []*database.MESSAGE_DIGEST
+	Newer   string // the cursors of the pages around this one, if any
+	Older   string
+}
+
+// Fill in the page of PostsPerPage posts in the page's view (all of
+// them, if empty or without a person) at this cursor (or the latest, if
+// nil), as seen by this person, with the cursors around it
+func (page *DisplayPostsPage) LoadPosts(stmt map[string]*sql.Stmt, cursor *database.MESSAGE_CURSOR, person *database.PERSON) error {
+	view, err := database.LookupMessageView(page.View)
+	if err != nil || len(person.Id) == 0 {
+		view = database.MESSAGE_VIEWS[database.VIEW_ALL]
+	}
+	page.View = view.Name
+
+	messages, err := view.Page(stmt, person, cursor, CurrentSettings().PostsPerPage)
+	if err != nil {
+		return err
+	}
+	page.Posts, _ = database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages.Messages, person.Id)
+	if messages.Newer != nil {
+		page.Newer = messages.Newer.String()
+	}
+	if messages.Older != nil {
+		page.Older = messages.Older.String()
+	}
+	return nil
 }
 
 func DisplayPosts(w http.ResponseWriter, r *http.Request, db database.DBConnection, opts ...interface{}) {
 	var (
 		s *database.SESSION
 		p *database.PERSON
-		m []*database.MESSAGE_DIGEST
 	)
 	alert := new(Alert)
 	confirmSession := false
+	posts := &DisplayPostsPage{Title: TITLE_POSTS, Alert: alert}
+
+	// the posts to show (for the tabs), and the page of them (for the next
+	// and previous links), from either form
+	if view := r.URL.Query().Get("view"); len(view) > 0 {
+		if _, viewErr := database.LookupMessageView(view); viewErr != nil {
+			alert.AsError(INVALID_VIEW)
+		} else {
+			posts.View = view
+		}
+	}
+
+	var cursor *database.MESSAGE_CURSOR
+	if token := r.URL.Query().Get("cursor"); len(token) > 0 {
+		parsed, cursorErr := database.ParseMessageCursor(token)
+		if cursorErr != nil {
+			alert.AsError(INVALID_CURSOR)
+		} else {
+			cursor = parsed
+		}
+	}
 
 	if "POST" == r.Method {
 		r.ParseForm()
@@ -93,34 +141,39 @@ func DisplayPosts(w http.ResponseWriter, r *http.Request, db database.DBConnecti
 					s = session
 					p = person
 
-					messages, _ := person.LookupLatestMessages(stmt[database.LATEST_MESSAGES], POSTS_PER_PAGE, 0)
-					digests, _ := database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages, p.Id)
-					m = digests
+					if err := posts.LoadPosts(stmt, cursor, p); err != nil {
+						logging.FromRequest(r).Error("Cannot look up messages", "error", err)
+					}
+				}
+				if !withDatabase(w, r, db, fn) {
+					return
 				}
-				database.WithDatabase(db, fn)
 			}
 		}
 
 	} else {
-		// retrieve the latest digests, without session/person
-		fn := func(stmt map[string]*sql.Stmt) {
-			messages, _ := database.RetrieveMessages(stmt[database.LATEST_MESSAGES], "", POSTS_PER_PAGE, 0)
-			digests, _ := database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages, "")
-			m = digests
-		}
-		database.WithDatabase(db, fn)
-
 		// define these as empty, so the session template renders properly
 		s = new(database.SESSION)
 		p = new(database.PERSON)
 
+		// retrieve the latest digests, without session/person
+		fn := func(stmt map[string]*sql.Stmt) {
+			if err := posts.LoadPosts(stmt, cursor, p); err != nil {
+				logging.FromRequest(r).Error("Cannot look up messages", "error", err)
+			}
+		}
+		if !withDatabase(w, r, db, fn) {
+			return
+		}
+
 	}
 
 	if confirmSession && s == nil && p == nil {
 		sessionForm := &ConfirmSessionPage{Title: TITLE_CONFIRM_SESSION, Alert: alert}
 		CONFIRM_SESSION_TEMPLATE.Execute(w, sessionForm)
 	} else {
-		posts := &DisplayPostsPage{Title: TITLE_POSTS, Alert: alert, Session: s, Person: p, Posts: m}
+		posts.Session = s
+		posts.Person = p
 		ALL_POSTS_TEMPLATE.Execute(w, posts)
 	}
 }
@@ -21,7 +21,6 @@ func DownloadMessage(w http.ResponseWriter, r *http.Request, db database.DBConne
 		m      *database.MESSAGE
 		s      *database.SESSION
 		p      *database.PERSON
-		d      []*database.MESSAGE_DIGEST
 		domain string
 	)
 	alert := new(Alert)
@@ -102,7 +101,9 @@ func DownloadMessage(w http.ResponseWriter, r *http.Request, db database.DBConne
 					s = session
 					p = person
 				}
-				database.WithDatabase(db, fn)
+				if !withDatabase(w, r, db, fn) {
+					return
+				}
 			}
 		}
 	}
@@ -120,7 +121,9 @@ func DownloadMessage(w http.ResponseWriter, r *http.Request, db database.DBConne
 				messageFound = true
 			}
 		}
-		database.WithDatabase(db, fn)
+		if !withDatabase(w, r, db, fn) {
+			return
+		}
 	}
 
 	if messageFound {
@@ -141,28 +144,20 @@ func DownloadMessage(w http.ResponseWriter, r *http.Request, db database.DBConne
 		alert.AsError(NO_SUCH_MESSAGE)
 
 		if s == nil && p == nil {
-			// retrieve the latest digests, without session/person
-			fn := func(stmt map[string]*sql.Stmt) {
-				messages, _ := database.RetrieveMessages(stmt[database.LATEST_MESSAGES], "", POSTS_PER_PAGE, 0)
-				digests, _ := database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages, "")
-				d = digests
-			}
-			database.WithDatabase(db, fn)
-
-			// define these as empty, so the session template renders properly
+			// the latest digests, without session/person: define these as
+			// empty, so the session template renders properly
 			s = new(database.SESSION)
 			p = new(database.PERSON)
-		} else {
-			// use the session data
-			fn := func(stmt map[string]*sql.Stmt) {
-				messages, _ := p.LookupLatestMessages(stmt[database.LATEST_MESSAGES], POSTS_PER_PAGE, 0)
-				digests, _ := database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages, p.Id)
-				d = digests
-			}
-			database.WithDatabase(db, fn)
 		}
 
-		posts := &DisplayPostsPage{Title: "Latest Posts", Alert: alert, Session: s, Person: p, Posts: d}
+		posts := &DisplayPostsPage{Title: TITLE_POSTS, Alert: alert, Session: s, Person: p}
+		fn := func(stmt map[string]*sql.Stmt) {
+			posts.LoadPosts(stmt, nil, p)
+		}
+		if !withDatabase(w, r, db, fn) {
+			return
+		}
+
 		ALL_POSTS_TEMPLATE.Execute(w, posts)
 	}
 }
@@ -0,0 +1,20 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"net/http"
+)
+
+// Append this change to the person's public key to the key transparency
+// log; a failure is logged, but does not stop the change itself (a key
+// which is served without a log entry gets one then)
+func LogKeyChange(r *http.Request, stmt map[string]*sql.Stmt, action, email string, key *database.PUBLIC_KEY) {
+	if _, err := database.LogKeyChange(stmt[database.KEY_LOG_INSERT], action, email, key); err != nil {
+		logging.FromRequest(r).Error("Cannot log key change", "action", action, "key_id", key.Id, "error", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"net/http"
+	"strings"
+)
+
+const (
+	LOGGED_OUT       = "You have been logged out (you can <a href=\"/session\">start a new session here</a>)"
+	SESSION_REVOKED  = "The session has been revoked"
+	SESSIONS_REVOKED = "All of your sessions have been revoked, on every device (you can <a href=\"/session\">start a new session here</a>)"
+)
+
+type ManageSessionsPage struct {
+	Title    string
+	Alert    *Alert
+	Session  *database.SESSION
+	Person   *database.PERSON
+	Sessions []*database.SESSION
+}
+
+// End the current session immediately, rather than waiting for it to expire
+func Logout(w http.ResponseWriter, r *http.Request, db database.DBConnection, opts ...interface{}) {
+	alert := new(Alert)
+	alert.Message = "If you do not have a public key associated with your email address, you can <a href=\"/upload\">upload it here</a>"
+
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		sessionId := strings.Join(r.PostForm["session"], "")
+		personId := strings.Join(r.PostForm["person"], "")
+		if len(sessionId) > 0 && len(personId) > 0 {
+
+			fn := func(stmt map[string]*sql.Stmt) {
+				session, _, sessionErr := ConfirmPersonSession(sessionId, personId, stmt)
+				if sessionErr != nil {
+					alert.AsError(sessionErr.Error())
+					return
+				}
+
+				if session.Delete(stmt[database.SESSION_DELETE]) != nil {
+					alert.AsError(OTHER_ERROR)
+					return
+				}
+
+				alert.Update("alert-success", "fa-check", LOGGED_OUT)
+			}
+			if !withDatabase(w, r, db, fn) {
+				return
+			}
+		}
+	}
+
+	// the session is gone, so render the page without one
+	s := new(database.SESSION)
+	p := new(database.PERSON)
+
+	sessionForm := &CreateSessionPage{Title: TITLE_CREATE_SESSION, Alert: alert, Session: s, Person: p}
+	CREATE_SESSION_TEMPLATE.Execute(w, sessionForm)
+}
+
+// List all of the person's active sessions, revoking any one of them
+// ("revoke") or all of them at once ("revokeAll") on request
+func ManageSessions(w http.ResponseWriter, r *http.Request, db database.DBConnection, opts ...interface{}) {
+	var (
+		s *database.SESSION
+		p *database.PERSON
+		l []*database.SESSION
+	)
+	alert := new(Alert)
+	alert.Message = "These are all the sessions currently open with your email address; revoke any you do not recognize"
+	loggedOut := false
+
+	if "POST" == r.Method {
+		r.ParseForm()
+
+		sessionId := strings.Join(r.PostForm["session"], "")
+		personId := strings.Join(r.PostForm["person"], "")
+		if len(sessionId) > 0 && len(personId) > 0 {
+
+			fn := func(stmt map[string]*sql.Stmt) {
+				session, person, sessionErr := ConfirmPersonSession(sessionId, personId, stmt)
+				if sessionErr != nil {
+					alert.AsError(sessionErr.Error())
+					return
+				}
+
+				if _, revokeAll := r.PostForm["revokeAll"]; revokeAll {
+					// sign out everywhere, including this session
+					if person.DeleteSessions(stmt[database.SESSION_DELETE_BY_PERSON]) != nil {
+						alert.AsError(OTHER_ERROR)
+						return
+					}
+					alert.Update("alert-success", "fa-check", SESSIONS_REVOKED)
+					loggedOut = true
+					return
+				}
+
+				sessions, sessionsErr := person.LookupSessions(stmt[database.SESSION_LOOKUP_BY_PERSON])
+				if sessionsErr != nil {
+					alert.AsError(OTHER_ERROR)
+					return
+				}
+
+				if revokeHandle := strings.Join(r.PostForm["revoke"], ""); len(revokeHandle) > 0 {
+					// only sessions belonging to this person can be revoked,
+					// by their handles (the ids of the others are never shown)
+					remaining := make([]*database.SESSION, 0)
+					for _, personSession := range sessions {
+						if personSession.Handle() == revokeHandle {
+							if personSession.Delete(stmt[database.SESSION_DELETE]) != nil {
+								alert.AsError(OTHER_ERROR)
+								return
+							}
+							alert.Update("alert-success", "fa-check", SESSION_REVOKED)
+							if personSession.Id == session.Id {
+								loggedOut = true
+								alert.Message = LOGGED_OUT
+							}
+						} else {
+							remaining = append(remaining, personSession)
+						}
+					}
+					sessions = remaining
+				}
+
+				if !loggedOut {
+					s = session
+					p = person
+					l = sessions
+				}
+			}
+			if !withDatabase(w, r, db, fn) {
+				return
+			}
+		}
+	}
+
+	if s == nil && p == nil {
+		s = new(database.SESSION)
+		p = new(database.PERSON)
+
+		if !loggedOut && "alert-danger" != alert.AlertType {
+			alert.AsError(INVALID_SESSION)
+		}
+
+		sessionForm := &CreateSessionPage{Title: TITLE_CREATE_SESSION, Alert: alert, Session: s, Person: p}
+		CREATE_SESSION_TEMPLATE.Execute(w, sessionForm)
+	} else {
+		page := &ManageSessionsPage{Title: TITLE_SESSIONS, Alert: alert, Session: s, Person: p, Sessions: l}
+		SESSIONS_TEMPLATE.Execute(w, page)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"context"
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"github.com/Banrai/TeamWork.io/server/metrics"
+)
+
+var (
+	// the instance-wide counts, read from the database at each scrape
+	PersonCount  = metrics.NewGauge("persons", "Persons, by state (all, enabled or verified)", "state")
+	SessionCount = metrics.NewGauge("sessions", "Unexpired sessions, by state (active, i.e., verified, or pending)", "state")
+	MessageCount = metrics.NewGauge("messages", "Messages, by state (all, or expired but not yet removed)", "state")
+	KeyCount     = metrics.NewGauge("public_keys", "Public keys")
+
+	// the session requests counted at /debug/vars, for Prometheus too
+	SessionRequestsTotal = metrics.NewCounter("session_requests_total", "Session requests, by outcome (allowed, email_limited or ip_limited)", "outcome")
+)
+
+// Set the instance-wide gauges from the database, before each scrape
+func RecordStatistics(db database.DBConnection) func() {
+	return func() {
+		err := database.TryWithDatabase(context.Background(), db, func(stmt map[string]*sql.Stmt) {
+			stats, statsErr := database.LookupStatistics(stmt[database.INSTANCE_STATISTICS])
+			if statsErr != nil {
+				logging.Error("Cannot read the instance statistics", "error", statsErr)
+				return
+			}
+			PersonCount.Set(float64(stats.Persons), "all")
+			PersonCount.Set(float64(stats.EnabledPersons), "enabled")
+			PersonCount.Set(float64(stats.VerifiedPersons), "verified")
+			SessionCount.Set(float64(stats.ActiveSessions), "active")
+			SessionCount.Set(float64(stats.PendingSessions), "pending")
+			MessageCount.Set(float64(stats.Messages), "all")
+			MessageCount.Set(float64(stats.ExpiredMessages), "expired")
+			KeyCount.Set(float64(stats.PublicKeys))
+		})
+		if err != nil {
+			logging.Error("Cannot read the instance statistics", "error", err)
+		}
+	}
+}
@@ -5,8 +5,9 @@ package ui
 
 import (
 	"database/sql"
+	"fmt"
 	"github.com/Banrai/TeamWork.io/server/database"
-	"log"
+	"github.com/Banrai/TeamWork.io/server/logging"
 	"net/http"
 	"strings"
 )
@@ -31,7 +32,6 @@ func PostMessage(w http.ResponseWriter, r *http.Request, db database.DBConnectio
 		p *database.PERSON
 		k []*database.PUBLIC_KEY
 		x []*Recipient
-		d []*database.MESSAGE_DIGEST
 	)
 	alert := new(Alert)
 	alert.Message = "You need to <a href=\"/help.html#decrypt-session\">login here with your own email address</a> to be able to post a new message. If you have already decrypted a session code, you can <a href=\"/confirm\">login with it here</a>."
@@ -132,12 +132,13 @@ func PostMessage(w http.ResponseWriter, r *http.Request, db database.DBConnectio
 					message := new(database.MESSAGE)
 					message.Message = strings.Join(messageData, "")
 					message.PersonId = person.Id
-					msgId, msgIdErr := message.Add(stmt[database.MESSAGE_INSERT], MESSAGE_DURATION)
+					msgId, msgIdErr := message.Add(stmt[database.MESSAGE_INSERT], CurrentSettings().MessageDuration)
 					if msgIdErr != nil {
 						alert.AsError("Your message could not be posted at this time")
 						return
 					}
 					message.Id = msgId
+					RecordAuditEvent(r, stmt, person, database.AUDIT_MESSAGE_POST, msgId, fmt.Sprintf("%d recipient(s)", len(r.PostForm["recipients"])))
 
 					// add the list of recipients to the message
 					recipientList, recipientListExists := r.PostForm["recipients"]
@@ -146,7 +147,7 @@ func PostMessage(w http.ResponseWriter, r *http.Request, db database.DBConnectio
 						for _, recipientEmail := range recipientList {
 							recipient, recipientErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], recipientEmail)
 							if recipientErr != nil { // for now, but maybe prepare an alert
-								log.Println(recipientErr)
+								logging.FromRequest(r).Error("Cannot look up recipient", "error", recipientErr)
 							} else {
 								people = append(people, recipient)
 							}
@@ -154,7 +155,7 @@ func PostMessage(w http.ResponseWriter, r *http.Request, db database.DBConnectio
 						if len(people) > 0 {
 							for _, msgRecipientErr := range message.AddRecipients(stmt[database.RECIPIENT_INSERT], people) {
 								if msgRecipientErr != nil { // for now
-									log.Println(msgRecipientErr)
+									logging.FromRequest(r).Error("Cannot add message recipient", "message_id", message.Id, "error", msgRecipientErr)
 								}
 							}
 						}
@@ -163,7 +164,9 @@ func PostMessage(w http.ResponseWriter, r *http.Request, db database.DBConnectio
 					// success
 					messagePosted = true
 				}
-				database.WithDatabase(db, fn)
+				if !withDatabase(w, r, db, fn) {
+					return
+				}
 			}
 		}
 	}
@@ -179,14 +182,14 @@ func PostMessage(w http.ResponseWriter, r *http.Request, db database.DBConnectio
 			// note the update, and go back to all posts
 			alert.Message = "Your message has been posted"
 
+			posts := &DisplayPostsPage{Title: TITLE_POSTS, Alert: alert, Session: s, Person: p}
 			fn := func(stmt map[string]*sql.Stmt) {
-				messages, _ := p.LookupLatestMessages(stmt[database.LATEST_MESSAGES], POSTS_PER_PAGE, 0)
-				digests, _ := database.GetMessageDigests(stmt[database.PERSON_LOOKUP_BY_ID], stmt[database.RECIPIENTS_BY_MESSAGE], messages, p.Id)
-				d = digests
+				posts.LoadPosts(stmt, nil, p)
+			}
+			if !withDatabase(w, r, db, fn) {
+				return
 			}
-			database.WithDatabase(db, fn)
 
-			posts := &DisplayPostsPage{Title: TITLE_POSTS, Alert: alert, Session: s, Person: p, Posts: d}
 			ALL_POSTS_TEMPLATE.Execute(w, posts)
 		} else {
 			// go back to the post-message form
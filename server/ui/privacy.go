@@ -0,0 +1,104 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"net/http"
+	"time"
+)
+
+const (
+	// in privacy mode, responses which could reveal whether or not an
+	// email address has an account take at least this long
+	PRIVACY_RESPONSE_TIME = 2 * time.Second
+
+	// in privacy mode, the session form always gives this same response,
+	// and the outcome is sent only to the email address itself
+	PRIVATE_SESSION_SENT = "If this email address has a public key associated with it, a session code has been sent to it; otherwise, the email explains what to do next"
+
+	NOTICE_SUBJECT = "Your TeamWork.io session request"
+	NOTICE_IGNORE  = "If you did not make this request, you can safely ignore this message."
+)
+
+var (
+	UNKNOWN_NOTICE = []string{
+		"Someone (hopefully you) asked for a TeamWork.io session for this email address, but it does not have any public keys associated with it.",
+		"You can add one using the \"New Public Key\" page at TeamWork.io, and then request a new session.",
+		NOTICE_IGNORE}
+
+	DISABLED_NOTICE = []string{
+		"Someone (hopefully you) asked for a TeamWork.io session for this email address, but it has been disabled, along with all of its public keys.",
+		NOTICE_IGNORE}
+
+	NO_KEYS_NOTICE = []string{
+		"Someone (hopefully you) asked for a TeamWork.io session for this email address, but it does not have any public keys associated with it anymore.",
+		"You need at least one public key: you can add one using the \"New Public Key\" page at TeamWork.io, and then request a new session.",
+		NOTICE_IGNORE}
+)
+
+// Wait until at least the given duration has passed since start, so that
+// the response time does not depend on which branch produced it
+func EqualizeResponseTime(start time.Time, minimum time.Duration) {
+	if elapsed := time.Since(start); elapsed < minimum {
+		time.Sleep(minimum - elapsed)
+	}
+}
+
+// Does the handler option at this position turn on privacy mode?
+func privacyModeOption(opts []interface{}, position int) bool {
+	if len(opts) > position {
+		if enabled, ok := opts[position].(bool); ok {
+			return enabled
+		}
+	}
+	return false
+}
+
+// Create a new session for this email address without revealing the outcome
+// to the requestor: every path ends with an email to the address (either the
+// encrypted session code, or a notice explaining why there is none), and any
+// problems are only logged
+func CreatePrivateSession(r *http.Request, email string, stmt map[string]*sql.Stmt) {
+	if !AllowNewSession(r, email, stmt) {
+		return
+	}
+
+	var notice []string
+
+	person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], email)
+	if personErr != nil {
+		logging.FromRequest(r).Error("Cannot look up person", "error", personErr)
+		return
+	}
+
+	if len(person.Id) == 0 {
+		notice = UNKNOWN_NOTICE
+	} else if !person.Enabled {
+		notice = DISABLED_NOTICE
+	} else {
+		publicKeys, publicKeysErr := person.LookupPublicKeys(stmt[database.PK_LOOKUP])
+		if publicKeysErr != nil {
+			logging.FromRequest(r).Error("Cannot look up public keys", "person_id", person.Id, "error", publicKeysErr)
+			return
+		}
+
+		if len(publicKeys) == 0 {
+			notice = NO_KEYS_NOTICE
+		} else {
+			if sessionErr := CreateNewSession(r.Context(), person, publicKeys, stmt[database.SESSION_INSERT]); sessionErr != nil {
+				logging.FromRequest(r).Error("Cannot create session", "person_id", person.Id, "error", sessionErr)
+			} else {
+				RecordAuditEvent(r, stmt, nil, database.AUDIT_SESSION_CREATE, person.Id, email)
+			}
+			return
+		}
+	}
+
+	if noticeErr := SendEmailMessage(r.Context(), email, NOTICE_SUBJECT, notice, nil); noticeErr != nil {
+		logging.FromRequest(r).Error("Cannot send session notice", "error", noticeErr)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"expvar"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMITED = "Too many sessions have been requested recently: please check your email for the codes already sent, or wait a while before asking for another"
+)
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// A token bucket rate limit: each key may spend up to Capacity tokens at
+// once, and earns them back at Capacity tokens per Period; the buckets are
+// kept in memory, or in the database if they need to be shared by several
+// server instances
+type RateLimit struct {
+	Capacity    float64
+	Period      time.Duration
+	UseDatabase bool
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+
+	// the clock of the buckets in memory (replaced in tests)
+	now func() time.Time
+}
+
+// A capacity of zero (or less) means no limit
+func NewRateLimit(capacity int, period time.Duration, useDatabase bool) *RateLimit {
+	return &RateLimit{Capacity: float64(capacity), Period: period, UseDatabase: useDatabase, buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+// The refill rate, in tokens per second
+func (l *RateLimit) rate() float64 {
+	return l.Capacity / l.Period.Seconds()
+}
+
+// Take one token from the bucket for this key, if one is available
+func (l *RateLimit) Allow(stmt *sql.Stmt, key string) (bool, error) {
+	if l == nil || l.Capacity <= 0 || l.Period <= 0 {
+		return true, nil
+	}
+
+	if l.UseDatabase {
+		return database.TakeRateLimitToken(stmt, key, l.Capacity, l.rate())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.Capacity, updated: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.rate()
+	if bucket.tokens > l.Capacity {
+		bucket.tokens = l.Capacity
+	}
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, nil
+	}
+	bucket.tokens--
+	return true, nil
+}
+
+// Forget the buckets which have refilled completely, at most once per
+// Period (the caller holds the lock)
+func (l *RateLimit) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.Period {
+		return
+	}
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate() >= l.Capacity {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+var (
+	// limits on the number of new session emails, by recipient and by client
+	EmailSessionLimit *RateLimit
+	IPSessionLimit    *RateLimit
+
+	// operator-visible counts of session requests, published at /debug/vars
+	SessionRequests = expvar.NewMap("session_requests")
+)
+
+// Define the session creation limits: up to perEmail and perIP sessions at
+// once (zero for no limit), earned back over each period
+func InitializeRateLimits(perEmail, perIP int, period time.Duration, useDatabase bool) {
+	EmailSessionLimit = NewRateLimit(perEmail, period, useDatabase)
+	IPSessionLimit = NewRateLimit(perIP, period, useDatabase)
+}
+
+// Can this client request a new session code for this email address?
+func AllowNewSession(r *http.Request, email string, stmt map[string]*sql.Stmt) bool {
+	// a database problem should not lock everyone out, so errors allow the request
+	ipKey := "session:" + ipAttemptKey(r)
+	ipAllowed, ipErr := IPSessionLimit.Allow(stmt[database.RATE_LIMIT_TAKE], ipKey)
+	if ipErr != nil {
+		logging.FromRequest(r).Error("Cannot apply the session limit", "error", ipErr)
+	}
+	if !ipAllowed && ipErr == nil {
+		SessionRequests.Add("ip_limited", 1)
+		SessionRequestsTotal.Inc("ip_limited")
+		logging.FromRequest(r).Warn("Session request limit reached", "key", ipKey)
+		return false
+	}
+
+	emailAllowed, emailErr := EmailSessionLimit.Allow(stmt[database.RATE_LIMIT_TAKE], "session:email:"+email)
+	if emailErr != nil {
+		logging.FromRequest(r).Error("Cannot apply the session limit", "error", emailErr)
+	}
+	if !emailAllowed && emailErr == nil {
+		SessionRequests.Add("email_limited", 1)
+		SessionRequestsTotal.Inc("email_limited")
+		logging.FromRequest(r).Warn("Session request limit reached", "email", email)
+		return false
+	}
+
+	if useDatabaseLimits() {
+		database.CleanupRateLimits(stmt[database.RATE_LIMIT_CLEANUP], longestLimitPeriod())
+	}
+
+	SessionRequests.Add("allowed", 1)
+	SessionRequestsTotal.Inc("allowed")
+	return true
+}
+
+// The longest period of the limits kept in the database, after which any
+// of their buckets is full again
+func longestLimitPeriod() time.Duration {
+	var period time.Duration
+	for _, l := range []*RateLimit{EmailSessionLimit, IPSessionLimit} {
+		if l != nil && l.UseDatabase && l.Period > period {
+			period = l.Period
+		}
+	}
+	return period
+}
+
+// Are the rate limits kept in the database?
+func useDatabaseLimits() bool {
+	return (EmailSessionLimit != nil && EmailSessionLimit.UseDatabase) || (IPSessionLimit != nil && IPSessionLimit.UseDatabase)
+}
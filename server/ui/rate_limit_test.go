@@ -0,0 +1,170 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"github.com/Banrai/TeamWork.io/server/database"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The rate_limit table, as RATE_LIMIT_TAKE and RATE_LIMIT_CLEANUP change
+// it, with the fake clock standing in for the database's now()
+
+type bucketRow struct {
+	tokens  float64
+	updated time.Time
+}
+
+type bucketTable struct {
+	clock *fakeClock
+	rows  map[string]*bucketRow
+}
+
+var currentBuckets *bucketTable
+
+func (b *bucketTable) take(args []driver.Value) []driver.Value {
+	key, capacity, rate := args[0].(string), args[1].(float64), args[2].(float64)
+	now := b.clock.Now()
+
+	row, exists := b.rows[key]
+	if !exists {
+		b.rows[key] = &bucketRow{tokens: capacity - 1, updated: now}
+		return []driver.Value{true}
+	}
+	available := math.Min(capacity, row.tokens+now.Sub(row.updated).Seconds()*rate)
+	allowed := available >= 1
+	if allowed {
+		available--
+	}
+	row.tokens, row.updated = available, now
+	return []driver.Value{allowed}
+}
+
+func (b *bucketTable) cleanup(args []driver.Value) {
+	age := time.Duration(args[0].(float64) * float64(time.Second))
+	for key, row := range b.rows {
+		if !row.updated.After(b.clock.Now().Add(-age)) {
+			delete(b.rows, key)
+		}
+	}
+}
+
+// Take tokens for this key until the limit refuses one, returning how
+// many were allowed (up to 100)
+func allowed(t *testing.T, limit *RateLimit, stmt *sql.Stmt, key string) int {
+	for n := 0; n < 100; n++ {
+		ok, err := limit.Allow(stmt, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return n
+		}
+	}
+	return 100
+}
+
+func testRateLimit(t *testing.T, limit *RateLimit, clock *fakeClock, stmt *sql.Stmt) {
+	tests := []struct {
+		wait     time.Duration
+		expected int
+	}{
+		{0, 3},                  // the whole burst at once
+		{10 * time.Minute, 0},   // half a token earned back
+		{10 * time.Minute, 1},   // (with the half from before)
+		{40 * time.Minute, 2},   // a token per twenty minutes
+		{48 * time.Hour, 3},     // but never more than the capacity
+		{20*time.Minute - 1, 0}, // not quite one token
+		{time.Nanosecond, 1},    // exactly one
+	}
+	for i, test := range tests {
+		clock.Advance(test.wait)
+		if n := allowed(t, limit, stmt, "session:email:dev@example.org"); n != test.expected {
+			t.Errorf("step %d (after %v): %d allowed, expected %d", i+1, test.wait, n, test.expected)
+		}
+	}
+
+	// other keys have their own buckets
+	if n := allowed(t, limit, stmt, "session:ip:192.0.2.7"); n != 3 {
+		t.Errorf("%d allowed for another key, expected 3", n)
+	}
+}
+
+func TestMemoryRateLimit(t *testing.T) {
+	clock := &fakeClock{now: testNow}
+	limit := NewRateLimit(3, time.Hour, false)
+	limit.now = clock.Now
+	testRateLimit(t, limit, clock, nil)
+
+	// full buckets are forgotten, at most once per period
+	clock.Advance(time.Hour)
+	allowed(t, limit, nil, "session:ip:192.0.2.8")
+	if len(limit.buckets) != 1 {
+		t.Errorf("%d buckets kept, expected only the new one", len(limit.buckets))
+	}
+
+	// no capacity (or no limit at all) means no limit
+	var none *RateLimit
+	for _, l := range []*RateLimit{NewRateLimit(0, time.Hour, false), none} {
+		if n := allowed(t, l, nil, "session:ip:192.0.2.7"); n != 100 {
+			t.Errorf("%d allowed without a limit", n)
+		}
+	}
+}
+
+func TestDatabaseRateLimit(t *testing.T) {
+	db, err := sql.Open("teamwork-ui-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := map[string]*sql.Stmt{}
+	for _, p := range database.PreparedStatements {
+		if stmt[p], err = db.Prepare(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock := &fakeClock{now: testNow}
+	currentBuckets = &bucketTable{clock: clock, rows: map[string]*bucketRow{}}
+	limit := NewRateLimit(3, time.Hour, true)
+	testRateLimit(t, limit, clock, stmt[database.RATE_LIMIT_TAKE])
+
+	// nothing is kept in memory, and the keys are hashed in the database
+	if len(limit.buckets) != 0 || len(currentBuckets.rows) != 2 {
+		t.Errorf("%d buckets in memory and %d in the database", len(limit.buckets), len(currentBuckets.rows))
+	}
+	for key := range currentBuckets.rows {
+		if strings.Contains(key, "example.org") || strings.Contains(key, "192.0.2.7") {
+			t.Errorf("a key was stored as-is: %s", key)
+		}
+	}
+
+	// buckets are only cleaned up once their period (here longer than a
+	// day) has refilled them
+	defer func(email, ip *RateLimit) { EmailSessionLimit, IPSessionLimit = email, ip }(EmailSessionLimit, IPSessionLimit)
+	InitializeRateLimits(3, 3, 72*time.Hour, true)
+	currentBuckets.rows = map[string]*bucketRow{}
+	if n := allowed(t, EmailSessionLimit, stmt[database.RATE_LIMIT_TAKE], "session:email:dev@example.org"); n != 3 {
+		t.Fatalf("%d allowed at first, expected 3", n)
+	}
+	clock.Advance(48 * time.Hour)
+	r := httptest.NewRequest("POST", "/session", nil)
+	if !AllowNewSession(r, "other@example.org", stmt) {
+		t.Fatal("a session request for another address was refused")
+	}
+	if n := allowed(t, EmailSessionLimit, stmt[database.RATE_LIMIT_TAKE], "session:email:dev@example.org"); n != 2 {
+		t.Errorf("%d allowed after two days, expected 2 (the bucket was reset)", n)
+	}
+	clock.Advance(72 * time.Hour)
+	AllowNewSession(r, "other@example.org", stmt)
+	if len(currentBuckets.rows) != 2 {
+		t.Errorf("%d buckets left after their period, expected the 2 just used", len(currentBuckets.rows))
+	}
+}
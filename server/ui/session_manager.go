@@ -5,19 +5,24 @@ package ui
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/Banrai/TeamWork.io/server/cryptutil"
 	"github.com/Banrai/TeamWork.io/server/database"
 	"github.com/Banrai/TeamWork.io/server/emailer"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
 // Create a new session for this Person and email them the corresponding session code to decrypt
-func CreateNewSession(person *database.PERSON, keys []*database.PUBLIC_KEY, sessionInsert *sql.Stmt) error {
+func CreateNewSession(ctx context.Context, person *database.PERSON, keys []*database.PUBLIC_KEY, sessionInsert *sql.Stmt) error {
 	// generate a random session code for this person
 	session := new(database.SESSION)
-	sessionCode, sessionCodeErr := session.Add(sessionInsert, person.Id, SESSION_WORDS, SESSION_DURATION)
+	sessionCode, sessionCodeErr := session.Add(sessionInsert, person.Id, SESSION_WORDS, CurrentSettings().SessionDuration)
 	if sessionCodeErr != nil {
 		return sessionCodeErr
 	}
@@ -36,29 +41,139 @@ func CreateNewSession(person *database.PERSON, keys []*database.PUBLIC_KEY, sess
 		"Decrypt the attached file with your private key, and use it at the session form."}
 	attachments := []*emailer.EmailAttachment{&emailer.EmailAttachment{ContentType: emailer.TEXT_MIME, Contents: encryptedCode, FileName: sessionFilename, FileLocation: sessionFilename}}
 
+	return SendEmailMessage(ctx, person.Email, sessionSubject, messageData, attachments)
+}
+
+// Render the message data with the email templates, and send it (with any
+// attachments) to this address
+func SendEmailMessage(ctx context.Context, email, subject string, messageData []string, attachments []*emailer.EmailAttachment) error {
 	var textBody, htmlBody bytes.Buffer
-	EMAIL_TEMPLATE.Execute(&textBody, &EmailMessage{Subject: sessionSubject, Message: messageData})
-	HTML_EMAIL_TEMPLATE.Execute(&htmlBody, &EmailMessage{Subject: sessionSubject, Heading: sessionSubject, Message: messageData})
-	return emailer.Send(sessionSubject,
+	EMAIL_TEMPLATE.Execute(&textBody, &EmailMessage{Subject: subject, Message: messageData})
+	HTML_EMAIL_TEMPLATE.Execute(&htmlBody, &EmailMessage{Subject: subject, Heading: subject, Message: messageData})
+	return emailer.Send(ctx, subject,
 		textBody.String(),
 		htmlBody.String(),
-		&emailer.EmailAddress{DisplayName: "TeamWork.io", Address: CONTACT_SENDER},
-		&emailer.EmailAddress{DisplayName: person.Email, Address: person.Email},
+		&emailer.EmailAddress{DisplayName: "TeamWork.io", Address: CurrentSettings().ContactSender},
+		&emailer.EmailAddress{DisplayName: email, Address: email},
 		attachments)
 }
 
+// The session confirmation form, for the email address which requested the code
+func ConfirmSessionLink(email string) string {
+	return fmt.Sprintf("/confirm?email=%s", url.QueryEscape(email))
+}
+
 // Wipe any expired sessions, and then confirm this code, returning the session object
 func ConfirmSessionCode(code string, cleanup, lookup *sql.Stmt) (*database.SESSION, error) {
 	database.CleanupSessions(cleanup)
 	return database.LookupSession(lookup, code)
 }
 
+// Confirm that the given session id is valid and verified, and that it
+// belongs to the enabled person with the given id
+func ConfirmPersonSession(sessionId, personId string, stmt map[string]*sql.Stmt) (*database.SESSION, *database.PERSON, error) {
+	session, sessionErr := ConfirmSessionCode(sessionId, stmt[database.SESSION_CLEANUP], stmt[database.SESSION_LOOKUP_BY_ID])
+	if sessionErr != nil {
+		return nil, nil, errors.New(OTHER_ERROR)
+	}
+
+	if len(session.Id) == 0 || !session.Verified {
+		return nil, nil, errors.New(INVALID_SESSION)
+	}
+
+	person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_ID], session.PersonId)
+	if personErr != nil {
+		return nil, nil, errors.New(OTHER_ERROR)
+	}
+
+	if len(person.Id) == 0 {
+		return nil, nil, errors.New(UNKNOWN)
+	}
+
+	if !person.Enabled {
+		return nil, nil, errors.New(DISABLED)
+	}
+
+	// make sure the session matches the person from the form
+	if person.Id != personId {
+		return nil, nil, errors.New(INVALID_SESSION)
+	}
+
+	return session, person, nil
+}
+
+// The session code as typed or pasted: its words, separated by single
+// spaces
+func NormalizeSessionCode(code string) string {
+	return strings.Join(strings.Fields(code), " ")
+}
+
+// Confirm the session code decrypted by the person with this email address,
+// counting any wrong guesses against both the client and the person, and
+// mark the session (and the person) as verified
+func VerifySessionCode(r *http.Request, email, code string, stmt map[string]*sql.Stmt) (*database.SESSION, *database.PERSON, error) {
+	if AttemptsLocked(r, "") {
+		return nil, nil, errors.New(TOO_MANY_ATTEMPTS)
+	}
+
+	// attempt to find the person for this email address
+	person, personErr := database.LookupPerson(stmt[database.PERSON_LOOKUP_BY_EMAIL], email)
+	if personErr != nil {
+		return nil, nil, errors.New(OTHER_ERROR)
+	}
+
+	if len(person.Id) == 0 {
+		AttemptFailed(r, "")
+		return nil, nil, errors.New(INVALID_SESSION)
+	}
+
+	if AttemptsLocked(r, person.Id) {
+		return nil, nil, errors.New(TOO_MANY_ATTEMPTS)
+	}
+
+	database.CleanupSessions(stmt[database.SESSION_CLEANUP])
+	session, sessionErr := database.LookupPersonSession(stmt[database.SESSION_LOOKUP_CODES_BY_PERSON], person.Id, code)
+	if sessionErr != nil {
+		return nil, nil, errors.New(OTHER_ERROR)
+	}
+
+	if len(session.Id) == 0 {
+		// too many wrong guesses invalidate the pending sessions
+		AttemptFailed(r, person.Id)
+		person.FailSessionAttempt(stmt[database.SESSION_FAILED_ATTEMPT], stmt[database.SESSION_INVALIDATE], MAX_SESSION_ATTEMPTS)
+		return nil, nil, errors.New(INVALID_SESSION)
+	}
+	AttemptSucceeded(r, person.Id)
+
+	if !person.Enabled {
+		return nil, nil, errors.New(DISABLED)
+	}
+
+	if !session.Verified {
+		session.Verified = true
+		if session.Update(stmt[database.SESSION_UPDATE]) != nil {
+			return nil, nil, errors.New(OTHER_ERROR)
+		}
+	}
+
+	if !person.Verified {
+		person.Verified = true
+		if person.Update(stmt[database.PERSON_UPDATE]) != nil {
+			return nil, nil, errors.New(OTHER_ERROR)
+		}
+	}
+
+	RecordAuditEvent(r, stmt, person, database.AUDIT_SESSION_VERIFY, session.Id, "decrypted code")
+	return session, person, nil
+}
+
 // Generate a new public key, and associate it with this person
-func AddPublicKey(person *database.PERSON, keyData, keySource, keyNickname string, pkInsert *sql.Stmt) error {
+func AddPublicKey(person *database.PERSON, keyData, keySource, keyNickname string, pkInsert *sql.Stmt) (*database.PUBLIC_KEY, error) {
 	publicKey := new(database.PUBLIC_KEY)
 	publicKey.Key = keyData
 	publicKey.Source = keySource
 	publicKey.Nickname = keyNickname
-	_, pkErr := publicKey.Add(pkInsert, person.Id)
-	return pkErr
+	pkId, pkErr := publicKey.Add(pkInsert, person.Id)
+	publicKey.Id = pkId
+	return publicKey, pkErr
 }
@@ -5,50 +5,88 @@ package ui
 
 import (
 	"bytes"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/Banrai/TeamWork.io/server/database"
+	"github.com/Banrai/TeamWork.io/server/logging"
 	"html/template"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"path"
+	"sync"
 	"time"
 )
 
 const (
 	// configuration
-	SESSION_WORDS    = 6 // it's a magic number
-	SESSION_DURATION = 30 * time.Minute
-	MESSAGE_DURATION = 30 * 24 * time.Hour
+	SESSION_WORDS = 6 // it's a magic number
 
 	// Errors and alerts
-	DISABLED        = "This email address and all of its public keys has been disabled"
-	UNKNOWN         = "This email address does not have any public keys associated with it (you can <a href=\"/upload\">add one here</a>)"
-	NO_KEYS         = "You need at least one public key associated with your email address (go <a href=\"/upload\">here to upload it</a>)"
-	NO_EMAIL        = "You need to provide an email address"
-	INVALID_EMAIL   = "That email address is not valid"
-	INVALID_SESSION = "This session is no longer valid (go <a href=\"/session\">here to create a new one</a>)"
-	INVALID_PK      = "We could not process your public key (please make sure it is in the correct format)"
-	OTHER_ERROR     = "There was an internal problem"
+	DISABLED             = "This email address and all of its public keys has been disabled"
+	UNKNOWN              = "This email address does not have any public keys associated with it (you can <a href=\"/upload\">add one here</a>)"
+	NO_KEYS              = "You need at least one public key associated with your email address (go <a href=\"/upload\">here to upload it</a>)"
+	NO_EMAIL             = "You need to provide an email address"
+	INVALID_EMAIL        = "That email address is not valid"
+	INVALID_SESSION      = "This session is no longer valid (go <a href=\"/session\">here to create a new one</a>)"
+	INVALID_PK           = "We could not process your public key (please make sure it is in the correct format)"
+	OTHER_ERROR          = "There was an internal problem"
+	DATABASE_UNAVAILABLE = "The database is unavailable (please try again later)"
+	INVALID_REQUEST      = "The request is missing some required information"
+	INVALID_CURSOR       = "That page of posts does not exist (these are the latest)"
+	INVALID_VIEW         = "That list of posts does not exist (these are all of them)"
+
+	TEMPLATES_NOT_LOADED = "The html templates are not loaded"
 
 	// site/domain specific
-	CONTACT_SENDER = "noreply@teamwork.io"
-	KEY_SOURCE     = "TeamWork.io"
-
-	// user interface
-	POSTS_PER_PAGE = 20
+	KEY_SOURCE = "TeamWork.io"
 
 	// page titles
-	TITLE_POSTS           = "Latest Posts"
-	TITLE_CREATE_SESSION  = "New Session"
-	TITLE_CONFIRM_SESSION = "Confirm Session"
-	TITLE_ADD_POST        = "New Post"
-	TITLE_ADD_KEY         = "New Public Key"
-	TITLE_INDEX           = "Welcome to " + KEY_SOURCE
-	TITLE_HELP            = "Help"
-	TITLE_DONATE          = "Donate to " + KEY_SOURCE
+	TITLE_POSTS             = "Latest Posts"
+	TITLE_CREATE_SESSION    = "New Session"
+	TITLE_CONFIRM_SESSION   = "Confirm Session"
+	TITLE_CHALLENGE_SESSION = "Sign Challenge"
+	TITLE_ADD_POST          = "New Post"
+	TITLE_ADD_KEY           = "New Public Key"
+	TITLE_INDEX             = "Welcome to " + KEY_SOURCE
+	TITLE_HELP              = "Help"
+	TITLE_DONATE            = "Donate to " + KEY_SOURCE
+	TITLE_SESSIONS          = "Active Sessions"
+	TITLE_ADMIN             = "Admin"
 )
 
+// The settings which can change while the server runs (see Configure,
+// which main calls at startup and on reload)
+type Settings struct {
+	SessionDuration time.Duration
+	MessageDuration time.Duration
+	ContactSender   string
+	PostsPerPage    int64
+}
+
+var current = struct {
+	sync.RWMutex
+	Settings
+}{Settings: Settings{SessionDuration: 30 * time.Minute,
+	MessageDuration: 30 * 24 * time.Hour,
+	ContactSender:   "noreply@teamwork.io",
+	PostsPerPage:    20}}
+
+// Use these settings from now on
+func Configure(settings Settings) {
+	current.Lock()
+	defer current.Unlock()
+	current.Settings = settings
+}
+
+// The settings in use
+func CurrentSettings() Settings {
+	current.RLock()
+	defer current.RUnlock()
+	return current.Settings
+}
+
 var (
 	TEMPLATE_LIST = func(templatesFolder string, templateFiles []string) []string {
 		t := make([]string, 0)
@@ -62,39 +100,55 @@ var (
 	UNSUPPORTED_TEMPLATE_FILE = "browser_not_supported.html"
 
 	INDEX_TEMPLATE_FILES = []string{"index.html", "head.html", "navigation.html", "scripts.html"}
-	INDEX_TEMPLATE       *template.Template
+	INDEX_TEMPLATE       = &Template{files: INDEX_TEMPLATE_FILES}
 
 	HELP_TEMPLATE_FILES = []string{"help.html", "head.html", "navigation.html", "scripts.html"}
-	HELP_TEMPLATE       *template.Template
+	HELP_TEMPLATE       = &Template{files: HELP_TEMPLATE_FILES}
 
 	// dynamically-generated pages
 	NEW_POST_TEMPLATE_FILES = []string{"new-post.html", "head.html", "modal.html", "alert.html", "navigation.html", "scripts.html"}
-	NEW_POST_TEMPLATE       *template.Template
+	NEW_POST_TEMPLATE       = &Template{files: NEW_POST_TEMPLATE_FILES}
 
 	ALL_POSTS_TEMPLATE_FILES = []string{"posts.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
-	ALL_POSTS_TEMPLATE       *template.Template
+	ALL_POSTS_TEMPLATE       = &Template{files: ALL_POSTS_TEMPLATE_FILES}
 
 	CREATE_SESSION_TEMPLATE_FILES = []string{"create-session.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
-	CREATE_SESSION_TEMPLATE       *template.Template
+	CREATE_SESSION_TEMPLATE       = &Template{files: CREATE_SESSION_TEMPLATE_FILES}
 
 	CONFIRM_SESSION_TEMPLATE_FILES = []string{"confirm-session.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
-	CONFIRM_SESSION_TEMPLATE       *template.Template
+	CONFIRM_SESSION_TEMPLATE       = &Template{files: CONFIRM_SESSION_TEMPLATE_FILES}
+
+	CHALLENGE_SESSION_TEMPLATE_FILES = []string{"challenge-session.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
+	CHALLENGE_SESSION_TEMPLATE       = &Template{files: CHALLENGE_SESSION_TEMPLATE_FILES}
 
 	NEW_KEY_TEMPLATE_FILES = []string{"new-key.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
-	NEW_KEY_TEMPLATE       *template.Template
+	NEW_KEY_TEMPLATE       = &Template{files: NEW_KEY_TEMPLATE_FILES}
+
+	SESSIONS_TEMPLATE_FILES = []string{"sessions.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
+	SESSIONS_TEMPLATE       = &Template{files: SESSIONS_TEMPLATE_FILES}
+
+	ADMIN_TEMPLATE_FILES = []string{"admin.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
+	ADMIN_TEMPLATE       = &Template{files: ADMIN_TEMPLATE_FILES}
+
+	ADMIN_PERSON_TEMPLATE_FILES = []string{"admin-person.html", "head.html", "alert.html", "navigation.html", "scripts.html"}
+	ADMIN_PERSON_TEMPLATE       = &Template{files: ADMIN_PERSON_TEMPLATE_FILES}
 
 	DONATE_TEMPLATE_FILES = []string{"donate.html", "head.html", "alert.html", "modal.html", "navigation.html", "scripts.html"}
-	DONATE_TEMPLATE       *template.Template
+	DONATE_TEMPLATE       = &Template{files: DONATE_TEMPLATE_FILES}
 
 	EMAIL_TEMPLATE_FILES = []string{"email.txt"}
-	EMAIL_TEMPLATE       *template.Template
+	EMAIL_TEMPLATE       = &Template{files: EMAIL_TEMPLATE_FILES}
 
 	HTML_EMAIL_TEMPLATE_FILES = []string{"email.html"}
-	HTML_EMAIL_TEMPLATE       *template.Template
-
-	TEMPLATES_INITIALIZED = false
+	HTML_EMAIL_TEMPLATE       = &Template{files: HTML_EMAIL_TEMPLATE_FILES}
 )
 
+// the parsed templates in use, which a reload replaces all at once
+var loaded struct {
+	sync.RWMutex
+	templates Templates
+}
+
 // Use this to redirect one request to another target (string)
 func Redirect(target string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -109,6 +163,18 @@ func MakeHTMLHandler(fn func(http.ResponseWriter, *http.Request, database.DBConn
 	}
 }
 
+// Run fn with the prepared statements, traced under the request's span; if
+// the database cannot be reached, answer 503 instead, and return false (so
+// the handler stops there)
+func withDatabase(w http.ResponseWriter, r *http.Request, db database.DBConnection, fn func(map[string]*sql.Stmt)) bool {
+	if err := database.TryWithDatabase(r.Context(), db, fn); err != nil {
+		logging.FromRequest(r).Error("Cannot use the database", "error", err)
+		http.Error(w, DATABASE_UNAVAILABLE, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
 // Show the static template for unsupported browsers
 func UnsupportedBrowserHandler(templatesFolder string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -152,20 +218,85 @@ type EmailMessage struct {
 	Message []string
 }
 
+// A page or email template, parsed from these files in the templates folder
+type Template struct {
+	files []string
+}
+
+// The parsed templates, ready to replace the ones in use
+type Templates map[*Template]*template.Template
+
+// Every template, parsed together
+func allTemplates() []*Template {
+	return []*Template{NEW_POST_TEMPLATE, ALL_POSTS_TEMPLATE, CREATE_SESSION_TEMPLATE,
+		CONFIRM_SESSION_TEMPLATE, CHALLENGE_SESSION_TEMPLATE, NEW_KEY_TEMPLATE,
+		SESSIONS_TEMPLATE, ADMIN_TEMPLATE, ADMIN_PERSON_TEMPLATE, DONATE_TEMPLATE,
+		EMAIL_TEMPLATE, HTML_EMAIL_TEMPLATE, INDEX_TEMPLATE, HELP_TEMPLATE}
+}
+
+// Apply the parsed version of this template in use to the data
+func (t *Template) Execute(w io.Writer, data interface{}) error {
+	loaded.RLock()
+	tm := loaded.templates[t]
+	loaded.RUnlock()
+
+	if tm == nil {
+		return errors.New(TEMPLATES_NOT_LOADED)
+	}
+	return tm.Execute(w, data)
+}
+
+// Parse all of the templates in the folder, failing if any one of them
+// does not parse
+func ParseTemplates(folder string) (Templates, error) {
+	parsed := make(Templates)
+	for _, t := range allTemplates() {
+		tm, err := template.ParseFiles(TEMPLATE_LIST(folder, t.files)...)
+		if err != nil {
+			return nil, err
+		}
+		parsed[t] = tm
+	}
+	return parsed, nil
+}
+
+// Replace the templates in use with these (requests in progress finish
+// with the ones they started with)
+func UseTemplates(parsed Templates) {
+	loaded.Lock()
+	loaded.templates = parsed
+	loaded.Unlock()
+}
+
+// Parse all of the templates in the folder, and use them only if every one
+// of them parses (so a reload with a broken template keeps the current ones)
+func ReloadTemplates(folder string) error {
+	parsed, err := ParseTemplates(folder)
+	if err != nil {
+		return err
+	}
+	UseTemplates(parsed)
+	return nil
+}
+
 // InitializeTemplates confirms the given folder string leads to the html
-// template files, otherwise templates.Must() will complain
+// template files, otherwise it will panic
 func InitializeTemplates(folder string) {
-	NEW_POST_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, NEW_POST_TEMPLATE_FILES)...))
-	ALL_POSTS_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ALL_POSTS_TEMPLATE_FILES)...))
-	CREATE_SESSION_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, CREATE_SESSION_TEMPLATE_FILES)...))
-	CONFIRM_SESSION_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, CONFIRM_SESSION_TEMPLATE_FILES)...))
-	NEW_KEY_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, NEW_KEY_TEMPLATE_FILES)...))
-	DONATE_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, DONATE_TEMPLATE_FILES)...))
-	EMAIL_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, EMAIL_TEMPLATE_FILES)...))
-	HTML_EMAIL_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, HTML_EMAIL_TEMPLATE_FILES)...))
-	INDEX_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, INDEX_TEMPLATE_FILES)...))
-	HELP_TEMPLATE = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, HELP_TEMPLATE_FILES)...))
-	TEMPLATES_INITIALIZED = true
+	if err := ReloadTemplates(folder); err != nil {
+		panic(err)
+	}
+}
+
+// Check that every template is loaded
+func CheckTemplates() error {
+	loaded.RLock()
+	defer loaded.RUnlock()
+	for _, t := range allTemplates() {
+		if loaded.templates[t] == nil {
+			return errors.New(TEMPLATES_NOT_LOADED)
+		}
+	}
+	return nil
 }
 
 // static file rendering
@@ -175,7 +306,7 @@ type StaticPage struct {
 	Person  *database.PERSON
 }
 
-func renderStaticTemplateToFile(s *StaticPage, tm *template.Template, folder string, filename string) error {
+func renderStaticTemplateToFile(s *StaticPage, tm *Template, folder string, filename string) error {
 	var doc bytes.Buffer
 	err := tm.Execute(&doc, s)
 	if err != nil {
@@ -185,7 +316,7 @@ func renderStaticTemplateToFile(s *StaticPage, tm *template.Template, folder str
 }
 
 func GenerateStaticFiles(templatesFolder string, outputFolder string) {
-	if !TEMPLATES_INITIALIZED {
+	if CheckTemplates() != nil {
 		InitializeTemplates(templatesFolder)
 	}
 
@@ -197,16 +328,16 @@ func GenerateStaticFiles(templatesFolder string, outputFolder string) {
 	index := &StaticPage{Title: TITLE_INDEX, Session: s, Person: p}
 	err = renderStaticTemplateToFile(index, INDEX_TEMPLATE, outputFolder, "index.html")
 	if err != nil {
-		log.Println(err)
+		logging.Error("Cannot create static file", "file", "index.html", "error", err)
 	} else {
-		log.Println(fmt.Sprintf("Created '%s/index.html'", outputFolder))
+		logging.Info("Created static file", "file", outputFolder+"/index.html")
 	}
 
 	help := &StaticPage{Title: TITLE_HELP, Session: s, Person: p}
 	err = renderStaticTemplateToFile(help, HELP_TEMPLATE, outputFolder, "help.html")
 	if err != nil {
-		log.Println(err)
+		logging.Error("Cannot create static file", "file", "help.html", "error", err)
 	} else {
-		log.Println(fmt.Sprintf("Created '%s/help.html'", outputFolder))
+		logging.Info("Created static file", "file", outputFolder+"/help.html")
 	}
 }
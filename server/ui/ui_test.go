@@ -0,0 +1,114 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"github.com/Banrai/TeamWork.io/server/database"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTemplates = "../../html/templates"
+
+func TestReloadTemplates(t *testing.T) {
+	defer UseTemplates(nil)
+	if err := ReloadTemplates(testTemplates); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckTemplates(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a folder with one broken template changes nothing
+	broken := t.TempDir()
+	files, err := ioutil.ReadDir(testTemplates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(path.Join(testTemplates, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name() == "sessions.html" {
+			data = append(data, []byte("{{ if }}")...)
+		}
+		if err := ioutil.WriteFile(path.Join(broken, f.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded.RLock()
+	before := loaded.templates[INDEX_TEMPLATE]
+	loaded.RUnlock()
+	if err := ReloadTemplates(broken); err == nil {
+		t.Fatal("a broken template was accepted")
+	}
+	loaded.RLock()
+	after := loaded.templates[INDEX_TEMPLATE]
+	loaded.RUnlock()
+	if after != before {
+		t.Error("the templates were replaced by a reload which failed")
+	}
+}
+
+func TestTemplatesReloadedDuringRequests(t *testing.T) {
+	defer UseTemplates(nil)
+	parsed, err := ParseTemplates(testTemplates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseTemplates(parsed)
+	page := &StaticPage{Title: TITLE_HELP, Session: new(database.SESSION), Person: new(database.PERSON)}
+
+	// pages keep rendering while the templates are swapped (run with -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := HELP_TEMPLATE.Execute(ioutil.Discard, page); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		UseTemplates(parsed)
+	}
+	wg.Wait()
+}
+
+func TestTemplatesNotLoaded(t *testing.T) {
+	UseTemplates(nil)
+	if err := CheckTemplates(); err == nil || err.Error() != TEMPLATES_NOT_LOADED {
+		t.Errorf("unexpected check result: %v", err)
+	}
+	if err := INDEX_TEMPLATE.Execute(os.Stdout, nil); err == nil || err.Error() != TEMPLATES_NOT_LOADED {
+		t.Errorf("an unloaded template was executed: %v", err)
+	}
+}
+
+func TestDatabaseUnavailable(t *testing.T) {
+	defer UseTemplates(nil)
+	if err := ReloadTemplates(testTemplates); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens on port 1, so the connection is refused at once
+	db := database.DBConnection{DBName: "teamwork", User: "teamwork", Host: "127.0.0.1", Port: 1, SSLMode: "disable", ConnectTimeout: time.Second}
+	w := httptest.NewRecorder()
+	MakeHTMLHandler(DisplayPosts, db)(w, httptest.NewRequest("GET", "/posts", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), DATABASE_UNAVAILABLE) {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
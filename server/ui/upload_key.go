@@ -7,11 +7,11 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
-	"github.com/Banrai/TeamWork.io/server/api"
 	"github.com/Banrai/TeamWork.io/server/cryptutil"
 	"github.com/Banrai/TeamWork.io/server/database"
 	"github.com/Banrai/TeamWork.io/server/emailer"
 	"github.com/Banrai/TeamWork.io/server/httputil"
+	"github.com/Banrai/TeamWork.io/server/transparency"
 	"html/template"
 	"io"
 	"net/http"
@@ -45,7 +45,7 @@ func UploadKey(w http.ResponseWriter, r *http.Request, db database.DBConnection,
 				personId := strings.Join(personCode, "")
 				if len(sessionId) > 0 && len(personId) > 0 {
 					// make sure the session is still valid
-					session, sessionErr := ConfirmSessionCode(sessionId, stmt[database.SESSION_CLEANUP], stmt[database.SESSION_LOOKUP_BY_CODE])
+					session, sessionErr := ConfirmSessionCode(sessionId, stmt[database.SESSION_CLEANUP], stmt[database.SESSION_LOOKUP_BY_ID])
 					if sessionErr != nil {
 						alert.AsError(OTHER_ERROR)
 						return
@@ -73,7 +73,8 @@ func UploadKey(w http.ResponseWriter, r *http.Request, db database.DBConnection,
 						return
 					}
 
-					// session and person are established
+					// session and person are established (and the person is
+					// the actor in the audit events, which have none otherwise)
 					s = session
 					p = person
 				}
@@ -121,7 +122,7 @@ func UploadKey(w http.ResponseWriter, r *http.Request, db database.DBConnection,
 			// determine the public key source: file or url
 			kt, ktExists := r.PostForm["keyType"]
 			if !ktExists {
-				alert.AsError(api.INVALID_REQUEST)
+				alert.AsError(INVALID_REQUEST)
 				return
 			}
 
@@ -160,22 +161,24 @@ func UploadKey(w http.ResponseWriter, r *http.Request, db database.DBConnection,
 				}
 				if !alreadyExists {
 					// now add this key to the database for this person
-					pkErr := AddPublicKey(person, uploadedKey, KEY_SOURCE, pkFileHeader.Filename, stmt[database.PK_INSERT])
+					pk, pkErr := AddPublicKey(person, uploadedKey, KEY_SOURCE, pkFileHeader.Filename, stmt[database.PK_INSERT])
 					if pkErr != nil {
 						alert.AsError(OTHER_ERROR)
 						return
 					}
+					LogKeyChange(r, stmt, transparency.ACTION_ADD, email, pk)
+					RecordAuditEvent(r, stmt, p, database.AUDIT_KEY_ADD, person.Id, email+" "+pkFileHeader.Filename)
 				}
 			} else {
 				// source is a url
 				u, uExists := r.PostForm["publicKeyUrl"]
 				if !uExists {
-					alert.AsError(api.INVALID_REQUEST)
+					alert.AsError(INVALID_REQUEST)
 					return
 				}
 
 				url := strings.Join(u, "")
-				urlKey, urlKeyErr := httputil.URLFetchAsString(url)
+				urlKey, urlKeyErr := httputil.URLFetchAsString(r.Context(), url)
 				if urlKeyErr != nil {
 					alert.AsError(urlKeyErr.Error())
 					return
@@ -199,31 +202,41 @@ func UploadKey(w http.ResponseWriter, r *http.Request, db database.DBConnection,
 
 				if !alreadyExists {
 					// now add this key to the database for this person
-					pkErr := AddPublicKey(person, urlKey, KEY_SOURCE, url, stmt[database.PK_INSERT])
+					pk, pkErr := AddPublicKey(person, urlKey, KEY_SOURCE, url, stmt[database.PK_INSERT])
 					if pkErr != nil {
 						alert.AsError(OTHER_ERROR)
 						return
 					}
+					LogKeyChange(r, stmt, transparency.ACTION_ADD, email, pk)
+					RecordAuditEvent(r, stmt, p, database.AUDIT_KEY_ADD, person.Id, email+" "+url)
 				}
 			}
 
 			_, createSessionExists := r.PostForm["createSession"]
 			if createSessionExists {
+				if !AllowNewSession(r, email, stmt) {
+					alert.Update("alert-warning", "fa-hand-paper-o", RATE_LIMITED)
+					return
+				}
+
 				// create the session, and ask for confirmation of the decrypted code
-				sessionErr := CreateNewSession(person, publicKeys, stmt[database.SESSION_INSERT])
+				sessionErr := CreateNewSession(r.Context(), person, publicKeys, stmt[database.SESSION_INSERT])
 				if sessionErr != nil {
 					alert.AsError(sessionErr.Error())
 					return
 				} else {
+					RecordAuditEvent(r, stmt, p, database.AUDIT_SESSION_CREATE, person.Id, email)
 					// present the session code form
-					Redirect("/confirm")(w, r)
+					Redirect(ConfirmSessionLink(email))(w, r)
 				}
 			} else {
 				alert.Message = template.HTML(fmt.Sprintf("The public key for \"%s\" was added successfully", email))
 			}
 		}
 
-		database.WithDatabase(db, fn)
+		if !withDatabase(w, r, db, fn) {
+			return
+		}
 	}
 
 	if s == nil && p == nil {